@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+
+	"github.com/Clever/analytics-util/analyticspipeline"
+	"github.com/Clever/s3-to-redshift/v3/logger"
+	redshift "github.com/Clever/s3-to-redshift/v3/redshift"
+	s3filepath "github.com/Clever/s3-to-redshift/v3/s3filepath"
+	"github.com/kardianos/osext"
+)
+
+var (
+	// the same secrets and credentials as s3-to-redshift
+	credentialProvider redshift.CredentialProvider = redshift.EnvCredentialProvider{}
+	kmsKeyARN                                      = os.Getenv("KMS_KEY_ARN")
+)
+
+type payload struct {
+	Schema   string `config:"schema,required"`
+	Table    string `config:"table,required"`
+	Query    string `config:"query"`
+	Prefix   string `config:"prefix,required"`
+	Region   string `config:"region"`
+	Format   string `config:"format"`
+	Parallel bool   `config:"parallel"`
+	GZip     bool   `config:"gzip"`
+	DryRun   bool   `config:"dryRun"`
+}
+
+// This worker is the reverse of s3-to-redshift: it UNLOADs a table (or the results of a query
+// on it) to files in s3, e.g. for backups or copying the table to another region
+func main() {
+	dir, err := osext.ExecutableFolder()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := logger.SetGlobalRouting(path.Join(dir, "kvconfig.yml")); err != nil {
+		log.Fatal(err)
+	}
+
+	flags := payload{ // Specifying defaults:
+		Format:   redshift.UnloadFormatText,
+		Parallel: true,
+		GZip:     true,
+	}
+	nextPayload, err := analyticspipeline.AnalyticsWorker(&flags)
+	if err != nil {
+		log.Fatalf("err: %#v", err)
+	}
+	defer analyticspipeline.PrintPayload(nextPayload)
+
+	creds, err := credentialProvider.Credentials()
+	if err != nil {
+		log.Fatalf("error getting credentials: %s", err)
+	}
+	// without a role or keys for UNLOAD, use whatever credentials we're running with
+	if creds.RoleARN == "" && (creds.AccessID == "" || creds.SecretKey == "") {
+		chain, err := s3filepath.ChainCredentials()
+		if err != nil {
+			log.Fatalf("Either REDSHIFT_ROLE_ARN or AWS credentials must be set: %s", err)
+		}
+		creds.AccessID, creds.SecretKey, creds.Token = chain.AccessKeyID, chain.SecretAccessKey, chain.SessionToken
+	}
+	query := flags.Query
+	if query == "" {
+		query = fmt.Sprintf(`SELECT * FROM "%s"."%s"`, flags.Schema, flags.Table)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Signal(syscall.SIGTERM))
+	go func() {
+		for range c {
+			cancel()
+		}
+	}()
+
+	db, err := redshift.NewRedshiftFromCredentials(ctx, creds, 60)
+	if err != nil {
+		log.Fatalf("error getting redshift instance: %s", err)
+	}
+	db.SetDryRun(flags.DryRun)
+
+	bucket := creds.Bucket("", flags.Region)
+	bucket.KMSKeyARN = kmsKeyARN
+	opts := redshift.UnloadOptions{
+		Bucket:   bucket,
+		Format:   flags.Format,
+		Parallel: flags.Parallel,
+		GZip:     flags.GZip,
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("error beginning transaction: %s", err)
+	}
+	if err := db.Unload(tx, query, flags.Prefix, opts); err != nil {
+		tx.Rollback()
+		log.Fatalf("error unloading %s.%s: %s", flags.Schema, flags.Table, err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("error committing transaction: %s", err)
+	}
+	logger.GetLogger().InfoD("unload-done", logger.M{"schema": flags.Schema, "table": flags.Table, "prefix": flags.Prefix})
+}
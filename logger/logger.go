@@ -1,6 +1,10 @@
 package logger
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"gopkg.in/Clever/kayvee-go.v6/logger"
 )
 
@@ -28,6 +32,32 @@ func SetGlobalRouting(kvconfigPath string) error {
 	return logger.SetGlobalRouting(kvconfigPath)
 }
 
+// SetPlainText switches the logger from JSON to human readable lines, which is
+// easier to follow when running locally. Log routing still happens, but the log
+// pipeline can't parse the output, so this shouldn't be used in production.
+func SetPlainText() {
+	log.SetFormatter(plainTextFormat)
+}
+
+// plainTextFormat formats a log line as "<level> <title> key=value ..." with the keys sorted
+func plainTextFormat(data map[string]interface{}) string {
+	var keys []string
+	for k := range data {
+		switch k {
+		case "level", "title", "source", "_kvmeta":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := []string{fmt.Sprintf("%v", data["level"]), fmt.Sprintf("%v", data["title"])}
+	for _, k := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%v", k, data[k]))
+	}
+	return strings.Join(fields, " ")
+}
+
 // JobFinishedEvent logs when s3-to-redshift has completed
 // along with payload and success/failure
 func JobFinishedEvent(payload string, didSucceed bool) {
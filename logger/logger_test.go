@@ -49,3 +49,15 @@ func TestJobFinished(t *testing.T) {
 		assert.Equal(counts[test.rule], 1)
 	}
 }
+
+func TestPlainTextFormat(t *testing.T) {
+	line := plainTextFormat(map[string]interface{}{
+		"level":   "info",
+		"title":   "load-table-done",
+		"source":  "s3-to-redshift",
+		"table":   "bar",
+		"schema":  "foo",
+		"_kvmeta": map[string]interface{}{},
+	})
+	assert.Equal(t, "info load-table-done schema=foo table=bar", line)
+}
@@ -1,23 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Clever/analytics-util/analyticspipeline"
 	discovery "github.com/Clever/discovery-go"
 	"github.com/Clever/s3-to-redshift/v3/logger"
+	"github.com/Clever/s3-to-redshift/v3/metrics"
 	redshift "github.com/Clever/s3-to-redshift/v3/redshift"
+	redshifter "github.com/Clever/s3-to-redshift/v3/redshifter"
 	s3filepath "github.com/Clever/s3-to-redshift/v3/s3filepath"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -29,15 +38,27 @@ import (
 )
 
 var (
-	// things which will would strongly suggest launching as a second worker are env vars
+	// things which will would strongly suggest launching as a second worker are env vars, which
+	// are only read once there's something to load (see loadCleanupConfig), so that --help,
+	// validating a config, health checks and listing dates don't need them
+	cleanupWorker string
+
 	// also the secrets ... shhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhh
-	host            = os.Getenv("REDSHIFT_HOST")
-	port            = os.Getenv("REDSHIFT_PORT")
-	dbName          = env.MustGet("REDSHIFT_DB")
-	user            = env.MustGet("REDSHIFT_USER")
-	pwd             = env.MustGet("REDSHIFT_PASSWORD")
-	redshiftRoleARN = env.MustGet("REDSHIFT_ROLE_ARN")
-	cleanupWorker   = env.MustGet("CLEANUP_WORKER")
+	// from the environment, unless another provider (e.g. one backed by Vault) is swapped in.
+	// If there's no role for redshift to assume, COPY falls back to the AWS keys. The session
+	// token is only set when running with temporary credentials (e.g. an assumed role on ECS)
+	credentialProvider redshift.CredentialProvider = redshift.EnvCredentialProvider{}
+
+	// the KMS key the bucket's objects are encrypted with, if they use a customer managed key
+	kmsKeyARN = os.Getenv("KMS_KEY_ARN")
+
+	// overrides the S3 API endpoint for finding and reading data and configs, i.e. MinIO for testing
+	s3Endpoint = os.Getenv("S3_ENDPOINT")
+
+	// the comma separated schemas --reset refuses to drop tables in, unless CONFIRM_RESET_SCHEMA
+	// is set to the schema too, so resetting a production table takes more than one flag
+	productionSchemas  = os.Getenv("PRODUCTION_SCHEMAS")
+	confirmResetSchema = os.Getenv("CONFIRM_RESET_SCHEMA")
 
 	// payloadForSignalFx holds a subset of the job payload that
 	// we want to alert on as a dimension in SignalFx.
@@ -47,15 +68,32 @@ var (
 	payloadForSignalFx string
 
 	gearmanAdminURL string
+
+	// the build --version prints, set with -ldflags "-X main.version=..." by make build
+	version   = "dev"
+	gitSHA    = "unknown"
+	buildDate = "unknown"
+
+	// metricsReporter receives per-table load metrics, a no-op unless --statsdAddr or --serveMetrics is set
+	metricsReporter metrics.Reporter = metrics.NoopReporter{}
 )
 
-func init() {
+// loadCleanupConfig reads the cleanup worker and gearman-admin secrets for queueVacuum from the
+// environment, panicking if any aren't set
+func loadCleanupConfig() {
+	cleanupWorker = env.MustGet("CLEANUP_WORKER")
 	gearmanAdminUser := env.MustGet("GEARMAN_ADMIN_USER")
 	gearmanAdminPass := env.MustGet("GEARMAN_ADMIN_PASS")
 	gearmanAdminPath := env.MustGet("GEARMAN_ADMIN_PATH")
 	gearmanAdminURL = generateServiceEndpoint(gearmanAdminUser, gearmanAdminPass, gearmanAdminPath)
 }
 
+// queuesVacuums is whether a load with the flags queues vacuums, so needs loadCleanupConfig: not
+// with --vacuum, which runs them itself, or --dryRun, which stops before vacuuming
+func queuesVacuums(flags payload) bool {
+	return !flags.Vacuum && !flags.DryRun
+}
+
 func generateServiceEndpoint(user, pass, path string) string {
 	hostPort, err := discovery.HostPort("gearman-admin", "http")
 	if err != nil {
@@ -69,59 +107,110 @@ func generateServiceEndpoint(user, pass, path string) string {
 	return fmt.Sprintf("%s://%s:%s@%s%s", proto, user, pass, hostPort, path)
 }
 
+// versionString is what --version prints, e.g. "s3-to-redshift 3.0.0 (git 1a2b3c4, built 2020-01-01T00:00:00Z)"
+func versionString() string {
+	return fmt.Sprintf("s3-to-redshift %s (git %s, built %s)", version, gitSHA, buildDate)
+}
+
+// fatal fails the job with the message, e.g. for a flag which can't be used
+func fatal(msg string) {
+	logger.GetLogger().CriticalD("fatal-error", logger.M{"message": msg})
+	logger.JobFinishedEvent(payloadForSignalFx, false)
+	panic(msg)
+}
+
 func fatalIfErr(err error, msg string) {
 	if err != nil {
+		logger.GetLogger().CriticalD("fatal-error", logger.M{"message": msg, "error": err.Error()})
 		logger.JobFinishedEvent(payloadForSignalFx, false)
-		panic(fmt.Sprintf("%s: %s", msg, err)) // TODO: kayvee
+		panic(fmt.Sprintf("%s: %s", msg, err))
 	}
 }
 
-// helper function used for verifying inputs
-func getMapKeys(m map[string]bool) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
+// isolationLevelNames returns the names --isolationLevel may be, sorted
+func isolationLevelNames() []string {
+	var names []string
+	for name := range redshift.IsolationLevels {
+		if name != "" {
+			names = append(names, name)
+		}
 	}
-	return keys
+	sort.Strings(names)
+	return names
 }
 
-// Rounds down a dateTime to a granularity
-// For instance, 11:50AM will be truncated to 11:00AM
-// if given a granularity of an hour
-func truncateDate(date time.Time, granularity string) time.Time {
-	switch granularity {
-	case "hour":
-		return date.Truncate(time.Hour)
-	default:
-		// Round down to day granularity by default
-		return date.Truncate(24 * time.Hour)
+// copyCredentials gets the credentials from the credential provider. Without a role or keys for
+// COPY, it uses whatever credentials we're running with, e.g. an instance profile on EC2 or a task
+// role on ECS, returning the name of the provider in the SDK's chain they came from.
+func copyCredentials() (redshift.Credentials, string, error) {
+	creds, err := credentialProvider.Credentials()
+	if err != nil {
+		return creds, "", fmt.Errorf("error getting credentials: %w", err)
 	}
+	if creds.RoleARN != "" || (creds.AccessID != "" && creds.SecretKey != "") {
+		return creds, "", nil
+	}
+	chain, err := s3filepath.ChainCredentials()
+	if err != nil {
+		return creds, "", fmt.Errorf("either REDSHIFT_ROLE_ARN or AWS credentials must be set: %w", err)
+	}
+	creds.AccessID, creds.SecretKey, creds.Token = chain.AccessKeyID, chain.SecretAccessKey, chain.SessionToken
+	return creds, chain.ProviderName, nil
 }
 
-// Calculates whether or not input data (s3) is more stale than target data (Redshift)
-// Expects:
-// - inputDataDate corresponds to the s3 data timestamp of the job
-// - targetDataDate is the maximum timestamp of the DB table
-// - granularity indicating how often data snapshots are recorded in the target
-func isInputDataStale(inputDataDate time.Time, targetDataDate *time.Time,
-	granularity string, targetDataLoc *time.Location,
-) bool {
-	// If target table has no data, then input data is fresh by default
-	if targetDataDate == nil {
-		return false
-	}
+// the longest --healthcheck waits on redshift
+const healthCheckTimeout = 30 * time.Second
 
-	// Handle comparison for target data in a different time zone (ex. PT)
-	_, offsetSec := targetDataDate.In(targetDataLoc).Zone()
-	offsetDuration, err := time.ParseDuration(fmt.Sprintf("%vs", -1*offsetSec))
-	fatalIfErr(err, "isInputDataStale was unable to parse offset duration")
+// healthStatus is what --healthcheck prints, as a line of JSON. Each check is "ok" or its error
+type healthStatus struct {
+	OK       bool   `json:"ok"`
+	Redshift string `json:"redshift"`
+	S3       string `json:"s3"`
+}
 
-	*targetDataDate = targetDataDate.Add(offsetDuration)
+// checkHealth runs both checks, even if the first fails, so the status says everything that's wrong
+func checkHealth(checkRedshift, checkS3 func() error) healthStatus {
+	status := healthStatus{OK: true, Redshift: "ok", S3: "ok"}
+	if err := checkRedshift(); err != nil {
+		status.OK, status.Redshift = false, err.Error()
+	}
+	if err := checkS3(); err != nil {
+		status.OK, status.S3 = false, err.Error()
+	}
+	return status
+}
 
-	// We truncate the timestamps to make the comparison at the correct granularity
-	// i.e. input data lagging by two hours is considered stale when granularity is hourly,
-	// but it can still be considered fresh when the granularity is daily.
-	return truncateDate(*targetDataDate, granularity).After(truncateDate(inputDataDate, granularity))
+// runHealthCheck checks that redshift can be queried with our credentials, and that the bucket
+// can be reached, without loading anything
+func runHealthCheck(bucketName, bucketRegion string) healthStatus {
+	return checkHealth(func() error {
+		creds, _, err := copyCredentials()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+		db, err := redshift.NewRedshiftFromCredentials(ctx, creds, int(healthCheckTimeout.Seconds()))
+		if err != nil {
+			return fmt.Errorf("error getting redshift instance: %w", err)
+		}
+		defer db.Close()
+		return db.HealthCheck()
+	}, func() error {
+		region := os.Getenv("AWS_REGION")
+		if bucketRegion != "" {
+			region = bucketRegion
+		} else if s3Endpoint == "" {
+			var err error
+			if region, err = getRegionForBucket(bucketName); err != nil {
+				return err
+			}
+		}
+		if err := s3filepath.HeadBucket(s3filepath.S3Bucket{Name: bucketName, Region: region, Endpoint: s3Endpoint}); err != nil {
+			return fmt.Errorf("can't reach bucket %s: %w", bucketName, err)
+		}
+		return nil
+	})
 }
 
 // getRegionForBucket looks up the region name for the given bucket
@@ -136,7 +225,7 @@ func getRegionForBucket(name string) (string, error) {
 	}
 	resp, err := client.GetBucketLocation(&params)
 	if err != nil {
-		return "", fmt.Errorf("failed to get location for bucket '%s', %s", name, err)
+		return "", fmt.Errorf("failed to get location for bucket '%s', %w", name, err)
 	}
 	if resp.LocationConstraint == nil {
 		// "US Standard", returns an empty region. So return any region in the US
@@ -145,289 +234,1055 @@ func getRegionForBucket(name string) (string, error) {
 	return *resp.LocationConstraint, nil
 }
 
-// in a transaction, truncate, create or update, and then copy from the s3 data file or manifest
-// yell loudly if there is anything different in the target table compared to config (different distkey, etc)
-func runCopy(
-	db *redshift.Redshift, inputConf s3filepath.S3File, inputTable redshift.Table, targetTable *redshift.Table,
-	truncate, gzip bool, delimiter, timeGranularity, targetTimeZone, streamStart, streamEnd string,
-) error {
-	tx, err := db.Begin()
+type payload struct {
+	InputSchemaName  string `config:"schema"`
+	InputTables      string `config:"tables"`
+	TablesFromFile   string `config:"tablesFromFile"`
+	InputBucket      string `config:"bucket"`
+	BucketRegion     string `config:"bucketRegion"`
+	Truncate         bool   `config:"truncate"`
+	Swap             bool   `config:"swap"`
+	Force            bool   `config:"force"`
+	OnlyIfChanged    bool   `config:"onlyIfChanged"`
+	DataDate         string `config:"date"`
+	StartDate        string `config:"startDate"`
+	EndDate          string `config:"endDate"`
+	Since            string `config:"since"`
+	ConfigFile       string `config:"config"`
+	S3Path           string `config:"s3Path"`
+	GZip             bool   `config:"gzip"`
+	Delimiter        string `config:"delimiter"`
+	TimeGranularity  string `config:"granularity,required"`
+	StreamStart      string `config:"streamStart"`
+	StreamEnd        string `config:"streamEnd"`
+	TargetTimezone   string `config:"timezone"`
+	SkipLoad         bool   `config:"skipLoad"`
+	PlainTextLogs    bool   `config:"plainTextLogs"`
+	DryRun           bool   `config:"dryRun"`
+	Preflight        bool   `config:"preflight"`
+	Healthcheck      bool   `config:"healthcheck"`
+	Version          bool   `config:"version"`
+	ValidateConfig   bool   `config:"validateConfigOnly"`
+	ListDates        bool   `config:"listDates"`
+	Reconcile        bool   `config:"reconcile"`
+	Upsert           bool   `config:"upsert"`
+	Dedup            bool   `config:"dedup"`
+	Vacuum           bool   `config:"vacuum"`
+	AllowKeyDrift    bool   `config:"allowKeyDrift"`
+	AllowDropColumns bool   `config:"allowDropColumns"`
+	AllowRebuild     bool   `config:"allowRebuild"`
+	Reset            bool   `config:"reset"`
+	Manifest         bool   `config:"manifest"`
+	VerifyCounts     bool   `config:"verifyCounts"`
+	ValidateGzip     bool   `config:"validateGzip"`
+	KeyTemplate      string `config:"keyTemplate"`
+	DateMetadata     string `config:"dateMetadata"`
+	RequesterPays    bool   `config:"requesterPays"`
+	StagingBucket    string `config:"stagingBucket"`
+	ParallelCopy     string `config:"parallelCopy"`
+	StagingSchema    string `config:"stagingSchema"`
+	QueryGroup       string `config:"queryGroup"`
+	SessionParams    string `config:"sessionParams"`
+	KMSKeyARN        string `config:"kmsKeyARN"`
+	MaxErrors        string `config:"maxErrors"`
+	Concurrency      string `config:"concurrency"`
+	MaxRetries       string `config:"maxRetries"`
+	DeadlockRetries  string `config:"deadlockRetries"`
+	RetryBaseDelay   string `config:"retryBaseDelay"`
+	StatementTimeout string `config:"statementTimeout"`
+	IsolationLevel   string `config:"isolationLevel"`
+	WaitForDate      string `config:"waitForDate"`
+	MaxDataAge       string `config:"maxDataAge"`
+	StaleData        string `config:"staleData"`
+	EmptyFiles       string `config:"emptyFiles"`
+	Timeout          string `config:"timeout"`
+	MaxConns         string `config:"maxConns"`
+	ConnMaxLifetime  string `config:"connMaxLifetime"`
+	TablePattern     string `config:"tablePattern"`
+	StatsdAddr       string `config:"statsdAddr"`
+	ServeMetrics     string `config:"serveMetrics"`
+	NotifyURL        string `config:"notifyURL"`
+}
+
+// This worker finds the latest file in s3 and uploads it to redshift
+// If the destination table does not exist, the worker creates it
+// If the destination table lacks columns, the worker creates those as well
+// The worker also uses a column in the data to figure out whether the s3 data is
+// newer than what already exists.
+func main() {
+	dir, err := osext.ExecutableFolder()
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-
-	// TRUNCATE for dimension tables, but not fact tables
-	if truncate && targetTable != nil {
-		log.Println("truncating table!")
-		if err := db.Truncate(tx, inputConf.Schema, inputTable.Name); err != nil {
-			return fmt.Errorf("err running truncate table: %s", err)
-		}
+	err = logger.SetGlobalRouting(path.Join(dir, "kvconfig.yml"))
+	if err != nil {
+		log.Fatal(err)
 	}
-	if targetTable == nil {
-		if err := db.CreateTable(tx, inputTable); err != nil {
-			return fmt.Errorf("err running create table: %s", err)
-		}
-	} else {
-		var start, end time.Time
-		var err error
-		if timeGranularity == "stream" {
-			start, err = time.Parse("2006-01-02T15:04:05", streamStart)
-			if err != nil {
-				return err
-			}
-			end, err = time.Parse("2006-01-02T15:04:05", streamEnd)
-			if err != nil {
-				return err
-			}
-		} else {
-			start, end = startEndFromGranularity(inputConf.DataDate, timeGranularity, targetTimeZone)
-		}
-		// To prevent duplicates, clear away any existing data within a certain time range as the data date
-		// (that is, sharing the same data date up to a certain time granularity)
-		if err := db.TruncateInTimeRange(tx, inputConf.Schema, inputTable.Name, inputTable.Meta.DataDateColumn, start, end); err != nil {
-			return fmt.Errorf("err truncating data for data refresh: %s", err)
-		}
 
-		if err := db.UpdateTable(tx, inputTable, *targetTable); err != nil {
-			return fmt.Errorf("err running update table: %s", err)
-		}
+	flags := payload{ // Specifying defaults:
+		InputSchemaName:  "mongo_raw",
+		InputTables:      "",
+		TablesFromFile:   "",
+		InputBucket:      "",
+		BucketRegion:     "",
+		Truncate:         false,
+		Swap:             false,
+		Force:            false,
+		OnlyIfChanged:    false,
+		DataDate:         "",
+		StartDate:        "",
+		EndDate:          "",
+		Since:            "",
+		ConfigFile:       "",
+		S3Path:           "",
+		GZip:             true,
+		Delimiter:        "",
+		TimeGranularity:  "day",
+		StreamStart:      "",
+		StreamEnd:        "",
+		TargetTimezone:   "UTC",
+		SkipLoad:         false,
+		PlainTextLogs:    false,
+		DryRun:           false,
+		Preflight:        false,
+		Healthcheck:      false,
+		Version:          false,
+		ValidateConfig:   false,
+		ListDates:        false,
+		Upsert:           false,
+		Dedup:            false,
+		Vacuum:           false,
+		AllowKeyDrift:    false,
+		AllowDropColumns: false,
+		AllowRebuild:     false,
+		Reset:            false,
+		Manifest:         false,
+		VerifyCounts:     false,
+		ValidateGzip:     false,
+		KeyTemplate:      "",
+		DateMetadata:     "",
+		RequesterPays:    false,
+		StagingBucket:    "",
+		ParallelCopy:     "1",
+		StagingSchema:    "",
+		QueryGroup:       "",
+		SessionParams:    "",
+		KMSKeyARN:        "",
+		MaxErrors:        "0",
+		Concurrency:      "1",
+		MaxRetries:       "3",
+		DeadlockRetries:  "3",
+		RetryBaseDelay:   "5s",
+		StatementTimeout: "",
+		IsolationLevel:   "",
+		WaitForDate:      "",
+		MaxDataAge:       "",
+		StaleData:        redshifter.StaleDataFail,
+		EmptyFiles:       redshifter.EmptyFilesLoad,
+		Timeout:          "",
+		MaxConns:         "0",
+		ConnMaxLifetime:  "",
+		TablePattern:     "",
 	}
 
-	// COPY direct into it, ok to do since we're in a transaction
-	// can't switch on file ending as manifest files b/c
-	// manifest files obscure the underlying file types
-	// instead just pass the delimiter along even if it's null
-	if err := db.Copy(tx, inputConf, delimiter, true, gzip); err != nil {
-		return fmt.Errorf("err running copy: %s", err)
+	nextPayload, err := analyticspipeline.AnalyticsWorker(&flags)
+	if err != nil {
+		log.Fatalf("err: %#v", err)
 	}
+	defer analyticspipeline.PrintPayload(nextPayload)
 
-	// Update the latency info table so we have an easier record of the last update.
-	if err := db.UpdateLatencyInfo(tx, *targetTable); err != nil {
-		return fmt.Errorf("err updating latency info: %s", err)
+	if flags.Version {
+		fmt.Println(versionString())
+		os.Exit(0)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("err committing transaction: %s", err)
+	if flags.PlainTextLogs {
+		logger.SetPlainText()
 	}
+	logger.GetLogger().InfoD("worker-start", logger.M{"version": version, "git_sha": gitSHA, "build_date": buildDate})
 
-	// There's a good chance we've deleted some data in the table here (e.g. a stream load,
-	// truncate, or update historical set that exists). Run a vacuum to clear out the old data.
-	// Only one vacuum can be run at a time, so we're going to throw this over the wall to
-	// redshift-vacuum and use gearman-admin as a queueing service.
-	if len(gearmanAdminURL) == 0 {
-		log.Fatalf("Unable to post vacuum-analyze job to %s", cleanupWorker)
-	} else {
-		log.Println("Submitting job to Gearman admin")
-
-		// N.B. We need to pass backslashes to escape the quotation marks as required
-		// by Golang's os.Args for command line arguments
-		cleanupArgs := map[string]string{
-			"targets":     inputConf.Schema + `."` + inputTable.Name + `"`,
-			"vacuum_mode": "delete",
-			// If we truncated, analyze will run regardless since 100% of the rows have changed. Otherwise,
-			// only analyze if we've changed enough rows (threshold > 1%)
-			"analyze_mode":      "full",
-			"analyze_threshold": "1",
+	if flags.StatsdAddr != "" {
+		reporter, err := metrics.NewStatsdReporter(flags.StatsdAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
-
-		payload, err := json.Marshal(cleanupArgs)
+		defer reporter.Close()
+		metricsReporter = reporter
+	}
+	// the metrics are served for as long as the worker runs, for prometheus to scrape
+	if flags.ServeMetrics != "" {
+		reporter := metrics.NewPrometheusReporter()
+		listener, err := net.Listen("tcp", flags.ServeMetrics)
 		if err != nil {
-			log.Fatalf("Error creating new payload: %s", err)
+			log.Fatalf("error serving metrics on %s: %s", flags.ServeMetrics, err)
 		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", reporter)
+		server := &http.Server{Handler: mux}
+		go server.Serve(listener)
+		defer server.Close()
+		metricsReporter = metrics.MultiReporter{metricsReporter, reporter}
+	}
 
-		client := &http.Client{}
-		endpoint := gearmanAdminURL + fmt.Sprintf("/%s", cleanupWorker)
-		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
-		if err != nil {
-			log.Fatalf("Error creating new request: %s", err)
+	// without a URL, nothing is notified
+	var notifier redshifter.Notifier
+	if flags.NotifyURL != "" {
+		httpNotifier := redshifter.NewHTTPNotifier(flags.NotifyURL)
+		httpNotifier.OnError = func(err error) {
+			logger.GetLogger().WarnD("notify-error", logger.M{"error": err.Error()})
 		}
-		req.Header.Add("Content-Type", "text/plain")
-		_, err = client.Do(req)
+		notifier = httpNotifier
+	}
+
+	// If we're to skip the load, do it early. Don't print out the schema or job finished info.
+	// This wasn't a job that we did anything for.
+	if flags.SkipLoad {
+		// Proceed directly to next job. Do not pass go. Do not collect logs.
+		return
+	}
+
+	// CI only wants to know whether the config is valid, without any secrets or credentials
+	if flags.ValidateConfig {
+		if flags.ConfigFile == "" {
+			panic("validateConfigOnly requires --config")
+		}
+		configs, err := redshift.ReadConfFile(s3filepath.S3Bucket{Region: os.Getenv("AWS_REGION"), Endpoint: s3Endpoint}, flags.ConfigFile)
 		if err != nil {
-			log.Fatalf("Error submitting job: %s", err)
+			log.Fatalf("error reading config %s: %s", flags.ConfigFile, err)
+		}
+		if err := validateConfigs(configs); err != nil {
+			logger.GetLogger().ErrorD("invalid-config", logger.M{"config": flags.ConfigFile, "error": err.Error()})
+			os.Exit(exitSchemaMismatch)
 		}
+		logger.GetLogger().InfoD("config-valid", logger.M{"config": flags.ConfigFile, "tables": len(configs)})
+		os.Exit(0)
+	}
+	// everything else needs the bucket, which --validateConfigOnly doesn't
+	if flags.InputBucket == "" {
+		log.Fatal("Missing required fields: [bucket]")
 	}
-	return nil
-}
 
-func startEndFromGranularity(t time.Time, granularity string, targetTimezone string) (time.Time, time.Time) {
-	// Rotate time if in PT
-	log.Print(targetTimezone)
-	if targetTimezone != "UTC" {
-		ptLoc, err := time.LoadLocation(targetTimezone)
-		fatalIfErr(err, "startEndFromGranularity was unable to load timezone")
+	// a monitoring probe only wants to know whether we can reach redshift and s3, so print that
+	// and exit without a payload for the next job
+	if flags.Healthcheck {
+		status := runHealthCheck(flags.InputBucket, flags.BucketRegion)
+		json.NewEncoder(os.Stdout).Encode(status)
+		if !status.OK {
+			os.Exit(exitLoadFailed)
+		}
+		os.Exit(0)
+	}
 
-		_, ptOffsetSec := t.In(ptLoc).Zone()
-		ptOffsetDuration, err := time.ParseDuration(fmt.Sprintf("%vs", ptOffsetSec))
-		fatalIfErr(err, "startEndFromGranularity was unable to parse offset duration")
+	payloadForSignalFx = fmt.Sprintf("--schema %s", flags.InputSchemaName)
+	defer logger.JobFinishedEvent(payloadForSignalFx, true)
 
-		t = t.Add(ptOffsetDuration)
+	// a date range, or --since, loads every date in it that there's data for, instead of a single
+	// date. selectDates picks them out of the dates there's data for
+	var selectDates func(available []time.Time) []time.Time
+	if flags.StartDate != "" || flags.EndDate != "" {
+		if flags.DataDate != "" || flags.Since != "" {
+			fatal("date and since can't be used with startDate and endDate")
+		}
+		startDate, startErr := time.Parse(time.RFC3339, flags.StartDate)
+		endDate, endErr := time.Parse(time.RFC3339, flags.EndDate)
+		if startErr != nil || endErr != nil || endDate.Before(startDate) {
+			fatal(fmt.Sprintf("Invalid date range '%s' to '%s', startDate and endDate must both be RFC3339 dates, in order",
+				flags.StartDate, flags.EndDate))
+		}
+		selectDates = func(available []time.Time) []time.Time { return datesInRange(available, startDate, endDate) }
+	} else if flags.Since != "" {
+		if flags.DataDate != "" {
+			fatal("date can't be used with since")
+		}
+		since, err := time.Parse(time.RFC3339, flags.Since)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid since '%s', must be an RFC3339 date", flags.Since))
+		}
+		selectDates = func(available []time.Time) []time.Time { return datesAfter(available, since) }
 	}
+	dateRange := selectDates != nil
 
-	var duration time.Duration
-	if granularity == "day" {
-		duration = time.Hour * 24
-	} else {
-		duration = time.Hour
+	// listing dates or reconciling doesn't load anything, so doesn't need one
+	if flags.DataDate == "" && !dateRange && !flags.ListDates && !flags.Reconcile {
+		fatal("No date provided")
 	}
 
-	start := t.UTC().Truncate(duration)
-	end := start.Add(duration)
-	return start, end
-}
+	// each date of a range would drop the ones before it
+	if flags.Reset && dateRange {
+		fatal("reset can't be used with a date range")
+	}
 
-type payload struct {
-	InputSchemaName string `config:"schema"`
-	InputTables     string `config:"tables"`
-	InputBucket     string `config:"bucket,required"`
-	Truncate        bool   `config:"truncate"`
-	Force           bool   `config:"force"`
-	DataDate        string `config:"date,required"`
-	ConfigFile      string `config:"config"`
-	GZip            bool   `config:"gzip"`
-	Delimiter       string `config:"delimiter"`
-	TimeGranularity string `config:"granularity,required"`
-	StreamStart     string `config:"streamStart"`
-	StreamEnd       string `config:"streamEnd"`
-	TargetTimezone  string `config:"timezone"`
-	SkipLoad        bool   `config:"skipLoad"`
-}
+	// the tables to reconcile are the ones in the config file
+	if flags.Reconcile && flags.ConfigFile == "" {
+		fatal("reconcile requires --config")
+	}
 
-// This worker finds the latest file in s3 and uploads it to redshift
-// If the destination table does not exist, the worker creates it
-// If the destination table lacks columns, the worker creates those as well
-// The worker also uses a column in the data to figure out whether the s3 data is
-// newer than what already exists.
-func main() {
-	dir, err := osext.ExecutableFolder()
+	// the numbers and durations are checked for range, along with which options can be used
+	// together, by LoadConfig.Validate below
+	maxErrors, err := strconv.Atoi(flags.MaxErrors)
 	if err != nil {
-		log.Fatal(err)
+		fatal(fmt.Sprintf("Invalid maxErrors '%s', must be a non-negative integer", flags.MaxErrors))
 	}
-	err = logger.SetGlobalRouting(path.Join(dir, "kvconfig.yml"))
+	maxRetries, err := strconv.Atoi(flags.MaxRetries)
 	if err != nil {
-		log.Fatal(err)
+		fatal(fmt.Sprintf("Invalid maxRetries '%s', must be a non-negative integer", flags.MaxRetries))
+	}
+	deadlockRetries, err := strconv.Atoi(flags.DeadlockRetries)
+	if err != nil {
+		fatal(fmt.Sprintf("Invalid deadlockRetries '%s', must be a non-negative integer", flags.DeadlockRetries))
+	}
+	// parallelCopy is a positive number of COPYs to split a manifest load between
+	parallelCopy, err := strconv.Atoi(flags.ParallelCopy)
+	if err != nil || parallelCopy < 1 {
+		fatal(fmt.Sprintf("Invalid parallelCopy '%s', must be a positive integer", flags.ParallelCopy))
+	}
+	// verify that the timeout for the whole run, if any, is a positive duration
+	var runTimeout time.Duration
+	if flags.Timeout != "" {
+		if runTimeout, err = time.ParseDuration(flags.Timeout); err != nil || runTimeout <= 0 {
+			fatal(fmt.Sprintf("Invalid timeout '%s', must be a positive duration (e.g. 2h)", flags.Timeout))
+		}
+	}
+	retryBaseDelay, err := time.ParseDuration(flags.RetryBaseDelay)
+	if err != nil {
+		fatal(fmt.Sprintf("Invalid retryBaseDelay '%s', must be a non-negative duration (e.g. 5s)", flags.RetryBaseDelay))
 	}
 
-	flags := payload{ // Specifying defaults:
-		InputSchemaName: "mongo_raw",
-		InputTables:     "",
-		InputBucket:     "",
-		Truncate:        false,
-		Force:           false,
-		DataDate:        "",
-		ConfigFile:      "",
-		GZip:            true,
-		Delimiter:       "",
-		TimeGranularity: "day",
-		StreamStart:     "",
-		StreamEnd:       "",
-		TargetTimezone:  "UTC",
-		SkipLoad:        false,
+	var statementTimeout time.Duration
+	if flags.StatementTimeout != "" {
+		if statementTimeout, err = time.ParseDuration(flags.StatementTimeout); err != nil || statementTimeout <= 0 {
+			fatal(fmt.Sprintf("Invalid statementTimeout '%s', must be a positive duration (e.g. 1h)", flags.StatementTimeout))
+		}
 	}
 
-	nextPayload, err := analyticspipeline.AnalyticsWorker(&flags)
-	if err != nil {
-		log.Fatalf("err: %#v", err)
+	isolationLevel, ok := redshift.IsolationLevels[flags.IsolationLevel]
+	if !ok {
+		fatal(fmt.Sprintf("Invalid isolationLevel '%s', must be one of %v", flags.IsolationLevel, isolationLevelNames()))
 	}
-	defer analyticspipeline.PrintPayload(nextPayload)
 
-	// If we're to skip the load, do it early. Don't print out the schema or job finished info.
-	// This wasn't a job that we did anything for.
-	if flags.SkipLoad {
-		// Proceed directly to next job. Do not pass go. Do not collect logs.
-		return
+	var waitForDate time.Duration
+	if flags.WaitForDate != "" {
+		if waitForDate, err = time.ParseDuration(flags.WaitForDate); err != nil || waitForDate <= 0 {
+			fatal(fmt.Sprintf("Invalid waitForDate '%s', must be a positive duration (e.g. 30m)", flags.WaitForDate))
+		}
 	}
 
-	payloadForSignalFx = fmt.Sprintf("--schema %s", flags.InputSchemaName)
-	defer logger.JobFinishedEvent(payloadForSignalFx, true)
+	var maxDataAge time.Duration
+	if flags.MaxDataAge != "" {
+		if maxDataAge, err = time.ParseDuration(flags.MaxDataAge); err != nil || maxDataAge <= 0 {
+			fatal(fmt.Sprintf("Invalid maxDataAge '%s', must be a positive duration (e.g. 48h)", flags.MaxDataAge))
+		}
+	}
 
-	if flags.DataDate == "" {
-		logger.JobFinishedEvent(payloadForSignalFx, false)
-		panic("No date provided")
+	// verify that concurrency is a positive number of tables to load at once
+	concurrency, err := strconv.Atoi(flags.Concurrency)
+	if err != nil || concurrency < 1 {
+		fatal(fmt.Sprintf("Invalid concurrency '%s', must be a positive integer", flags.Concurrency))
 	}
 
-	// verify that timeGranularity is a supported value. for convenience,
-	// we use the convention that granularities must be valid PostgreSQL dateparts
-	// (see: http://www.postgresql.org/docs/8.1/static/functions-datetime.html#FUNCTIONS-DATETIME-TRUNC)
-	supportedGranularities := map[string]bool{"hour": true, "day": true, "stream": true}
-	if !supportedGranularities[flags.TimeGranularity] {
-		logger.JobFinishedEvent(payloadForSignalFx, false)
-		panic(fmt.Sprintf("Unsupported granularity, must be one of %v", getMapKeys(supportedGranularities)))
+	// verify that maxConns leaves a spare connection: each table being loaded holds one for its
+	// transaction, and needs another now and then (e.g. for the latency table). 0 means no limit
+	maxConns, err := strconv.Atoi(flags.MaxConns)
+	if err != nil || maxConns < 0 || (maxConns > 0 && maxConns <= concurrency) {
+		fatal(fmt.Sprintf("Invalid maxConns '%s', must be 0 or more than concurrency", flags.MaxConns))
+	}
+	var connMaxLifetime time.Duration
+	if flags.ConnMaxLifetime != "" {
+		if connMaxLifetime, err = time.ParseDuration(flags.ConnMaxLifetime); err != nil || connMaxLifetime <= 0 {
+			fatal(fmt.Sprintf("Invalid connMaxLifetime '%s', must be a positive duration (e.g. 30m)", flags.ConnMaxLifetime))
+		}
 	}
 
-	// verify that targetTimezone is a supported Golang location (i.e. "America/Los_Angeles")
-	targetDataLocation, err := time.LoadLocation(flags.TargetTimezone)
-	fatalIfErr(err, fmt.Sprintf("unable to load timezone '%s'", flags.TargetTimezone))
+	// the load's options, which LoadTable is given for each table and date. The database and the
+	// bucket's region and credentials are filled in once they're known
+	base := redshifter.LoadConfig{
+		Bucket: s3filepath.S3Bucket{
+			KeyTemplate: flags.KeyTemplate, DateMetadata: flags.DateMetadata,
+			RequesterPays: flags.RequesterPays, StagingBucket: flags.StagingBucket,
+		},
+		ConfigFile:       flags.ConfigFile,
+		S3Path:           flags.S3Path,
+		Manifest:         flags.Manifest,
+		ParallelCopy:     parallelCopy,
+		GZip:             flags.GZip,
+		Delimiter:        flags.Delimiter,
+		TimeGranularity:  flags.TimeGranularity,
+		StreamStart:      flags.StreamStart,
+		StreamEnd:        flags.StreamEnd,
+		TargetTimezone:   flags.TargetTimezone,
+		Truncate:         flags.Truncate,
+		Swap:             flags.Swap,
+		Force:            flags.Force,
+		OnlyIfChanged:    flags.OnlyIfChanged,
+		DryRun:           flags.DryRun,
+		Upsert:           flags.Upsert,
+		Dedup:            flags.Dedup,
+		Vacuum:           flags.Vacuum,
+		AllowKeyDrift:    flags.AllowKeyDrift,
+		AllowDropColumns: flags.AllowDropColumns,
+		AllowRebuild:     flags.AllowRebuild,
+		Reset:            flags.Reset,
+		VerifyCounts:     flags.VerifyCounts,
+		ValidateGzip:     flags.ValidateGzip,
+		EmptyFiles:       flags.EmptyFiles,
+		MaxErrors:        maxErrors,
+		MaxRetries:       maxRetries,
+		DeadlockRetries:  deadlockRetries,
+		RetryBaseDelay:   retryBaseDelay,
+		StatementTimeout: statementTimeout,
+		IsolationLevel:   isolationLevel,
+		WaitForDate:      waitForDate,
+		MaxDataAge:       maxDataAge,
+		StaleData:        flags.StaleData,
+		Metrics:          metricsReporter,
+		Notifier:         notifier,
+		QueueVacuum:      queueVacuum,
+	}
+	fatalIfErr(base.Validate(), "invalid options")
 
-	awsRegion, locationErr := getRegionForBucket(flags.InputBucket)
-	fatalIfErr(locationErr, "error getting location for bucket "+flags.InputBucket)
+	// work out which schema each table is in
+	inputTables := flags.InputTables
+	if flags.TablesFromFile != "" {
+		open := func(path string) (io.ReadCloser, error) {
+			return s3filepath.Reader(s3filepath.S3Bucket{Region: os.Getenv("AWS_REGION"), Endpoint: s3Endpoint}, path)
+		}
+		fileTables, err := readTablesFile(open, flags.TablesFromFile)
+		fatalIfErr(err, "error reading tables file "+flags.TablesFromFile)
+		inputTables = mergeTables(inputTables, fileTables)
+	}
+	var targets []tableTarget
+	if inputTables != "" || flags.TablePattern == "" {
+		targets, err = parseTargets(flags.InputSchemaName, inputTables)
+		fatalIfErr(err, "error parsing tables")
+	}
+
+	// custom endpoints (e.g. MinIO) don't have AWS regions to look up, so use the configured one
+	// --bucketRegion saves looking it up, which needs s3:GetBucketLocation on the bucket
+	awsRegion := os.Getenv("AWS_REGION")
+	if flags.BucketRegion != "" {
+		awsRegion = flags.BucketRegion
+	} else if s3Endpoint == "" {
+		var locationErr error
+		awsRegion, locationErr = getRegionForBucket(flags.InputBucket)
+		fatalIfErr(locationErr, "error getting location for bucket "+flags.InputBucket)
+	}
+
+	creds, chainProvider, err := copyCredentials()
+	fatalIfErr(err, "error getting copy credentials")
+	if chainProvider != "" {
+		logger.GetLogger().InfoD("using-credential-chain", logger.M{"provider": chainProvider})
+	}
 
 	// use an custom bucket type for testablitity
-	bucket := s3filepath.S3Bucket{
-		Name:            flags.InputBucket,
-		Region:          awsRegion,
-		RedshiftRoleARN: redshiftRoleARN}
+	bucket := creds.Bucket(flags.InputBucket, awsRegion)
+	// keys from the provider sign our own s3 requests too, rather than whatever the chain finds
+	if chainProvider == "" {
+		bucket.Credentials = creds.S3Credentials()
+	}
+	bucket.KMSKeyARN = kmsKeyARN
+	bucket.Endpoint = s3Endpoint
+	bucket.KeyTemplate = flags.KeyTemplate
+	bucket.DateMetadata = flags.DateMetadata
+	bucket.RequesterPays = flags.RequesterPays
+	bucket.StagingBucket = flags.StagingBucket
+	if flags.KMSKeyARN != "" {
+		bucket.KMSKeyARN = flags.KMSKeyARN
+	}
 
-	timeout := 60 // can parameterize later if this is an issue
-	if host == "" {
-		host = "localhost"
+	// add any tables matching --tablePattern in each schema which weren't asked for already
+	store := s3filepath.S3ObjectStore{Region: bucket.Region, Endpoint: bucket.Endpoint, RequesterPays: bucket.RequesterPays, Credentials: bucket.Credentials}
+	if flags.TablePattern != "" {
+		targets, err = discoverTargets(store, bucket, flags.InputSchemaName, flags.TablePattern, targets)
+		fatalIfErr(err, "error discovering tables")
+	}
+	// an exact file is only the data of one table, for one date
+	if flags.S3Path != "" && (len(targets) != 1 || dateRange) {
+		fatal("s3Path can only be used to load a single table, without a date range")
 	}
-	if port == "" {
-		port = "5439"
+	if flags.Reset {
+		fatalIfErr(checkReset(targets, productionSchemas, confirmResetSchema), "error resetting tables")
+		for _, t := range targets {
+			logger.GetLogger().WarnD("reset-requested", logger.M{"schema": t.schema, "table": t.table})
+		}
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+
+	// with --config, a table's config can say its data is in another bucket than --bucket
+	buckets := map[string]s3filepath.S3Bucket{}
+	var configs map[string]redshift.Table
+	if flags.ConfigFile != "" {
+		configs, err = redshift.ReadConfFile(bucket, flags.ConfigFile)
+		fatalIfErr(err, "error reading config "+flags.ConfigFile)
+		buckets, err = tableBuckets(configs, targets, bucket, func(name string) (string, error) {
+			if s3Endpoint != "" {
+				return os.Getenv("AWS_REGION"), nil
+			}
+			return getRegionForBucket(name)
+		})
+		fatalIfErr(err, "error getting the tables' buckets")
+	}
+	bucketFor := func(t tableTarget) s3filepath.S3Bucket {
+		if b, ok := buckets[t.schema+"."+t.table]; ok {
+			return b
+		}
+		return bucket
+	}
+
+	// print the data dates in s3 for each table, without touching redshift
+	if flags.ListDates {
+		for _, t := range targets {
+			b := bucketFor(t)
+			dates, err := s3filepath.ListAvailableDates(s3filepath.S3ObjectStore{Region: b.Region, Endpoint: b.Endpoint, RequesterPays: b.RequesterPays, Credentials: b.Credentials}, b, t.schema, t.table)
+			fatalIfErr(err, fmt.Sprintf("error listing dates for %s.%s", t.schema, t.table))
+			for _, date := range dates {
+				fmt.Printf("%s.%s %s\n", t.schema, t.table, date.Format(time.RFC3339))
+			}
+		}
+		return
+	}
+
+	timeout := 60 // can parameterize later if this is an issue
+	// the whole run is bounded by --timeout, if set, so a stuck query can't hold the worker forever
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if runTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), runTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	inFlight := newInFlightTables()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Signal(syscall.SIGTERM))
 	go func() {
-		for range c {
+		for sig := range c {
 			// sfncli will send signals to our container
-			// we should gracefully terminate any running SQL queries
+			// we should gracefully terminate any running SQL queries, which rolls back their
+			// transactions rather than leaving them holding locks
+			logger.GetLogger().WarnD("interrupted", logger.M{"signal": sig.String(), "in_flight": inFlight.list()})
 			cancel()
 		}
 	}()
 
-	db, err := redshift.NewRedshift(ctx, host, port, dbName, user, pwd, timeout)
+	db, err := redshift.NewRedshiftFromCredentials(ctx, creds, timeout)
 	fatalIfErr(err, "error getting redshift instance")
+	db.SetDryRun(flags.DryRun)
+	// keep a connection around for each table being loaded at once, and each of its parallel COPYs
+	db.SetMaxIdleConns(concurrency * parallelCopy)
+	if maxConns > 0 {
+		db.SetMaxOpenConns(maxConns)
+	}
+	if connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(connMaxLifetime)
+	}
+	db.SetStagingSchema(flags.StagingSchema)
+	sessionParams, err := parseSessionParams(flags.QueryGroup, flags.SessionParams)
+	fatalIfErr(err, "error parsing session parameters")
+	fatalIfErr(db.SetSessionParams(sessionParams), "error setting session parameters")
 
-	var copyErrors error
-	// for each table passed in - likely we could goroutine this out
-	for _, t := range strings.Split(flags.InputTables, ",") {
-		log.Printf("attempting to run on schema: %s table: %s", flags.InputSchemaName, t)
-		// override most recent data file
-		parsedInputDate, err := time.Parse(time.RFC3339, flags.DataDate)
+	// report how every table in the config differs from redshift, without changing anything
+	if flags.Reconcile {
+		drifts, err := reconcileTables(configs, db.GetTable, db.DiffTable)
+		fatalIfErr(err, "error reconciling tables")
+		drifted := 0
+		enc := json.NewEncoder(os.Stdout)
+		for _, d := range drifts {
+			enc.Encode(d)
+			if d.Drifted {
+				drifted++
+			}
+		}
+		logger.GetLogger().InfoD("reconcile-done", logger.M{"tables": len(drifts), "drifted": drifted})
+		if drifted > 0 {
+			os.Exit(exitSchemaMismatch)
+		}
+		return
+	}
+
+	// only loads queue vacuums, so nothing before needs these secrets
+	if queuesVacuums(flags) {
+		loadCleanupConfig()
+	}
+
+	// check each schema can be loaded into from each of its buckets before loading anything
+	if flags.Preflight {
+		checked := map[string]bool{}
+		for _, t := range targets {
+			b := bucketFor(t)
+			if !checked[t.schema+" "+b.Name] {
+				checked[t.schema+" "+b.Name] = true
+				fatalIfErr(db.Preflight(t.schema, b), fmt.Sprintf("preflight check failed for schema %s from bucket %s", t.schema, b.Name))
+			}
+		}
+		logger.GetLogger().InfoD("preflight-ok", logger.M{"checks": len(checked)})
+	}
+
+	// override most recent data file
+	var parsedInputDate time.Time
+	if !dateRange {
+		parsedInputDate, err = time.Parse(time.RFC3339, flags.DataDate)
 		fatalIfErr(err, fmt.Sprintf("issue parsing date: %s", flags.DataDate))
-		inputConf, err := s3filepath.CreateS3File(s3filepath.S3PathChecker{}, bucket, flags.InputSchemaName, t, flags.ConfigFile, parsedInputDate)
-		fatalIfErr(err, "Issue getting data file from s3")
-		inputTable, err := db.GetTableFromConf(*inputConf) // allow passing explicit config later
-		fatalIfErr(err, "Issue getting table from input")
+	}
 
-		// figure out what the current state of the table is to determine if the table is already up to date
-		targetTable, targetDataDate, err := db.GetTableMetadata(inputConf.Schema, inputConf.Table, inputTable.Meta.DataDateColumn)
-		if err != nil {
-			fatalIfErr(err, "Error getting existing latest table metadata") // use fatalIfErr to stay the same
+	base.DB, base.Bucket = db, bucket
+	// temporary credentials can expire during a long run, so get them afresh for each COPY
+	if creds.Token != "" {
+		base.RefreshCredentials = func() (redshift.Credentials, error) {
+			creds, _, err := copyCredentials()
+			return creds, err
+		}
+	}
+
+	// each worker loads one table at a time in its own transaction, so a failure in one table
+	// doesn't abort the others. With a date range or since, each date is loaded in its own transaction,
+	// oldest first, and a failure stops the table's later dates but leaves the earlier ones loaded
+	var copyErrors error
+	var copyErrorsLock sync.Mutex
+	var wg sync.WaitGroup
+	tables := make(chan tableTarget)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tables {
+				dates := []time.Time{parsedInputDate}
+				b := bucketFor(t)
+				var err error
+				if dateRange {
+					var available []time.Time
+					store := s3filepath.S3ObjectStore{Region: b.Region, Endpoint: b.Endpoint, RequesterPays: b.RequesterPays, Credentials: b.Credentials}
+					if available, err = s3filepath.ListAvailableDates(store, b, t.schema, t.table); err == nil {
+						dates = selectDates(available)
+						logger.GetLogger().InfoD("dates-to-load", logger.M{"schema": t.schema, "table": t.table, "dates": len(dates)})
+					}
+				}
+				inFlight.add(t)
+				for i := 0; err == nil && i < len(dates); i++ {
+					cfg := base
+					cfg.Bucket, cfg.Schema, cfg.Table, cfg.DataDate = b, t.schema, t.table, dates[i]
+					// a backfill's older dates are meant to be old, only the newest says if the data's stale
+					if i < len(dates)-1 {
+						cfg.MaxDataAge = 0
+					}
+					_, err = redshifter.LoadTable(ctx, cfg)
+				}
+				inFlight.remove(t)
+				if err != nil && t.discovered && errors.Is(err, redshift.ErrTableNotInConf) {
+					// new tables may land in s3 before anyone's configured them
+					logger.GetLogger().WarnD("skip-unconfigured-table", logger.M{"schema": t.schema, "table": t.table})
+				} else if err != nil {
+					logger.GetLogger().ErrorD("load-table-error", logger.M{
+						"schema": t.schema, "table": t.table, "error": err.Error(),
+					})
+					copyErrorsLock.Lock()
+					copyErrors = multierror.Append(copyErrors, fmt.Errorf("table %s.%s: %w", t.schema, t.table, err))
+					copyErrorsLock.Unlock()
+				}
+			}
+		}()
+	}
+	undispatched := dispatch(ctx, tables, targets)
+	close(tables)
+	wg.Wait()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.GetLogger().ErrorD("run-timed-out", logger.M{
+			"schemas": flags.InputSchemaName, "timeout": runTimeout.String(), "not_started": len(undispatched),
+		})
+		copyErrors = notStartedErrors(copyErrors, undispatched, ctx.Err())
+	} else if ctx.Err() == context.Canceled {
+		// the loads in progress were rolled back, and fail the run with the tables never started
+		logger.GetLogger().ErrorD("run-interrupted", logger.M{
+			"schemas": flags.InputSchemaName, "not_started": len(undispatched),
+		})
+		copyErrors = notStartedErrors(copyErrors, undispatched, ctx.Err())
+	}
+	if copyErrors != nil {
+		log.Printf("error loading tables: %s", copyErrors)
+		logger.JobFinishedEvent(payloadForSignalFx, false)
+		os.Exit(exitCode(copyErrors))
+	}
+}
+
+// dispatch sends the targets to the workers until the run is interrupted or times out, after
+// which no more tables are started. Returns the targets which weren't sent
+func dispatch(ctx context.Context, tables chan<- tableTarget, targets []tableTarget) []tableTarget {
+	for i, t := range targets {
+		select {
+		case tables <- t:
+		case <-ctx.Done():
+			return targets[i:]
+		}
+	}
+	return nil
+}
+
+// notStartedErrors adds an error for each of the tables the run stopped before starting to the
+// tables' load errors, so that they fail the run
+func notStartedErrors(loadErrors error, notStarted []tableTarget, cause error) error {
+	for _, t := range notStarted {
+		loadErrors = multierror.Append(loadErrors, fmt.Errorf("table %s.%s: not started: %w", t.schema, t.table, cause))
+	}
+	return loadErrors
+}
+
+// the worker's exit codes when loads fail, so whatever runs it can tell a table which needs its
+// config or target fixed from a load which might work when retried
+const (
+	exitLoadFailed     = 1
+	exitSchemaMismatch = 3
+	exitCopyFailed     = 4
+	exitTimedOut       = 5
+)
+
+// exitCode picks the exit code for the tables' load errors. A schema mismatch in any table wins,
+// since retrying won't help it
+func exitCode(loadErrors error) int {
+	errs := []error{loadErrors}
+	if merr, ok := loadErrors.(*multierror.Error); ok {
+		errs = merr.Errors
+	}
+	code := exitLoadFailed
+	for _, err := range errs {
+		if errors.Is(err, redshift.ErrTableSchemaMismatch) {
+			return exitSchemaMismatch
+		}
+		var copyErr *redshift.CopyError
+		if errors.As(err, &copyErr) {
+			code = exitCopyFailed
+		} else if (errors.Is(err, redshift.ErrStatementTimeout) || errors.Is(err, context.DeadlineExceeded)) && code == exitLoadFailed {
+			code = exitTimedOut
+		}
+	}
+	return code
+}
+
+// queueVacuum throws the table over the wall to redshift-vacuum to vacuum and analyze, using
+// gearman-admin as a queueing service, since only one vacuum can be run at a time
+func queueVacuum(schema, table string) {
+	if len(gearmanAdminURL) == 0 {
+		log.Fatalf("Unable to post vacuum-analyze job to %s", cleanupWorker)
+	}
+	logger.GetLogger().InfoD("submit-cleanup-job", logger.M{"worker": cleanupWorker, "schema": schema, "table": table})
+
+	// N.B. We need to pass backslashes to escape the quotation marks as required
+	// by Golang's os.Args for command line arguments
+	cleanupArgs := map[string]string{
+		"targets":     schema + `."` + table + `"`,
+		"vacuum_mode": "delete",
+		// If we truncated, analyze will run regardless since 100% of the rows have changed. Otherwise,
+		// only analyze if we've changed enough rows (threshold > 1%)
+		"analyze_mode":      "full",
+		"analyze_threshold": "1",
+	}
+
+	payload, err := json.Marshal(cleanupArgs)
+	if err != nil {
+		log.Fatalf("Error creating new payload: %s", err)
+	}
+
+	client := &http.Client{}
+	endpoint := gearmanAdminURL + fmt.Sprintf("/%s", cleanupWorker)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		log.Fatalf("Error creating new request: %s", err)
+	}
+	req.Header.Add("Content-Type", "text/plain")
+	_, err = client.Do(req)
+	if err != nil {
+		log.Fatalf("Error submitting job: %s", err)
+	}
+}
+
+// inFlightTables is the set of tables being loaded, so an interruption can say which it stopped
+type inFlightTables struct {
+	sync.Mutex
+	tables map[string]bool
+}
+
+func newInFlightTables() *inFlightTables {
+	return &inFlightTables{tables: map[string]bool{}}
+}
+
+func (f *inFlightTables) add(t tableTarget) {
+	f.Lock()
+	defer f.Unlock()
+	f.tables[t.schema+"."+t.table] = true
+}
+
+func (f *inFlightTables) remove(t tableTarget) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.tables, t.schema+"."+t.table)
+}
+
+// list returns the tables being loaded, sorted
+func (f *inFlightTables) list() []string {
+	f.Lock()
+	defer f.Unlock()
+	var tables []string
+	for t := range f.tables {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// tableBuckets returns the bucket of each of the targets whose config in configs says its data is
+// in a bucket other than def, keyed by schema.table. They're like def, but for the bucket's name
+// and region, which is looked up with region unless the config has it, and whether it's requester
+// pays. Each bucket's region is only looked up once.
+func tableBuckets(configs map[string]redshift.Table, targets []tableTarget, def s3filepath.S3Bucket,
+	region func(name string) (string, error),
+) (map[string]s3filepath.S3Bucket, error) {
+	byTable := map[string]redshift.Table{}
+	for _, c := range configs {
+		byTable[c.Meta.Schema+"."+c.Name] = c
+	}
+	regions := map[string]string{}
+	buckets := map[string]s3filepath.S3Bucket{}
+	for _, t := range targets {
+		key := t.schema + "." + t.table
+		c, ok := byTable[key]
+		if !ok || c.Meta.Bucket == "" || c.Meta.Bucket == def.Name {
+			continue
 		}
+		b := def
+		b.Name = c.Meta.Bucket
+		b.Region = c.Meta.BucketRegion
+		b.RequesterPays = c.Meta.RequesterPays
+		if b.Region == "" {
+			if _, ok := regions[b.Name]; !ok {
+				r, err := region(b.Name)
+				if err != nil {
+					return nil, fmt.Errorf("error getting location for bucket %s of table %s: %w", b.Name, key, err)
+				}
+				regions[b.Name] = r
+			}
+			b.Region = regions[b.Name]
+		}
+		buckets[key] = b
+	}
+	return buckets, nil
+}
+
+// validateConfigs runs ValidateTableConfig on each table in the config file, returning every
+// table's errors, in the order of their keys
+func validateConfigs(configs map[string]redshift.Table) error {
+	keys := make([]string, 0, len(configs))
+	for k := range configs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var errs error
+	for _, k := range keys {
+		if err := redshift.ValidateTableConfig(configs[k]); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("table %s: %w", k, err))
+		}
+	}
+	return errs
+}
+
+// tableDrift is what --reconcile prints for each table in the config, as a line of JSON. Missing
+// tables don't exist in redshift yet, so have no diff
+type tableDrift struct {
+	Schema  string              `json:"schema"`
+	Table   string              `json:"table"`
+	Drifted bool                `json:"drifted"`
+	Missing bool                `json:"missing,omitempty"`
+	Diff    *redshift.TableDiff `json:"diff,omitempty"`
+}
 
-		// unless --force, don't update unless input data is new
-		if flags.TimeGranularity != "stream" && isInputDataStale(parsedInputDate, targetDataDate, flags.TimeGranularity, targetDataLocation) {
-			if flags.Force == false {
-				log.Printf("Recent data already exists in db: %s", *targetDataDate)
-				continue
+// reconcileTables diffs each table in configs against the table in redshift, as got by getTable,
+// sorted by schema then table. A table which doesn't exist counts as drifted.
+func reconcileTables(configs map[string]redshift.Table, getTable func(schema, table string) (*redshift.Table, error),
+	diff func(inputTable, targetTable redshift.Table) (redshift.TableDiff, error),
+) ([]tableDrift, error) {
+	var drifts []tableDrift
+	for _, c := range configs {
+		target, err := getTable(c.Meta.Schema, c.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting table %s.%s: %w", c.Meta.Schema, c.Name, err)
+		}
+		d := tableDrift{Schema: c.Meta.Schema, Table: c.Name}
+		if target == nil {
+			d.Drifted, d.Missing = true, true
+		} else {
+			tableDiff, err := diff(c, *target)
+			if err != nil {
+				return nil, fmt.Errorf("error diffing table %s.%s: %w", c.Meta.Schema, c.Name, err)
 			}
-			log.Printf("Forcing update of inputTable: %s", inputConf.Table)
+			d.Drifted, d.Diff = !tableDiff.Empty(), &tableDiff
 		}
+		drifts = append(drifts, d)
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].Schema != drifts[j].Schema {
+			return drifts[i].Schema < drifts[j].Schema
+		}
+		return drifts[i].Table < drifts[j].Table
+	})
+	return drifts, nil
+}
 
-		if err := runCopy(
-			db, *inputConf, *inputTable, targetTable, flags.Truncate, flags.GZip, flags.Delimiter,
-			flags.TimeGranularity, flags.TargetTimezone, flags.StreamStart, flags.StreamEnd,
-		); err != nil {
-			log.Printf("error running copy for table %s: %s", t, err)
-			copyErrors = multierror.Append(copyErrors, err)
+// tableTarget is a table to load and the schema it's in
+// discovered tables were found by --tablePattern rather than asked for by name
+type tableTarget struct {
+	schema     string
+	table      string
+	discovered bool
+}
+
+// parseTargets pairs each of the comma separated tables with its schema. A table may be qualified
+// as schema.table, in which case the schema must be one of the comma separated schemas. Unqualified
+// tables are in the schema, which is only allowed when there's just one.
+func parseTargets(schemas, tables string) ([]tableTarget, error) {
+	schemaList := strings.Split(schemas, ",")
+	knownSchemas := map[string]bool{}
+	for _, s := range schemaList {
+		knownSchemas[s] = true
+	}
+	var targets []tableTarget
+	for _, t := range strings.Split(tables, ",") {
+		if parts := strings.SplitN(t, ".", 2); len(parts) == 2 {
+			if !knownSchemas[parts[0]] {
+				return nil, fmt.Errorf("table %s is in schema %s, which isn't one of the schemas %s", t, parts[0], schemas)
+			}
+			targets = append(targets, tableTarget{schema: parts[0], table: parts[1]})
+		} else if len(schemaList) == 1 {
+			targets = append(targets, tableTarget{schema: schemas, table: t})
 		} else {
-			// DON'T NEED TO CREATE VIEWS - will be handled by the refresh script
-			log.Printf("done with table: %s.%s", inputConf.Schema, t)
+			return nil, fmt.Errorf("table %s must be qualified as schema.table when there are multiple schemas", t)
 		}
 	}
-	if copyErrors != nil {
-		log.Fatalf("error loading tables: %s", copyErrors)
+	return targets, nil
+}
+
+// readTablesFile returns the tables listed in the file, which may be local or in s3, one per line.
+// Blank lines and lines starting with # are skipped.
+func readTablesFile(open func(path string) (io.ReadCloser, error), path string) ([]string, error) {
+	reader, err := open(path)
+	if err != nil {
+		return nil, fmt.Errorf("issue opening tables file %s: %w", path, err)
+	}
+	defer reader.Close()
+	var tables []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.ContainsAny(line, ", \t") {
+			return nil, fmt.Errorf("tables file %s has more than one table on line %q", path, line)
+		}
+		tables = append(tables, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("issue reading tables file %s: %w", path, err)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("tables file %s doesn't list any tables", path)
+	}
+	return tables, nil
+}
+
+// mergeTables adds the tables which aren't already in the comma separated tables to them
+func mergeTables(tables string, more []string) string {
+	var all []string
+	seen := map[string]bool{}
+	if tables != "" {
+		all = strings.Split(tables, ",")
+		for _, t := range all {
+			seen[t] = true
+		}
+	}
+	for _, t := range more {
+		if !seen[t] {
+			seen[t] = true
+			all = append(all, t)
+		}
+	}
+	return strings.Join(all, ",")
+}
+
+// parseSessionParams parses the comma separated name=value session parameters, after setting
+// query_group to the query group if there is one
+func parseSessionParams(queryGroup, params string) ([]redshift.SessionParam, error) {
+	var sessionParams []redshift.SessionParam
+	if queryGroup != "" {
+		sessionParams = append(sessionParams, redshift.SessionParam{Name: "query_group", Value: queryGroup})
+	}
+	if params == "" {
+		return sessionParams, nil
+	}
+	for _, p := range strings.Split(params, ",") {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("session parameter %s must be name=value", p)
+		}
+		sessionParams = append(sessionParams, redshift.SessionParam{Name: parts[0], Value: parts[1]})
+	}
+	return sessionParams, nil
+}
+
+// discoverTargets adds the tables in each of the comma separated schemas which match the pattern
+// to the targets, skipping any which are already there
+func discoverTargets(store s3filepath.ObjectStore, bucket s3filepath.S3Bucket, schemas, pattern string, targets []tableTarget) ([]tableTarget, error) {
+	seen := map[tableTarget]bool{}
+	for _, t := range targets {
+		seen[tableTarget{schema: t.schema, table: t.table}] = true
+	}
+	for _, schema := range strings.Split(schemas, ",") {
+		tables, err := s3filepath.DiscoverTables(store, bucket, schema, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			if t := (tableTarget{schema: schema, table: table}); !seen[t] {
+				seen[t] = true
+				t.discovered = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	logger.GetLogger().InfoD("discovered-tables", logger.M{"schemas": schemas, "pattern": pattern, "tables": len(targets)})
+	return targets, nil
+}
+
+// checkReset refuses to reset tables in any of the comma separated production schemas, unless
+// the schema is confirmed too. Only one schema can be confirmed at a time
+func checkReset(targets []tableTarget, production, confirmed string) error {
+	for _, t := range targets {
+		for _, schema := range strings.Split(production, ",") {
+			if strings.TrimSpace(schema) == t.schema && confirmed != t.schema {
+				return fmt.Errorf("%s.%s is in production schema %s, set CONFIRM_RESET_SCHEMA=%s to reset it",
+					t.schema, t.table, t.schema, t.schema)
+			}
+		}
+	}
+	return nil
+}
+
+// datesInRange returns the dates between start and end inclusive, oldest first
+func datesInRange(dates []time.Time, start, end time.Time) []time.Time {
+	var inRange []time.Time
+	for _, date := range dates {
+		if !date.Before(start) && !date.After(end) {
+			inRange = append(inRange, date)
+		}
+	}
+	sort.Slice(inRange, func(i, j int) bool { return inRange[i].Before(inRange[j]) })
+	return inRange
+}
+
+// datesAfter returns the dates strictly after since, oldest first
+func datesAfter(dates []time.Time, since time.Time) []time.Time {
+	var after []time.Time
+	for _, date := range dates {
+		if date.After(since) {
+			after = append(after, date)
+		}
 	}
+	sort.Slice(after, func(i, j int) bool { return after[i].Before(after[j]) })
+	return after
 }
@@ -1,56 +1,302 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
+	redshift "github.com/Clever/s3-to-redshift/v3/redshift"
+	s3filepath "github.com/Clever/s3-to-redshift/v3/s3filepath"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestTimeGranularity(t *testing.T) {
-	baseTime := time.Date(2017, 7, 11, 12, 9, 0, 0, time.UTC)
+func TestDatesInRange(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2017, 8, d, 0, 0, 0, 0, time.UTC) }
+	dates := []time.Time{day(20), day(18), day(16), day(15), day(14)}
+	assert.Equal(t, []time.Time{day(15), day(16), day(18)}, datesInRange(dates, day(15), day(18)))
+	assert.Equal(t, []time.Time{day(16)}, datesInRange(dates, day(16), day(16)))
+	assert.Empty(t, datesInRange(dates, day(21), day(25)))
+}
+
+func TestDatesAfter(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2017, 8, d, 0, 0, 0, 0, time.UTC) }
+	dates := []time.Time{day(20), day(18), day(16), day(15)}
+	assert.Equal(t, []time.Time{day(18), day(20)}, datesAfter(dates, day(16)))
+	assert.Equal(t, []time.Time{day(16), day(18), day(20)}, datesAfter(dates, day(15).Add(time.Hour)))
+	assert.Empty(t, datesAfter(dates, day(20)))
+}
+
+func TestInFlightTables(t *testing.T) {
+	inFlight := newInFlightTables()
+	inFlight.add(tableTarget{schema: "s", table: "b"})
+	inFlight.add(tableTarget{schema: "s", table: "a"})
+	inFlight.add(tableTarget{schema: "other", table: "c"})
+	inFlight.remove(tableTarget{schema: "s", table: "b"})
+	assert.Equal(t, []string{"other.c", "s.a"}, inFlight.list())
+}
+
+func TestParseTargets(t *testing.T) {
+	targets, err := parseTargets("mongo", "users,schools")
+	assert.NoError(t, err)
+	assert.Equal(t, []tableTarget{{schema: "mongo", table: "users"}, {schema: "mongo", table: "schools"}}, targets)
+
+	targets, err = parseTargets("mongo,mysql", "mongo.users,mysql.sections")
+	assert.NoError(t, err)
+	assert.Equal(t, []tableTarget{{schema: "mongo", table: "users"}, {schema: "mysql", table: "sections"}}, targets)
+
+	// unqualified tables are ambiguous with multiple schemas
+	_, err = parseTargets("mongo,mysql", "mongo.users,sections")
+	assert.Error(t, err)
+
+	// as are schemas that weren't asked for
+	_, err = parseTargets("mongo", "mysql.sections")
+	assert.Error(t, err)
+}
+
+func TestReadTablesFile(t *testing.T) {
+	files := map[string]string{
+		"s3://configs/tables.txt": "# loaded nightly\nusers\n\n  schools  \nmysql.sections\n",
+		"s3://configs/empty.txt":  "# nothing yet\n",
+		"s3://configs/bad.txt":    "users,schools\n",
+	}
+	open := func(path string) (io.ReadCloser, error) {
+		data, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("no such file %s", path)
+		}
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+	tables, err := readTablesFile(open, "s3://configs/tables.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"users", "schools", "mysql.sections"}, tables)
 
-	start, end := startEndFromGranularity(baseTime, "day", "UTC")
-	assert.Equal(t, start, time.Date(2017, 7, 11, 0, 0, 0, 0, time.UTC))
-	assert.Equal(t, end, time.Date(2017, 7, 12, 0, 0, 0, 0, time.UTC))
+	_, err = readTablesFile(open, "s3://configs/empty.txt")
+	assert.EqualError(t, err, "tables file s3://configs/empty.txt doesn't list any tables")
+	_, err = readTablesFile(open, "s3://configs/bad.txt")
+	assert.Error(t, err)
+	_, err = readTablesFile(open, "s3://configs/missing.txt")
+	assert.Error(t, err)
+}
+
+func TestMergeTables(t *testing.T) {
+	assert.Equal(t, "users,schools,sections", mergeTables("users,schools", []string{"schools", "sections"}))
+	assert.Equal(t, "schools,sections", mergeTables("", []string{"schools", "sections"}))
+}
 
-	start, end = startEndFromGranularity(baseTime, "hour", "UTC")
-	assert.Equal(t, start, time.Date(2017, 7, 11, 12, 0, 0, 0, time.UTC))
-	assert.Equal(t, end, time.Date(2017, 7, 11, 13, 0, 0, 0, time.UTC))
+func TestTableBuckets(t *testing.T) {
+	def := s3filepath.S3Bucket{Name: "analytics", Region: "us-west-1", RedshiftRoleARN: "role"}
+	configs := map[string]redshift.Table{
+		"events":  {Name: "events", Meta: redshift.Meta{Schema: "mongo", Bucket: "events-bucket"}},
+		"clicks":  {Name: "clicks", Meta: redshift.Meta{Schema: "mongo", Bucket: "events-bucket"}},
+		"metrics": {Name: "metrics", Meta: redshift.Meta{Schema: "mongo", Bucket: "metrics-bucket", BucketRegion: "eu-west-1", RequesterPays: true}},
+		"users":   {Name: "users", Meta: redshift.Meta{Schema: "mongo"}},
+		"other":   {Name: "other", Meta: redshift.Meta{Schema: "mongo", Bucket: "other-bucket"}},
+	}
+	targets := []tableTarget{
+		{schema: "mongo", table: "events"}, {schema: "mongo", table: "clicks"},
+		{schema: "mongo", table: "metrics"}, {schema: "mongo", table: "users"},
+	}
+	lookups := 0
+	buckets, err := tableBuckets(configs, targets, def, func(name string) (string, error) {
+		lookups++
+		return "us-east-1", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]s3filepath.S3Bucket{
+		"mongo.events":  {Name: "events-bucket", Region: "us-east-1", RedshiftRoleARN: "role"},
+		"mongo.clicks":  {Name: "events-bucket", Region: "us-east-1", RedshiftRoleARN: "role"},
+		"mongo.metrics": {Name: "metrics-bucket", Region: "eu-west-1", RedshiftRoleARN: "role", RequesterPays: true},
+	}, buckets)
+	// the shared bucket's region is only looked up once, and tables not being loaded are left alone
+	assert.Equal(t, 1, lookups)
 
-	// Simulate timestamps that cross timezones in PT vs UTC
-	baseTime = time.Date(2017, 7, 11, 4, 0, 0, 0, time.UTC)
+	_, err = tableBuckets(configs, targets, def, func(name string) (string, error) {
+		return "", errors.New("access denied")
+	})
+	assert.EqualError(t, err, "error getting location for bucket events-bucket of table mongo.events: access denied")
+}
 
-	start, end = startEndFromGranularity(baseTime, "day", "UTC")
-	assert.Equal(t, start, time.Date(2017, 7, 11, 0, 0, 0, 0, time.UTC))
-	assert.Equal(t, end, time.Date(2017, 7, 12, 0, 0, 0, 0, time.UTC))
+func TestExitCode(t *testing.T) {
+	copyErr := fmt.Errorf("table mongo.events: %w", &redshift.CopyError{Err: errors.New("Load into table 'events' failed")})
+	mismatch := fmt.Errorf("table mongo.users: %w", redshift.ErrTableSchemaMismatch)
+	other := errors.New("table mongo.clicks: access denied")
 
-	start, end = startEndFromGranularity(baseTime, "day", "America/Los_Angeles")
-	assert.Equal(t, start, time.Date(2017, 7, 10, 0, 0, 0, 0, time.UTC))
-	assert.Equal(t, end, time.Date(2017, 7, 11, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, exitLoadFailed, exitCode(other))
+	assert.Equal(t, exitCopyFailed, exitCode(copyErr))
+	assert.Equal(t, exitCopyFailed, exitCode(multierror.Append(other, copyErr)))
+	assert.Equal(t, exitSchemaMismatch, exitCode(multierror.Append(copyErr, mismatch, other)))
+	timedOut := fmt.Errorf("table mongo.users: %w: canceling statement due to statement timeout", redshift.ErrStatementTimeout)
+	assert.Equal(t, exitTimedOut, exitCode(multierror.Append(other, timedOut)))
 }
 
-func TestIsInputDataStale(t *testing.T) {
-	locationUTC, _ := time.LoadLocation("UTC")
-	inputDataDate, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
-	targetDataDate, _ := time.Parse(time.RFC3339, "2017-08-15T21:00:00Z")
+// a run which times out before its tables are started fails, rather than exiting as if it had loaded them
+func TestDispatchTimedOut(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Minute))
+	defer cancel()
+	targets := []tableTarget{{schema: "mongo", table: "events"}, {schema: "mongo", table: "users"}}
+
+	// no workers are reading, so nothing can be sent
+	notStarted := dispatch(ctx, make(chan tableTarget), targets)
+	assert.Equal(t, targets, notStarted)
 
-	assert.Equal(t, false, isInputDataStale(inputDataDate, &targetDataDate, "day", locationUTC))
-	assert.Equal(t, true, isInputDataStale(inputDataDate, &targetDataDate, "hour", locationUTC))
-	assert.Equal(t, false, isInputDataStale(inputDataDate, nil, "hour", locationUTC))
+	err := notStartedErrors(nil, notStarted, ctx.Err())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "table mongo.events: not started: context deadline exceeded")
+		assert.Contains(t, err.Error(), "table mongo.users: not started")
+	}
+	assert.Equal(t, exitTimedOut, exitCode(err))
+}
+
+// an interrupted run fails with the tables it never started, like a timed out one
+func TestDispatchInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	targets := []tableTarget{{schema: "mongo", table: "events"}}
+
+	notStarted := dispatch(ctx, make(chan tableTarget), targets)
+	assert.Equal(t, targets, notStarted)
+	err := notStartedErrors(nil, notStarted, ctx.Err())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "table mongo.events: not started: context canceled")
+	}
+	assert.Equal(t, exitLoadFailed, exitCode(err))
+}
+
+func TestCheckReset(t *testing.T) {
+	targets := []tableTarget{{schema: "dev", table: "users"}, {schema: "mongo", table: "users"}}
+	assert.NoError(t, checkReset(targets, "", ""))
+	assert.NoError(t, checkReset(targets, "prod, analytics", ""))
+	assert.EqualError(t, checkReset(targets, "prod, mongo", ""),
+		"mongo.users is in production schema mongo, set CONFIRM_RESET_SCHEMA=mongo to reset it")
+	assert.Error(t, checkReset(targets, "mongo", "dev"))
+	assert.NoError(t, checkReset(targets, "mongo", "mongo"))
+}
 
-	// Simulate Redshift timestamp without time zones that is parsed as UTC but is actually PT
-	locationPT, _ := time.LoadLocation("America/Los_Angeles")
-	targetDataDatePT, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
-	inputDataDateUTC, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+func TestCheckHealth(t *testing.T) {
+	ok := func() error { return nil }
+	assert.Equal(t, healthStatus{OK: true, Redshift: "ok", S3: "ok"}, checkHealth(ok, ok))
+	// both are checked, whichever fails
+	assert.Equal(t, healthStatus{Redshift: "can't query redshift: connection refused", S3: "can't reach bucket b: Forbidden"},
+		checkHealth(func() error { return errors.New("can't query redshift: connection refused") },
+			func() error { return errors.New("can't reach bucket b: Forbidden") }))
+	assert.Equal(t, healthStatus{Redshift: "ok", S3: "can't reach bucket b: Forbidden"},
+		checkHealth(ok, func() error { return errors.New("can't reach bucket b: Forbidden") }))
+}
+
+func TestQueuesVacuums(t *testing.T) {
+	assert.True(t, queuesVacuums(payload{}))
+	// running the vacuum itself, or not loading at all, doesn't need the cleanup worker's secrets
+	assert.False(t, queuesVacuums(payload{Vacuum: true}))
+	assert.False(t, queuesVacuums(payload{DryRun: true}))
+}
+
+func TestVersionString(t *testing.T) {
+	assert.Equal(t, "s3-to-redshift dev (git unknown, built unknown)", versionString())
+}
+
+func TestValidateConfigs(t *testing.T) {
+	valid := redshift.Table{
+		Name:    "users",
+		Columns: []redshift.ColInfo{{Name: "id", Type: "int"}, {Name: "created", Type: "timestamp"}},
+		Meta:    redshift.Meta{Schema: "mongo", DataDateColumn: "created"},
+	}
+	assert.NoError(t, validateConfigs(map[string]redshift.Table{"users": valid}))
+
+	invalid := valid
+	invalid.Meta.DataDateColumn = "updated"
+	err := validateConfigs(map[string]redshift.Table{"users": valid, "schools": invalid})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "table schools: ")
+		assert.Contains(t, err.Error(), "data date column updated isn't one of the columns")
+		assert.NotContains(t, err.Error(), "table users")
+	}
+}
+
+func TestReconcileTables(t *testing.T) {
+	config := func(schema, name string, cols ...redshift.ColInfo) redshift.Table {
+		return redshift.Table{Name: name, Columns: cols, Meta: redshift.Meta{Schema: schema}}
+	}
+	id := redshift.ColInfo{Name: "id", Type: "int"}
+	name := redshift.ColInfo{Name: "name", Type: "text"}
+	configs := map[string]redshift.Table{
+		"users":   config("mongo", "users", id, name),
+		"schools": config("mongo", "schools", id),
+		"events":  config("analytics", "events", id),
+	}
+	live := map[string]*redshift.Table{
+		"mongo.users":   {Name: "users", Columns: []redshift.ColInfo{{Name: "id", Type: "integer"}}},
+		"mongo.schools": {Name: "schools", Columns: []redshift.ColInfo{{Name: "id", Type: "integer"}}},
+	}
+	getTable := func(schema, table string) (*redshift.Table, error) { return live[schema+"."+table], nil }
+	db := &redshift.Redshift{}
+
+	drifts, err := reconcileTables(configs, getTable, db.DiffTable)
+	assert.NoError(t, err)
+	assert.Equal(t, []tableDrift{
+		{Schema: "analytics", Table: "events", Drifted: true, Missing: true},
+		{Schema: "mongo", Table: "schools", Diff: &redshift.TableDiff{}},
+		{Schema: "mongo", Table: "users", Drifted: true, Diff: &redshift.TableDiff{AddedColumns: []redshift.ColInfo{name}}},
+	}, drifts)
+
+	_, err = reconcileTables(configs, func(schema, table string) (*redshift.Table, error) {
+		return nil, errors.New("connection refused")
+	}, db.DiffTable)
+	assert.Error(t, err)
+}
+
+func TestParseSessionParams(t *testing.T) {
+	params, err := parseSessionParams("loads", "statement_timeout=3600000,search_path=mongo,public")
+	assert.Error(t, err)
+
+	params, err = parseSessionParams("loads", "statement_timeout=3600000,datestyle=ISO")
+	assert.NoError(t, err)
+	assert.Equal(t, []redshift.SessionParam{
+		{Name: "query_group", Value: "loads"},
+		{Name: "statement_timeout", Value: "3600000"},
+		{Name: "datestyle", Value: "ISO"},
+	}, params)
+
+	params, err = parseSessionParams("", "")
+	assert.NoError(t, err)
+	assert.Empty(t, params)
+}
+
+type mockObjectStore struct {
+	dirs map[string][]string
+}
+
+func (ms mockObjectStore) ListKeys(bucket, prefix string) ([]string, error) { return nil, nil }
+func (ms mockObjectStore) ListDirs(bucket, prefix string) ([]string, error) {
+	return ms.dirs[prefix], nil
+}
+func (ms mockObjectStore) Head(path string) (s3filepath.ObjectInfo, error) {
+	return s3filepath.ObjectInfo{}, nil
+}
+func (ms mockObjectStore) Write(path string, data []byte) error { return nil }
+func (ms mockObjectStore) Copy(src, dst string) error           { return nil }
 
-	assert.Equal(t, false, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "hour", locationUTC))
-	assert.Equal(t, true, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "hour", locationPT))
+func TestDiscoverTargets(t *testing.T) {
+	store := mockObjectStore{dirs: map[string][]string{
+		"mongo/": {"events_clicks", "users", "events_views"},
+		"mysql/": {"events_logins"},
+	}}
+	bucket := s3filepath.S3Bucket{Name: "b"}
 
-	// Test Redshift timestamp without time zones where UTC and PT are on different days
-	targetDataDatePT, _ = time.Parse(time.RFC3339, "2017-08-15T23:00:00Z")
-	inputDataDateUTC, _ = time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+	// tables asked for by name aren't repeated
+	targets, err := discoverTargets(store, bucket, "mongo,mysql", "events_*", []tableTarget{{schema: "mongo", table: "events_views"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []tableTarget{
+		{schema: "mongo", table: "events_views"},
+		{schema: "mongo", table: "events_clicks", discovered: true},
+		{schema: "mysql", table: "events_logins", discovered: true},
+	}, targets)
 
-	assert.Equal(t, false, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "day", locationUTC))
-	assert.Equal(t, true, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "day", locationPT))
+	_, err = discoverTargets(store, bucket, "mongo", "events_[", nil)
+	assert.Error(t, err)
 }
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prefix is prepended to every metric name we emit
+const prefix = "s3_to_redshift."
+
+// Reporter is the interface for emitting load metrics, which allows swapping in a
+// no-op implementation for tests or when no metrics backend is configured.
+type Reporter interface {
+	Timing(name string, d time.Duration, tags map[string]string)
+	Gauge(name string, value int64, tags map[string]string)
+	Count(name string, value int64, tags map[string]string)
+}
+
+// NoopReporter drops every metric, and is used when no statsd address is configured.
+type NoopReporter struct{}
+
+// Timing implements Reporter
+func (NoopReporter) Timing(name string, d time.Duration, tags map[string]string) {}
+
+// Gauge implements Reporter
+func (NoopReporter) Gauge(name string, value int64, tags map[string]string) {}
+
+// Count implements Reporter
+func (NoopReporter) Count(name string, value int64, tags map[string]string) {}
+
+// MultiReporter sends every metric to each of its reporters, e.g. to statsd and prometheus both
+type MultiReporter []Reporter
+
+// Timing implements Reporter
+func (m MultiReporter) Timing(name string, d time.Duration, tags map[string]string) {
+	for _, r := range m {
+		r.Timing(name, d, tags)
+	}
+}
+
+// Gauge implements Reporter
+func (m MultiReporter) Gauge(name string, value int64, tags map[string]string) {
+	for _, r := range m {
+		r.Gauge(name, value, tags)
+	}
+}
+
+// Count implements Reporter
+func (m MultiReporter) Count(name string, value int64, tags map[string]string) {
+	for _, r := range m {
+		r.Count(name, value, tags)
+	}
+}
+
+// StatsdReporter sends metrics to a statsd agent over UDP, using the DogStatsD
+// tag extension so metrics can be broken down by schema and table.
+type StatsdReporter struct {
+	conn net.Conn
+}
+
+// NewStatsdReporter returns a reporter sending to the statsd agent at addr (host:port)
+func NewStatsdReporter(addr string) (*StatsdReporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to statsd at %s: %s", addr, err)
+	}
+	return &StatsdReporter{conn: conn}, nil
+}
+
+// Timing implements Reporter, reporting the duration in milliseconds
+func (s *StatsdReporter) Timing(name string, d time.Duration, tags map[string]string) {
+	s.send(name, fmt.Sprintf("%d|ms", d.Nanoseconds()/int64(time.Millisecond)), tags)
+}
+
+// Gauge implements Reporter
+func (s *StatsdReporter) Gauge(name string, value int64, tags map[string]string) {
+	s.send(name, fmt.Sprintf("%d|g", value), tags)
+}
+
+// Count implements Reporter
+func (s *StatsdReporter) Count(name string, value int64, tags map[string]string) {
+	s.send(name, fmt.Sprintf("%d|c", value), tags)
+}
+
+// Close closes the connection to the statsd agent
+func (s *StatsdReporter) Close() error {
+	return s.conn.Close()
+}
+
+// send writes a single metric line. statsd is fire and forget, so write errors are ignored.
+func (s *StatsdReporter) send(name, value string, tags map[string]string) {
+	s.conn.Write([]byte(formatLine(name, value, tags)))
+}
+
+// formatLine renders a metric as "<prefix><name>:<value>|#k:v,k:v" with tags sorted by key
+func formatLine(name, value string, tags map[string]string) string {
+	line := prefix + name + ":" + value
+	if len(tags) == 0 {
+		return line
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+":"+tags[k])
+	}
+	return line + "|#" + strings.Join(pairs, ",")
+}
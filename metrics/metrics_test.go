@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatLine(t *testing.T) {
+	assert.Equal(t, "s3_to_redshift.load.rows:10|g", formatLine("load.rows", "10|g", nil))
+	assert.Equal(t, "s3_to_redshift.load.rows:10|g|#schema:foo,table:bar",
+		formatLine("load.rows", "10|g", map[string]string{"table": "bar", "schema": "foo"}))
+}
+
+func TestStatsdReporter(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	reporter, err := NewStatsdReporter(listener.LocalAddr().String())
+	assert.NoError(t, err)
+	defer reporter.Close()
+
+	tags := map[string]string{"schema": "foo", "table": "bar"}
+	for _, expected := range []struct {
+		emit func()
+		line string
+	}{
+		{func() { reporter.Timing("load.duration", 1500*time.Millisecond, tags) }, "s3_to_redshift.load.duration:1500|ms|#schema:foo,table:bar"},
+		{func() { reporter.Gauge("load.rows", 42, tags) }, "s3_to_redshift.load.rows:42|g|#schema:foo,table:bar"},
+		{func() { reporter.Count("load.errors", 1, tags) }, "s3_to_redshift.load.errors:1|c|#schema:foo,table:bar"},
+	} {
+		expected.emit()
+		buf := make([]byte, 1024)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.line, string(buf[:n]))
+	}
+}
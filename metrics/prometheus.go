@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the prometheus metric types our metrics map to
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+	typeSummary = "summary"
+)
+
+// PrometheusReporter keeps the latest value of each metric in memory and serves them in the
+// Prometheus text format for scraping. Timings are summaries (without quantiles) in seconds.
+type PrometheusReporter struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+// family is every series of a metric, keyed by their rendered labels
+type family struct {
+	kind   string
+	series map[string]*series
+}
+
+// series is a metric's value for one set of labels. Summaries also count their observations
+type series struct {
+	value float64
+	count int64
+}
+
+// NewPrometheusReporter returns a reporter without any metrics yet
+func NewPrometheusReporter() *PrometheusReporter {
+	return &PrometheusReporter{families: map[string]*family{}}
+}
+
+// Timing implements Reporter, adding the duration to the metric's summary
+func (p *PrometheusReporter) Timing(name string, d time.Duration, tags map[string]string) {
+	p.update(promName(name)+"_seconds", typeSummary, tags, func(s *series) {
+		s.value += d.Seconds()
+		s.count++
+	})
+}
+
+// Gauge implements Reporter
+func (p *PrometheusReporter) Gauge(name string, value int64, tags map[string]string) {
+	p.update(promName(name), typeGauge, tags, func(s *series) { s.value = float64(value) })
+}
+
+// Count implements Reporter
+func (p *PrometheusReporter) Count(name string, value int64, tags map[string]string) {
+	p.update(promName(name)+"_total", typeCounter, tags, func(s *series) { s.value += float64(value) })
+}
+
+// update applies the change to the metric's series for the tags, creating either if need be
+func (p *PrometheusReporter) update(name, kind string, tags map[string]string, change func(s *series)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f, ok := p.families[name]
+	if !ok {
+		f = &family{kind: kind, series: map[string]*series{}}
+		p.families[name] = f
+	}
+	labels := formatLabels(tags)
+	s, ok := f.series[labels]
+	if !ok {
+		s = &series{}
+		f.series[labels] = s
+	}
+	change(s)
+}
+
+// ServeHTTP writes every metric in the Prometheus text format, sorted by name then labels
+func (p *PrometheusReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, p.render())
+}
+
+// render returns every metric in the Prometheus text format
+func (p *PrometheusReporter) render() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		f := p.families[name]
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.kind)
+		labels := make([]string, 0, len(f.series))
+		for l := range f.series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			s := f.series[l]
+			if f.kind == typeSummary {
+				fmt.Fprintf(&b, "%s_sum%s %g\n", name, l, s.value)
+				fmt.Fprintf(&b, "%s_count%s %d\n", name, l, s.count)
+			} else {
+				fmt.Fprintf(&b, "%s%s %g\n", name, l, s.value)
+			}
+		}
+	}
+	return b.String()
+}
+
+// promName turns a metric name like "load.rows" into a prometheus one, "s3_to_redshift_load_rows"
+func promName(name string) string {
+	return strings.Replace(strings.Replace(prefix+name, ".", "_", -1), "-", "_", -1)
+}
+
+// formatLabels renders the tags as {k="v",k="v"} sorted by key, or nothing without any
+func formatLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, tags[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
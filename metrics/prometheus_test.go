@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromName(t *testing.T) {
+	assert.Equal(t, "s3_to_redshift_load_rows", promName("load.rows"))
+	assert.Equal(t, "s3_to_redshift_table_size_mb", promName("table.size_mb"))
+}
+
+func TestPrometheusReporter(t *testing.T) {
+	reporter := NewPrometheusReporter()
+	foo := map[string]string{"table": "foo", "schema": "s"}
+	bar := map[string]string{"table": "bar", "schema": "s"}
+	reporter.Timing("load.duration", 1500*time.Millisecond, foo)
+	reporter.Timing("load.duration", 500*time.Millisecond, foo)
+	reporter.Gauge("load.rows", 10, foo)
+	reporter.Gauge("load.rows", 42, foo)
+	reporter.Gauge("load.rows", 7, bar)
+	reporter.Count("load.errors", 1, bar)
+	reporter.Count("load.errors", 1, bar)
+
+	server := httptest.NewServer(reporter)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `# TYPE s3_to_redshift_load_duration_seconds summary
+s3_to_redshift_load_duration_seconds_sum{schema="s",table="foo"} 2
+s3_to_redshift_load_duration_seconds_count{schema="s",table="foo"} 2
+# TYPE s3_to_redshift_load_errors_total counter
+s3_to_redshift_load_errors_total{schema="s",table="bar"} 2
+# TYPE s3_to_redshift_load_rows gauge
+s3_to_redshift_load_rows{schema="s",table="bar"} 7
+s3_to_redshift_load_rows{schema="s",table="foo"} 42
+`, string(body))
+}
@@ -2,18 +2,26 @@ package redshift
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	kvlogger "gopkg.in/Clever/kayvee-go.v6/logger"
 	yaml "gopkg.in/yaml.v2"
 
-	"github.com/Clever/pathio"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	multierror "github.com/hashicorp/go-multierror"
 
 	// Use our own version of the postgres library so we get keep-alive support.
@@ -41,33 +49,195 @@ type Redshift struct {
 	port string
 	db   string
 	user string
+	// in dry run mode statements which modify the database are logged but not run
+	dryRun bool
+	// ParallelCopy's staging tables go in this schema, if set, rather than alongside the table
+	stagingSchema string
+	// SET at the start of each transaction, in order
+	sessionParams []SessionParam
+}
+
+// SessionParam is a session parameter to SET, e.g. query_group or statement_timeout
+type SessionParam struct {
+	Name  string
+	Value string
 }
 
 // Table is our representation of a Redshift table
 type Table struct {
-	Name    string    `yaml:"dest"`
-	Columns []ColInfo `yaml:"columns"`
-	Meta    Meta      `yaml:"meta"`
+	Name    string    `yaml:"dest" json:"dest"`
+	Columns []ColInfo `yaml:"columns" json:"columns"`
+	Meta    Meta      `yaml:"meta" json:"meta"`
 }
 
 // Meta holds information that might be not in Redshift or annoying to access
 // in this case, we want to know the schema a table is part of
 // and the column which corresponds to the timestamp at which the data was gathered
 type Meta struct {
-	DataDateColumn string `yaml:"datadatecolumn"`
-	Schema         string `yaml:"schema"`
+	DataDateColumn string `yaml:"datadatecolumn" json:"datadatecolumn"`
+	Schema         string `yaml:"schema" json:"schema"`
+	// DataDateHourColumn is an integer column holding the hour of the data date, for tables that
+	// split the timestamp into a date column and an hour column. The two are combined for the data date
+	DataDateHourColumn string `yaml:"datadatehourcolumn" json:"datadatehourcolumn"`
+	// DataDateTimezone is the timezone the data date is recorded in, e.g. "America/Los_Angeles",
+	// overriding the --timezone flag for this table
+	DataDateTimezone string `yaml:"datadatetimezone" json:"datadatetimezone"`
+	// TimeFormat and DateFormat are passed to COPY as TIMEFORMAT and DATEFORMAT, e.g. 'auto',
+	// 'epochsecs' or 'YYYY-MM-DD HH:MI:SS'. TimeFormat defaults to 'auto', DateFormat to redshift's default
+	TimeFormat string `yaml:"timeformat" json:"timeformat"`
+	DateFormat string `yaml:"dateformat" json:"dateformat"`
+	// SortKeyStyle is compound (the default) or interleaved. Interleaved sortkeys give each
+	// sortkey column equal weight, for tables filtered on several independent columns
+	SortKeyStyle string `yaml:"sortkeystyle" json:"sortkeystyle"`
+	// TruncateColumns makes COPY cut strings down to their column's width rather than reject the
+	// row. It defaults to true, which is how COPY has always been run
+	TruncateColumns *bool `yaml:"truncatecolumns" json:"truncatecolumns"`
+	// AcceptInvChars makes COPY replace invalid UTF-8 characters with this single character rather
+	// than reject the row
+	AcceptInvChars string `yaml:"acceptinvchars" json:"acceptinvchars"`
+	// EmptyAsNull and BlanksAsNull make COPY load empty, or all whitespace, CSV fields into
+	// varchar columns as NULL rather than empty strings. EmptyAsNull defaults to true, which is how
+	// CSVs have always been loaded. Neither applies to JSON
+	EmptyAsNull  *bool `yaml:"emptyasnull" json:"emptyasnull"`
+	BlanksAsNull bool  `yaml:"blanksasnull" json:"blanksasnull"`
+	// NullAs is the string the data uses for NULL, e.g. \N or NULL, which COPY loads as NULL
+	// rather than as the string itself. It applies to JSON and CSV, and is unset by default
+	NullAs string `yaml:"nullas,omitempty" json:"nullas,omitempty"`
+	// Delimiter is the delimiter of the table's CSV data, overriding --delimiter for this table, and
+	// Quote the character its fields are quoted with, e.g. a backtick. With a Quote the data is
+	// loaded as CSV, with COPY's CSV QUOTE AS, rather than by removing quotes and escapes
+	Delimiter string `yaml:"delimiter,omitempty" json:"delimiter,omitempty"`
+	Quote     string `yaml:"quote,omitempty" json:"quote,omitempty"`
+	// JSONPaths is the s3 path of a jsonpaths file mapping JSON data to the columns, for data whose
+	// keys don't match the column names. Without one, COPY matches them up with 'auto'
+	JSONPaths string `yaml:"jsonpaths" json:"jsonpaths"`
+	// StatUpdate and CompUpdate turn COPY's STATUPDATE and COMPUPDATE on or off, e.g. off for big
+	// append-only tables which are analyzed on a schedule instead. StatUpdate defaults to on, which
+	// is how COPY has always been run, and CompUpdate to redshift's default
+	StatUpdate *bool `yaml:"statupdate" json:"statupdate"`
+	CompUpdate *bool `yaml:"compupdate" json:"compupdate"`
+	// ColumnList names the config's columns in the COPY, so CSV fields are loaded into them in the
+	// config's order and columns the table has beyond them are left to their defaults, rather than
+	// COPY expecting data for every column of the table
+	ColumnList bool `yaml:"columnlist" json:"columnlist"`
+	// Truncate says whether the table is cleared before each load, e.g. true for dimension tables
+	// and false for fact tables, overriding the --truncate flag for this table
+	Truncate *bool `yaml:"truncate,omitempty" json:"truncate,omitempty"`
+	// Grants are who may SELECT from the table, each a user, "GROUP <group>" or "ROLE <role>".
+	// They're granted on every load, after the table is created or updated
+	Grants []string `yaml:"grants,omitempty" json:"grants,omitempty"`
+	// DedupKey is the columns identifying a row when --dedup removes duplicates from the data,
+	// keeping the row with the latest data date for each. Without one, only exact duplicates are removed
+	DedupKey []string `yaml:"dedupkey,omitempty" json:"dedupkey,omitempty"`
+	// Bucket is the bucket the table's data is in, when it isn't the worker's --bucket, and
+	// BucketRegion its region, which is looked up if not set. Only used from a --config file
+	Bucket       string `yaml:"bucket,omitempty" json:"bucket,omitempty"`
+	BucketRegion string `yaml:"bucketregion,omitempty" json:"bucketregion,omitempty"`
+	// RequesterPays says Bucket is requester pays, which needs --manifest and --stagingBucket
+	RequesterPays bool `yaml:"requesterpays,omitempty" json:"requesterpays,omitempty"`
+}
+
+// columnListSQL returns the quoted list of the table's columns, for a COPY into just those columns
+func columnListSQL(table Table) string {
+	var names []string
+	for _, c := range table.Columns {
+		names = append(names, fmt.Sprintf(`"%s"`, c.Name))
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(names, ", "))
+}
+
+// dataDateSQL returns the SQL expression for a table's data date: the data date column, or the
+// data date column plus the hour column when there is one
+func (m Meta) dataDateSQL() string {
+	if m.DataDateHourColumn == "" {
+		return fmt.Sprintf(`"%s"`, m.DataDateColumn)
+	}
+	return fmt.Sprintf(`DATEADD(hour, "%s", "%s")`, m.DataDateHourColumn, m.DataDateColumn)
+}
+
+// The sortkey styles for Meta.SortKeyStyle
+const (
+	SortKeyCompound    = "compound"
+	SortKeyInterleaved = "interleaved"
+)
+
+// redshift's limit on the number of columns in an interleaved sortkey
+const maxInterleavedSortKeyColumns = 8
+
+// LoadError is a row from stl_load_errors describing why redshift rejected a line during a COPY
+type LoadError struct {
+	LineNumber    int64
+	ColName       string
+	RawFieldValue string
+	ErrReason     string
+}
+
+func (e LoadError) String() string {
+	return fmt.Sprintf("line %d, column %s, value '%s': %s", e.LineNumber, e.ColName, e.RawFieldValue, e.ErrReason)
+}
+
+// CopyError is returned when a COPY fails, with the rows redshift rejected if stl_load_errors has
+// any. errors.Is matches it to ErrCopyFailed
+type CopyError struct {
+	File       string
+	LoadErrors []LoadError
+	Err        error
+}
+
+func (e *CopyError) Error() string {
+	if len(e.LoadErrors) == 0 {
+		return e.Err.Error()
+	}
+	details := make([]string, 0, len(e.LoadErrors))
+	for _, le := range e.LoadErrors {
+		details = append(details, le.String())
+	}
+	return fmt.Sprintf("%s, load errors: [%s]", e.Err, strings.Join(details, "; "))
+}
+
+// Unwrap returns the error running the COPY
+func (e *CopyError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrCopyFailed
+func (e *CopyError) Is(target error) bool { return target == ErrCopyFailed }
+
+// StatementTimeoutError is returned for a load which redshift cancelled for running past the
+// statement_timeout. errors.Is matches it to ErrStatementTimeout, and it unwraps to the load's error,
+// e.g. a CopyError
+type StatementTimeoutError struct {
+	Err error
+}
+
+func (e *StatementTimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrStatementTimeout, e.Err)
 }
 
+// Unwrap returns the load's error
+func (e *StatementTimeoutError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrStatementTimeout
+func (e *StatementTimeoutError) Is(target error) bool { return target == ErrStatementTimeout }
+
+// schemaMismatch marks an error reconciling the input and target tables as ErrTableSchemaMismatch,
+// keeping its message
+type schemaMismatch struct{ error }
+
+func (e schemaMismatch) Unwrap() error        { return e.error }
+func (e schemaMismatch) Is(target error) bool { return target == ErrTableSchemaMismatch }
+
 // ColInfo is a struct that contains information about a column in a Redshift database.
 // SortOrdinal and DistKey only make sense for Redshift
 type ColInfo struct {
-	Name        string `yaml:"dest"`
-	Type        string `yaml:"type"`
-	DefaultVal  string `yaml:"defaultval"`
-	NotNull     bool   `yaml:"notnull"`
-	PrimaryKey  bool   `yaml:"primarykey"`
-	DistKey     bool   `yaml:"distkey"`
-	SortOrdinal int    `yaml:"sortord"`
+	Name        string `yaml:"dest" json:"dest"`
+	Type        string `yaml:"type" json:"type"`
+	DefaultVal  string `yaml:"defaultval" json:"defaultval"`
+	NotNull     bool   `yaml:"notnull" json:"notnull"`
+	PrimaryKey  bool   `yaml:"primarykey" json:"primarykey"`
+	DistKey     bool   `yaml:"distkey" json:"distkey"`
+	SortOrdinal int    `yaml:"sortord" json:"sortord"`
+	// Encoding is the compression encoding for the column, e.g. zstd or az64. Redshift picks
+	// one when it's not set
+	Encoding string `yaml:"encoding" json:"encoding"`
 }
 
 type rangeQuery int
@@ -112,9 +282,63 @@ WHERE c.relkind = 'r'::char
     AND n.nspname = '%s'  -- Replace with schema name
     AND c.relname = '%s'  -- Replace with table name
      AND f.attnum > 0 ORDER BY f.attnum`
+
+	// returns the rows rejected by the most recent COPY from files under the given s3 prefix
+	// need to pass the prefix first, then the limit on the number of rows
+	loadErrorsQueryFormat = `SELECT line_number, TRIM(colname), TRIM(raw_field_value), TRIM(err_reason)
+FROM stl_load_errors
+WHERE query = (SELECT MAX(query) FROM stl_load_errors
+	WHERE session = %d AND starttime >= '%s' AND TRIM(filename) LIKE '%s%%')
+ORDER BY line_number LIMIT %d`
+
+	// returns the session and the time, for finding a COPY's rows in stl_load_errors if it fails
+	copySessionQuery = `SELECT pg_backend_pid(), GETDATE()`
+
+	// the most load errors we include when reporting a failed COPY
+	maxLoadErrorsReported = 10
+
+	// returns the size of a table, in rows and 1MB blocks, and the percentage of its rows which
+	// are unsorted. There's no row if the table is empty
+	// need to pass a schema and table name as the parameters
+	statsQueryFormat = `SELECT tbl_rows, size, unsorted FROM svv_table_info WHERE "schema" = '%s' AND "table" = '%s'`
+
+	// counts the rows loaded by the last COPY run in this session
+	lastCopyCountQuery = `SELECT pg_last_copy_count()`
+
+	// counts the rows rejected by the last COPY run in this session, which MAXERROR allowed through
+	rejectedRowsQuery = `SELECT COUNT(*) FROM stl_load_errors WHERE query = pg_last_copy_id()`
 )
 
 var (
+	// ErrTableNotInConf is returned by GetTableFromConf when the conf file doesn't have the table
+	ErrTableNotInConf = errors.New("can't find table in conf")
+
+	// ErrNoNewData is returned by CheckNewData when the s3 data has already been loaded
+	ErrNoNewData = errors.New("no new data to load")
+
+	// ErrNoLoadHistory is returned by CheckNewData when there's no record of a load for the date,
+	// so only the table's data can say whether the date was loaded
+	ErrNoLoadHistory = errors.New("no load history for the data date")
+
+	// ErrTableSchemaMismatch is matched by UpdateTable's errors when the target table can't be
+	// updated to match the input table's columns or keys
+	ErrTableSchemaMismatch = errors.New("table schema mismatch")
+
+	// ErrCopyFailed is matched by the CopyError returned when a COPY fails
+	ErrCopyFailed = errors.New("copy failed")
+
+	// ErrStatementTimeout is for loads which redshift cancelled for running past statement_timeout
+	ErrStatementTimeout = errors.New("statement timed out")
+
+	// a grantee is a user, group or role name, e.g. "GROUP analysts"
+	granteeRegex = regexp.MustCompile(`^(?:(GROUP|ROLE) )?([A-Za-z_][A-Za-z0-9_$]*)$`)
+
+	// session parameter names are plain identifiers, as they can't be quoted in SET
+	sessionParamRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// matches redshift's internal representation of varchar types, capturing the length
+	varcharRegex = regexp.MustCompile(`^character varying\((\d+)\)$`)
+
 	// map between the config file and the redshift internal representations for types
 	typeMapping = map[string]string{
 		"boolean":   "boolean",
@@ -125,378 +349,2145 @@ var (
 		"timestamp": "timestamp without time zone", // timestamp with timezone is not supported in redshift
 		"text":      "character varying(256)",      // unfortunately redshift turns text -> varchar 256
 		"longtext":  "character varying(65535)",    // when you actually need more than 256 characters
+		"super":     "super",                       // semi-structured data, e.g. nested JSON objects and arrays
+	}
+
+	// the compression encodings redshift supports for columns
+	encodings = map[string]bool{
+		"raw": true, "az64": true, "bytedict": true, "delta": true, "delta32k": true, "lzo": true,
+		"mostly8": true, "mostly16": true, "mostly32": true, "runlength": true, "text255": true,
+		"text32k": true, "zstd": true,
 	}
 )
 
+// Credentials are the secrets to connect to redshift with, and for COPY and UNLOAD to use with s3:
+// a role for redshift to assume, or else AWS keys (with a session token, for temporary keys)
+type Credentials struct {
+	Host      string
+	Port      string
+	DB        string
+	User      string
+	Password  string
+	RoleARN   string
+	AccessID  string
+	SecretKey string
+	Token     string
+}
+
+// CredentialProvider is the interface for looking up the credentials, which allows getting them
+// from a secrets store such as Vault or AWS Secrets Manager rather than the environment
+type CredentialProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// EnvCredentialProvider reads the credentials from the environment: REDSHIFT_HOST (defaulting to
+// localhost), REDSHIFT_PORT (defaulting to 5439), REDSHIFT_DB, REDSHIFT_USER and REDSHIFT_PASSWORD,
+// which must be set, REDSHIFT_ROLE_ARN, and AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+type EnvCredentialProvider struct{}
+
+// Credentials implements CredentialProvider
+func (EnvCredentialProvider) Credentials() (Credentials, error) {
+	c := Credentials{
+		Host:      os.Getenv("REDSHIFT_HOST"),
+		Port:      os.Getenv("REDSHIFT_PORT"),
+		DB:        os.Getenv("REDSHIFT_DB"),
+		User:      os.Getenv("REDSHIFT_USER"),
+		Password:  os.Getenv("REDSHIFT_PASSWORD"),
+		RoleARN:   os.Getenv("REDSHIFT_ROLE_ARN"),
+		AccessID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	var missing []string
+	for name, v := range map[string]string{"REDSHIFT_DB": c.DB, "REDSHIFT_USER": c.User, "REDSHIFT_PASSWORD": c.Password} {
+		if v == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return Credentials{}, fmt.Errorf("missing environment variables %s", strings.Join(missing, ", "))
+	}
+	if c.Host == "" {
+		c.Host = "localhost"
+	}
+	if c.Port == "" {
+		c.Port = "5439"
+	}
+	return c, nil
+}
+
+// Bucket returns the s3 bucket, with the credentials for COPY and UNLOAD to use with it
+func (c Credentials) Bucket(name, region string) s3filepath.S3Bucket {
+	return s3filepath.S3Bucket{
+		Name:            name,
+		Region:          region,
+		RedshiftRoleARN: c.RoleARN,
+		AccessID:        c.AccessID,
+		SecretKey:       c.SecretKey,
+		Token:           c.Token,
+	}
+}
+
+// ApplyTo returns the bucket with the credentials for COPY and UNLOAD replaced by these, e.g. after
+// refreshing temporary credentials which are about to expire. If the bucket's own requests are
+// signed with keys rather than the default chain, those are replaced too.
+func (c Credentials) ApplyTo(b s3filepath.S3Bucket) s3filepath.S3Bucket {
+	b.RedshiftRoleARN, b.AccessID, b.SecretKey, b.Token = c.RoleARN, c.AccessID, c.SecretKey, c.Token
+	if b.Credentials != nil {
+		b.Credentials = c.S3Credentials()
+	}
+	return b
+}
+
+// S3Credentials returns the AWS keys for our own requests to s3 to be signed with, for
+// s3filepath.S3Bucket's Credentials, or nil if there aren't any, to use the SDK's default chain
+func (c Credentials) S3Credentials() *credentials.Credentials {
+	if c.AccessID == "" || c.SecretKey == "" {
+		return nil
+	}
+	return credentials.NewStaticCredentials(c.AccessID, c.SecretKey, c.Token)
+}
+
+// NewRedshiftFromCredentials is NewRedshift, connecting with the credentials, e.g. from a CredentialProvider
+func NewRedshiftFromCredentials(ctx context.Context, c Credentials, timeout int) (*Redshift, error) {
+	return NewRedshift(ctx, c.Host, c.Port, c.DB, c.User, c.Password, timeout)
+}
+
+// NewRedshiftFromProvider is NewRedshift, connecting with the credentials the provider looks up,
+// e.g. from Vault rather than the environment
+func NewRedshiftFromProvider(ctx context.Context, p CredentialProvider, timeout int) (*Redshift, error) {
+	c, err := p.Credentials()
+	if err != nil {
+		return nil, fmt.Errorf("error getting credentials: %w", err)
+	}
+	return NewRedshiftFromCredentials(ctx, c, timeout)
+}
+
 // NewRedshift returns a pointer to a new redshift object using configuration values passed in
 // on instantiation and the AWS env vars we assume exist
 // Don't need to pass s3 info unless doing a COPY operation
+// host may be a comma separated list of host:port endpoints, e.g. a primary and a DR cluster, which
+// are tried in order. The first which can be pinged and runs SELECT 1 is used. Hosts without a
+// port are on port, the default port argument.
 func NewRedshift(ctx context.Context, host, port, db, user, password string, timeout int) (*Redshift, error) {
-	source := fmt.Sprintf("host=%s port=%s dbname=%s keepalive=1 connect_timeout=%d", host, port, db, timeout)
-	log.Println("Connecting to Redshift Source: ", source)
-	source += fmt.Sprintf(" user=%s password=%s", user, password)
-	sqldb, err := sql.Open("postgres", source)
-	if err != nil {
-		return nil, err
+	open := func(e endpoint) (*sql.DB, error) {
+		source := fmt.Sprintf("host=%s port=%s dbname=%s keepalive=1 connect_timeout=%d", e.host, e.port, db, timeout)
+		logger.GetLogger().InfoD("redshift-connect", kvlogger.M{"source": source})
+		source += fmt.Sprintf(" user=%s password=%s", user, password)
+		return sql.Open("postgres", source)
 	}
-	if err := sqldb.Ping(); err != nil {
+	sqldb, chosen, err := connectFirst(ctx, parseEndpoints(host, port), open)
+	if err != nil {
 		return nil, err
 	}
 	return &Redshift{
 		dbExecCloser: sqldb,
 		ctx:          ctx,
-		host:         host,
-		port:         port,
+		host:         chosen.host,
+		port:         chosen.port,
 		db:           db,
 		user:         user,
 	}, nil
 }
 
-// Begin wraps a new transaction in the databases context
-func (r *Redshift) Begin() (*sql.Tx, error) {
-	return r.dbExecCloser.BeginTx(r.ctx, nil)
+// endpoint is the host and port of a cluster
+type endpoint struct {
+	host string
+	port string
 }
 
-// GetTableFromConf returns the redshift table representation of the s3 conf file
-// It opens, unmarshalls, and does very very simple validation of the conf file
-// This belongs here - s3filepath should not have to know about redshift tables
-func (r *Redshift) GetTableFromConf(f s3filepath.S3File) (*Table, error) {
-	var tempSchema map[string]Table
+// parseEndpoints splits the comma separated hosts into endpoints, each either host:port or a host
+// on the default port
+func parseEndpoints(hosts, port string) []endpoint {
+	var endpoints []endpoint
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if host, p, err := net.SplitHostPort(h); err == nil {
+			endpoints = append(endpoints, endpoint{host: host, port: p})
+		} else {
+			endpoints = append(endpoints, endpoint{host: h, port: port})
+		}
+	}
+	return endpoints
+}
 
-	log.Printf("Parsing file: %s", f.ConfFile)
-	reader, err := pathio.Reader(f.ConfFile)
-	if err != nil {
-		return nil, fmt.Errorf("error opening conf file: %s", err)
+// connectFirst opens each endpoint in turn, returning the first which can be pinged. When there are
+// several it must also answer SELECT 1, since a cluster which is failing over may still accept
+// connections. A single endpoint's error is returned as is, otherwise every endpoint's error is.
+func connectFirst(ctx context.Context, endpoints []endpoint, open func(e endpoint) (*sql.DB, error)) (*sql.DB, endpoint, error) {
+	var errs error
+	for _, e := range endpoints {
+		sqldb, err := connectEndpoint(ctx, e, open, len(endpoints) > 1)
+		if err == nil {
+			if len(endpoints) > 1 {
+				logger.GetLogger().InfoD("redshift-endpoint-chosen", kvlogger.M{"host": e.host, "port": e.port})
+			}
+			return sqldb, e, nil
+		}
+		if len(endpoints) == 1 {
+			return nil, endpoint{}, err
+		}
+		logger.GetLogger().WarnD("redshift-endpoint-failed", kvlogger.M{"host": e.host, "port": e.port, "error": err.Error()})
+		errs = multierror.Append(errs, fmt.Errorf("endpoint %s:%s: %w", e.host, e.port, err))
 	}
-	data, err := ioutil.ReadAll(reader)
+	return nil, endpoint{}, errs
+}
+
+// connectEndpoint opens the endpoint and pings it, and runs SELECT 1 on it if sanityCheck
+func connectEndpoint(ctx context.Context, e endpoint, open func(e endpoint) (*sql.DB, error), sanityCheck bool) (*sql.DB, error) {
+	sqldb, err := open(e)
 	if err != nil {
 		return nil, err
 	}
-	if err := yaml.Unmarshal(data, &tempSchema); err != nil {
-		return nil, fmt.Errorf("warning: could not parse file %s, err: %s", f.ConfFile, err)
+	if err := sqldb.PingContext(ctx); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+	if sanityCheck {
+		var one int
+		if err := sqldb.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+			sqldb.Close()
+			return nil, fmt.Errorf("can't query redshift: %w", err)
+		}
 	}
+	return sqldb, nil
+}
 
-	// data we want is nested in a map - possible to have multiple tables in a conf file
-	for _, config := range tempSchema {
-		if config.Name == f.Table {
-			if config.Meta.Schema != f.Schema {
-				return nil, fmt.Errorf("mismatched schema, conf: %s, file: %s", config.Meta.Schema, f.Schema)
-			}
-			if config.Meta.DataDateColumn == "" {
-				return nil, fmt.Errorf("data date column must be set")
-			}
+// NewRedshiftFromDB returns a redshift object using an already open database, e.g. a mock one in tests
+func NewRedshiftFromDB(ctx context.Context, db *sql.DB) *Redshift {
+	return &Redshift{dbExecCloser: db, ctx: ctx}
+}
 
-			return &config, nil
-		}
+// transientErrorCodes are the SQLSTATEs of errors which are worth retrying, as they're down to
+// contention or the cluster's state (e.g. restarting or resizing) rather than the load itself
+var transientErrorCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+	"08000": true, // connection_exception
+	"08001": true, // sqlclient_unable_to_establish_sqlconnection
+	"08003": true, // connection_does_not_exist
+	"08006": true, // connection_failure
+}
+
+// IsTransientError reports whether the error, or any error it wraps, is a transient one worth
+// retrying the load for. The whole transaction should be retried, as postgres aborts it on any error.
+func IsTransientError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return transientErrorCodes[pqErr.Code]
 	}
-	return nil, fmt.Errorf("can't find table in conf")
+	return errors.Is(err, driver.ErrBadConn)
 }
 
-// GetTableMetadata looks for a table and returns both the Table representation
-// of the db table and the last data in the table, if that exists
-// if the table does not exist it returns an empty table but does not error
-func (r *Redshift) GetTableMetadata(schema, tableName, dataDateCol string) (*Table, *time.Time, error) {
-	var cols []ColInfo
+// deadlockDetected is the SQLSTATE of a transaction redshift aborted to break a deadlock
+const deadlockDetected pq.ErrorCode = "40P01"
 
-	// does the table exist?
-	var placeholder string
-	q := fmt.Sprintf(existQueryFormat, schema, tableName)
-	if err := r.QueryRowContext(r.ctx, q).Scan(&placeholder); err != nil {
-		// If the table doesn't exist, log it, but don't return an
-		// error since this is not an application error.
-		// The correct behavior is to create a new table.
-		if err == sql.ErrNoRows {
-			log.Printf("schema: %s, table: %s does not exist", schema, tableName)
-			return nil, nil, nil
-		}
-		return nil, nil, fmt.Errorf("issue just checking if the table exists: %s", err)
+// IsDeadlockError reports whether the error, or any error it wraps, is redshift aborting the
+// transaction to break a deadlock with another, which only a fresh transaction can get past
+func IsDeadlockError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == deadlockDetected
+}
+
+// IsExpiredTokenError reports whether the error is COPY failing because the session token in its
+// credentials has expired, which new credentials will fix
+func IsExpiredTokenError(err error) bool {
+	if err == nil {
+		return false
 	}
+	msg := err.Error()
+	return strings.Contains(msg, "ExpiredToken") || strings.Contains(msg, "token has expired") ||
+		strings.Contains(msg, "security token included in the request is expired")
+}
 
-	// table exists, what are the columns?
-	rows, err := r.QueryContext(r.ctx, fmt.Sprintf(schemaQueryFormat, schema, tableName))
-	if err != nil {
-		return nil, nil, fmt.Errorf("issue running column query: %s, err: %s", schemaQueryFormat, err)
+// IsStatementTimeoutError reports whether the error, or any error it wraps, is redshift cancelling
+// a statement for running past the statement_timeout. It isn't transient, as the statement would
+// most likely time out again.
+func IsStatementTimeoutError(err error) bool {
+	if errors.Is(err, ErrStatementTimeout) {
+		return true
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var c ColInfo
-		if err := rows.Scan(&c.Name, &c.Type, &c.DefaultVal, &c.NotNull,
-			&c.PrimaryKey, &c.DistKey, &c.SortOrdinal,
-		); err != nil {
-			return nil, nil, fmt.Errorf("issue scanning column, err: %s", err)
-		}
+	var pqErr *pq.Error
+	// query_canceled is also what cancelling the context gets, so check it was the timeout
+	return errors.As(err, &pqErr) && pqErr.Code == "57014" && strings.Contains(pqErr.Message, "statement timeout")
+}
 
-		cols = append(cols, c)
+// SetMaxOpenConns limits how many connections the pool opens at once, as in database/sql. Like
+// SetMaxIdleConns and SetConnMaxLifetime, it does nothing if the redshift object doesn't wrap a pool
+func (r *Redshift) SetMaxOpenConns(n int) {
+	if db, ok := r.dbExecCloser.(*sql.DB); ok {
+		db.SetMaxOpenConns(n)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, nil, fmt.Errorf("issue iterating over columns, err: %s", err)
+}
+
+// SetMaxIdleConns sets how many idle connections the pool keeps for reuse
+func (r *Redshift) SetMaxIdleConns(n int) {
+	if db, ok := r.dbExecCloser.(*sql.DB); ok {
+		db.SetMaxIdleConns(n)
 	}
+}
 
-	// turn into Table struct
-	retTable := Table{
-		Name:    tableName,
-		Columns: cols,
-		Meta: Meta{
-			DataDateColumn: dataDateCol,
-			Schema:         schema,
-		},
+// SetConnMaxLifetime sets how long a connection may be reused for before it's closed, so
+// connections don't go stale over a long run
+func (r *Redshift) SetConnMaxLifetime(d time.Duration) {
+	if db, ok := r.dbExecCloser.(*sql.DB); ok {
+		db.SetConnMaxLifetime(d)
 	}
+}
 
-	// what's the last data in the table?
-	lastData, err := r.MaxTime(fmt.Sprintf(`"%s"."%s"`, schema, tableName), dataDateCol)
+// Ping checks the database can still be reached, e.g. before each table of a long run. The pool
+// throws away connections which have gone bad and opens new ones, so this reconnects if it has to
+func (r *Redshift) Ping() error {
+	if db, ok := r.dbExecCloser.(*sql.DB); ok {
+		return db.PingContext(r.ctx)
+	}
+	return nil
+}
 
-	if err != nil {
-		return nil, nil, err
+// SetStagingSchema makes ParallelCopy create its staging tables in the schema, e.g. a scratch
+// schema, rather than in the schema of the table being loaded. They outlive the COPY's connection,
+// so can't be TEMP tables, unlike upsert's and dedup's, which are. Swap and rebuild tables are
+// renamed into place, so have to be in the table's schema, but only exist in the load's transaction
+func (r *Redshift) SetStagingSchema(schema string) {
+	r.stagingSchema = schema
+}
+
+// SetSessionParams sets the session parameters each transaction starts by SETting, e.g.
+// query_group to route loads to their own WLM queue, or statement_timeout
+func (r *Redshift) SetSessionParams(params []SessionParam) error {
+	for _, p := range params {
+		if !sessionParamRegex.MatchString(p.Name) {
+			return fmt.Errorf("invalid session parameter name %q", p.Name)
+		}
 	}
-	return &retTable, &lastData, nil
+	r.sessionParams = params
+	return nil
 }
 
-// MaxTime returns the maximum value for the time field in the specified table
-func (r *Redshift) MaxTime(fullName, dataDateCol string) (time.Time, error) {
-	return r.maxTime(fullName, dataDateCol, rangeDay)
+// SetDryRun toggles dry run mode, where statements which would modify the database
+// (CREATE, ALTER, DELETE, COPY, etc) are only logged. Reads still run as normal.
+func (r *Redshift) SetDryRun(dryRun bool) {
+	r.dryRun = dryRun
 }
 
-// maxTime is a helper function to scan progressively larger ranges of time to get more optimized
-// max(time) queries - redshift doesn't have good optimizations for max on sort-keyed columns.
-func (r *Redshift) maxTime(fullName, dataDateCol string, rangeLimit rangeQuery) (time.Time, error) {
-	lastDataQuery := fmt.Sprintf(`SELECT MAX("%s") FROM %s`, dataDateCol, fullName)
-	// SQL Optimization: Redshift doesn't do proper optimizations on max for sort keys, so to reduce our
-	// efficiency, we'll add a where clause to reduce our query area.
-	if rangeLimit != rangeAll {
-		lastDataQuery += fmt.Sprintf(` WHERE "%s" > GETDATE() - INTERVAL '1 %s'`, dataDateCol, rangeQueryString(rangeLimit))
+// dryRunSkip logs the statement we would have run and reports whether it should be skipped
+func (r *Redshift) dryRunSkip(query string) bool {
+	if r.dryRun {
+		logger.GetLogger().InfoD("dry-run-sql", kvlogger.M{"sql": query})
 	}
+	return r.dryRun
+}
 
-	var lastData pq.NullTime
-	err := r.QueryRowContext(r.ctx, lastDataQuery).Scan(&lastData)
-	// max will either return a value or null if no data, rather than no rows.
+// Begin wraps a new transaction in the databases context, and SETs the session parameters in it.
+// These don't modify the database, so are run in dry run mode too.
+func (r *Redshift) Begin() (*sql.Tx, error) {
+	return r.BeginIsolated(sql.LevelDefault)
+}
+
+// IsolationLevels are the isolation levels a transaction can be begun with, by name. Redshift
+// runs them all as serializable, unless the database uses snapshot isolation
+var IsolationLevels = map[string]sql.IsolationLevel{
+	"":                 sql.LevelDefault,
+	"read-uncommitted": sql.LevelReadUncommitted,
+	"read-committed":   sql.LevelReadCommitted,
+	"repeatable-read":  sql.LevelRepeatableRead,
+	"serializable":     sql.LevelSerializable,
+}
+
+// BeginIsolated is Begin, but with the isolation level, or the database's default for LevelDefault
+func (r *Redshift) BeginIsolated(level sql.IsolationLevel) (*sql.Tx, error) {
+	var opts *sql.TxOptions
+	if level != sql.LevelDefault {
+		opts = &sql.TxOptions{Isolation: level}
+	}
+	tx, err := r.dbExecCloser.BeginTx(r.ctx, opts)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("issue running query: %s, err: %s", lastDataQuery, err)
-	} else if !lastData.Valid {
-		// If we didn't find a hit in our reduced range, expand it and try again
-		if rangeLimit != rangeAll {
-			return r.maxTime(fullName, dataDateCol, rangeLimit-1)
+		return nil, err
+	}
+	for _, p := range r.sessionParams {
+		if _, err := tx.ExecContext(r.ctx, fmt.Sprintf(`SET %s TO %s`, p.Name, quoteLiteral(p.Value))); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("issue setting %s: %w", p.Name, err)
 		}
-		return time.Time{}, nil
 	}
-	return lastData.Time, nil
+	return tx, nil
 }
 
-func getColumnSQL(c ColInfo) string {
-	// note that we are relying on redshift to fail if we have created multiple sort keys
-	// currently we don't support that
-	defaultVal := ""
-	if c.DefaultVal != "" {
-		defaultVal = fmt.Sprintf("DEFAULT %s", c.DefaultVal)
+// SetStatementTimeout limits how long each statement in the transaction may run for, after which
+// redshift cancels it, failing the transaction. Unlike a statement_timeout session parameter, it
+// only applies until the transaction ends.
+func (r *Redshift) SetStatementTimeout(tx *sql.Tx, timeout time.Duration) error {
+	setSQL := fmt.Sprintf(`SET LOCAL statement_timeout TO %d`, timeout.Milliseconds())
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": setSQL})
+	if _, err := tx.ExecContext(r.ctx, setSQL); err != nil {
+		return fmt.Errorf("issue setting statement_timeout: %w", err)
 	}
-	notNull := ""
-	if c.NotNull {
-		notNull = "NOT NULL"
+	return nil
+}
+
+// HealthCheck checks redshift can be queried at all, by running SELECT 1
+func (r *Redshift) HealthCheck() error {
+	var one int
+	if err := r.QueryRowContext(r.ctx, `SELECT 1`).Scan(&one); err != nil {
+		return fmt.Errorf("can't query redshift: %w", err)
 	}
-	primaryKey := ""
-	if c.PrimaryKey {
-		primaryKey = "PRIMARY KEY"
+	return nil
+}
+
+// Preflight checks that a load into the schema from the bucket could work, so misconfigurations
+// fail quickly rather than part way through a run: that the connection works, the user can create
+// tables in the schema and the staging schema, if set, and COPY can read from the bucket with its
+// credentials. Nothing is changed.
+// COPY is checked against a prefix of the bucket with nothing under it, which redshift can only
+// say doesn't exist once it's been allowed to list the bucket.
+func (r *Redshift) Preflight(schema string, bucket s3filepath.S3Bucket) error {
+	if err := r.HealthCheck(); err != nil {
+		return err
 	}
-	sortKey := ""
-	if c.SortOrdinal == 1 {
-		sortKey = "SORTKEY"
+
+	if err := r.checkCanCreate(schema); err != nil {
+		return err
 	}
-	distKey := ""
-	if c.DistKey {
-		distKey = "DISTKEY"
+	if r.stagingSchema != "" && r.stagingSchema != schema {
+		if err := r.checkCanCreate(r.stagingSchema); err != nil {
+			return fmt.Errorf("staging schema: %w", err)
+		}
 	}
 
-	return fmt.Sprintf(" \"%s\" %s %s %s %s %s %s", c.Name, typeMapping[c.Type], defaultVal, notNull, sortKey, primaryKey, distKey)
+	tx, err := r.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(r.ctx, `CREATE TEMP TABLE "s3_to_redshift_preflight" (c character varying(256))`); err != nil {
+		return fmt.Errorf("can't create a temporary table: %w", err)
+	}
+	prefix := fmt.Sprintf("s3://%s/%s/_s3_to_redshift_preflight_", bucket.Name, schema)
+	copySQL := fmt.Sprintf(`COPY "s3_to_redshift_preflight" FROM '%s' REGION '%s' NOLOAD %s`, prefix, bucket.Region, credentialsSQL(bucket))
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": copySQL, "schema": schema})
+	_, err = tx.ExecContext(r.ctx, copySQL)
+	// "The specified S3 prefix ... does not exist" means COPY could list the bucket, unlike S3's
+	// "The specified bucket does not exist"
+	if err == nil || (strings.Contains(err.Error(), "S3 prefix") && strings.Contains(err.Error(), "does not exist")) {
+		return nil
+	}
+	return fmt.Errorf("COPY can't read from s3://%s: %w", bucket.Name, err)
 }
 
-// CreateTable runs the full create table command in the provided transaction, given a
-// redshift representation of the table.
-func (r *Redshift) CreateTable(tx *sql.Tx, table Table) error {
-	var columnSQL []string
-	for _, c := range table.Columns {
-		columnSQL = append(columnSQL, getColumnSQL(c))
+// checkCanCreate checks the user can create tables in the schema
+func (r *Redshift) checkCanCreate(schema string) error {
+	var canCreate bool
+	q := fmt.Sprintf(`SELECT has_schema_privilege(current_user, %s, 'CREATE')`, quoteLiteral(schema))
+	if err := r.QueryRowContext(r.ctx, q).Scan(&canCreate); err != nil {
+		return fmt.Errorf("can't check privileges on schema %s (does it exist?): %w", schema, err)
+	} else if !canCreate {
+		return fmt.Errorf("user %s can't create tables in schema %s", r.user, schema)
 	}
-	args := []interface{}{strings.Join(columnSQL, ",")}
-	// for some reason prepare here was unable to succeed, perhaps look at this later
-	createSQL := fmt.Sprintf(`CREATE TABLE "%s"."%s" (%s)`, table.Meta.Schema, table.Name, strings.Join(columnSQL, ","))
+	return nil
+}
 
-	if match, _ := regexp.MatchString("SORTKEY|DISTKEY", createSQL); !match {
-		return fmt.Errorf("both SORTKEY and DISTKEY should be specified in create table: %s. Either create your own table if you truly don't want those keys, or update the config to contain both", createSQL)
-	}
+// ReadConfFile reads all the table configs in the conf file at path, which may be local or in
+// the bucket, keyed as in the file. Conf files are YAML, unless they're named as JSON
+func ReadConfFile(bucket s3filepath.S3Bucket, path string) (map[string]Table, error) {
+	var tables map[string]Table
 
-	createStmt, err := tx.PrepareContext(r.ctx, createSQL)
+	logger.GetLogger().InfoD("parse-conf-file", kvlogger.M{"file": path})
+	reader, err := s3filepath.Reader(bucket, path)
 	if err != nil {
-		return fmt.Errorf("issue preparing statement: %s", err)
+		return nil, fmt.Errorf("error opening conf file: %w", err)
 	}
-
-	log.Printf("Running command: %s with args: %v", createSQL, args)
-	_, err = createStmt.ExecContext(r.ctx)
-	return err
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	unmarshal := yaml.Unmarshal
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		unmarshal = json.Unmarshal
+	}
+	if err := unmarshal(data, &tables); err != nil {
+		return nil, fmt.Errorf("warning: could not parse file %s, err: %w", path, err)
+	}
+	return tables, nil
 }
 
-// UpdateTable figures out what columns we need to add to the target table based on the
-// input table, and completes this action in the transaction provided
-// Note: only supports adding columns currently, not updating existing columns or removing them
-func (r *Redshift) UpdateTable(tx *sql.Tx, inputTable, targetTable Table) error {
-
-	columnOps, err := checkSchemas(inputTable, targetTable)
+// GetTableFromConf returns the redshift table representation of the s3 conf file
+// It opens, unmarshalls, and does very very simple validation of the conf file
+// The table's columns, types and keys come from the conf file as written, nothing is inferred
+// from the data, and the s3 file only says which table (and schema) to look for. A conf file may
+// have tables with the same name in different schemas, but only one for each schema
+// This belongs here - s3filepath should not have to know about redshift tables
+func (r *Redshift) GetTableFromConf(f s3filepath.S3File) (*Table, error) {
+	tempSchema, err := ReadConfFile(f.Bucket, f.ConfFile)
 	if err != nil {
-		return fmt.Errorf("mismatched schema: %s", err)
+		return nil, err
 	}
 
-	// postgres only allows adding one column at a time
-	for _, op := range columnOps {
-		alterStmt, err := tx.PrepareContext(r.ctx, op)
-		if err != nil {
-			return fmt.Errorf("issue preparing statement: '%s' - err: %s", op, err)
+	// data we want is nested in a map - possible to have multiple tables in a conf file
+	var match *Table
+	otherSchema := ""
+	for key, config := range tempSchema {
+		if config.Name != f.Table {
+			continue
 		}
-
-		log.Printf("Running command: %s", op)
-		_, err = alterStmt.ExecContext(r.ctx)
-		if err != nil {
-			return fmt.Errorf("issue running statement %s: %s", op, err)
+		if config.Meta.Schema != f.Schema {
+			otherSchema = config.Meta.Schema
+			continue
 		}
+		if match != nil {
+			return nil, fmt.Errorf("table %s.%s is in conf file %s more than once, as %s too", f.Schema, f.Table, f.ConfFile, key)
+		}
+		config := config
+		match = &config
 	}
-	return nil
+	if match == nil && otherSchema != "" {
+		return nil, fmt.Errorf("mismatched schema, conf: %s, file: %s", otherSchema, f.Schema)
+	}
+	if match == nil {
+		return nil, ErrTableNotInConf
+	}
+	if match.Meta.DataDateColumn == "" {
+		return nil, fmt.Errorf("data date column must be set")
+	}
+	return match, nil
+}
+
+// ValidateTableConfig checks a table from a config file is well formed, so that mistakes fail the run
+// before anything in the database is touched: the name, schema and data date column must be set,
+// the data date column must be one of the columns, column names must be unique with known types,
+// there can be at most one distkey, and the sortkey ordinals must run 1, 2, 3... (up to 8 for an
+// interleaved sortkey)
+func ValidateTableConfig(table Table) error {
+	var errors error
+	if table.Name == "" {
+		errors = multierror.Append(errors, fmt.Errorf("table name must be set"))
+	}
+	if table.Meta.Schema == "" {
+		errors = multierror.Append(errors, fmt.Errorf("schema must be set"))
+	}
+	if table.Meta.DataDateColumn == "" {
+		errors = multierror.Append(errors, fmt.Errorf("data date column must be set"))
+	}
+
+	seen := map[string]bool{}
+	var distKeys []string
+	sortOrdinals := map[int]string{}
+	for _, col := range table.Columns {
+		if col.Name == "" {
+			errors = multierror.Append(errors, fmt.Errorf("column with type %s has no name", col.Type))
+			continue
+		}
+		if seen[col.Name] {
+			errors = multierror.Append(errors, fmt.Errorf("column %s is listed more than once", col.Name))
+		}
+		seen[col.Name] = true
+		if _, ok := typeMapping[col.Type]; !ok {
+			errors = multierror.Append(errors, fmt.Errorf("column %s has unknown type %s, must be one of %s",
+				col.Name, col.Type, strings.Join(configTypes(), ", ")))
+		}
+		if col.Encoding != "" && !encodings[strings.ToLower(col.Encoding)] {
+			errors = multierror.Append(errors, fmt.Errorf("column %s has unknown encoding %s, must be one of %s",
+				col.Name, col.Encoding, strings.Join(columnEncodings(), ", ")))
+		}
+		if col.DistKey {
+			distKeys = append(distKeys, col.Name)
+		}
+		if col.Type == "super" && (col.DistKey || col.SortOrdinal != 0) {
+			errors = multierror.Append(errors, fmt.Errorf("column %s is super, which can't be in the distkey or sortkey", col.Name))
+		}
+		if col.SortOrdinal < 0 {
+			errors = multierror.Append(errors, fmt.Errorf("column %s has negative sortord %d", col.Name, col.SortOrdinal))
+		} else if col.SortOrdinal > 0 {
+			if other, ok := sortOrdinals[col.SortOrdinal]; ok {
+				errors = multierror.Append(errors, fmt.Errorf("columns %s and %s have the same sortord %d", other, col.Name, col.SortOrdinal))
+			}
+			sortOrdinals[col.SortOrdinal] = col.Name
+		}
+	}
+	if table.Meta.DataDateColumn != "" && !seen[table.Meta.DataDateColumn] {
+		errors = multierror.Append(errors, fmt.Errorf("data date column %s isn't one of the columns", table.Meta.DataDateColumn))
+	}
+	if table.Meta.DataDateHourColumn != "" && !seen[table.Meta.DataDateHourColumn] {
+		errors = multierror.Append(errors, fmt.Errorf("data date hour column %s isn't one of the columns", table.Meta.DataDateHourColumn))
+	}
+	if table.Meta.DataDateTimezone != "" {
+		if _, err := time.LoadLocation(table.Meta.DataDateTimezone); err != nil {
+			errors = multierror.Append(errors, fmt.Errorf("unknown data date timezone %s: %w", table.Meta.DataDateTimezone, err))
+		}
+	}
+	if len(distKeys) > 1 {
+		errors = multierror.Append(errors, fmt.Errorf("only one column can be the distkey, got %s", strings.Join(distKeys, ", ")))
+	}
+	for i := 1; i <= len(sortOrdinals); i++ {
+		if _, ok := sortOrdinals[i]; !ok {
+			errors = multierror.Append(errors, fmt.Errorf("sortord %d is missing, sortords must run from 1 without gaps", i))
+			break
+		}
+	}
+	for _, grantee := range table.Meta.Grants {
+		if !granteeRegex.MatchString(grantee) {
+			errors = multierror.Append(errors, fmt.Errorf("grant to %q must be a user, GROUP <group> or ROLE <role>", grantee))
+		}
+	}
+	for _, key := range table.Meta.DedupKey {
+		if !seen[key] {
+			errors = multierror.Append(errors, fmt.Errorf("dedup key column %s isn't one of the columns", key))
+		}
+	}
+	if p := table.Meta.JSONPaths; p != "" && !strings.HasPrefix(p, "s3://") {
+		errors = multierror.Append(errors, fmt.Errorf("jsonpaths must be an s3 path, got %s", p))
+	}
+	// redshift only takes a single ASCII character, other than NULL, as the replacement
+	if c := table.Meta.AcceptInvChars; c != "" && (len(c) != 1 || c[0] == 0 || c[0] > 127) {
+		errors = multierror.Append(errors, fmt.Errorf("acceptinvchars must be a single ASCII character, got %q", c))
+	}
+	for _, opt := range [][2]string{{"delimiter", table.Meta.Delimiter}, {"quote", table.Meta.Quote}} {
+		if c := opt[1]; c != "" && (len(c) != 1 || c[0] == 0 || c[0] > 127) {
+			errors = multierror.Append(errors, fmt.Errorf("%s must be a single ASCII character, got %q", opt[0], c))
+		}
+	}
+	if table.Meta.Quote != "" && table.Meta.Quote == table.Meta.Delimiter {
+		errors = multierror.Append(errors, fmt.Errorf("quote and delimiter can't both be %q", table.Meta.Quote))
+	}
+	switch table.Meta.SortKeyStyle {
+	case "", SortKeyCompound:
+	case SortKeyInterleaved:
+		if len(sortOrdinals) > maxInterleavedSortKeyColumns {
+			errors = multierror.Append(errors, fmt.Errorf("interleaved sortkeys can have at most %d columns, got %d",
+				maxInterleavedSortKeyColumns, len(sortOrdinals)))
+		}
+	default:
+		errors = multierror.Append(errors, fmt.Errorf("unknown sortkey style %s, must be %s or %s",
+			table.Meta.SortKeyStyle, SortKeyCompound, SortKeyInterleaved))
+	}
+	return errors
+}
+
+// configTypes returns the column types a config can use, sorted
+func configTypes() []string {
+	types := make([]string, 0, len(typeMapping))
+	for t := range typeMapping {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// columnEncodings returns the compression encodings a column can use, sorted
+func columnEncodings() []string {
+	names := make([]string, 0, len(encodings))
+	for e := range encodings {
+		names = append(names, e)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetTableMetadata looks for a table and returns both the Table representation
+// of the db table and the last data in the table, if that exists
+// if the table does not exist it returns a nil table and data date but does not error,
+// so a new table is always treated as needing a load.
+// The data date columns of dataDate say where the last data is
+func (r *Redshift) GetTableMetadata(schema, tableName string, dataDate Meta) (*Table, *time.Time, error) {
+	table, err := r.GetTable(schema, tableName)
+	if err != nil || table == nil {
+		return nil, nil, err
+	}
+	table.Meta.DataDateColumn = dataDate.DataDateColumn
+	table.Meta.DataDateHourColumn = dataDate.DataDateHourColumn
+
+	// what's the last data in the table?
+	lastData, err := r.MaxTime(fmt.Sprintf(`"%s"."%s"`, schema, tableName), dataDate)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	return table, &lastData, nil
+}
+
+// GetTable returns the Table representation of the db table, without looking at its data,
+// or nil if the table doesn't exist
+func (r *Redshift) GetTable(schema, tableName string) (*Table, error) {
+	var cols []ColInfo
+
+	// does the table exist?
+	var placeholder string
+	q := fmt.Sprintf(existQueryFormat, schema, tableName)
+	if err := r.QueryRowContext(r.ctx, q).Scan(&placeholder); err != nil {
+		// If the table doesn't exist, log it, but don't return an
+		// error since this is not an application error.
+		// The correct behavior is to create a new table.
+		if err == sql.ErrNoRows {
+			logger.GetLogger().InfoD("table-does-not-exist", kvlogger.M{"schema": schema, "table": tableName})
+			return nil, nil
+		}
+		return nil, fmt.Errorf("issue just checking if the table exists: %w", err)
+	}
+
+	// table exists, what are the columns?
+	rows, err := r.QueryContext(r.ctx, fmt.Sprintf(schemaQueryFormat, schema, tableName))
+	if err != nil {
+		return nil, fmt.Errorf("issue running column query: %s, err: %w", schemaQueryFormat, err)
+	}
+	defer rows.Close()
+	sortKeyStyle := ""
+	for rows.Next() {
+		var c ColInfo
+		if err := rows.Scan(&c.Name, &c.Type, &c.DefaultVal, &c.NotNull,
+			&c.PrimaryKey, &c.DistKey, &c.SortOrdinal,
+		); err != nil {
+			return nil, fmt.Errorf("issue scanning column, err: %w", err)
+		}
+		// the columns of an interleaved sortkey alternate between positive and negative ordinals
+		if c.SortOrdinal < 0 {
+			c.SortOrdinal = -c.SortOrdinal
+			sortKeyStyle = SortKeyInterleaved
+		}
+
+		cols = append(cols, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("issue iterating over columns, err: %w", err)
+	}
+
+	// turn into Table struct
+	return &Table{
+		Name:    tableName,
+		Columns: cols,
+		Meta: Meta{
+			Schema:       schema,
+			SortKeyStyle: sortKeyStyle,
+		},
+	}, nil
+}
+
+// MaxTime returns the maximum data date, from the data date columns of dataDate, in the specified table
+func (r *Redshift) MaxTime(fullName string, dataDate Meta) (time.Time, error) {
+	return r.maxTime(fullName, dataDate, rangeDay)
+}
+
+// maxTime is a helper function to scan progressively larger ranges of time to get more optimized
+// max(time) queries - redshift doesn't have good optimizations for max on sort-keyed columns.
+func (r *Redshift) maxTime(fullName string, dataDate Meta, rangeLimit rangeQuery) (time.Time, error) {
+	lastDataQuery := fmt.Sprintf(`SELECT MAX(%s) FROM %s`, dataDate.dataDateSQL(), fullName)
+	// SQL Optimization: Redshift doesn't do proper optimizations on max for sort keys, so to reduce our
+	// efficiency, we'll add a where clause to reduce our query area.
+	if rangeLimit != rangeAll {
+		// filter on the date column alone so redshift can still use it as a sortkey
+		lastDataQuery += fmt.Sprintf(` WHERE "%s" > GETDATE() - INTERVAL '1 %s'`, dataDate.DataDateColumn, rangeQueryString(rangeLimit))
+	}
+
+	var lastData pq.NullTime
+	err := r.QueryRowContext(r.ctx, lastDataQuery).Scan(&lastData)
+	// max will either return a value or null if no data, rather than no rows.
+	if err != nil {
+		return time.Time{}, fmt.Errorf("issue running query: %s, err: %w", lastDataQuery, err)
+	} else if !lastData.Valid {
+		// If we didn't find a hit in our reduced range, expand it and try again
+		if rangeLimit != rangeAll {
+			return r.maxTime(fullName, dataDate, rangeLimit-1)
+		}
+		return time.Time{}, nil
+	}
+	return lastData.Time, nil
+}
+
+func getColumnSQL(c ColInfo) string {
+	// note that we are relying on redshift to fail if we have created multiple sort keys
+	// currently we don't support that
+	defaultVal := ""
+	if c.DefaultVal != "" {
+		defaultVal = fmt.Sprintf("DEFAULT %s", c.DefaultVal)
+	}
+	encoding := ""
+	if c.Encoding != "" {
+		encoding = fmt.Sprintf("ENCODE %s", strings.ToLower(c.Encoding))
+	}
+	notNull := ""
+	if c.NotNull {
+		notNull = "NOT NULL"
+	}
+	primaryKey := ""
+	if c.PrimaryKey {
+		primaryKey = "PRIMARY KEY"
+	}
+	sortKey := ""
+	if c.SortOrdinal == 1 {
+		sortKey = "SORTKEY"
+	}
+	distKey := ""
+	if c.DistKey {
+		distKey = "DISTKEY"
+	}
+
+	return fmt.Sprintf(" \"%s\" %s %s %s %s %s %s %s", c.Name, typeMapping[c.Type], defaultVal, encoding, notNull, sortKey, primaryKey, distKey)
+}
+
+// CreateTable runs the full create table command in the provided transaction, given a
+// redshift representation of the table. If the table already exists it's left alone.
+func (r *Redshift) CreateTable(tx *sql.Tx, table Table) error {
+	// a single column compound sortkey can go on the column, but anything else needs a table
+	// level sortkey after the columns
+	_, sortCols := keyColumns(table)
+	tableSortKey := table.Meta.SortKeyStyle == SortKeyInterleaved || len(sortCols) > 1
+	var columnSQL []string
+	for _, c := range table.Columns {
+		if tableSortKey {
+			c.SortOrdinal = 0
+		}
+		columnSQL = append(columnSQL, getColumnSQL(c))
+	}
+	args := []interface{}{strings.Join(columnSQL, ",")}
+	sortKeySQL := ""
+	if tableSortKey && len(sortCols) > 0 {
+		style := "COMPOUND"
+		if table.Meta.SortKeyStyle == SortKeyInterleaved {
+			style = "INTERLEAVED"
+		}
+		sortKeySQL = fmt.Sprintf(` %s SORTKEY ("%s")`, style, strings.Join(sortCols, `", "`))
+	}
+	// for some reason prepare here was unable to succeed, perhaps look at this later
+	createSQL := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s"."%s" (%s)%s`, table.Meta.Schema, table.Name, strings.Join(columnSQL, ","), sortKeySQL)
+
+	if match, _ := regexp.MatchString("SORTKEY|DISTKEY", createSQL); !match {
+		return fmt.Errorf("both SORTKEY and DISTKEY should be specified in create table: %s. Either create your own table if you truly don't want those keys, or update the config to contain both", createSQL)
+	}
+	if r.dryRunSkip(createSQL) {
+		return nil
+	}
+
+	createStmt, err := tx.PrepareContext(r.ctx, createSQL)
+	if err != nil {
+		return fmt.Errorf("issue preparing statement: %w", err)
+	}
+
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": createSQL, "args": args})
+	_, err = createStmt.ExecContext(r.ctx)
+	return err
+}
+
+// EnsureTable creates the table in the transaction for its first load. Another load may have
+// created it since we looked for it, in which case CreateTable leaves their table alone, so it's
+// brought up to date with the config like any existing table. Only tables other transactions
+// have committed are seen, not one this transaction has just created.
+func (r *Redshift) EnsureTable(tx *sql.Tx, table Table, allowKeyDrift, allowDropColumns bool) error {
+	if err := r.CreateTable(tx, table); err != nil {
+		return err
+	}
+	existing, err := r.GetTable(table.Meta.Schema, table.Name)
+	if err != nil || existing == nil {
+		return err
+	}
+	logger.GetLogger().InfoD("table-created-concurrently", kvlogger.M{"schema": table.Meta.Schema, "table": table.Name})
+	return r.UpdateTable(tx, table, *existing, allowKeyDrift, allowDropColumns)
+}
+
+// UpdateTable figures out what columns we need to add to the target table based on the
+// input table, and completes this action in the transaction provided
+// Note: only supports adding columns currently, not updating existing columns. Existing columns
+// whose type (or default, nullability or primary key) differs from the config are an error listing
+// every mismatch, so upstream type changes don't go unnoticed; varchars which have only grown are
+// left to WidenColumns. Columns which are
+// no longer in the input table are only removed if allowDropColumns is set, since it's destructive.
+// If the distkey or sortkey of the target table has drifted from the input table it's an error,
+// unless allowKeyDrift is set, in which case we only warn.
+func (r *Redshift) UpdateTable(tx *sql.Tx, inputTable, targetTable Table, allowKeyDrift, allowDropColumns bool) error {
+
+	var dropOps []string
+	if allowDropColumns {
+		var err error
+		if dropOps, targetTable, err = dropColumnOps(inputTable, targetTable); err != nil {
+			return err
+		}
+	}
+
+	columnOps, err := checkSchemas(inputTable, targetTable)
+	if err != nil {
+		return schemaMismatch{fmt.Errorf("mismatched schema: %w", err)}
+	}
+	// drop first, so the remaining columns line up for any that need adding
+	columnOps = append(dropOps, columnOps...)
+	if err := checkKeys(inputTable, targetTable); err != nil {
+		if !allowKeyDrift {
+			return schemaMismatch{fmt.Errorf("mismatched keys: %w", err)}
+		}
+		logger.GetLogger().WarnD("key-drift", kvlogger.M{
+			"schema": targetTable.Meta.Schema, "table": targetTable.Name, "error": err.Error(),
+		})
+	}
+
+	// postgres only allows adding one column at a time
+	for _, op := range columnOps {
+		if r.dryRunSkip(op) {
+			continue
+		}
+		alterStmt, err := tx.PrepareContext(r.ctx, op)
+		if err != nil {
+			return fmt.Errorf("issue preparing statement: '%s' - err: %w", op, err)
+		}
+
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": op})
+		_, err = alterStmt.ExecContext(r.ctx)
+		if err != nil {
+			return fmt.Errorf("issue running statement %s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// TableDiff is how a table in redshift differs from its config: what UpdateTable and WidenColumns
+// would change, or refuse to
+type TableDiff struct {
+	// AddedColumns are in the config but not the table
+	AddedColumns []ColInfo `json:"added_columns"`
+	// DroppedColumns are in the table but not the config, and are only dropped with allowDropColumns
+	DroppedColumns []ColInfo `json:"dropped_columns"`
+	// TypeChanges are columns whose type in the config isn't the table's, such as grown varchars
+	TypeChanges []TypeChange `json:"type_changes"`
+	// KeyChanges describe how the distkey or sortkey in the config disagree with the table's
+	KeyChanges []string `json:"key_changes"`
+}
+
+// TypeChange is a column whose type in the table, From, differs from the config's, To
+type TypeChange struct {
+	Column string `json:"column"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// Empty returns whether the table already matches its config
+func (d TableDiff) Empty() bool {
+	return len(d.AddedColumns) == 0 && len(d.DroppedColumns) == 0 && len(d.TypeChanges) == 0 && len(d.KeyChanges) == 0
+}
+
+// DiffTable compares the target table in redshift against the input table's config, without
+// changing anything, e.g. to see what a load would do before running it. Columns are matched
+// up by name. It's an error if the config has a column of an unknown type.
+func (r *Redshift) DiffTable(inputTable, targetTable Table) (TableDiff, error) {
+	var diff TableDiff
+	targetCols := map[string]ColInfo{}
+	for _, c := range targetTable.Columns {
+		targetCols[columnKey(c.Name)] = c
+	}
+	inputCols := map[string]bool{}
+	for _, inCol := range inputTable.Columns {
+		inputCols[columnKey(inCol.Name)] = true
+		if _, ok := typeMapping[inCol.Type]; !ok {
+			return TableDiff{}, fmt.Errorf("column %s has unknown type %s", inCol.Name, inCol.Type)
+		}
+		targetCol, ok := targetCols[columnKey(inCol.Name)]
+		if !ok {
+			diff.AddedColumns = append(diff.AddedColumns, inCol)
+		} else if typeMapping[inCol.Type] != targetCol.Type {
+			diff.TypeChanges = append(diff.TypeChanges, TypeChange{Column: inCol.Name, From: targetCol.Type, To: typeMapping[inCol.Type]})
+		}
+	}
+	for _, c := range targetTable.Columns {
+		if !inputCols[columnKey(c.Name)] {
+			diff.DroppedColumns = append(diff.DroppedColumns, c)
+		}
+	}
+	if err := checkKeys(inputTable, targetTable); err != nil {
+		if merr, ok := err.(*multierror.Error); ok {
+			for _, e := range merr.Errors {
+				diff.KeyChanges = append(diff.KeyChanges, e.Error())
+			}
+		} else {
+			diff.KeyChanges = append(diff.KeyChanges, err.Error())
+		}
+	}
+	return diff, nil
+}
+
+// WidenColumns grows any varchar columns of the target table which are narrower than in the
+// input table. Redshift can't alter a column's type inside a transaction block, so unlike
+// UpdateTable this runs on its own connection and should be run before the load's transaction.
+// Widening is always safe, so it's fine for it to stick even if the load then fails.
+func (r *Redshift) WidenColumns(inputTable, targetTable Table) error {
+	ops, err := widenColumnOps(inputTable, targetTable)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if r.dryRunSkip(op) {
+			continue
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": op})
+		if _, err := r.ExecContext(r.ctx, op); err != nil {
+			return fmt.Errorf("issue running statement %s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// widenColumnOps returns the alter table commands to grow each varchar column of the target table
+// which is narrower than the input table's. Narrowing could lose data, so it's refused with an error.
+func widenColumnOps(inputTable, targetTable Table) ([]string, error) {
+	var ops []string
+	var errors error
+	for _, inCol := range inputTable.Columns {
+		inLength, ok := varcharLength(typeMapping[inCol.Type])
+		if !ok {
+			continue
+		}
+		for _, targetCol := range targetTable.Columns {
+			if columnKey(inCol.Name) != columnKey(targetCol.Name) {
+				continue
+			}
+			targetLength, ok := varcharLength(targetCol.Type)
+			if !ok {
+				continue
+			}
+			if inLength < targetLength {
+				errors = multierror.Append(errors, fmt.Errorf("refusing to narrow column %s from %s to %s",
+					inCol.Name, targetCol.Type, typeMapping[inCol.Type]))
+			} else if inLength > targetLength {
+				logger.GetLogger().InfoD("widen-column", kvlogger.M{
+					"schema": targetTable.Meta.Schema, "table": targetTable.Name, "column": inCol.Name,
+					"old_type": targetCol.Type, "new_type": typeMapping[inCol.Type],
+				})
+				ops = append(ops, fmt.Sprintf(`ALTER TABLE "%s"."%s" ALTER COLUMN "%s" TYPE %s`,
+					targetTable.Meta.Schema, targetTable.Name, targetCol.Name, typeMapping[inCol.Type]))
+			}
+		}
+	}
+	return ops, errors
+}
+
+// varcharLength returns the length of a redshift varchar type, and whether it is one
+func varcharLength(colType string) (int, bool) {
+	match := varcharRegex.FindStringSubmatch(colType)
+	if match == nil {
+		return 0, false
+	}
+	length, err := strconv.Atoi(match[1])
+	return length, err == nil
+}
+
+// dropColumnOps returns the alter table commands to drop every column of the target table which
+// isn't in the input table, along with the target table as it will be once they're dropped.
+// It refuses to drop distkey or sortkey columns, since redshift can't either.
+func dropColumnOps(inputTable, targetTable Table) ([]string, Table, error) {
+	inputCols := map[string]bool{}
+	for _, c := range inputTable.Columns {
+		inputCols[columnKey(c.Name)] = true
+	}
+
+	var dropOps []string
+	var keptCols []ColInfo
+	for _, c := range targetTable.Columns {
+		if inputCols[columnKey(c.Name)] {
+			keptCols = append(keptCols, c)
+			continue
+		}
+		if c.DistKey || c.SortOrdinal != 0 {
+			return nil, targetTable, fmt.Errorf("refusing to drop column %s, it is part of the distkey or sortkey", c.Name)
+		}
+		logger.GetLogger().WarnD("drop-column", kvlogger.M{
+			"schema": targetTable.Meta.Schema, "table": targetTable.Name, "column": c.Name,
+		})
+		dropOps = append(dropOps, fmt.Sprintf(`ALTER TABLE "%s"."%s" DROP COLUMN "%s"`,
+			targetTable.Meta.Schema, targetTable.Name, c.Name))
+	}
+	targetTable.Columns = keptCols
+	return dropOps, targetTable, nil
+}
+
+// columnKey is the column name for matching a config's columns up with a table's. Redshift folds
+// unquoted identifiers to lower case, but tables created with quoted mixed case names keep them,
+// so names are compared without case or quotes.
+func columnKey(name string) string {
+	return strings.ToLower(strings.Trim(name, `"`))
+}
+
+// checkSchemas takes in two tables and compares their column schemas to make sure they're compatible.
+// If they have any mismatched columns they are returned in the errors array. If the input table has
+// columns at the end that the target table does not then the appropriate alter tables sql commands are
+// returned.
+func checkSchemas(inputTable, targetTable Table) ([]string, error) {
+	// If the schema is mongo_raw then we know the input files are json so ordering doesn't matter. At
+	// some point we could handle this in a more general way by checking if the input files are json.
+	// This wouldn't be too hard, but we would have to peak in the manifest file to check if all the
+	// files references are json.
+	if targetTable.Meta.Schema == "mongo_raw" {
+		return checkColumnsWithoutOrdering(inputTable, targetTable)
+	}
+	return checkColumnsAndOrdering(inputTable, targetTable)
+}
+
+func checkColumnsAndOrdering(inputTable, targetTable Table) ([]string, error) {
+	var columnOps []string
+	var errors error
+	if len(inputTable.Columns) < len(targetTable.Columns) {
+		errors = multierror.Append(errors, fmt.Errorf("target table has more columns than the input table"))
+	}
+
+	for idx, inCol := range inputTable.Columns {
+		if len(targetTable.Columns) <= idx {
+			alterSQL, err := addColumnSQL(targetTable, inCol)
+			if err != nil {
+				errors = multierror.Append(errors, err)
+				continue
+			}
+			columnOps = append(columnOps, alterSQL)
+			continue
+		}
+
+		targetCol := targetTable.Columns[idx]
+		err := checkColumn(inCol, targetCol)
+		if err != nil {
+			errors = multierror.Append(errors, err)
+		}
+
+	}
+	return columnOps, errors
+}
+
+func checkColumnsWithoutOrdering(inputTable, targetTable Table) ([]string, error) {
+	var columnOps []string
+	var errors error
+
+	for _, inCol := range inputTable.Columns {
+		foundMatching := false
+		for _, targetCol := range targetTable.Columns {
+			if columnKey(inCol.Name) == columnKey(targetCol.Name) {
+				foundMatching = true
+				if err := checkColumn(inCol, targetCol); err != nil {
+					errors = multierror.Append(errors, err)
+				}
+			}
+		}
+		if !foundMatching {
+			alterSQL, err := addColumnSQL(targetTable, inCol)
+			if err != nil {
+				errors = multierror.Append(errors, err)
+				continue
+			}
+			columnOps = append(columnOps, alterSQL)
+		}
+	}
+	return columnOps, errors
+}
+
+// addColumnSQL returns the statement adding a column missing from the target table.
+// The existing rows need a value for a NOT NULL column, so it must have a default.
+func addColumnSQL(targetTable Table, inCol ColInfo) (string, error) {
+	logger.GetLogger().InfoD("missing-column", kvlogger.M{
+		"schema": targetTable.Meta.Schema, "table": targetTable.Name, "column": inCol.Name,
+	})
+	if inCol.NotNull && inCol.DefaultVal == "" {
+		return "", fmt.Errorf("can't add NOT NULL column %s to %s.%s without a defaultval for the existing rows",
+			inCol.Name, targetTable.Meta.Schema, targetTable.Name)
+	}
+	return fmt.Sprintf(`ALTER TABLE "%s"."%s" ADD COLUMN %s`, targetTable.Meta.Schema, targetTable.Name, getColumnSQL(inCol)), nil
+}
+
+func checkColumn(inCol ColInfo, targetCol ColInfo) error {
+	var errors error
+	mismatchedTemplate := "mismatched column: %s property: %s, input: %v, target: %v"
+	if columnKey(inCol.Name) != columnKey(targetCol.Name) {
+		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "Name", inCol.Name, targetCol.Name))
+	}
+	if typeMapping[inCol.Type] != targetCol.Type {
+		if strings.HasPrefix(typeMapping[inCol.Type], "character varying") && strings.HasPrefix(targetCol.Type, "character varying") {
+			// If they are both varchars but differing values, we will ignore this, widenColumnOps handles it
+		} else if typeMapping[inCol.Type] == "bigint" && targetCol.Type == "integer" {
+			errors = multierror.Append(errors, fmt.Errorf("can't widen column %s from integer to bigint: redshift only supports altering varchar sizes, the table must be rebuilt", inCol.Name))
+		} else {
+			errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "Type", typeMapping[inCol.Type], targetCol.Type))
+		}
+	}
+	if inCol.DefaultVal != targetCol.DefaultVal {
+		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "DefaultVal", inCol.DefaultVal, targetCol.DefaultVal))
+	}
+	if inCol.NotNull != targetCol.NotNull {
+		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "NotNull", inCol.NotNull, targetCol.NotNull))
+	}
+	if inCol.PrimaryKey != targetCol.PrimaryKey {
+		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "PrimaryKey", inCol.PrimaryKey, targetCol.PrimaryKey))
+	}
+	// distkey & sortkey are compared for the table as a whole in checkKeys
+	return errors
+}
+
+// keyColumns returns the name of the table's distkey column (if any) and its sortkey columns in order
+func keyColumns(table Table) (string, []string) {
+	distKey := ""
+	sortCols := map[int]string{}
+	for _, c := range table.Columns {
+		if c.DistKey {
+			distKey = c.Name
+		}
+		if c.SortOrdinal > 0 {
+			sortCols[c.SortOrdinal] = c.Name
+		}
+	}
+	var sortKey []string
+	for i := 1; i <= len(sortCols); i++ {
+		sortKey = append(sortKey, sortCols[i])
+	}
+	return distKey, sortKey
+}
+
+// checkKeys compares the distkey and sortkey of the input table's config against the live target
+// table. It's ok if the config doesn't specify them, but they should at least not disagree: the
+// distkey must match and the configured sortkey columns must lead the live sortkey.
+// Keys on columns which don't exist in the target yet are left to the ALTER which adds them.
+func checkKeys(inputTable, targetTable Table) error {
+	var errors error
+	inDist, inSort := keyColumns(inputTable)
+	targetDist, targetSort := keyColumns(targetTable)
+	targetCols := map[string]bool{}
+	for _, c := range targetTable.Columns {
+		targetCols[columnKey(c.Name)] = true
+	}
+	if !targetCols[columnKey(inDist)] {
+		inDist = ""
+	}
+	for _, c := range inSort {
+		if !targetCols[columnKey(c)] {
+			inSort = nil
+			break
+		}
+	}
+
+	if inDist != "" && columnKey(inDist) != columnKey(targetDist) {
+		errors = multierror.Append(errors, fmt.Errorf("mismatched distkey, config: %s, table: %s", inDist, targetDist))
+	}
+	// a table with a one column sortkey looks the same either way
+	if len(inSort) > 1 && len(targetSort) > 1 && styleOrCompound(inputTable) != styleOrCompound(targetTable) {
+		errors = multierror.Append(errors, fmt.Errorf("mismatched sortkey style, config: %s, table: %s",
+			styleOrCompound(inputTable), styleOrCompound(targetTable)))
+	}
+	if len(inSort) > 0 {
+		matches := len(inSort) <= len(targetSort)
+		for i := 0; matches && i < len(inSort); i++ {
+			matches = columnKey(inSort[i]) == columnKey(targetSort[i])
+		}
+		if !matches {
+			errors = multierror.Append(errors, fmt.Errorf("mismatched sortkey, config: (%s), table: (%s)",
+				strings.Join(inSort, ", "), strings.Join(targetSort, ", ")))
+		}
+	}
+	return errors
+}
+
+// styleOrCompound returns the sortkey style of the table, which is compound unless it's set
+func styleOrCompound(table Table) string {
+	if table.Meta.SortKeyStyle == "" {
+		return SortKeyCompound
+	}
+	return table.Meta.SortKeyStyle
+}
+
+// credentialsSQL returns the authorization clause for a COPY from the bucket, preferring the
+// IAM role and falling back to access keys, including the session token for temporary credentials
+func credentialsSQL(b s3filepath.S3Bucket) string {
+	if b.RedshiftRoleARN != "" {
+		return fmt.Sprintf(`IAM_ROLE '%s'`, b.RedshiftRoleARN)
+	}
+	creds := fmt.Sprintf("aws_access_key_id=%s;aws_secret_access_key=%s", b.AccessID, b.SecretKey)
+	if b.Token != "" {
+		creds += fmt.Sprintf(";token=%s", b.Token)
+	}
+	return fmt.Sprintf(`CREDENTIALS '%s'`, creds)
+}
+
+// updateSQL returns the STATUPDATE and COMPUPDATE options for a table's COPY. Options the table
+// doesn't set are left out, for redshift's defaults, except STATUPDATE ON when statUpdate is set
+func updateSQL(meta Meta, statUpdate bool) string {
+	onOff := func(on bool) string {
+		if on {
+			return "ON"
+		}
+		return "OFF"
+	}
+	var options []string
+	if meta.StatUpdate != nil {
+		options = append(options, "STATUPDATE "+onOff(*meta.StatUpdate))
+	} else if statUpdate {
+		options = append(options, "STATUPDATE ON")
+	}
+	if meta.CompUpdate != nil {
+		options = append(options, "COMPUPDATE "+onOff(*meta.CompUpdate))
+	}
+	return strings.Join(options, " ")
+}
+
+// Copy copies either CSV or JSON data present in an S3 file into a redshift table.
+// It also supports CSV or JSON data pointed at by a manifest file, if you pass in a manifest file.
+// this is meant to be run in a transaction, so the first arg must be a sql.Tx
+// JSON is matched up with the columns by name, unless inputTable.Meta.JSONPaths has a jsonpaths file
+// maxError is the number of rows redshift may reject before failing the load, 0 means none
+// the compression option comes from s3File.Compression, the time and date formats from inputTable.Meta
+// It returns the number of rows loaded
+func (r *Redshift) Copy(tx *sql.Tx, f s3filepath.S3File, inputTable Table, delimiter string, creds bool, maxError int) (int64, error) {
+	return r.CopyInto(tx, fmt.Sprintf(`"%s"."%s"`, f.Schema, f.Table), f, inputTable, delimiter, creds, maxError)
+}
+
+// CopyInto is Copy, but loads into the given (already quoted) destination table rather than
+// the one the s3 file belongs to, e.g. a staging table
+func (r *Redshift) CopyInto(tx *sql.Tx, dest string, f s3filepath.S3File, inputTable Table, delimiter string, creds bool, maxError int) (int64, error) {
+	var credSQL string
+	if creds {
+		credSQL = credentialsSQL(f.Bucket)
+	}
+	manifestSQL := ""
+	if f.Suffix == "manifest" {
+		manifestSQL = "manifest"
+	}
+	maxErrorSQL := ""
+	if maxError > 0 {
+		maxErrorSQL = fmt.Sprintf("MAXERROR %d", maxError)
+	}
+	timeFormat := "auto"
+	if inputTable.Meta.TimeFormat != "" {
+		timeFormat = inputTable.Meta.TimeFormat
+	}
+	dateFormatSQL := ""
+	if inputTable.Meta.DateFormat != "" {
+		dateFormatSQL = fmt.Sprintf("DATEFORMAT %s", quoteLiteral(inputTable.Meta.DateFormat))
+	}
+	truncateSQL := "TRUNCATECOLUMNS"
+	if inputTable.Meta.TruncateColumns != nil && !*inputTable.Meta.TruncateColumns {
+		truncateSQL = ""
+	}
+	if inputTable.Meta.AcceptInvChars != "" {
+		truncateSQL += fmt.Sprintf(" ACCEPTINVCHARS AS %s", quoteLiteral(inputTable.Meta.AcceptInvChars))
+	}
+	// backslashes are escapes in redshift's string literals, so e.g. \N has to be doubled up
+	if inputTable.Meta.NullAs != "" {
+		truncateSQL += fmt.Sprintf(" NULL AS %s", quoteLiteral(strings.Replace(inputTable.Meta.NullAs, `\`, `\\`, -1)))
+	}
+
+	nullSQL := "EMPTYASNULL"
+	if inputTable.Meta.EmptyAsNull != nil && !*inputTable.Meta.EmptyAsNull {
+		nullSQL = ""
+	}
+	if inputTable.Meta.BlanksAsNull {
+		nullSQL += " BLANKSASNULL"
+	}
+
+	// default to CSV
+	jsonSQL := ""
+	jsonPathsSQL := ""
+	// always removequotes, UNLOAD should add quotes
+	// always say escape for CSVs, UNLOAD should always escape
+	delimSQL := fmt.Sprintf("DELIMITER AS '%s' REMOVEQUOTES ESCAPE TRIMBLANKS %s ACCEPTANYDATE", delimiter, nullSQL)
+	// data from elsewhere may quote its fields with something else, which is CSV to COPY
+	if q := inputTable.Meta.Quote; q != "" {
+		delimSQL = fmt.Sprintf("CSV QUOTE AS %s DELIMITER AS %s TRIMBLANKS %s ACCEPTANYDATE", quoteLiteral(q), quoteLiteral(delimiter), nullSQL)
+	}
+	// figure out if we're doing JSON - no delim means JSON
+	if delimiter == "" {
+		jsonSQL = "JSON"
+		jsonPathsSQL = "'auto'"
+		if inputTable.Meta.JSONPaths != "" {
+			jsonPathsSQL = quoteLiteral(inputTable.Meta.JSONPaths)
+		}
+		delimSQL = ""
+	}
+	if inputTable.Meta.ColumnList {
+		dest += columnListSQL(inputTable)
+	}
+	copySQL := fmt.Sprintf(`COPY %s FROM '%s' WITH %s %s %s REGION '%s' TIMEFORMAT %s %s %s %s %s %s %s %s`,
+		dest, f.GetDataFilename(), f.Compression, jsonSQL, jsonPathsSQL, f.Bucket.Region, quoteLiteral(timeFormat),
+		truncateSQL, updateSQL(inputTable.Meta, true), manifestSQL, credSQL, delimSQL, maxErrorSQL, dateFormatSQL)
+	if r.dryRunSkip(copySQL) {
+		return 0, nil
+	}
+	session, err := r.copySession(tx)
+	if err != nil {
+		return 0, err
+	}
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": copySQL})
+	// can't use prepare b/c of redshift-specific syntax that postgres does not like
+	if _, err := tx.ExecContext(r.ctx, copySQL); err != nil {
+		return 0, r.copyError(f, session, err)
+	}
+
+	if maxError > 0 {
+		var rejected int
+		if err := tx.QueryRowContext(r.ctx, rejectedRowsQuery).Scan(&rejected); err != nil {
+			return 0, fmt.Errorf("issue counting rejected rows: %w", err)
+		}
+		if rejected > 0 {
+			logger.GetLogger().WarnD("copy-rejected-rows", kvlogger.M{
+				"schema": f.Schema, "table": f.Table, "rejected": rejected, "max_errors": maxError,
+			})
+		}
+	}
+	return r.LastCopyCount(tx)
+}
+
+// Formats UNLOAD can write. UnloadFormatText is pipe delimited, quoted and escaped text, which is
+// what Copy expects for CSV files, so the result can be loaded back in as-is.
+const (
+	UnloadFormatText    = ""
+	UnloadFormatCSV     = "CSV"
+	UnloadFormatParquet = "PARQUET"
+)
+
+// UnloadOptions are the options for Unload. Bucket supplies the credentials, region and KMS key,
+// in the same way as for Copy.
+type UnloadOptions struct {
+	Bucket   s3filepath.S3Bucket
+	Format   string
+	Parallel bool
+	GZip     bool
+}
+
+// Unload exports the results of the query to files in S3 starting with the s3prefix, the reverse of Copy.
+// With Parallel each slice writes its own files, otherwise they're written serially by one.
+// Parquet files are always compressed, so GZip can't be used with them.
+func (r *Redshift) Unload(tx *sql.Tx, query, s3prefix string, opts UnloadOptions) error {
+	var formatSQL string
+	switch opts.Format {
+	case UnloadFormatText:
+		formatSQL = "DELIMITER AS '|' ADDQUOTES ESCAPE"
+	case UnloadFormatCSV:
+		formatSQL = "FORMAT AS CSV"
+	case UnloadFormatParquet:
+		if opts.GZip {
+			return fmt.Errorf("parquet unloads can't be gzipped")
+		}
+		formatSQL = "FORMAT AS PARQUET"
+	default:
+		return fmt.Errorf("unsupported unload format %s, must be one of CSV or PARQUET, or empty for text", opts.Format)
+	}
+	parallelSQL := "PARALLEL OFF"
+	if opts.Parallel {
+		parallelSQL = "PARALLEL ON"
+	}
+	gzipSQL := ""
+	if opts.GZip {
+		gzipSQL = "GZIP"
+	}
+	regionSQL := ""
+	if opts.Bucket.Region != "" {
+		regionSQL = fmt.Sprintf("REGION '%s'", opts.Bucket.Region)
+	}
+	kmsSQL := ""
+	if opts.Bucket.KMSKeyARN != "" {
+		kmsSQL = fmt.Sprintf("KMS_KEY_ID '%s' ENCRYPTED", opts.Bucket.KMSKeyARN)
+	}
+
+	unloadSQL := fmt.Sprintf(`UNLOAD (%s) TO '%s' %s %s %s %s %s %s`, quoteLiteral(query), s3prefix,
+		credentialsSQL(opts.Bucket), formatSQL, parallelSQL, gzipSQL, regionSQL, kmsSQL)
+	if r.dryRunSkip(unloadSQL) {
+		return nil
+	}
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": unloadSQL})
+	if _, err := tx.ExecContext(r.ctx, unloadSQL); err != nil {
+		return fmt.Errorf("issue running unload: %w", err)
+	}
+	return nil
+}
+
+// quoteLiteral single quotes a string for use in SQL, escaping any quotes in it
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// LastCopyCount returns the number of rows loaded by the last COPY run in the transaction
+func (r *Redshift) LastCopyCount(tx *sql.Tx) (int64, error) {
+	if r.dryRun {
+		return 0, nil
+	}
+	var count int64
+	if err := tx.QueryRowContext(r.ctx, lastCopyCountQuery).Scan(&count); err != nil {
+		return 0, fmt.Errorf("issue running query: %s, err: %w", lastCopyCountQuery, err)
+	}
+	return count, nil
+}
+
+// ParquetCopy copies Parquet data present in an S3 file (or pointed at by a manifest) into a
+// redshift table. Parquet is columnar and self-describing, and redshift maps its columns onto the
+// table by position, so we warn loudly if the config ordering doesn't line up with the live table.
+// this is meant to be run in a transaction, so the first arg must be a sql.Tx
+// It returns the number of rows loaded
+func (r *Redshift) ParquetCopy(tx *sql.Tx, f s3filepath.S3File, inputTable Table, targetTable *Table) (int64, error) {
+	return r.ParquetCopyInto(tx, fmt.Sprintf(`"%s"."%s"`, f.Schema, f.Table), f, inputTable, targetTable)
+}
+
+// ParquetCopyInto is ParquetCopy, but loads into the given (already quoted) destination table
+// rather than the one the s3 file belongs to, e.g. a staging table
+func (r *Redshift) ParquetCopyInto(tx *sql.Tx, dest string, f s3filepath.S3File, inputTable Table, targetTable *Table) (int64, error) {
+	if targetTable != nil {
+		for _, mismatch := range parquetOrderMismatches(inputTable, *targetTable) {
+			logger.GetLogger().WarnD("parquet-column-order-mismatch", kvlogger.M{
+				"schema": f.Schema, "table": f.Table, "mismatch": mismatch,
+			})
+		}
+	}
+	manifestSQL := ""
+	if f.Suffix == "manifest" {
+		manifestSQL = "manifest"
+	}
+	// nested parquet columns can only be loaded into super columns as JSON
+	serializeSQL := ""
+	for _, c := range inputTable.Columns {
+		if c.Type == "super" {
+			serializeSQL = "SERIALIZETOJSON"
+			break
+		}
+	}
+	// like any COPY, it fails confusingly without the bucket's region if that isn't the cluster's
+	copySQL := fmt.Sprintf(`COPY %s FROM '%s' REGION '%s' %s FORMAT AS PARQUET %s %s %s`,
+		dest, f.GetDataFilename(), f.Bucket.Region, credentialsSQL(f.Bucket), serializeSQL, manifestSQL, updateSQL(inputTable.Meta, false))
+	if r.dryRunSkip(copySQL) {
+		return 0, nil
+	}
+	session, err := r.copySession(tx)
+	if err != nil {
+		return 0, err
+	}
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": copySQL})
+	if _, err := tx.ExecContext(r.ctx, copySQL); err != nil {
+		return 0, r.copyError(f, session, err)
+	}
+	return r.LastCopyCount(tx)
+}
+
+// parquetOrderMismatches returns a description of every position where the input table's column
+// does not match the target table's column, since parquet columns are loaded positionally.
+func parquetOrderMismatches(inputTable, targetTable Table) []string {
+	var mismatches []string
+	for idx, inCol := range inputTable.Columns {
+		if idx >= len(targetTable.Columns) {
+			break
+		}
+		if targetCol := targetTable.Columns[idx]; inCol.Name != targetCol.Name {
+			mismatches = append(mismatches, fmt.Sprintf("position %d, input: %s, target: %s", idx, inCol.Name, targetCol.Name))
+		}
+	}
+	return mismatches
+}
+
+// LoadErrors returns the rows rejected by the most recent COPY of files under the s3 file's folder
+// run in the session (its pg_backend_pid()) since the given time, i.e. by a COPY which has just
+// failed. A COPY which failed without rejecting any rows, e.g. for access denied, has none.
+// A failed COPY aborts its transaction, so this runs on its own connection rather than in the tx -
+// stl_load_errors is written regardless of whether the load is rolled back.
+func (r *Redshift) LoadErrors(f s3filepath.S3File, session int, since time.Time, limit int) ([]LoadError, error) {
+	prefix := fmt.Sprintf("s3://%s/%s/", f.Bucket.Name, f.Subfolder)
+	q := fmt.Sprintf(loadErrorsQueryFormat, session, since.UTC().Format("2006-01-02 15:04:05"), prefix, limit)
+	rows, err := r.QueryContext(r.ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("issue running load errors query: %s, err: %w", q, err)
+	}
+	defer rows.Close()
+	var loadErrors []LoadError
+	for rows.Next() {
+		var e LoadError
+		if err := rows.Scan(&e.LineNumber, &e.ColName, &e.RawFieldValue, &e.ErrReason); err != nil {
+			return nil, fmt.Errorf("issue scanning load error, err: %w", err)
+		}
+		loadErrors = append(loadErrors, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("issue iterating over load errors, err: %w", err)
+	}
+	return loadErrors, nil
+}
+
+// copySession is the session a COPY runs in and when it started, to tell its rows in
+// stl_load_errors from those of earlier loads
+type copySession struct {
+	pid   int
+	start time.Time
+}
+
+// copySession returns the transaction's session and redshift's time, before running a COPY in it
+func (r *Redshift) copySession(tx *sql.Tx) (copySession, error) {
+	var s copySession
+	if err := tx.QueryRowContext(r.ctx, copySessionQuery).Scan(&s.pid, &s.start); err != nil {
+		return s, fmt.Errorf("issue running query: %s, err: %w", copySessionQuery, err)
+	}
+	return s, nil
+}
+
+// copyError returns a failed COPY's error as a CopyError, with the details redshift recorded in
+// stl_load_errors for it
+func (r *Redshift) copyError(f s3filepath.S3File, session copySession, copyErr error) error {
+	// redshift's access denied for a KMS encrypted object doesn't mention KMS at all
+	if f.Bucket.KMSKeyARN != "" && strings.Contains(strings.ToLower(copyErr.Error()), "access denied") {
+		copyErr = fmt.Errorf("%w (the data is encrypted with KMS key %s, check the copy credentials are allowed to kms:Decrypt with it)",
+			copyErr, f.Bucket.KMSKeyARN)
+	}
+	loadErrors, err := r.LoadErrors(f, session.pid, session.start, maxLoadErrorsReported)
+	if err != nil {
+		logger.GetLogger().WarnD("load-errors-lookup-failed", kvlogger.M{
+			"file": f.GetDataFilename(), "error": err.Error(),
+		})
+	}
+	return &CopyError{File: f.GetDataFilename(), LoadErrors: loadErrors, Err: copyErr}
 }
 
-// checkSchemas takes in two tables and compares their column schemas to make sure they're compatible.
-// If they have any mismatched columns they are returned in the errors array. If the input table has
-// columns at the end that the target table does not then the appropriate alter tables sql commands are
-// returned.
-func checkSchemas(inputTable, targetTable Table) ([]string, error) {
-	// If the schema is mongo_raw then we know the input files are json so ordering doesn't matter. At
-	// some point we could handle this in a more general way by checking if the input files are json.
-	// This wouldn't be too hard, but we would have to peak in the manifest file to check if all the
-	// files references are json.
-	if targetTable.Meta.Schema == "mongo_raw" {
-		return checkColumnsWithoutOrdering(inputTable, targetTable)
+// CreateStagingTable creates a temporary table with the same columns as the given table, which
+// loads can be copied into before being merged into the table. Temporary tables only live for the
+// session, so they don't clash with other runs and are cleaned up even if the load fails.
+// Returns the quoted staging table name.
+func (r *Redshift) CreateStagingTable(tx *sql.Tx, table Table) (string, error) {
+	staging := fmt.Sprintf(`"%s_staging"`, table.Name)
+	createSQL := fmt.Sprintf(`CREATE TEMP TABLE %s (LIKE "%s"."%s")`, staging, table.Meta.Schema, table.Name)
+	if r.dryRunSkip(createSQL) {
+		return staging, nil
 	}
-	return checkColumnsAndOrdering(inputTable, targetTable)
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": createSQL})
+	if _, err := tx.ExecContext(r.ctx, createSQL); err != nil {
+		return "", fmt.Errorf("issue creating staging table: %w", err)
+	}
+	return staging, nil
 }
 
-func checkColumnsAndOrdering(inputTable, targetTable Table) ([]string, error) {
-	var columnOps []string
-	var errors error
-	if len(inputTable.Columns) < len(targetTable.Columns) {
-		errors = multierror.Append(errors, fmt.Errorf("target table has more columns than the input table"))
+// CreateSwapTable creates a new table from the config alongside the table, to be loaded and then
+// swapped in for the table by SwapTable. Returns the new table's name, which is unique to the run.
+func (r *Redshift) CreateSwapTable(tx *sql.Tx, table Table) (string, error) {
+	suffix, err := stagingSuffix()
+	if err != nil {
+		return "", err
+	}
+	swap := table
+	swap.Name = fmt.Sprintf("%s_swap_%s", table.Name, suffix)
+	if err := r.CreateTable(tx, swap); err != nil {
+		return "", fmt.Errorf("issue creating swap table: %w", err)
 	}
+	return swap.Name, nil
+}
 
-	for idx, inCol := range inputTable.Columns {
-		if len(targetTable.Columns) <= idx {
-			log.Printf("Missing column -- running alter table\n")
-			alterSQL := fmt.Sprintf(`ALTER TABLE "%s"."%s" ADD COLUMN %s`, targetTable.Meta.Schema, targetTable.Name, getColumnSQL(inCol))
-			columnOps = append(columnOps, alterSQL)
+// SwapTable renames the table out of the way and the swap table into its place, so once the
+// transaction commits readers go straight from the old data to the new, never seeing it part
+// loaded. Returns the name the old table was renamed to, for dropping after the commit.
+func (r *Redshift) SwapTable(tx *sql.Tx, schema, table, swap string) (string, error) {
+	old := fmt.Sprintf("%s_old_%s", table, strings.TrimPrefix(swap, table+"_swap_"))
+	for _, op := range []string{
+		fmt.Sprintf(`ALTER TABLE "%s"."%s" RENAME TO "%s"`, schema, table, old),
+		fmt.Sprintf(`ALTER TABLE "%s"."%s" RENAME TO "%s"`, schema, swap, table),
+	} {
+		if r.dryRunSkip(op) {
 			continue
 		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": op})
+		if _, err := tx.ExecContext(r.ctx, op); err != nil {
+			return "", fmt.Errorf("issue swapping in table %s.%s: %w", schema, table, err)
+		}
+	}
+	return old, nil
+}
 
-		targetCol := targetTable.Columns[idx]
-		err := checkColumn(inCol, targetCol)
-		if err != nil {
-			errors = multierror.Append(errors, err)
+// RebuildTable recreates the target table from the input table's config, for when their distkey
+// or sortkey differ, which can't be altered in place: a new table is created with the config's
+// keys, the target's rows are copied into it with INSERT SELECT, and it's swapped in with
+// SwapTable. It's all in the transaction, so readers see the old table until it commits. Columns
+// of the target which aren't in the config would be lost, so they're an error. Returns the name
+// the old table was renamed to, for dropping after the commit.
+func (r *Redshift) RebuildTable(tx *sql.Tx, inputTable, targetTable Table) (string, error) {
+	inputCols := map[string]bool{}
+	for _, c := range inputTable.Columns {
+		inputCols[columnKey(c.Name)] = true
+	}
+	var cols, missing []string
+	for _, c := range targetTable.Columns {
+		if !inputCols[columnKey(c.Name)] {
+			missing = append(missing, c.Name)
+			continue
+		}
+		cols = append(cols, fmt.Sprintf(`"%s"`, c.Name))
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("can't rebuild %s.%s, columns %s aren't in the config and would be lost",
+			targetTable.Meta.Schema, targetTable.Name, strings.Join(missing, ", "))
+	}
+	swap, err := r.CreateSwapTable(tx, inputTable)
+	if err != nil {
+		return "", err
+	}
+	colSQL := strings.Join(cols, ", ")
+	insertSQL := fmt.Sprintf(`INSERT INTO "%s"."%s" (%s) SELECT %s FROM "%s"."%s"`,
+		inputTable.Meta.Schema, swap, colSQL, colSQL, targetTable.Meta.Schema, targetTable.Name)
+	if !r.dryRunSkip(insertSQL) {
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": insertSQL})
+		if _, err := tx.ExecContext(r.ctx, insertSQL); err != nil {
+			return "", fmt.Errorf("issue copying rows into rebuilt table: %w", err)
 		}
+	}
+	return r.SwapTable(tx, targetTable.Meta.Schema, targetTable.Name, swap)
+}
 
+// GrantAccess grants SELECT on the table to each of the config's grantees. Granting a privilege
+// that's already held does nothing, so this can run on every load.
+func (r *Redshift) GrantAccess(tx *sql.Tx, table Table) error {
+	for _, grantee := range table.Meta.Grants {
+		match := granteeRegex.FindStringSubmatch(grantee)
+		if match == nil {
+			return fmt.Errorf("invalid grantee %q", grantee)
+		}
+		to := fmt.Sprintf(`"%s"`, match[2])
+		if match[1] != "" {
+			to = match[1] + " " + to
+		}
+		grantSQL := fmt.Sprintf(`GRANT SELECT ON "%s"."%s" TO %s`, table.Meta.Schema, table.Name, to)
+		if r.dryRunSkip(grantSQL) {
+			continue
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": grantSQL})
+		if _, err := tx.ExecContext(r.ctx, grantSQL); err != nil {
+			return fmt.Errorf("issue granting select on %s.%s to %s: %w", table.Meta.Schema, table.Name, grantee, err)
+		}
 	}
-	return columnOps, errors
+	return nil
 }
 
-func checkColumnsWithoutOrdering(inputTable, targetTable Table) ([]string, error) {
-	var columnOps []string
-	var errors error
+// DropTable drops the table in the transaction, or outside of any if tx is nil, e.g. the old
+// table after a swap
+func (r *Redshift) DropTable(tx *sql.Tx, schema, table string) error {
+	dropSQL := fmt.Sprintf(`DROP TABLE "%s"."%s"`, schema, table)
+	if r.dryRunSkip(dropSQL) {
+		return nil
+	}
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": dropSQL})
+	exec := r.ExecContext
+	if tx != nil {
+		exec = tx.ExecContext
+	}
+	if _, err := exec(r.ctx, dropSQL); err != nil {
+		return fmt.Errorf("issue dropping table %s.%s: %w", schema, table, err)
+	}
+	return nil
+}
 
-	for _, inCol := range inputTable.Columns {
-		foundMatching := false
-		for _, targetCol := range targetTable.Columns {
-			if inCol.Name == targetCol.Name {
-				foundMatching = true
-				if err := checkColumn(inCol, targetCol); err != nil {
-					errors = multierror.Append(errors, err)
-				}
-			}
+// MergeStagingTable upserts the rows of the staging table into the target table: rows in the
+// target sharing a primary key with a staged row are deleted, then all staged rows are inserted.
+// The staging table is dropped afterwards. The primary key comes from the table config.
+func (r *Redshift) MergeStagingTable(tx *sql.Tx, staging string, table Table) error {
+	target := fmt.Sprintf(`"%s"."%s"`, table.Meta.Schema, table.Name)
+	var matches []string
+	for _, c := range table.Columns {
+		if c.PrimaryKey {
+			matches = append(matches, fmt.Sprintf(`%s."%s" = %s."%s"`, target, c.Name, staging, c.Name))
 		}
-		if !foundMatching {
-			log.Printf("Missing column -- running alter table\n")
-			alterSQL := fmt.Sprintf(`ALTER TABLE "%s"."%s" ADD COLUMN %s`,
-				targetTable.Meta.Schema, targetTable.Name, getColumnSQL(inCol))
-			columnOps = append(columnOps, alterSQL)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("table %s has no primary key columns to merge on", target)
+	}
+
+	for _, op := range []string{
+		fmt.Sprintf(`DELETE FROM %s USING %s WHERE %s`, target, staging, strings.Join(matches, " AND ")),
+		fmt.Sprintf(`INSERT INTO %s SELECT * FROM %s`, target, staging),
+		fmt.Sprintf(`DROP TABLE %s`, staging),
+	} {
+		if r.dryRunSkip(op) {
+			continue
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": op})
+		if _, err := tx.ExecContext(r.ctx, op); err != nil {
+			return fmt.Errorf("issue running statement %s: %w", op, err)
 		}
 	}
-	return columnOps, errors
+	return nil
 }
 
-func checkColumn(inCol ColInfo, targetCol ColInfo) error {
+// DedupStagingTable removes duplicate rows from the staging table before they're inserted into
+// the table. With the config's dedup key, only the row with the latest data date is kept for each
+// key, otherwise only exact duplicates are removed. The deduped rows are put in a temporary
+// table while the staging table is emptied and refilled from it.
+func (r *Redshift) DedupStagingTable(tx *sql.Tx, staging string, table Table) error {
+	var names, keys []string
+	for _, c := range table.Columns {
+		names = append(names, fmt.Sprintf(`"%s"`, c.Name))
+	}
+	for _, k := range table.Meta.DedupKey {
+		keys = append(keys, fmt.Sprintf(`"%s"`, k))
+	}
+	cols := strings.Join(names, ", ")
+	selectSQL := fmt.Sprintf(`SELECT DISTINCT %s FROM %s`, cols, staging)
+	if len(keys) > 0 {
+		selectSQL = fmt.Sprintf(`SELECT %s FROM (SELECT %s, ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s DESC) AS "_dedup_row" FROM %s) AS deduped WHERE "_dedup_row" = 1`,
+			cols, cols, strings.Join(keys, ", "), table.Meta.dataDateSQL(), staging)
+	}
+	deduped := fmt.Sprintf(`"%s_dedup"`, table.Name)
+	for _, op := range []string{
+		fmt.Sprintf(`CREATE TEMP TABLE %s AS %s`, deduped, selectSQL),
+		fmt.Sprintf(`DELETE FROM %s`, staging),
+		fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s`, staging, cols, cols, deduped),
+		fmt.Sprintf(`DROP TABLE %s`, deduped),
+	} {
+		if r.dryRunSkip(op) {
+			continue
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": op})
+		if _, err := tx.ExecContext(r.ctx, op); err != nil {
+			return fmt.Errorf("issue running statement %s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// InsertStagingTable inserts all the rows of the staging table into the target table, then drops
+// the staging table.
+func (r *Redshift) InsertStagingTable(tx *sql.Tx, staging string, table Table) error {
+	for _, op := range []string{
+		fmt.Sprintf(`INSERT INTO "%s"."%s" SELECT * FROM %s`, table.Meta.Schema, table.Name, staging),
+		fmt.Sprintf(`DROP TABLE %s`, staging),
+	} {
+		if r.dryRunSkip(op) {
+			continue
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": op})
+		if _, err := tx.ExecContext(r.ctx, op); err != nil {
+			return fmt.Errorf("issue running statement %s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// AppendTable moves all the rows of the source table into the target table with ALTER TABLE
+// APPEND, which moves the data blocks rather than copying rows, so it's much faster than INSERT
+// SELECT (the source table is left empty). The tables' columns are checked first, as redshift
+// requires them to match and its own error doesn't say how they differ.
+// ALTER TABLE APPEND can't run inside a transaction and commits immediately, so unlike most
+// methods this doesn't take one.
+func (r *Redshift) AppendTable(sourceTable, targetTable Table) error {
+	if err := checkAppendable(sourceTable, targetTable); err != nil {
+		return fmt.Errorf("can't append %s.%s to %s.%s: %w",
+			sourceTable.Meta.Schema, sourceTable.Name, targetTable.Meta.Schema, targetTable.Name, err)
+	}
+	appendSQL := fmt.Sprintf(`ALTER TABLE "%s"."%s" APPEND FROM "%s"."%s"`,
+		targetTable.Meta.Schema, targetTable.Name, sourceTable.Meta.Schema, sourceTable.Name)
+	if r.dryRunSkip(appendSQL) {
+		return nil
+	}
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": appendSQL})
+	if _, err := r.ExecContext(r.ctx, appendSQL); err != nil {
+		return fmt.Errorf("issue running statement %s: %w", appendSQL, err)
+	}
+	return nil
+}
+
+// checkAppendable returns the ways in which two tables' definitions differ that would stop
+// ALTER TABLE APPEND between them: they need the same columns, by name, with the same types and
+// nullability, and the same distkey and sortkey. The tables can be from a config or redshift.
+func checkAppendable(sourceTable, targetTable Table) error {
 	var errors error
-	mismatchedTemplate := "mismatched column: %s property: %s, input: %v, target: %v"
-	if inCol.Name != targetCol.Name {
-		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "Name", inCol.Name, targetCol.Name))
+	targetCols := map[string]ColInfo{}
+	for _, c := range targetTable.Columns {
+		targetCols[c.Name] = c
 	}
-	if typeMapping[inCol.Type] != targetCol.Type {
-		if strings.HasPrefix(typeMapping[inCol.Type], "character varying") && strings.HasPrefix(typeMapping[inCol.Type], "character varying") {
-			// If they are both varchars but differing values, we will ignore this
-		} else {
-			errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "Type", typeMapping[inCol.Type], targetCol.Type))
+	sourceCols := map[string]bool{}
+	for _, sourceCol := range sourceTable.Columns {
+		sourceCols[sourceCol.Name] = true
+		targetCol, ok := targetCols[sourceCol.Name]
+		if !ok {
+			errors = multierror.Append(errors, fmt.Errorf("column %s is only in the source table", sourceCol.Name))
+			continue
+		}
+		if sourceType, targetType := redshiftType(sourceCol.Type), redshiftType(targetCol.Type); sourceType != targetType {
+			errors = multierror.Append(errors, fmt.Errorf("column %s has type %s in the source table but %s in the target table",
+				sourceCol.Name, sourceType, targetType))
+		}
+		if sourceCol.NotNull != targetCol.NotNull {
+			errors = multierror.Append(errors, fmt.Errorf("column %s has not null %t in the source table but %t in the target table",
+				sourceCol.Name, sourceCol.NotNull, targetCol.NotNull))
 		}
 	}
-	if inCol.DefaultVal != targetCol.DefaultVal {
-		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "DefaultVal", inCol.DefaultVal, targetCol.DefaultVal))
+	for _, c := range targetTable.Columns {
+		if !sourceCols[c.Name] {
+			errors = multierror.Append(errors, fmt.Errorf("column %s is only in the target table", c.Name))
+		}
 	}
-	if inCol.NotNull != targetCol.NotNull {
-		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "NotNull", inCol.NotNull, targetCol.NotNull))
+
+	sourceDistKey, sourceSortKey := keyColumns(sourceTable)
+	targetDistKey, targetSortKey := keyColumns(targetTable)
+	if sourceDistKey != targetDistKey {
+		errors = multierror.Append(errors, fmt.Errorf("distkey is %q in the source table but %q in the target table", sourceDistKey, targetDistKey))
 	}
-	if inCol.PrimaryKey != targetCol.PrimaryKey {
-		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "PrimaryKey", inCol.PrimaryKey, targetCol.PrimaryKey))
+	if strings.Join(sourceSortKey, ",") != strings.Join(targetSortKey, ",") {
+		errors = multierror.Append(errors, fmt.Errorf("sortkey is (%s) in the source table but (%s) in the target table",
+			strings.Join(sourceSortKey, ", "), strings.Join(targetSortKey, ", ")))
+	}
+	return errors
+}
+
+// redshiftType returns the redshift type for a config type, e.g. "character varying(256)" for
+// "text", or the type itself if it's already a redshift type
+func redshiftType(t string) string {
+	if mapped, ok := typeMapping[t]; ok {
+		return mapped
+	}
+	return t
+}
+
+// ParallelCopy spreads a big load over several COPYs running at once: each part (usually one of
+// the manifests from s3filepath.CreateManifestFiles) is copied into its own new staging table,
+// in its own transaction. The staging tables are in the staging schema (see SetStagingSchema),
+// or alongside the table, and named <table>_part<N>_<suffix>, where the suffix is unique to the
+// call so that runs loading the same table at once don't collide. Each transaction is begun with
+// the isolation level and the session parameters, the same as the load's, and given the statement
+// timeout, if it's set. If any of them fails, all the staging tables are dropped, and if one of them
+// timed out the error is a *StatementTimeoutError. Returns the quoted staging table names, for AppendStaging, and
+// the total number of rows copied.
+func (r *Redshift) ParallelCopy(parts []s3filepath.S3File, table Table, delimiter string, maxError int, level sql.IsolationLevel, timeout time.Duration) ([]string, int64, error) {
+	stagingSchema := table.Meta.Schema
+	if r.stagingSchema != "" {
+		stagingSchema = r.stagingSchema
+	}
+	suffix, err := stagingSuffix()
+	if err != nil {
+		return nil, 0, err
+	}
+	staging := make([]string, len(parts))
+	counts := make([]int64, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i := range parts {
+		stagingTable := table
+		stagingTable.Name = fmt.Sprintf("%s_part%d_%s", table.Name, i, suffix)
+		stagingTable.Meta.Schema = stagingSchema
+		staging[i] = fmt.Sprintf(`"%s"."%s"`, stagingSchema, stagingTable.Name)
+		wg.Add(1)
+		go func(i int, stagingTable Table) {
+			defer wg.Done()
+			counts[i], errs[i] = r.copyPart(parts[i], stagingTable, staging[i], delimiter, maxError, level, timeout)
+		}(i, stagingTable)
+	}
+	wg.Wait()
+
+	var errors error
+	var rows int64
+	timedOut := false
+	for i, err := range errs {
+		if err != nil {
+			errors = multierror.Append(errors, fmt.Errorf("issue copying %s: %w", parts[i].GetDataFilename(), err))
+			timedOut = timedOut || IsStatementTimeoutError(err)
+		}
+		rows += counts[i]
+	}
+	if errors != nil {
+		if err := r.DropStaging(staging); err != nil {
+			errors = multierror.Append(errors, err)
+		}
+		// the multierror doesn't unwrap, so errors.Is can't find a part's timeout through it
+		if timedOut {
+			return nil, 0, &StatementTimeoutError{Err: errors}
+		}
+		return nil, 0, errors
+	}
+	return staging, rows, nil
+}
+
+// stagingSuffix returns a suffix for staging table names which is unique to this process and call:
+// the process ID and some random hex
+func stagingSuffix() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("issue generating staging table name: %w", err)
+	}
+	return fmt.Sprintf("%d_%x", os.Getpid(), b), nil
+}
+
+// copyPart creates the staging table and copies the part into it, all in one transaction
+func (r *Redshift) copyPart(part s3filepath.S3File, stagingTable Table, staging, delimiter string, maxError int, level sql.IsolationLevel, timeout time.Duration) (int64, error) {
+	tx, err := r.BeginIsolated(level)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if timeout > 0 {
+		if err := r.SetStatementTimeout(tx, timeout); err != nil {
+			return 0, err
+		}
 	}
-	// for distkey & sortkey it's ok if the source doesn't have them, but they should at least not disagree
-	if inCol.DistKey && inCol.DistKey != targetCol.DistKey {
-		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "DistKey", inCol.DistKey, targetCol.DistKey))
+
+	if err := r.CreateTable(tx, stagingTable); err != nil {
+		return 0, fmt.Errorf("issue creating staging table: %w", err)
+	}
+	count, err := r.CopyInto(tx, staging, part, stagingTable, delimiter, true, maxError)
+	if err != nil {
+		return 0, err
+	}
+	if r.dryRun {
+		return count, nil
+	}
+	return count, tx.Commit()
+}
+
+// AppendError is returned by AppendStaging when an append fails, with the staging tables which
+// weren't appended. They're kept, so the append can be finished by hand, or the load rerun.
+type AppendError struct {
+	Remaining []string
+	Err       error
+}
+
+func (e *AppendError) Error() string {
+	return fmt.Sprintf("%s, staging tables not appended: [%s]", e.Err, strings.Join(e.Remaining, ", "))
+}
+
+// Unwrap returns the error running the append
+func (e *AppendError) Unwrap() error { return e.Err }
+
+// AppendStaging moves the rows of each staging table from ParallelCopy into the table with
+// ALTER TABLE APPEND, which moves the data blocks rather than copying rows, then drops the
+// (now empty) staging tables. Columns the table has that the staging tables don't are filled
+// with their defaults.
+// ALTER TABLE APPEND can't run inside a transaction and commits as it goes, so readers see the
+// rows of each staging table as it's appended, and if one fails the table is left with the rows
+// of the staging tables appended before it. Only those are dropped, the rest are returned in an
+// *AppendError.
+func (r *Redshift) AppendStaging(staging []string, table Table) error {
+	target := fmt.Sprintf(`"%s"."%s"`, table.Meta.Schema, table.Name)
+	for i, s := range staging {
+		appendSQL := fmt.Sprintf(`ALTER TABLE %s APPEND FROM %s FILLTARGET`, target, s)
+		if r.dryRunSkip(appendSQL) {
+			continue
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": appendSQL})
+		if _, err := r.ExecContext(r.ctx, appendSQL); err != nil {
+			logger.GetLogger().ErrorD("staging-tables-not-appended", kvlogger.M{
+				"schema": table.Meta.Schema, "table": table.Name, "staging": staging[i:], "error": err.Error(),
+			})
+			// the appended tables are empty, so dropping them only tidies up, and mustn't hide the
+			// ones which weren't
+			if dropErr := r.DropStaging(staging[:i]); dropErr != nil {
+				logger.GetLogger().ErrorD("drop-staging-error", kvlogger.M{
+					"schema": table.Meta.Schema, "table": table.Name, "error": dropErr.Error(),
+				})
+			}
+			return &AppendError{
+				Remaining: staging[i:],
+				Err:       fmt.Errorf("issue appending %s, %d of %d staging tables were appended: %w", s, i, len(staging), err),
+			}
+		}
 	}
-	if inCol.SortOrdinal != 0 && inCol.SortOrdinal != targetCol.SortOrdinal {
-		errors = multierror.Append(errors, fmt.Errorf(mismatchedTemplate, inCol.Name, "SortOrdinal", inCol.SortOrdinal, targetCol.SortOrdinal))
+	return r.DropStaging(staging)
+}
+
+// DropStaging drops the staging tables from ParallelCopy, if they exist
+func (r *Redshift) DropStaging(staging []string) error {
+	var errors error
+	for _, s := range staging {
+		dropSQL := fmt.Sprintf(`DROP TABLE IF EXISTS %s`, s)
+		if r.dryRunSkip(dropSQL) {
+			continue
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": dropSQL})
+		if _, err := r.ExecContext(r.ctx, dropSQL); err != nil {
+			errors = multierror.Append(errors, fmt.Errorf("issue dropping staging table %s: %w", s, err))
+		}
 	}
 	return errors
 }
 
-// Copy copies either CSV or JSON data present in an S3 file into a redshift table.
-// It also supports CSV or JSON data pointed at by a manifest file, if you pass in a manifest file.
-// this is meant to be run in a transaction, so the first arg must be a sql.Tx
-// if not using jsonPaths, set s3File.JSONPaths to "auto"
-func (r *Redshift) Copy(tx *sql.Tx, f s3filepath.S3File, delimiter string, creds, gzip bool) error {
-	var credSQL string
-	if creds {
-		credSQL = fmt.Sprintf(`IAM_ROLE '%s'`, f.Bucket.RedshiftRoleARN)
+// TableStats is the size of a table and how much of it is unsorted, from svv_table_info
+type TableStats struct {
+	Rows        int64
+	SizeMB      int64
+	UnsortedPct float64
+}
+
+// GetTableStats returns the row count, size and unsorted percentage of a table.
+// svv_table_info only lists tables with data in them, so a new or empty table gets zero stats.
+func (r *Redshift) GetTableStats(schema, table string) (TableStats, error) {
+	var rows, size sql.NullInt64
+	var unsorted sql.NullFloat64
+	q := fmt.Sprintf(statsQueryFormat, schema, table)
+	if err := r.QueryRowContext(r.ctx, q).Scan(&rows, &size, &unsorted); err != nil && err != sql.ErrNoRows {
+		return TableStats{}, fmt.Errorf("issue running query: %s, err: %w", q, err)
 	}
-	gzipSQL := ""
-	if gzip {
-		gzipSQL = "GZIP"
+	return TableStats{Rows: rows.Int64, SizeMB: size.Int64, UnsortedPct: unsorted.Float64}, nil
+}
+
+// VacuumAnalyze runs VACUUM and then ANALYZE on the table. VACUUM is skipped if less than
+// unsortedThreshold percent of the table is unsorted.
+// Neither can run inside a transaction, so they run on their own connection after the load, and
+// aren't limited by the load's statement timeout (see SetStatementTimeout), only by a
+// statement_timeout set for the user or the WLM queue.
+func (r *Redshift) VacuumAnalyze(schema, table string, unsortedThreshold float64) error {
+	fullName := fmt.Sprintf(`"%s"."%s"`, schema, table)
+
+	stats, err := r.GetTableStats(schema, table)
+	if err != nil {
+		return err
 	}
-	manifestSQL := ""
-	if f.Suffix == "manifest" {
-		manifestSQL = "manifest"
+
+	ops := []string{fmt.Sprintf(`ANALYZE %s`, fullName)}
+	if stats.UnsortedPct >= unsortedThreshold {
+		ops = append([]string{fmt.Sprintf(`VACUUM %s`, fullName)}, ops...)
+	} else {
+		logger.GetLogger().InfoD("skip-vacuum", kvlogger.M{
+			"schema": schema, "table": table, "unsorted": stats.UnsortedPct, "threshold": unsortedThreshold,
+		})
 	}
 
-	// default to CSV
-	jsonSQL := ""
-	jsonPathsSQL := ""
-	// always removequotes, UNLOAD should add quotes
-	// always say escape for CSVs, UNLOAD should always escape
-	delimSQL := fmt.Sprintf("DELIMITER AS '%s' REMOVEQUOTES ESCAPE TRIMBLANKS EMPTYASNULL ACCEPTANYDATE", delimiter)
-	// figure out if we're doing JSON - no delim means JSON
-	if delimiter == "" {
-		jsonSQL = "JSON"
-		jsonPathsSQL = "'auto'"
-		delimSQL = ""
+	for _, op := range ops {
+		if r.dryRunSkip(op) {
+			continue
+		}
+		start := time.Now()
+		if _, err := r.ExecContext(r.ctx, op); err != nil {
+			return fmt.Errorf("issue running statement %s: %w", op, err)
+		}
+		logger.GetLogger().InfoD("run-sql", kvlogger.M{
+			"sql": op, "duration_ms": time.Since(start).Nanoseconds() / int64(time.Millisecond),
+		})
 	}
-	copySQL := fmt.Sprintf(`COPY "%s"."%s" FROM '%s' WITH %s %s %s REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON %s %s %s`,
-		f.Schema, f.Table, f.GetDataFilename(), gzipSQL, jsonSQL, jsonPathsSQL, f.Bucket.Region, manifestSQL, credSQL, delimSQL)
-	log.Printf("Running command: %s", copySQL)
-	// can't use prepare b/c of redshift-specific syntax that postgres does not like
-	_, err := tx.ExecContext(r.ctx, copySQL)
-	return err
+	return nil
+}
+
+// ColumnEncoding is a column's compression encoding recommended by ANALYZE COMPRESSION,
+// and the estimated percentage it would shrink the column's storage by
+type ColumnEncoding struct {
+	Column          string
+	Encoding        string
+	EstReductionPct float64
+}
+
+// AnalyzeCompression runs ANALYZE COMPRESSION on the table and logs the encoding it recommends
+// for each column. It can't run inside a transaction, so it runs on its own connection, and is
+// best run after the first load so there's data to sample. It doesn't change the table.
+func (r *Redshift) AnalyzeCompression(schema, table string) ([]ColumnEncoding, error) {
+	q := fmt.Sprintf(`ANALYZE COMPRESSION "%s"."%s"`, schema, table)
+	// ANALYZE COMPRESSION doesn't modify anything, but locks the table and reads all of it
+	if r.dryRunSkip(q) {
+		return nil, nil
+	}
+	logger.GetLogger().InfoD("run-sql", kvlogger.M{"sql": q})
+	rows, err := r.QueryContext(r.ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("issue running query: %s, err: %w", q, err)
+	}
+	defer rows.Close()
+	var encodings []ColumnEncoding
+	for rows.Next() {
+		var tableName string
+		var e ColumnEncoding
+		if err := rows.Scan(&tableName, &e.Column, &e.Encoding, &e.EstReductionPct); err != nil {
+			return nil, fmt.Errorf("issue scanning compression analysis, err: %w", err)
+		}
+		logger.GetLogger().InfoD("recommended-encoding", kvlogger.M{
+			"schema": schema, "table": table, "column": e.Column, "encoding": e.Encoding,
+			"est_reduction_pct": e.EstReductionPct,
+		})
+		encodings = append(encodings, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("issue iterating over compression analysis, err: %w", err)
+	}
+	return encodings, nil
 }
 
 // UpdateLatencyInfo updates the latency table with the current time to indicate
 // that the table data has been updated
 func (r *Redshift) UpdateLatencyInfo(tx *sql.Tx, table Table) error {
 	dest := fmt.Sprintf("%s.%s", table.Meta.Schema, table.Name)
+	if r.dryRunSkip(fmt.Sprintf("UPDATE latencies SET last_update = current_timestamp WHERE name = '%s'", dest)) {
+		return nil
+	}
 
 	// Insert a row for the latencies table if it doesn't already exist.
 	// We do this outside of the transaction, since there's no reason to lock the entire table.
@@ -514,7 +2505,7 @@ func (r *Redshift) UpdateLatencyInfo(tx *sql.Tx, table Table) error {
 	err = r.QueryRowContext(r.ctx, latencyQuery).Scan(&t)
 	// this will either return a value or null if no data, rather than no rows, because we inserted earleir
 	if err != nil {
-		return fmt.Errorf("error scanning latency table for %s: %s", dest, err)
+		return fmt.Errorf("error scanning latency table for %s: %w", dest, err)
 	}
 
 	// Update the latency table with the current timestamp, for the last run.
@@ -525,7 +2516,7 @@ func (r *Redshift) UpdateLatencyInfo(tx *sql.Tx, table Table) error {
 		"UPDATE latencies SET last_update = current_timestamp WHERE name = '%s'",
 		dest))
 	if err != nil {
-		return fmt.Errorf("error saving new latency to table for %s: %s", dest, err)
+		return fmt.Errorf("error saving new latency to table for %s: %w", dest, err)
 	}
 
 	logger.GetLogger().InfoD("analytics-run-latency", kvlogger.M{
@@ -537,12 +2528,160 @@ func (r *Redshift) UpdateLatencyInfo(tx *sql.Tx, table Table) error {
 	return nil
 }
 
+// LoadEntry is a record of one load of a table, successful or not
+type LoadEntry struct {
+	Schema     string
+	Table      string
+	DataDate   time.Time
+	S3Path     string
+	ETag       string
+	RowsLoaded int64
+	Start      time.Time
+	End        time.Time
+	Success    bool
+	Error      string
+}
+
+// maxLoadHistoryError is the most of a failed load's error recorded, the size of the column
+const maxLoadHistoryError = 65535
+
+const createLoadHistorySQL = `CREATE TABLE IF NOT EXISTS redshift_load_history (
+  schema_name character varying(128) NOT NULL,
+  table_name character varying(128) NOT NULL,
+  data_date timestamp without time zone,
+  s3_path character varying(1024),
+  etag character varying(128),
+  rows_loaded bigint,
+  started_at timestamp without time zone,
+  finished_at timestamp without time zone,
+  success boolean,
+  error character varying(65535)
+)`
+
+// RecordLoad adds the entry to the redshift_load_history table, creating it if it doesn't exist, so
+// there's a record of when each table was loaded and from what. It runs outside of the load's
+// transaction so that failed loads, whose transactions were rolled back, are recorded too.
+func (r *Redshift) RecordLoad(entry LoadEntry) error {
+	if len(entry.Error) > maxLoadHistoryError {
+		// don't leave half a character on the end
+		entry.Error = strings.ToValidUTF8(entry.Error[:maxLoadHistoryError], "")
+	}
+	insertSQL := fmt.Sprintf(`INSERT INTO redshift_load_history VALUES (%s, %s, '%s', %s, %s, %d, '%s', '%s', %t, %s)`,
+		quoteLiteral(entry.Schema), quoteLiteral(entry.Table), entry.DataDate.UTC().Format(time.RFC3339),
+		quoteLiteral(entry.S3Path), quoteLiteral(entry.ETag), entry.RowsLoaded, entry.Start.UTC().Format(time.RFC3339),
+		entry.End.UTC().Format(time.RFC3339), entry.Success, quoteLiteral(entry.Error))
+	for _, op := range []string{createLoadHistorySQL, insertSQL} {
+		if r.dryRunSkip(op) {
+			continue
+		}
+		if _, err := r.ExecContext(r.ctx, op); err != nil {
+			return fmt.Errorf("issue running statement %s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// LastLoad returns the most recent successful load of the table's data for the data date from the
+// redshift_load_history table, or nil if there hasn't been one (or there's no history table yet).
+// Only the schema, table, data date, s3 path and ETag are filled in.
+func (r *Redshift) LastLoad(schema, table string, dataDate time.Time) (*LoadEntry, error) {
+	entry, err := r.lastLoad(schema, table, fmt.Sprintf(` AND data_date = '%s'`, dataDate.UTC().Format(time.RFC3339)))
+	if entry != nil {
+		entry.DataDate = dataDate
+	}
+	return entry, err
+}
+
+// LastTableLoad is LastLoad, but for the table's most recent successful load of any data date,
+// which is filled in too
+func (r *Redshift) LastTableLoad(schema, table string) (*LoadEntry, error) {
+	return r.lastLoad(schema, table, "")
+}
+
+// lastLoad returns the most recent successful load of the table from the redshift_load_history
+// table matching the extra conditions, or nil if there hasn't been one
+func (r *Redshift) lastLoad(schema, table, conditions string) (*LoadEntry, error) {
+	var exists string
+	if err := r.QueryRowContext(r.ctx, fmt.Sprintf(existQueryFormat, "public", "redshift_load_history")).Scan(&exists); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("issue just checking if the load history table exists: %w", err)
+	}
+
+	q := fmt.Sprintf(`SELECT s3_path, etag, data_date FROM redshift_load_history
+		WHERE schema_name = %s AND table_name = %s%s AND success
+		ORDER BY finished_at DESC LIMIT 1`, quoteLiteral(schema), quoteLiteral(table), conditions)
+	entry := LoadEntry{Schema: schema, Table: table, Success: true}
+	var etag sql.NullString
+	var dataDate pq.NullTime
+	if err := r.QueryRowContext(r.ctx, q).Scan(&entry.S3Path, &etag, &dataDate); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("issue running query: %s, err: %w", q, err)
+	}
+	entry.ETag, entry.DataDate = etag.String, dataDate.Time
+	return &entry, nil
+}
+
+// CheckNewData returns ErrNoNewData if the data at s3Path is what was last loaded for the table's
+// data date, going by LastLoad, or ErrNoLoadHistory if nothing has been recorded as loaded for the
+// date. It's only worth calling once the target table's data date says it's up to date
+func (r *Redshift) CheckNewData(schema, table string, dataDate time.Time, s3Path, etag string) error {
+	lastLoad, err := r.LastLoad(schema, table, dataDate)
+	if err != nil {
+		return fmt.Errorf("error getting the last load of the table: %w", err)
+	}
+	if lastLoad == nil {
+		return ErrNoLoadHistory
+	}
+	if !sourceChanged(lastLoad, s3Path, etag) {
+		return ErrNoNewData
+	}
+	logger.GetLogger().InfoD("source-changed", kvlogger.M{
+		"schema": schema, "table": table, "data_date": dataDate,
+		"s3_path": s3Path, "last_s3_path": lastLoad.S3Path, "etag": etag, "last_etag": lastLoad.ETag,
+	})
+	return nil
+}
+
+// sourceChanged returns whether the data at path is different from what was last loaded for its
+// date, i.e. it's a different key or it's been re-uploaded. Without a record of the last load or
+// an ETag on either side, there's nothing to compare so it's treated as unchanged.
+func sourceChanged(lastLoad *LoadEntry, path, etag string) bool {
+	if lastLoad == nil {
+		return false
+	}
+	if lastLoad.S3Path != path {
+		return true
+	}
+	return etag != "" && lastLoad.ETag != "" && etag != lastLoad.ETag
+}
+
+// HasDataInTimeRange returns whether the table has any rows with a data date in the time range,
+// i.e. whether the data date's partition of the table has been loaded
+func (r *Redshift) HasDataInTimeRange(schema, table string, dataDate Meta, start, end time.Time) (bool, error) {
+	q := fmt.Sprintf(`SELECT 1 FROM "%s"."%s" WHERE %s >= '%s' AND %s < '%s' LIMIT 1`,
+		schema, table, dataDate.dataDateSQL(), start.Format("2006-01-02 15:04:05"),
+		dataDate.dataDateSQL(), end.Format("2006-01-02 15:04:05"))
+	var one int
+	if err := r.QueryRowContext(r.ctx, q).Scan(&one); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("issue running query: %s, err: %w", q, err)
+	}
+	return true, nil
+}
+
 // Truncate deletes all items from a table, given a transaction, a schema string and a table name
 // you should run vacuum and analyze soon after doing this for performance reasons
 func (r *Redshift) Truncate(tx *sql.Tx, schema, table string) error {
 	// We run 'DELETE FROM' instead of 'TRUNCATE' because 'TRUNCATE' can't be run in a transaction.
 	// See http://docs.aws.amazon.com/redshift/latest/dg/r_TRUNCATE.html.
-	truncStmt, err := tx.PrepareContext(r.ctx, fmt.Sprintf(`DELETE FROM "%s"."%s"`, schema, table))
+	truncSQL := fmt.Sprintf(`DELETE FROM "%s"."%s"`, schema, table)
+	if r.dryRunSkip(truncSQL) {
+		return nil
+	}
+	truncStmt, err := tx.PrepareContext(r.ctx, truncSQL)
 	if err != nil {
 		return err
 	}
@@ -552,20 +2691,25 @@ func (r *Redshift) Truncate(tx *sql.Tx, schema, table string) error {
 
 // TruncateInTimeRange deletes all items within a specific time range - that is,
 // matching `dataDate` when rounded to a certain granularity `timeGranularity`
-// NOTE: this assumes that "time" is a column in the table
-func (r *Redshift) TruncateInTimeRange(tx *sql.Tx, schema, table, dataDateCol string,
+// NOTE: this assumes that the data date columns of dataDate are columns in the table
+func (r *Redshift) TruncateInTimeRange(tx *sql.Tx, schema, table string, dataDate Meta,
 	start, end time.Time) error {
 	truncSQL := fmt.Sprintf(`
 		DELETE FROM "%s"."%s"
-		WHERE "%s" >= '%s' AND "%s" < '%s'
-		`, schema, table, dataDateCol, start.Format("2006-01-02 15:04:05"),
-		dataDateCol, end.Format("2006-01-02 15:04:05"))
+		WHERE %s >= '%s' AND %s < '%s'
+		`, schema, table, dataDate.dataDateSQL(), start.Format("2006-01-02 15:04:05"),
+		dataDate.dataDateSQL(), end.Format("2006-01-02 15:04:05"))
+	if r.dryRunSkip(truncSQL) {
+		return nil
+	}
 	truncStmt, err := tx.PrepareContext(r.ctx, truncSQL)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Refreshing with the latest data. Running command: %s", truncSQL)
+	logger.GetLogger().InfoD("truncate-in-time-range", kvlogger.M{
+		"schema": schema, "table": table, "start": start, "end": end, "sql": truncSQL,
+	})
 	_, err = truncStmt.ExecContext(r.ctx)
 	return err
 }
@@ -3,14 +3,18 @@ package redshift
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Clever/pq"
 	"github.com/Clever/s3-to-redshift/v3/s3filepath"
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
@@ -108,6 +112,50 @@ func TestTableFromConf(t *testing.T) {
 	if assert.Error(t, err) {
 		assert.Equal(t, true, strings.Contains(err.Error(), "data date column must be set"))
 	}
+
+	// tables with the same name in other schemas are skipped, but one schema can't have two
+	multiFile, err := ioutil.TempFile(os.TempDir(), "testconf")
+	assert.NoError(t, err)
+	defer multiFile.Close()
+	otherSchema := matchingTable
+	otherSchema.Meta.Schema = "otherschema"
+	d, err := yaml.Marshal(map[string]Table{"other": otherSchema, configKey: matchingTable})
+	assert.NoError(t, err)
+	_, err = multiFile.Write(d)
+	assert.NoError(t, err)
+	f.ConfFile = multiFile.Name()
+	returnedTable, err = db.GetTableFromConf(f)
+	assert.NoError(t, err)
+	assert.Equal(t, matchingTable, *returnedTable)
+
+	dupeFile, err := ioutil.TempFile(os.TempDir(), "testconf")
+	assert.NoError(t, err)
+	defer dupeFile.Close()
+	d, err = yaml.Marshal(map[string]Table{"dupe": matchingTable, configKey: matchingTable})
+	assert.NoError(t, err)
+	_, err = dupeFile.Write(d)
+	assert.NoError(t, err)
+	f.ConfFile = dupeFile.Name()
+	_, err = db.GetTableFromConf(f)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "table testschema.testtable is in conf file")
+		assert.Contains(t, err.Error(), "more than once")
+	}
+
+	// a JSON config
+	jsonFile, err := ioutil.TempFile(os.TempDir(), "testconf*.json")
+	assert.NoError(t, err)
+	defer jsonFile.Close()
+	_, err = jsonFile.WriteString(`{"testConfKey": {"dest": "testtable", "columns": [
+		{"dest": "id", "type": "text", "primarykey": true}
+	], "meta": {"schema": "testschema", "datadatecolumn": "foo"}}}`)
+	assert.NoError(t, err)
+	f.ConfFile = jsonFile.Name()
+	returnedTable, err = db.GetTableFromConf(f)
+	assert.NoError(t, err)
+	jsonTable := matchingTable
+	jsonTable.Columns = []ColInfo{{Name: "id", Type: "text", PrimaryKey: true}}
+	assert.Equal(t, jsonTable, *returnedTable)
 }
 
 // I'm not going to worry about if the db throws an error
@@ -169,7 +217,7 @@ func TestGetTableMetadata(t *testing.T) {
 
 	tx, err := mockRedshift.Begin()
 	assert.NoError(t, err)
-	returnedTable, returnedDate, err := mockRedshift.GetTableMetadata(schema, table, dataDateCol)
+	returnedTable, returnedDate, err := mockRedshift.GetTableMetadata(schema, table, Meta{DataDateColumn: dataDateCol})
 	assert.NoError(t, err)
 	assert.Equal(t, expectedTable, *returnedTable)
 	assert.Equal(t, expectedDate, *returnedDate)
@@ -191,7 +239,7 @@ func TestGetTableMetadata(t *testing.T) {
 
 	tx, err = mockRedshift.Begin()
 	assert.NoError(t, err)
-	returnedTable, returnedDate, err = mockRedshift.GetTableMetadata(schema, table, dataDateCol)
+	returnedTable, returnedDate, err = mockRedshift.GetTableMetadata(schema, table, Meta{DataDateColumn: dataDateCol})
 	assert.NoError(t, err)
 	assert.Nil(t, returnedTable)
 	assert.Nil(t, returnedDate)
@@ -209,17 +257,17 @@ func TestCreateTable(t *testing.T) {
 	dbTable := Table{
 		Name: table,
 		Columns: []ColInfo{
-			{"test1", "int", "100", true, false, true, 1},
-			{"id", "text", "", false, true, false, 0},
-			{"somelongtext", "longtext", "", false, false, false, 0},
-			{"test2", "bigint", "9999999999", false, false, false, 0},
+			{"test1", "int", "100", true, false, true, 1, ""},
+			{"id", "text", "", false, true, false, 0, ""},
+			{"somelongtext", "longtext", "", false, false, false, 0, ""},
+			{"test2", "bigint", "9999999999", false, false, false, 0, ""},
 		},
 		Meta: Meta{Schema: schema},
 	}
 
 	//createSQL := `aasdadsa character varying(256) PRIMARY KEY , test5 integer DEFAULT 100 NOT NULL SORTKEY DISTKEY , someww221longtext character varying(10000), test2 bigint DEFAULT 9999999999`
 	//sql := fmt.Sprintf(`CREATE TABLE "%s"."%s" (%s)`, schema, table, createSQL)
-	regex := `CREATE TABLE ".*".".*".*` +
+	regex := `CREATE TABLE IF NOT EXISTS ".*".".*".*` +
 		`"test1" integer DEFAULT 100 NOT NULL SORTKEY.*` +
 		`DISTKEY.*"id" character varying\(256\).*PRIMARY KEY.*` +
 		`"somelongtext" character varying\(65535\).*` + // a little awk, but the prepare makes sure this is good
@@ -245,15 +293,139 @@ func TestCreateTable(t *testing.T) {
 	}
 }
 
+// two loads of a new table racing to create it: the second's create finds the first's table,
+// so it's reconciled with the config rather than failing as a duplicate
+func TestEnsureTableConcurrentCreate(t *testing.T) {
+	schema, table := "testschema", "tablename"
+	dbTable := Table{
+		Name: table,
+		Columns: []ColInfo{
+			{Name: "id", Type: "int", DistKey: true},
+			{Name: "created", Type: "timestamp", SortOrdinal: 1},
+			{Name: "name", Type: "text"},
+		},
+		Meta: Meta{Schema: schema},
+	}
+	existRegex := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE table_schema='%s' AND table_name='%s'`, schema, table)
+	colInfoRegex := fmt.Sprintf(`SELECT .*nspname = '%s' .*relname = '%s'.*`, schema, table)
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	// the first create makes the table, which no one else can see until it commits
+	mock.ExpectBegin()
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "testschema"."tablename"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(existRegex).WithArgs().WillReturnError(sql.ErrNoRows)
+	mock.ExpectCommit()
+	// the second create leaves it alone, then adds the column its config has that the first's didn't
+	mock.ExpectBegin()
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "testschema"."tablename"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(existRegex).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow(table))
+	colInfoRows := sqlmock.NewRows([]string{"name", "col_type", "default_val", "not_null", "primary_key", "dist_key", "sort_ord"})
+	colInfoRows.AddRow("id", "integer", "", false, false, true, 0)
+	colInfoRows.AddRow("created", "timestamp without time zone", "", false, false, false, 1)
+	mock.ExpectQuery(colInfoRegex).WithArgs().WillReturnRows(colInfoRows)
+	mock.ExpectPrepare(`ALTER TABLE "testschema"."tablename" ADD COLUMN "name" character varying\(256\)`)
+	mock.ExpectExec(`ALTER TABLE ".*".".*" (.*)`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	first, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.EnsureTable(first, Table{Name: table, Columns: dbTable.Columns[:2], Meta: dbTable.Meta}, false, false))
+	assert.NoError(t, first.Commit())
+
+	second, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.EnsureTable(second, dbTable, false, false))
+	assert.NoError(t, second.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
 // that we disallow creation without a sortkey or distkey
+func TestCreateTableEncodings(t *testing.T) {
+	dbTable := Table{
+		Name: "tablename",
+		Columns: []ColInfo{
+			{Name: "id", Type: "text", PrimaryKey: true, DistKey: true, Encoding: "ZSTD"},
+			{Name: "created", Type: "timestamp", SortOrdinal: 1, Encoding: "raw"},
+			{Name: "count", Type: "int"},
+		},
+		Meta: Meta{Schema: "testschema"},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`"id" character varying\(256\)\s*ENCODE zstd\s*PRIMARY KEY DISTKEY\s*,\s*` +
+		`"created" timestamp without time zone\s*ENCODE raw\s*SORTKEY\s*,\s*"count" integer\s*\)$`).
+		WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.CreateTable(tx, dbTable))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCreateTableMultiColumnSortKey(t *testing.T) {
+	dbTable := Table{
+		Name: "tablename",
+		Columns: []ColInfo{
+			{"id", "text", "", false, true, true, 0, ""},
+			{"school", "text", "", false, false, false, 2, ""},
+			{"created", "timestamp", "", false, false, false, 1, ""},
+		},
+		Meta: Meta{Schema: "testschema"},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	for _, style := range []string{"COMPOUND", "INTERLEAVED"} {
+		// the sortkey is only at the end, not on the columns
+		mock.ExpectBegin()
+		mock.ExpectPrepare("This needs to be here, but not evaluated")
+		mock.ExpectExec(`"school" character varying\(256\)\s*,\s*"created" timestamp without time zone\s*\) ` +
+			style + ` SORTKEY \("created", "school"\)$`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		tx, err := mockRedshift.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, mockRedshift.CreateTable(tx, dbTable))
+		assert.NoError(t, tx.Commit())
+		dbTable.Meta.SortKeyStyle = SortKeyInterleaved
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
 func TestNoKeyCreateTable(t *testing.T) {
 	schema, table := "testschema", "tablename"
 	dbTable := Table{
 		Name: table,
 		Columns: []ColInfo{
-			{"test1", "int", "100", true, false, false, 0},
-			{"id", "text", "", false, false, false, 0},
-			{"somelongtext", "longtext", "", false, false, false, 0},
+			{"test1", "int", "100", true, false, false, 0, ""},
+			{"id", "text", "", false, false, false, 0, ""},
+			{"somelongtext", "longtext", "", false, false, false, 0, ""},
 		},
 		Meta: Meta{Schema: schema},
 	}
@@ -277,6 +449,19 @@ func TestNoKeyCreateTable(t *testing.T) {
 	}
 }
 
+// expectCopyCount expects the query for how many rows the last COPY loaded
+func expectCopyCount(mock sqlmock.Sqlmock, count int64) {
+	rows := sqlmock.NewRows([]string{"count"})
+	rows.AddRow(count)
+	mock.ExpectQuery(`SELECT pg_last_copy_count\(\)`).WithArgs().WillReturnRows(rows)
+}
+
+// expectCopySession expects the query for the session and time a COPY starts, which is run before it
+func expectCopySession(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta(copySessionQuery)).WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid", "getdate"}).AddRow(1234, time.Date(2015, 11, 10, 23, 5, 0, 0, time.UTC)))
+}
+
 func TestJSONCopy(t *testing.T) {
 	schema, table := "testschema", "tablename"
 	bucket, region, redshiftRoleARN := "bucket", "region", "redshiftRoleARN"
@@ -285,12 +470,13 @@ func TestJSONCopy(t *testing.T) {
 		Region:          region,
 		RedshiftRoleARN: redshiftRoleARN}
 	s3File := s3filepath.S3File{
-		Bucket:   b,
-		Schema:   schema,
-		Table:    table,
-		Suffix:   "json.gz",
-		DataDate: time.Now(),
-		ConfFile: "",
+		Bucket:      b,
+		Schema:      schema,
+		Table:       table,
+		Suffix:      "json.gz",
+		Compression: s3filepath.CompressionGzip,
+		DataDate:    time.Now(),
+		ConfFile:    "",
 	}
 	// test with creds and GZIP
 	sql := `COPY "%s"."%s" FROM '%s' WITH %s JSON 'auto' REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON IAM_ROLE '%s'`
@@ -302,12 +488,16 @@ func TestJSONCopy(t *testing.T) {
 	defer db.Close()
 	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
 	mock.ExpectBegin()
+	expectCopySession(mock)
 	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 42)
 	mock.ExpectCommit()
 
 	tx, err := mockRedshift.Begin()
 	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.Copy(tx, s3File, "", true, true))
+	count, err := mockRedshift.Copy(tx, s3File, Table{}, "", true, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), count)
 	assert.NoError(t, tx.Commit())
 
 	if err = mock.ExpectationsWereMet(); err != nil {
@@ -315,6 +505,7 @@ func TestJSONCopy(t *testing.T) {
 	}
 
 	// test with neither creds nor GZIP
+	s3File.Compression = s3filepath.CompressionNone
 	sql = `COPY "%s"."%s" FROM '%s' WITH%s JSON 'auto' REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON`
 	execRegex = fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(), "", region)
 
@@ -324,12 +515,44 @@ func TestJSONCopy(t *testing.T) {
 	mockRedshift = Redshift{dbExecCloser: db, ctx: textCtx}
 
 	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err = mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, Table{}, "", false, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+
+	// test with a max error threshold, which also checks how many rows were rejected
+	s3File.Compression = s3filepath.CompressionGzip
+	sql = `COPY "%s"."%s" FROM '%s' WITH %s JSON 'auto' REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON IAM_ROLE '%s' MAXERROR 5`
+	execRegex = fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(), "GZIP", region, redshiftRoleARN)
+
+	db, mock, err = sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift = Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
 	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	rejectedRows := sqlmock.NewRows([]string{"count"})
+	rejectedRows.AddRow(2)
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM stl_load_errors WHERE query = pg_last_copy_id\(\)`).WithArgs().WillReturnRows(rejectedRows)
+	expectCopyCount(mock, 0)
 	mock.ExpectCommit()
 
 	tx, err = mockRedshift.Begin()
 	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.Copy(tx, s3File, "", false, false))
+	_, err = mockRedshift.Copy(tx, s3File, Table{}, "", true, 5)
+	assert.NoError(t, err)
 	assert.NoError(t, tx.Commit())
 
 	if err = mock.ExpectationsWereMet(); err != nil {
@@ -345,12 +568,13 @@ func TestJSONManifestCopy(t *testing.T) {
 		Region:          region,
 		RedshiftRoleARN: redshiftRoleARN}
 	s3File := s3filepath.S3File{
-		Bucket:   b,
-		Schema:   schema,
-		Table:    table,
-		Suffix:   "manifest",
-		DataDate: time.Now(),
-		ConfFile: "",
+		Bucket:      b,
+		Schema:      schema,
+		Table:       table,
+		Suffix:      "manifest",
+		Compression: s3filepath.CompressionGzip,
+		DataDate:    time.Now(),
+		ConfFile:    "",
 	}
 	// test with creds and GZIP
 	sql := `COPY "%s"."%s" FROM '%s' WITH %s JSON 'auto' REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON manifest IAM_ROLE '%s'`
@@ -363,12 +587,15 @@ func TestJSONManifestCopy(t *testing.T) {
 	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
 
 	mock.ExpectBegin()
+	expectCopySession(mock)
 	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
 	mock.ExpectCommit()
 
 	tx, err := mockRedshift.Begin()
 	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.Copy(tx, s3File, "", true, true))
+	_, err = mockRedshift.Copy(tx, s3File, Table{}, "", true, 0)
+	assert.NoError(t, err)
 	assert.NoError(t, tx.Commit())
 
 	if err = mock.ExpectationsWereMet(); err != nil {
@@ -376,47 +603,32 @@ func TestJSONManifestCopy(t *testing.T) {
 	}
 }
 
-func TestTruncate(t *testing.T) {
-	schema, table := "test_schema", "test_table"
-	db, mock, err := sqlmock.New()
-	assert.NoError(t, err)
-	defer db.Close()
-	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
-
-	mock.ExpectBegin()
-	mock.ExpectPrepare(fmt.Sprintf(`DELETE FROM "%s"."%s"`, schema, table))
-	mock.ExpectExec(`DELETE FROM ".*".".*"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
-	mock.ExpectCommit()
+func TestCredentialsSQL(t *testing.T) {
+	b := s3filepath.S3Bucket{RedshiftRoleARN: "arn", AccessID: "id", SecretKey: "secret"}
+	assert.Equal(t, `IAM_ROLE 'arn'`, credentialsSQL(b))
 
-	tx, err := mockRedshift.Begin()
-	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.Truncate(tx, schema, table))
-	assert.NoError(t, tx.Commit())
+	b.RedshiftRoleARN = ""
+	assert.Equal(t, `CREDENTIALS 'aws_access_key_id=id;aws_secret_access_key=secret'`, credentialsSQL(b))
 
-	if err = mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expections: %s", err)
-	}
+	b.Token = "token"
+	assert.Equal(t, `CREDENTIALS 'aws_access_key_id=id;aws_secret_access_key=secret;token=token'`, credentialsSQL(b))
 }
 
-func TestCSVCopy(t *testing.T) {
+func TestCopyLoadErrors(t *testing.T) {
 	schema, table := "testschema", "tablename"
-	bucket, region, redshiftRoleARN := "bucket", "region", "redshiftRoleARN"
 	b := s3filepath.S3Bucket{
-		Name:            bucket,
-		Region:          region,
-		RedshiftRoleARN: redshiftRoleARN}
+		Name:            "bucket",
+		Region:          "region",
+		RedshiftRoleARN: "redshiftRoleARN"}
 	s3File := s3filepath.S3File{
-		Bucket:   b,
-		Schema:   schema,
-		Table:    table,
-		Suffix:   "gz",
-		DataDate: time.Now(),
-		ConfFile: "",
+		Bucket:    b,
+		Schema:    schema,
+		Table:     table,
+		Suffix:    "json.gz",
+		DataDate:  time.Now(),
+		Subfolder: "testschema/tablename",
+		ConfFile:  "",
 	}
-	// test with creds and GZIP
-	sql := `COPY "%s"."%s" FROM '%s' WITH %s REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON IAM_ROLE '%s' DELIMITER AS '|' REMOVQUOTES ESCAPE EMPTYASNULL ACCEPTANYDATE`
-	execRegex := fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(),
-		"GZIP", region, redshiftRoleARN)
 
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
@@ -424,42 +636,100 @@ func TestCSVCopy(t *testing.T) {
 	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
 
 	mock.ExpectBegin()
-	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
-	mock.ExpectCommit()
+	expectCopySession(mock)
+	mock.ExpectExec(`COPY "testschema"."tablename"`).WithArgs().WillReturnError(fmt.Errorf("Load into table 'tablename' failed"))
+	loadErrorRows := sqlmock.NewRows([]string{"line_number", "colname", "raw_field_value", "err_reason"})
+	loadErrorRows.AddRow(12, "foo", "notanint", "Invalid digit, Value 'n', Pos 0, Type: Integer")
+	mock.ExpectQuery(`SELECT line_number.*FROM stl_load_errors.*WHERE session = 1234 AND starttime >= '2015-11-10 23:05:00' AND .*LIKE 's3://bucket/testschema/tablename/%'`).
+		WithArgs().WillReturnRows(loadErrorRows)
+	mock.ExpectRollback()
 
 	tx, err := mockRedshift.Begin()
 	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.Copy(tx, s3File, "|", true, true))
-	assert.NoError(t, tx.Commit())
+	_, copyErr := mockRedshift.Copy(tx, s3File, Table{}, "", true, 0)
+	if assert.Error(t, copyErr) {
+		assert.Contains(t, copyErr.Error(), "Load into table 'tablename' failed")
+		assert.Contains(t, copyErr.Error(), "line 12, column foo, value 'notanint': Invalid digit")
+		assert.True(t, errors.Is(copyErr, ErrCopyFailed))
+		var ce *CopyError
+		if assert.True(t, errors.As(copyErr, &ce)) && assert.Len(t, ce.LoadErrors, 1) {
+			assert.Equal(t, "foo", ce.LoadErrors[0].ColName)
+		}
+	}
+	assert.NoError(t, tx.Rollback())
 
 	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expections: %s", err)
 	}
 
-	// test with neither creds nor GZIP
-	sql = `COPY "%s"."%s" FROM '%s' WITH %s REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON DELIMITER AS '|' REMOVEQUOTES ESCAPE TRIMBLANKS EMPTYASNULL ACCEPTANYDATE`
-	execRegex = fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(), "", region)
-
+	// an access denied error on a KMS encrypted bucket points at the key
+	s3File.Bucket.KMSKeyARN = "arn:aws:kms:region:1234:key/abcd"
 	db, mock, err = sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 	mockRedshift = Redshift{dbExecCloser: db, ctx: textCtx}
 
 	mock.ExpectBegin()
-	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
-	mock.ExpectCommit()
+	expectCopySession(mock)
+	mock.ExpectExec(`COPY "testschema"."tablename"`).WithArgs().WillReturnError(fmt.Errorf("S3ServiceException:Access Denied,Status 403"))
+	mock.ExpectQuery(`SELECT line_number.*FROM stl_load_errors`).WithArgs().WillReturnRows(
+		sqlmock.NewRows([]string{"line_number", "colname", "raw_field_value", "err_reason"}))
+	mock.ExpectRollback()
 
 	tx, err = mockRedshift.Begin()
 	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.Copy(tx, s3File, "|", false, false))
-	assert.NoError(t, tx.Commit())
+	_, copyErr = mockRedshift.Copy(tx, s3File, Table{}, "", true, 0)
+	if assert.Error(t, copyErr) {
+		assert.Contains(t, copyErr.Error(), "encrypted with KMS key arn:aws:kms:region:1234:key/abcd")
+	}
+	assert.NoError(t, tx.Rollback())
 
 	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expections: %s", err)
 	}
 }
 
-func TestCSVManifestCopy(t *testing.T) {
+// stl_load_errors has rows from an earlier load of the folder, but a COPY which failed without
+// rejecting any rows only looks for its own, so the old ones aren't blamed for it
+func TestCopyLoadErrorsStale(t *testing.T) {
+	s3File := s3filepath.S3File{
+		Bucket:    s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"},
+		Schema:    "testschema",
+		Table:     "tablename",
+		Suffix:    "manifest",
+		DataDate:  time.Now(),
+		Subfolder: "testschema/tablename",
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	// the earlier load's rows are in another session, before this COPY started, so none match
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(`COPY "testschema"."tablename"`).WithArgs().WillReturnError(fmt.Errorf("Manifest file is not in correct json format"))
+	mock.ExpectQuery(`FROM stl_load_errors\s+WHERE session = 1234 AND starttime >= '2015-11-10 23:05:00'`).WithArgs().WillReturnRows(
+		sqlmock.NewRows([]string{"line_number", "colname", "raw_field_value", "err_reason"}))
+	mock.ExpectRollback()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, copyErr := mockRedshift.Copy(tx, s3File, Table{}, "", true, 0)
+	var ce *CopyError
+	if assert.True(t, errors.As(copyErr, &ce)) {
+		assert.Empty(t, ce.LoadErrors)
+		assert.Equal(t, "Manifest file is not in correct json format", copyErr.Error())
+	}
+	assert.NoError(t, tx.Rollback())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestParquetCopy(t *testing.T) {
 	schema, table := "testschema", "tablename"
 	bucket, region, redshiftRoleARN := "bucket", "region", "redshiftRoleARN"
 	b := s3filepath.S3Bucket{
@@ -470,14 +740,13 @@ func TestCSVManifestCopy(t *testing.T) {
 		Bucket:   b,
 		Schema:   schema,
 		Table:    table,
-		Suffix:   "manifest",
+		Suffix:   "parquet",
 		DataDate: time.Now(),
 		ConfFile: "",
 	}
-	// test with creds and GZIP
-	sql := `COPY "%s"."%s" FROM '%s' WITH %s REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON manifest IAM_ROLE '%s' DELIMITER AS '|' REMOVEQUOTES ESCAPE TRIMBLANKS EMPTYASNULL ACCEPTANYDATE`
-	execRegex := fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(),
-		"GZIP", region, redshiftRoleARN)
+	inputTable := Table{Name: table, Columns: []ColInfo{{Name: "id"}, {Name: "time"}}}
+	sql := `COPY "%s"."%s" FROM '%s' REGION '%s' IAM_ROLE '%s' FORMAT AS PARQUET`
+	execRegex := fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(), region, redshiftRoleARN)
 
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
@@ -485,12 +754,28 @@ func TestCSVManifestCopy(t *testing.T) {
 	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
 
 	mock.ExpectBegin()
+	expectCopySession(mock)
 	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
 	mock.ExpectCommit()
 
 	tx, err := mockRedshift.Begin()
 	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.Copy(tx, s3File, "|", true, true))
+	_, err = mockRedshift.ParquetCopy(tx, s3File, inputTable, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	// nested columns are loaded into super columns as JSON
+	inputTable.Columns = append(inputTable.Columns, ColInfo{Name: "payload", Type: "super"})
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(execRegex + " SERIALIZETOJSON").WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+	tx, err = mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.ParquetCopy(tx, s3File, inputTable, nil)
+	assert.NoError(t, err)
 	assert.NoError(t, tx.Commit())
 
 	if err = mock.ExpectationsWereMet(); err != nil {
@@ -498,67 +783,536 @@ func TestCSVManifestCopy(t *testing.T) {
 	}
 }
 
-func TestUpdateTable(t *testing.T) {
-	schema, table := "testschema", "tablename"
+func TestParquetOrderMismatches(t *testing.T) {
+	inputTable := Table{Columns: []ColInfo{{Name: "id"}, {Name: "time"}, {Name: "new"}}}
+	targetTable := Table{Columns: []ColInfo{{Name: "time"}, {Name: "id"}}}
+	assert.Equal(t, 2, len(parquetOrderMismatches(inputTable, targetTable)))
 
-	inputTable := Table{
-		Name: table,
-		// order incorrectly on purpose to ensure ordering works
-		Columns: []ColInfo{
-			{"test3", "boolean", "true", false, false, false, 0},
-			{"test2", "int", "100", true, false, true, 1},
-			{"id", "text", "", false, true, false, 0},
-			{"test4", "float", "false", false, false, false, 0},
-			{"test5", "bigint", "9999999999", false, false, false, 0},
-		},
-		Meta: Meta{Schema: schema},
-	}
+	targetTable = Table{Columns: []ColInfo{{Name: "id"}, {Name: "time"}}}
+	assert.Equal(t, 0, len(parquetOrderMismatches(inputTable, targetTable)))
+}
 
+func TestTruncate(t *testing.T) {
+	schema, table := "test_schema", "test_table"
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
 
 	mock.ExpectBegin()
-	for _, updateSQL := range []string{
-		`ADD COLUMN id character varying(256) PRIMARY KEY `,
-		`ADD COLUMN test2 integer DEFAULT 100 NOT NULL SORTKEY DISTKEY `,
-		`ADD COLUMN test4 double precision`,
-		`ADD COLUMN test5 bigint DEFAULT 9999999999`,
-	} {
-		sql := fmt.Sprintf(`ALTER TABLE "%s"."%s" (%s)`, schema, table, updateSQL)
-		regex := `ALTER TABLE ".*".".*" (.*)` // a little awk, but the prepare makes sure this is good
-
-		mock.ExpectPrepare(sql)
-		mock.ExpectExec(regex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
-	}
+	mock.ExpectPrepare(fmt.Sprintf(`DELETE FROM "%s"."%s"`, schema, table))
+	mock.ExpectExec(`DELETE FROM ".*".".*"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
 	mock.ExpectCommit()
 
-	fewerColumnsTargetTable := Table{
-		Name: table,
-		Columns: []ColInfo{
-			{"test3", "boolean", "true", false, false, false, 0},
-		},
-		Meta: Meta{Schema: schema},
-	}
 	tx, err := mockRedshift.Begin()
 	assert.NoError(t, err)
-	assert.NoError(t, mockRedshift.UpdateTable(tx, inputTable, fewerColumnsTargetTable))
+	assert.NoError(t, mockRedshift.Truncate(tx, schema, table))
 	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
 }
 
-func TestCheckSchemasSame(t *testing.T) {
-	t1 := Table{Columns: []ColInfo{
-		ColInfo{Name: "IntColumn", PrimaryKey: true},
-		ColInfo{Name: "DateColumn", PrimaryKey: true},
-	}}
-	t2 := t1
-	columnOps, err := checkSchemas(t1, t2)
-	assert.Equal(t, 0, len(columnOps))
+func TestCompoundDataDate(t *testing.T) {
+	schema, table := "test_schema", "test_table"
+	dataDate := Meta{DataDateColumn: "date", DataDateHourColumn: "hour"}
+	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
-}
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
 
-func TestCheckSchemasAddColumns(t *testing.T) {
+	expectedDate := time.Date(2020, 1, 2, 13, 0, 0, 0, time.UTC)
+	dateRows := sqlmock.NewRows([]string{"date"})
+	dateRows.AddRow(expectedDate)
+	mock.ExpectQuery(`SELECT MAX\(DATEADD\(hour, "hour", "date"\)\) FROM "test_schema"."test_table" WHERE "date" > GETDATE\(\) - INTERVAL '1 DAY'`).
+		WithArgs().WillReturnRows(dateRows)
+	returnedDate, err := mockRedshift.MaxTime(fmt.Sprintf(`"%s"."%s"`, schema, table), dataDate)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedDate, returnedDate)
+
+	mock.ExpectBegin()
+	truncRegex := `DELETE FROM "test_schema"."test_table" WHERE DATEADD\(hour, "hour", "date"\) >= '2020-01-02 00:00:00' AND DATEADD\(hour, "hour", "date"\) < '2020-01-03 00:00:00'`
+	mock.ExpectPrepare(truncRegex)
+	mock.ExpectExec(truncRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	start := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, mockRedshift.TruncateInTimeRange(tx, schema, table, dataDate, start, start.Add(24*time.Hour)))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	schema, table := "test_schema", "test_table"
+	s3File := s3filepath.S3File{
+		Bucket:   s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "arn"},
+		Schema:   schema,
+		Table:    table,
+		Suffix:   "json.gz",
+		DataDate: time.Now(),
+	}
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+	mockRedshift.SetDryRun(true)
+
+	// nothing but the transaction itself should hit the database
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.Truncate(tx, schema, table))
+	_, err = mockRedshift.Copy(tx, s3File, Table{}, "", true, 5)
+	assert.NoError(t, err)
+	count, err := mockRedshift.LastCopyCount(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+	assert.NoError(t, mockRedshift.UpdateLatencyInfo(tx, Table{Name: table, Meta: Meta{Schema: schema}}))
+	assert.NoError(t, tx.Rollback())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCSVCopy(t *testing.T) {
+	schema, table := "testschema", "tablename"
+	bucket, region, redshiftRoleARN := "bucket", "region", "redshiftRoleARN"
+	b := s3filepath.S3Bucket{
+		Name:            bucket,
+		Region:          region,
+		RedshiftRoleARN: redshiftRoleARN}
+	s3File := s3filepath.S3File{
+		Bucket:      b,
+		Schema:      schema,
+		Table:       table,
+		Suffix:      "gz",
+		Compression: s3filepath.CompressionGzip,
+		DataDate:    time.Now(),
+		ConfFile:    "",
+	}
+	// test with creds and GZIP
+	sql := `COPY "%s"."%s" FROM '%s' WITH %s REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON IAM_ROLE '%s' DELIMITER AS '|' REMOVQUOTES ESCAPE EMPTYASNULL ACCEPTANYDATE`
+	execRegex := fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(),
+		"GZIP", region, redshiftRoleARN)
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, Table{}, "|", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+
+	// test with neither creds nor GZIP
+	s3File.Compression = s3filepath.CompressionNone
+	sql = `COPY "%s"."%s" FROM '%s' WITH %s REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON DELIMITER AS '|' REMOVEQUOTES ESCAPE TRIMBLANKS EMPTYASNULL ACCEPTANYDATE`
+	execRegex = fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(), "", region)
+
+	db, mock, err = sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift = Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err = mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, Table{}, "|", false, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCopyTimeFormats(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{
+		Bucket:   b,
+		Schema:   "testschema",
+		Table:    "tablename",
+		Suffix:   "json",
+		DataDate: time.Now(),
+	}
+	inputTable := Table{Name: "tablename", Meta: Meta{Schema: "testschema", TimeFormat: "epochsecs", DateFormat: "MM/DD/YYYY"}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(`COPY "testschema"."tablename" .* TIMEFORMAT 'epochsecs' TRUNCATECOLUMNS .* DATEFORMAT 'MM/DD/YYYY'`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCopySafetyValves(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{Bucket: b, Schema: "testschema", Table: "tablename", Suffix: "json", DataDate: time.Now()}
+	truncate := false
+	inputTable := Table{Name: "tablename", Meta: Meta{Schema: "testschema", TruncateColumns: &truncate, AcceptInvChars: "?"}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(`TIMEFORMAT 'auto' ACCEPTINVCHARS AS '\?' STATUPDATE ON`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCopyNullAs(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{Bucket: b, Schema: "testschema", Table: "tablename", Suffix: "json", DataDate: time.Now()}
+	inputTable := Table{Name: "tablename", Meta: Meta{Schema: "testschema", NullAs: `\N`}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(`JSON 'auto' .* TRUNCATECOLUMNS NULL AS '\\\\N' STATUPDATE ON`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	expectCopySession(mock)
+	mock.ExpectExec(`TRUNCATECOLUMNS NULL AS 'NULL' STATUPDATE ON .* DELIMITER AS '\|'`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	inputTable.Meta.NullAs = "NULL"
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "|", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCopyQuote(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{Bucket: b, Schema: "testschema", Table: "tablename", Suffix: ".gz", DataDate: time.Now(), Compression: s3filepath.CompressionGzip}
+	inputTable := Table{Name: "tablename", Meta: Meta{Schema: "testschema", Quote: "`"}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec("WITH GZIP .* CSV QUOTE AS '`' DELIMITER AS '\\|' TRIMBLANKS EMPTYASNULL ACCEPTANYDATE").WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "|", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCopyUpdateOptions(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{Bucket: b, Schema: "testschema", Table: "tablename", Suffix: "json", DataDate: time.Now()}
+	off := false
+	inputTable := Table{Name: "tablename", Meta: Meta{Schema: "testschema", StatUpdate: &off, CompUpdate: &off}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(`TRUNCATECOLUMNS STATUPDATE OFF COMPUPDATE OFF IAM_ROLE`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	expectCopySession(mock)
+	mock.ExpectExec(`FORMAT AS PARQUET STATUPDATE OFF COMPUPDATE OFF`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	s3File.Suffix = "parquet"
+	_, err = mockRedshift.ParquetCopyInto(tx, `"testschema"."tablename"`, s3File, inputTable, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+
+	assert.Equal(t, "STATUPDATE ON", updateSQL(Meta{}, true))
+	assert.Equal(t, "", updateSQL(Meta{}, false))
+}
+
+func TestCopyColumnList(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{Bucket: b, Schema: "testschema", Table: "tablename", Suffix: "json", DataDate: time.Now()}
+	inputTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "text"},
+	}, Meta: Meta{Schema: "testschema", ColumnList: true}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`COPY "testschema"."tablename" ("id", "name") FROM`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	// without it, COPY loads every column of the table
+	expectCopySession(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`COPY "testschema"."tablename" FROM`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	inputTable.Meta.ColumnList = false
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestJSONPathsCopy(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{Bucket: b, Schema: "testschema", Table: "tablename", Suffix: "json", DataDate: time.Now()}
+	inputTable := Table{Name: "tablename", Meta: Meta{Schema: "testschema", JSONPaths: "s3://bucket/jsonpaths/tablename.json"}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`WITH JSON 's3://bucket/jsonpaths/tablename.json' REGION 'region'`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCSVCopyNulls(t *testing.T) {
+	b := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	s3File := s3filepath.S3File{Bucket: b, Schema: "testschema", Table: "tablename", Suffix: "csv", DataDate: time.Now()}
+	emptyAsNull := false
+	inputTable := Table{Name: "tablename", Meta: Meta{Schema: "testschema", EmptyAsNull: &emptyAsNull, BlanksAsNull: true}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(`REMOVEQUOTES ESCAPE TRIMBLANKS BLANKSASNULL ACCEPTANYDATE`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	// JSON has no delimited fields to be empty
+	expectCopySession(mock)
+	mock.ExpectExec(`JSON 'auto' REGION 'region' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON IAM_ROLE 'redshiftRoleARN'$`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "|", true, 0)
+	assert.NoError(t, err)
+	s3File.Suffix = "json"
+	_, err = mockRedshift.Copy(tx, s3File, inputTable, "", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCSVManifestCopy(t *testing.T) {
+	schema, table := "testschema", "tablename"
+	bucket, region, redshiftRoleARN := "bucket", "region", "redshiftRoleARN"
+	b := s3filepath.S3Bucket{
+		Name:            bucket,
+		Region:          region,
+		RedshiftRoleARN: redshiftRoleARN}
+	s3File := s3filepath.S3File{
+		Bucket:      b,
+		Schema:      schema,
+		Table:       table,
+		Suffix:      "manifest",
+		Compression: s3filepath.CompressionGzip,
+		DataDate:    time.Now(),
+		ConfFile:    "",
+	}
+	// test with creds and GZIP
+	sql := `COPY "%s"."%s" FROM '%s' WITH %s REGION '%s' TIMEFORMAT 'auto' TRUNCATECOLUMNS STATUPDATE ON manifest IAM_ROLE '%s' DELIMITER AS '|' REMOVEQUOTES ESCAPE TRIMBLANKS EMPTYASNULL ACCEPTANYDATE`
+	execRegex := fmt.Sprintf(sql, schema, table, s3File.GetDataFilename(),
+		"GZIP", region, redshiftRoleARN)
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	expectCopySession(mock)
+	mock.ExpectExec(execRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopyCount(mock, 0)
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	_, err = mockRedshift.Copy(tx, s3File, Table{}, "|", true, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestUpdateTable(t *testing.T) {
+	schema, table := "testschema", "tablename"
+
+	inputTable := Table{
+		Name: table,
+		// order incorrectly on purpose to ensure ordering works
+		Columns: []ColInfo{
+			{"test3", "boolean", "true", false, false, false, 0, ""},
+			{"test2", "int", "100", true, false, true, 1, ""},
+			{"id", "text", "", false, true, false, 0, ""},
+			{"test4", "float", "false", false, false, false, 0, ""},
+			{"test5", "bigint", "9999999999", false, false, false, 0, ""},
+		},
+		Meta: Meta{Schema: schema},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	for _, updateSQL := range []string{
+		`ADD COLUMN id character varying(256) PRIMARY KEY `,
+		`ADD COLUMN test2 integer DEFAULT 100 NOT NULL SORTKEY DISTKEY `,
+		`ADD COLUMN test4 double precision`,
+		`ADD COLUMN test5 bigint DEFAULT 9999999999`,
+	} {
+		sql := fmt.Sprintf(`ALTER TABLE "%s"."%s" (%s)`, schema, table, updateSQL)
+		regex := `ALTER TABLE ".*".".*" (.*)` // a little awk, but the prepare makes sure this is good
+
+		mock.ExpectPrepare(sql)
+		mock.ExpectExec(regex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectCommit()
+
+	fewerColumnsTargetTable := Table{
+		Name: table,
+		Columns: []ColInfo{
+			{"test3", "boolean", "true", false, false, false, 0, ""},
+		},
+		Meta: Meta{Schema: schema},
+	}
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.UpdateTable(tx, inputTable, fewerColumnsTargetTable, false, false))
+	assert.NoError(t, tx.Commit())
+}
+
+func TestCheckSchemasSame(t *testing.T) {
+	t1 := Table{Columns: []ColInfo{
+		ColInfo{Name: "IntColumn", PrimaryKey: true},
+		ColInfo{Name: "DateColumn", PrimaryKey: true},
+	}}
+	t2 := t1
+	columnOps, err := checkSchemas(t1, t2)
+	assert.Equal(t, 0, len(columnOps))
+	assert.NoError(t, err)
+}
+
+func TestCheckSchemasAddColumns(t *testing.T) {
 	inputTable := Table{Columns: []ColInfo{
 		ColInfo{Name: "IntColumn", PrimaryKey: true},
 		ColInfo{Name: "DateColumn", PrimaryKey: false},
@@ -569,53 +1323,1500 @@ func TestCheckSchemasAddColumns(t *testing.T) {
 	}}
 	columnOps, err := checkSchemas(inputTable, t2)
 	assert.NoError(t, err)
-	assert.Equal(t, 2, len(columnOps))
+	assert.Equal(t, 2, len(columnOps))
+}
+
+func TestCheckSchemasAddNotNullColumns(t *testing.T) {
+	target := Table{Name: "tablename", Columns: []ColInfo{{Name: "id", Type: "integer"}}, Meta: Meta{Schema: "testschema"}}
+	input := Table{Columns: []ColInfo{
+		{Name: "id", Type: "int"},
+		{Name: "count", Type: "int", NotNull: true, DefaultVal: "0"},
+	}}
+	columnOps, err := checkSchemas(input, target)
+	assert.NoError(t, err)
+	if assert.Len(t, columnOps, 1) {
+		assert.Regexp(t, `ALTER TABLE "testschema"."tablename" ADD COLUMN\s+"count" integer DEFAULT 0\s+NOT NULL`, columnOps[0])
+	}
+
+	// the existing rows can't be null, so there has to be a default for them
+	input.Columns[1].DefaultVal = ""
+	for _, schema := range []string{"testschema", "mongo_raw"} {
+		target.Meta.Schema = schema
+		_, err = checkSchemas(input, target)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "can't add NOT NULL column count to "+schema+".tablename without a defaultval")
+		}
+	}
+}
+
+func TestUpdateTableColumnCase(t *testing.T) {
+	// the config is snake_case, but the table was created with quoted mixed case names
+	inputTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "userid", Type: "int", DistKey: true},
+		{Name: "\"CreatedAt\"", Type: "timestamp", SortOrdinal: 1},
+		{Name: "name", Type: "text"},
+		{Name: "count", Type: "int"},
+	}, Meta: Meta{Schema: "testschema"}}
+	targetTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "UserId", Type: "integer", DistKey: true},
+		{Name: "createdAt", Type: "timestamp without time zone", SortOrdinal: 1},
+		{Name: "Name", Type: "character varying(128)"},
+	}, Meta: Meta{Schema: "testschema"}}
+
+	for _, schema := range []string{"testschema", "mongo_raw"} {
+		inputTable.Meta.Schema, targetTable.Meta.Schema = schema, schema
+		columnOps, err := checkSchemas(inputTable, targetTable)
+		assert.NoError(t, err, schema)
+		// only the column that's really missing is added
+		if assert.Len(t, columnOps, 1, schema) {
+			assert.Contains(t, columnOps[0], `ADD COLUMN  "count" integer`)
+		}
+		assert.NoError(t, checkKeys(inputTable, targetTable), schema)
+	}
+
+	// the existing column's name is used to alter it
+	ops, err := widenColumnOps(inputTable, targetTable)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`ALTER TABLE "mongo_raw"."tablename" ALTER COLUMN "Name" TYPE character varying(256)`}, ops)
+
+	dropOps, _, err := dropColumnOps(inputTable, targetTable)
+	assert.NoError(t, err)
+	assert.Empty(t, dropOps)
+
+	diff, err := (&Redshift{}).DiffTable(inputTable, targetTable)
+	assert.NoError(t, err)
+	assert.Len(t, diff.AddedColumns, 1)
+	assert.Empty(t, diff.DroppedColumns)
+	assert.Empty(t, diff.KeyChanges)
+}
+
+func TestCheckSchemasDiffs(t *testing.T) {
+	// Do a re-order and a type difference
+	inputTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "IntColumn", Type: "int"},
+		ColInfo{Name: "DateColumn", Type: "timestamp without time zone"},
+		ColInfo{Name: "IntColumn2", Type: "int"},
+	}}
+	targetTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "DateColumn", Type: "timestamp"},
+		ColInfo{Name: "IntColumn", Type: "integer"},
+		ColInfo{Name: "IntColumn2", Type: "long"},
+	}}
+	columnOps, err := checkSchemas(inputTable, targetTable)
+	assert.Equal(t, 0, len(columnOps))
+	assert.Equal(t, 5, len(err.(*multierror.Error).Errors), fmt.Sprintf("Errors: %s", err))
+}
+
+func TestCheckKeysDifferingSortkey(t *testing.T) {
+	// Do a different sortkey
+	inputTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "DateColumn", Type: "timestamp"},
+		ColInfo{Name: "IntColumn", Type: "int", SortOrdinal: 1},
+		ColInfo{Name: "IntColumn2", Type: "int"},
+	}}
+	targetTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "DateColumn", Type: "timestamp without time zone"},
+		ColInfo{Name: "IntColumn", Type: "integer"},
+		ColInfo{Name: "IntColumn2", Type: "integer", SortOrdinal: 1},
+	}}
+	err := checkKeys(inputTable, targetTable)
+	assert.Equal(t, 1, len(err.(*multierror.Error).Errors), fmt.Sprintf("Errors: %s", err))
+	assert.Contains(t, err.Error(), "mismatched sortkey, config: (IntColumn), table: (IntColumn2)")
+}
+
+func TestCheckKeys(t *testing.T) {
+	inputTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "id", DistKey: true},
+		ColInfo{Name: "time", SortOrdinal: 1},
+		ColInfo{Name: "value"},
+	}}
+	// a config sortkey which leads the live sortkey is fine
+	targetTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "id", DistKey: true},
+		ColInfo{Name: "time", SortOrdinal: 1},
+		ColInfo{Name: "value", SortOrdinal: 2},
+	}}
+	assert.NoError(t, checkKeys(inputTable, targetTable))
+
+	// but a different distkey isn't
+	targetTable.Columns[0].DistKey = false
+	targetTable.Columns[2].DistKey = true
+	err := checkKeys(inputTable, targetTable)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mismatched distkey, config: id, table: value")
+	}
+
+	// keys left out of the config aren't compared
+	assert.NoError(t, checkKeys(Table{Columns: []ColInfo{{Name: "id"}}}, targetTable))
+
+	// nor is the style of one column sortkeys, but a compound sortkey isn't an interleaved one
+	inputTable.Columns[2].SortOrdinal = 2
+	inputTable.Meta.SortKeyStyle = SortKeyInterleaved
+	targetTable.Columns[0].DistKey = true
+	targetTable.Columns[2].DistKey = false
+	err = checkKeys(inputTable, targetTable)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mismatched sortkey style, config: interleaved, table: compound")
+	}
+}
+
+func TestUpdateTableKeyDrift(t *testing.T) {
+	inputTable := Table{Name: "tablename", Columns: []ColInfo{{Name: "id", Type: "int", DistKey: true}}, Meta: Meta{Schema: "testschema"}}
+	targetTable := Table{Name: "tablename", Columns: []ColInfo{{Name: "id", Type: "integer"}}, Meta: Meta{Schema: "testschema"}}
+	mockRedshift := Redshift{ctx: textCtx}
+
+	err := mockRedshift.UpdateTable(nil, inputTable, targetTable, false, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mismatched keys")
+		assert.True(t, errors.Is(err, ErrTableSchemaMismatch))
+	}
+	assert.NoError(t, mockRedshift.UpdateTable(nil, inputTable, targetTable, true, false))
+}
+
+func TestUpdateTableTypeMismatch(t *testing.T) {
+	inputTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "int"},
+		{Name: "count", Type: "bigint"},
+		{Name: "name", Type: "longtext"},
+		{Name: "created", Type: "timestamp"},
+	}, Meta: Meta{Schema: "testschema"}}
+	targetTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "character varying(256)"},
+		{Name: "count", Type: "integer"},
+		{Name: "name", Type: "character varying(256)"},
+		{Name: "created", Type: "timestamp without time zone"},
+	}, Meta: Meta{Schema: "testschema"}}
+	mockRedshift := Redshift{ctx: textCtx}
+
+	// nothing is altered, and the error lists every column whose type has drifted
+	err := mockRedshift.UpdateTable(nil, inputTable, targetTable, false, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mismatched column: id property: Type, input: integer, target: character varying(256)")
+		assert.True(t, errors.Is(err, ErrTableSchemaMismatch))
+		assert.Contains(t, err.Error(), "can't widen column count from integer to bigint")
+		assert.NotContains(t, err.Error(), "column: name")
+		assert.NotContains(t, err.Error(), "column: created")
+	}
+}
+
+func TestDiffTable(t *testing.T) {
+	inputTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "int", DistKey: true},
+		{Name: "name", Type: "longtext"},
+		{Name: "created", Type: "timestamp", SortOrdinal: 1},
+		{Name: "new", Type: "boolean"},
+	}, Meta: Meta{Schema: "testschema"}}
+	targetTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "integer"},
+		{Name: "name", Type: "character varying(256)"},
+		{Name: "created", Type: "timestamp without time zone", SortOrdinal: 1},
+		{Name: "old", Type: "integer"},
+	}, Meta: Meta{Schema: "testschema"}}
+	mockRedshift := Redshift{ctx: textCtx}
+
+	diff, err := mockRedshift.DiffTable(inputTable, targetTable)
+	assert.NoError(t, err)
+	assert.Equal(t, TableDiff{
+		AddedColumns:   []ColInfo{{Name: "new", Type: "boolean"}},
+		DroppedColumns: []ColInfo{{Name: "old", Type: "integer"}},
+		TypeChanges:    []TypeChange{{Column: "name", From: "character varying(256)", To: "character varying(65535)"}},
+		KeyChanges:     []string{"mismatched distkey, config: id, table: "},
+	}, diff)
+	assert.False(t, diff.Empty())
+
+	diff, err = mockRedshift.DiffTable(targetTable, targetTable)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "column id has unknown type integer")
+	}
+
+	inputTable.Columns = inputTable.Columns[:3]
+	inputTable.Columns[0].DistKey = false
+	inputTable.Columns[1].Type = "text"
+	targetTable.Columns = targetTable.Columns[:3]
+	diff, err = mockRedshift.DiffTable(inputTable, targetTable)
+	assert.NoError(t, err)
+	assert.True(t, diff.Empty())
+}
+
+func TestUpdateTableDropColumns(t *testing.T) {
+	schema, table := "testschema", "tablename"
+	inputTable := Table{
+		Name:    table,
+		Columns: []ColInfo{{Name: "id", Type: "int"}, {Name: "added", Type: "int"}},
+		Meta:    Meta{Schema: schema},
+	}
+	targetTable := Table{
+		Name:    table,
+		Columns: []ColInfo{{Name: "id", Type: "integer"}, {Name: "removed", Type: "integer"}},
+		Meta:    Meta{Schema: schema},
+	}
+
+	// without opting in, the extra column is a schema mismatch
+	mockRedshift := Redshift{ctx: textCtx}
+	assert.Error(t, mockRedshift.UpdateTable(nil, inputTable, targetTable, false, false))
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift = Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`ALTER TABLE "testschema"."tablename" DROP COLUMN "removed"`)
+	mock.ExpectExec(`ALTER TABLE "testschema"."tablename" DROP COLUMN "removed"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare(`ALTER TABLE "testschema"."tablename" ADD COLUMN "added" integer`)
+	mock.ExpectExec(`ALTER TABLE "testschema"."tablename" ADD COLUMN "added" integer`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.UpdateTable(tx, inputTable, targetTable, false, true))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+
+	// key columns are never dropped
+	targetTable.Columns[1].SortOrdinal = 1
+	err = mockRedshift.UpdateTable(nil, inputTable, targetTable, true, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "refusing to drop column removed")
+	}
+}
+
+func TestReorder(t *testing.T) {
+	inputTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "IntColumn2", Type: "int"},
+		ColInfo{Name: "IntColumn", Type: "int"},
+	}}
+	targetTable := Table{Columns: []ColInfo{
+		ColInfo{Name: "IntColumn", Type: "integer"},
+		ColInfo{Name: "IntColumn2", Type: "integer"},
+	}}
+	columnOps, err := checkSchemas(inputTable, targetTable)
+	assert.Equal(t, 0, len(columnOps))
+	assert.Equal(t, 2, len(err.(*multierror.Error).Errors), fmt.Sprintf("Errors: %s", err))
+}
+
+func TestUpsertWithStagingTable(t *testing.T) {
+	schema, table := "testschema", "tablename"
+	dbTable := Table{
+		Name: table,
+		Columns: []ColInfo{
+			{Name: "id", Type: "text", PrimaryKey: true},
+			{Name: "value", Type: "int"},
+		},
+		Meta: Meta{Schema: schema},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE "tablename_staging" \(LIKE "testschema"."tablename"\)`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM "testschema"."tablename" USING "tablename_staging" WHERE "testschema"."tablename"."id" = "tablename_staging"."id"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO "testschema"."tablename" SELECT \* FROM "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP TABLE "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	staging, err := mockRedshift.CreateStagingTable(tx, dbTable)
+	assert.NoError(t, err)
+	assert.Equal(t, `"tablename_staging"`, staging)
+	assert.NoError(t, mockRedshift.MergeStagingTable(tx, staging, dbTable))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+
+	// a table without a primary key can't be merged
+	dbTable.Columns[0].PrimaryKey = false
+	mergeErr := mockRedshift.MergeStagingTable(nil, staging, dbTable)
+	if assert.Error(t, mergeErr) {
+		assert.Contains(t, mergeErr.Error(), "no primary key columns")
+	}
+}
+
+func TestDedupStagingTable(t *testing.T) {
+	dbTable := Table{
+		Name: "tablename",
+		Columns: []ColInfo{
+			{Name: "id", Type: "text"},
+			{Name: "created", Type: "timestamp"},
+		},
+		Meta: Meta{Schema: "testschema", DataDateColumn: "created"},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	// without a dedup key, only exact duplicates are removed
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE "tablename_staging" \(LIKE "testschema"."tablename"\)`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TEMP TABLE "tablename_dedup" AS SELECT DISTINCT "id", "created" FROM "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO "tablename_staging" \("id", "created"\) SELECT "id", "created" FROM "tablename_dedup"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP TABLE "tablename_dedup"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO "testschema"."tablename" SELECT \* FROM "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP TABLE "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	staging, err := mockRedshift.CreateStagingTable(tx, dbTable)
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.DedupStagingTable(tx, staging, dbTable))
+	assert.NoError(t, mockRedshift.InsertStagingTable(tx, staging, dbTable))
+	assert.NoError(t, tx.Commit())
+
+	// with one, the latest row for each key is kept
+	dbTable.Meta.DedupKey = []string{"id"}
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE "tablename_dedup" AS SELECT "id", "created" FROM \(SELECT "id", "created", ROW_NUMBER\(\) OVER \(PARTITION BY "id" ORDER BY "created" DESC\) AS "_dedup_row" FROM "tablename_staging"\) AS deduped WHERE "_dedup_row" = 1`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO "tablename_staging"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP TABLE "tablename_dedup"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err = mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.DedupStagingTable(tx, staging, dbTable))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestGrantAccess(t *testing.T) {
+	table := Table{Name: "tablename", Meta: Meta{Schema: "testschema", Grants: []string{"GROUP analysts", "ROLE reader", "etl_user"}}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	for _, to := range []string{`GROUP "analysts"`, `ROLE "reader"`, `"etl_user"`} {
+		mock.ExpectExec(regexp.QuoteMeta(`GRANT SELECT ON "testschema"."tablename" TO ` + to)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.GrantAccess(tx, table))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestSwapTable(t *testing.T) {
+	table := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "int", DistKey: true},
+		{Name: "created", Type: "timestamp", SortOrdinal: 1},
+	}, Meta: Meta{Schema: "testschema"}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "testschema"."tablename_swap_\d+_[0-9a-f]{8}" \( "id" integer`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`ALTER TABLE "testschema"."tablename" RENAME TO "tablename_old_\d+_[0-9a-f]{8}"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`ALTER TABLE "testschema"."tablename_swap_\d+_[0-9a-f]{8}" RENAME TO "tablename"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectExec(`DROP TABLE "testschema"."tablename_old_\d+_[0-9a-f]{8}"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	swap, err := mockRedshift.CreateSwapTable(tx, table)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^tablename_swap_\d+_[0-9a-f]{8}$`, swap)
+	old, err := mockRedshift.SwapTable(tx, "testschema", "tablename", swap)
+	assert.NoError(t, err)
+	// the old table is named like the swap table, so it's clear which run they came from
+	assert.Equal(t, strings.Replace(swap, "_swap_", "_old_", 1), old)
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, mockRedshift.DropTable(nil, "testschema", old))
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRebuildTable(t *testing.T) {
+	inputTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "int", DistKey: true},
+		{Name: "created", Type: "timestamp", SortOrdinal: 1},
+		{Name: "name", Type: "text"},
+	}, Meta: Meta{Schema: "testschema"}}
+	targetTable := Table{Name: "tablename", Columns: []ColInfo{
+		{Name: "id", Type: "integer", SortOrdinal: 1},
+		{Name: "created", Type: "timestamp without time zone", DistKey: true},
+	}, Meta: Meta{Schema: "testschema"}}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "testschema"."tablename_swap_\d+_[0-9a-f]{8}" \( "id" integer`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO "testschema"."tablename_swap_\d+_[0-9a-f]{8}" \("id", "created"\) SELECT "id", "created" FROM "testschema"."tablename"`).
+		WithArgs().WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(`ALTER TABLE "testschema"."tablename" RENAME TO "tablename_old_\d+_[0-9a-f]{8}"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`ALTER TABLE "testschema"."tablename_swap_\d+_[0-9a-f]{8}" RENAME TO "tablename"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	old, err := mockRedshift.RebuildTable(tx, inputTable, targetTable)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^tablename_old_\d+_[0-9a-f]{8}$`, old)
+	assert.NoError(t, tx.Commit())
+
+	// a column only in the table would be dropped with its data
+	targetTable.Columns = append(targetTable.Columns, ColInfo{Name: "extra", Type: "integer"})
+	_, err = mockRedshift.RebuildTable(nil, inputTable, targetTable)
+	assert.EqualError(t, err, "can't rebuild testschema.tablename, columns extra aren't in the config and would be lost")
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestVacuumAnalyze(t *testing.T) {
+	schema, table := "testschema", "tablename"
+	statsRegex := `SELECT tbl_rows, size, unsorted FROM svv_table_info WHERE "schema" = 'testschema' AND "table" = 'tablename'`
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	// mostly unsorted, so vacuum and analyze
+	statsRows := sqlmock.NewRows([]string{"tbl_rows", "size", "unsorted"})
+	statsRows.AddRow(1000, 10, 20.5)
+	mock.ExpectQuery(statsRegex).WithArgs().WillReturnRows(statsRows)
+	mock.ExpectExec(`VACUUM "testschema"."tablename"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`ANALYZE "testschema"."tablename"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(t, mockRedshift.VacuumAnalyze(schema, table, 5))
+
+	// barely unsorted, so only analyze
+	statsRows = sqlmock.NewRows([]string{"tbl_rows", "size", "unsorted"})
+	statsRows.AddRow(1000, 10, 1.0)
+	mock.ExpectQuery(statsRegex).WithArgs().WillReturnRows(statsRows)
+	mock.ExpectExec(`ANALYZE "testschema"."tablename"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(t, mockRedshift.VacuumAnalyze(schema, table, 5))
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestGetTableStats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	statsRows := sqlmock.NewRows([]string{"tbl_rows", "size", "unsorted"})
+	statsRows.AddRow("123456", 42, 3.25)
+	mock.ExpectQuery(`SELECT tbl_rows, size, unsorted FROM svv_table_info`).WithArgs().WillReturnRows(statsRows)
+	stats, err := mockRedshift.GetTableStats("testschema", "tablename")
+	assert.NoError(t, err)
+	assert.Equal(t, TableStats{Rows: 123456, SizeMB: 42, UnsortedPct: 3.25}, stats)
+
+	// empty tables aren't in svv_table_info
+	mock.ExpectQuery(`SELECT tbl_rows, size, unsorted FROM svv_table_info`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"tbl_rows", "size", "unsorted"}))
+	stats, err = mockRedshift.GetTableStats("testschema", "tablename")
+	assert.NoError(t, err)
+	assert.Equal(t, TableStats{}, stats)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestWidenColumns(t *testing.T) {
+	schema, table := "testschema", "tablename"
+	inputTable := Table{
+		Name:    table,
+		Columns: []ColInfo{{Name: "id", Type: "int"}, {Name: "name", Type: "longtext"}},
+		Meta:    Meta{Schema: schema},
+	}
+	targetTable := Table{
+		Name:    table,
+		Columns: []ColInfo{{Name: "id", Type: "integer"}, {Name: "name", Type: "character varying(256)"}},
+		Meta:    Meta{Schema: schema},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectExec(`ALTER TABLE "testschema"."tablename" ALTER COLUMN "name" TYPE character varying\(65535\)`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(t, mockRedshift.WidenColumns(inputTable, targetTable))
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+
+	// the varchar width difference isn't a schema mismatch
+	columnOps, err := checkSchemas(inputTable, targetTable)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(columnOps))
+
+	// narrowing is refused
+	inputTable.Columns[1].Type = "text"
+	targetTable.Columns[1].Type = "character varying(1024)"
+	_, err = widenColumnOps(inputTable, targetTable)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "refusing to narrow column name from character varying(1024) to character varying(256)")
+	}
+
+	// and so is int -> bigint, which redshift can't alter in place
+	inputTable.Columns[0].Type = "bigint"
+	_, err = checkSchemas(inputTable, targetTable)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "can't widen column id from integer to bigint")
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := NewRedshiftFromDB(textCtx, db)
+
+	mockRedshift.SetMaxOpenConns(4)
+	mockRedshift.SetMaxIdleConns(2)
+	mockRedshift.SetConnMaxLifetime(time.Hour)
+	assert.Equal(t, 4, db.Stats().MaxOpenConnections)
+	assert.NoError(t, mockRedshift.Ping())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestEnvCredentialProvider(t *testing.T) {
+	vars := map[string]string{
+		"REDSHIFT_HOST": "", "REDSHIFT_PORT": "", "REDSHIFT_DB": "db", "REDSHIFT_USER": "", "REDSHIFT_PASSWORD": "",
+		"REDSHIFT_ROLE_ARN": "arn", "AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": "", "AWS_SESSION_TOKEN": "",
+	}
+	for name, v := range vars {
+		old, had := os.LookupEnv(name)
+		os.Setenv(name, v)
+		if had {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	_, err := EnvCredentialProvider{}.Credentials()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "REDSHIFT_PASSWORD, REDSHIFT_USER")
+	}
+
+	os.Setenv("REDSHIFT_USER", "user")
+	os.Setenv("REDSHIFT_PASSWORD", "password")
+	creds, err := EnvCredentialProvider{}.Credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Host: "localhost", Port: "5439", DB: "db", User: "user", Password: "password", RoleARN: "arn"}, creds)
+	assert.Equal(t, s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "arn"}, creds.Bucket("bucket", "region"))
+
+	// refreshed credentials replace the old ones, leaving the rest of the bucket alone
+	old := s3filepath.S3Bucket{Name: "bucket", Region: "region", AccessID: "id", SecretKey: "secret", Token: "expired", KMSKeyARN: "key"}
+	fresh := Credentials{AccessID: "id2", SecretKey: "secret2", Token: "token2"}
+	assert.Equal(t, s3filepath.S3Bucket{Name: "bucket", Region: "region", AccessID: "id2", SecretKey: "secret2", Token: "token2", KMSKeyARN: "key"},
+		fresh.ApplyTo(old))
+
+	// the provider's keys sign our own s3 requests, and are refreshed with the rest
+	assert.Nil(t, creds.S3Credentials())
+	old.Credentials = Credentials{AccessID: "id", SecretKey: "secret", Token: "expired"}.S3Credentials()
+	keys, err := fresh.ApplyTo(old).Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "id2", keys.AccessKeyID)
+	assert.Equal(t, "token2", keys.SessionToken)
+
+	os.Setenv("REDSHIFT_USER", "")
+	_, err = NewRedshiftFromProvider(textCtx, EnvCredentialProvider{}, 1)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error getting credentials: missing environment variables REDSHIFT_USER")
+	}
+}
+
+func TestSessionParams(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := NewRedshiftFromDB(textCtx, db)
+
+	assert.Error(t, mockRedshift.SetSessionParams([]SessionParam{{Name: "query_group; DROP TABLE x", Value: "loads"}}))
+	assert.NoError(t, mockRedshift.SetSessionParams([]SessionParam{
+		{Name: "query_group", Value: "loads"},
+		{Name: "statement_timeout", Value: "3600000"},
+	}))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET query_group TO 'loads'`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`SET statement_timeout TO '3600000'`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	// a parameter that can't be set fails the transaction
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET query_group TO 'loads'`)).WithArgs().WillReturnError(fmt.Errorf("unrecognized configuration parameter"))
+	mock.ExpectRollback()
+	_, err = mockRedshift.Begin()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "issue setting query_group")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestSetStatementTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := NewRedshiftFromDB(textCtx, db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET LOCAL statement_timeout TO 1800000`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.SetStatementTimeout(tx, 30*time.Minute))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestIsStatementTimeoutError(t *testing.T) {
+	timeout := &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}
+	assert.True(t, IsStatementTimeoutError(timeout))
+	assert.True(t, IsStatementTimeoutError(fmt.Errorf("err running copy: %w", timeout)))
+	assert.True(t, IsStatementTimeoutError(fmt.Errorf("%w: load took too long", ErrStatementTimeout)))
+	// cancelled some other way, e.g. on SIGTERM
+	assert.False(t, IsStatementTimeoutError(&pq.Error{Code: "57014", Message: "canceling statement due to user request"}))
+	assert.False(t, IsStatementTimeoutError(errors.New("statement timeout")))
+	assert.False(t, IsTransientError(timeout))
+}
+
+// a timed out COPY is still a CopyError, with its load errors, as well as a statement timeout
+func TestStatementTimeoutError(t *testing.T) {
+	timeout := &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}
+	copyErr := &CopyError{File: "s3://bucket/testschema/tablename/data.json.gz", Err: timeout}
+	var err error = &StatementTimeoutError{Err: fmt.Errorf("err running copy: %w", copyErr)}
+
+	assert.True(t, errors.Is(err, ErrStatementTimeout))
+	assert.True(t, IsStatementTimeoutError(err))
+	var ce *CopyError
+	if assert.True(t, errors.As(err, &ce)) {
+		assert.Equal(t, copyErr, ce)
+	}
+	var pqErr *pq.Error
+	if assert.True(t, errors.As(err, &pqErr)) {
+		assert.Equal(t, timeout, pqErr)
+	}
+	assert.Equal(t, "statement timed out: err running copy: pq: canceling statement due to statement timeout", err.Error())
+}
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, IsTransientError(&pq.Error{Code: "40001"}))
+	assert.True(t, IsTransientError(fmt.Errorf("err running copy: %w", &pq.Error{Code: "57P03"})))
+	assert.True(t, IsTransientError(fmt.Errorf("issue running statement: %w", driver.ErrBadConn)))
+	assert.False(t, IsTransientError(&pq.Error{Code: "42601"})) // syntax_error
+	assert.False(t, IsTransientError(fmt.Errorf("Load into table 'tablename' failed")))
+}
+
+func TestIsDeadlockError(t *testing.T) {
+	assert.True(t, IsDeadlockError(fmt.Errorf("err running copy: %w", &pq.Error{Code: "40P01"})))
+	assert.False(t, IsDeadlockError(&pq.Error{Code: "40001"}))
+	assert.False(t, IsDeadlockError(errors.New("deadlock detected")))
+}
+
+func TestIsExpiredTokenError(t *testing.T) {
+	assert.True(t, IsExpiredTokenError(fmt.Errorf("err running copy: %w", &pq.Error{
+		Message: "S3ServiceException:The provided token has expired.,Status 400,Error ExpiredToken",
+	})))
+	assert.True(t, IsExpiredTokenError(errors.New("The security token included in the request is expired")))
+	assert.False(t, IsExpiredTokenError(&pq.Error{Code: "40001"}))
+	assert.False(t, IsExpiredTokenError(nil))
+}
+
+func TestAnalyzeCompression(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	rows := sqlmock.NewRows([]string{"Table", "Column", "Encoding", "Est_reduction_pct"})
+	rows.AddRow("tablename", "id", "zstd", 62.5)
+	rows.AddRow("tablename", "created", "az64", 40.0)
+	mock.ExpectQuery(`ANALYZE COMPRESSION "testschema"."tablename"`).WithArgs().WillReturnRows(rows)
+
+	encodings, err := mockRedshift.AnalyzeCompression("testschema", "tablename")
+	assert.NoError(t, err)
+	assert.Equal(t, []ColumnEncoding{
+		{Column: "id", Encoding: "zstd", EstReductionPct: 62.5},
+		{Column: "created", Encoding: "az64", EstReductionPct: 40.0},
+	}, encodings)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestValidateTableConfig(t *testing.T) {
+	valid := Table{
+		Name: "tablename",
+		Columns: []ColInfo{
+			{Name: "id", Type: "text", PrimaryKey: true, DistKey: true},
+			{Name: "created", Type: "timestamp", SortOrdinal: 1},
+			{Name: "count", Type: "int", SortOrdinal: 2},
+		},
+		Meta: Meta{Schema: "testschema", DataDateColumn: "created"},
+	}
+	assert.NoError(t, ValidateTableConfig(valid))
+
+	invalid := Table{
+		Name: "tablename",
+		Columns: []ColInfo{
+			{Name: "id", Type: "text", DistKey: true},
+			{Name: "id", Type: "varchar", DistKey: true},
+			{Name: "count", Type: "int", SortOrdinal: 2},
+		},
+		Meta: Meta{DataDateColumn: "created"},
+	}
+	err := ValidateTableConfig(invalid)
+	if assert.Error(t, err) {
+		for _, expected := range []string{
+			"schema must be set",
+			"column id is listed more than once",
+			"column id has unknown type varchar",
+			"data date column created isn't one of the columns",
+			"only one column can be the distkey, got id, id",
+			"sortord 1 is missing",
+		} {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+
+	encoded := valid
+	encoded.Columns = []ColInfo{
+		{Name: "id", Type: "text", DistKey: true, Encoding: "ZSTD"},
+		{Name: "created", Type: "timestamp", SortOrdinal: 1, Encoding: "az64"},
+		{Name: "count", Type: "int", Encoding: "gzip"},
+	}
+	err = ValidateTableConfig(encoded)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "column count has unknown encoding gzip, must be one of az64, bytedict")
+		assert.NotContains(t, err.Error(), "column id")
+	}
+
+	grants := valid
+	grants.Meta.Grants = []string{"GROUP analysts", "etl_user", "analysts; DROP TABLE x"}
+	err = ValidateTableConfig(grants)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `grant to "analysts; DROP TABLE x" must be a user`)
+		assert.NotContains(t, err.Error(), "etl_user")
+	}
+
+	dedup := valid
+	dedup.Meta.DedupKey = []string{"id", "missing"}
+	err = ValidateTableConfig(dedup)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "dedup key column missing isn't one of the columns")
+		assert.NotContains(t, err.Error(), "column id")
+	}
+
+	jsonPaths := valid
+	jsonPaths.Meta.JSONPaths = "jsonpaths.json"
+	err = ValidateTableConfig(jsonPaths)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "jsonpaths must be an s3 path, got jsonpaths.json")
+	}
+
+	dataDate := valid
+	dataDate.Meta.DataDateHourColumn = "hour"
+	dataDate.Meta.DataDateTimezone = "Mars/Olympus_Mons"
+	err = ValidateTableConfig(dataDate)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "data date hour column hour isn't one of the columns")
+		assert.Contains(t, err.Error(), "unknown data date timezone Mars/Olympus_Mons")
+	}
+	dataDate.Meta.DataDateHourColumn = "count"
+	dataDate.Meta.DataDateTimezone = "America/Los_Angeles"
+	assert.NoError(t, ValidateTableConfig(dataDate))
+
+	invChars := valid
+	for _, c := range []string{"??", "é", "\x00"} {
+		invChars.Meta.AcceptInvChars = c
+		err = ValidateTableConfig(invChars)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "acceptinvchars must be a single ASCII character")
+		}
+	}
+
+	nested := valid
+	nested.Columns = append([]ColInfo{}, valid.Columns...)
+	nested.Columns = append(nested.Columns, ColInfo{Name: "payload", Type: "super"})
+	assert.NoError(t, ValidateTableConfig(nested))
+	nested.Columns[3].SortOrdinal = 3
+	err = ValidateTableConfig(nested)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "column payload is super, which can't be in the distkey or sortkey")
+	}
+
+	quoted := valid
+	quoted.Meta.Delimiter, quoted.Meta.Quote = "||", "|"
+	err = ValidateTableConfig(quoted)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "delimiter must be a single ASCII character")
+	}
+	quoted.Meta.Delimiter = "|"
+	err = ValidateTableConfig(quoted)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `quote and delimiter can't both be "|"`)
+	}
+	quoted.Meta.Quote = "`"
+	assert.NoError(t, ValidateTableConfig(quoted))
+
+	interleaved := valid
+	interleaved.Meta.SortKeyStyle = SortKeyInterleaved
+	assert.NoError(t, ValidateTableConfig(interleaved))
+	interleaved.Columns = nil
+	for i := 1; i <= 9; i++ {
+		interleaved.Columns = append(interleaved.Columns, ColInfo{Name: fmt.Sprintf("c%d", i), Type: "int", SortOrdinal: i})
+	}
+	interleaved.Meta.DataDateColumn = "c1"
+	err = ValidateTableConfig(interleaved)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "interleaved sortkeys can have at most 8 columns, got 9")
+	}
+	interleaved.Meta.SortKeyStyle = "sideways"
+	err = ValidateTableConfig(interleaved)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown sortkey style sideways")
+	}
+}
+
+func TestUnload(t *testing.T) {
+	bucket := s3filepath.S3Bucket{Region: "region", RedshiftRoleARN: "redshiftRoleARN"}
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UNLOAD ('SELECT * FROM "s"."t" WHERE name = ''foo''') TO 's3://bucket/backup/t_' ` +
+		`IAM_ROLE 'redshiftRoleARN' DELIMITER AS '|' ADDQUOTES ESCAPE PARALLEL ON GZIP REGION 'region'`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UNLOAD ('SELECT 1') TO 's3://bucket/backup/t_' IAM_ROLE 'redshiftRoleARN' FORMAT AS PARQUET PARALLEL OFF`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := mockRedshift.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, mockRedshift.Unload(tx, `SELECT * FROM "s"."t" WHERE name = 'foo'`, "s3://bucket/backup/t_",
+		UnloadOptions{Bucket: bucket, Parallel: true, GZip: true}))
+	assert.NoError(t, mockRedshift.Unload(tx, "SELECT 1", "s3://bucket/backup/t_",
+		UnloadOptions{Bucket: s3filepath.S3Bucket{RedshiftRoleARN: "redshiftRoleARN"}, Format: UnloadFormatParquet}))
+	// parquet is already compressed
+	assert.Error(t, mockRedshift.Unload(tx, "SELECT 1", "s3://bucket/backup/t_",
+		UnloadOptions{Bucket: bucket, Format: UnloadFormatParquet, GZip: true}))
+	assert.NoError(t, tx.Commit())
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRecordLoad(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	start := time.Date(2015, 11, 10, 23, 5, 0, 0, time.UTC)
+	entry := LoadEntry{
+		Schema: "testschema", Table: "tablename", DataDate: time.Date(2015, 11, 10, 23, 0, 0, 0, time.UTC),
+		S3Path: "s3://bucket/testschema_tablename.json.gz", ETag: "abc123", Start: start, End: start.Add(time.Minute),
+		Success: false, Error: "Load into table 'tablename' failed",
+	}
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS redshift_load_history`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO redshift_load_history VALUES ('testschema', 'tablename', '2015-11-10T23:00:00Z', ` +
+		`'s3://bucket/testschema_tablename.json.gz', 'abc123', 0, '2015-11-10T23:05:00Z', '2015-11-10T23:06:00Z', false, ` +
+		`'Load into table ''tablename'' failed')`)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, mockRedshift.RecordLoad(entry))
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestLastLoad(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+	dataDate := time.Date(2015, 11, 10, 23, 0, 0, 0, time.UTC)
+
+	// no history table yet
+	mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"table_name"}))
+	entry, err := mockRedshift.LastLoad("testschema", "tablename", dataDate)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// no successful load for the date
+	mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("redshift_load_history"))
+	mock.ExpectQuery(`SELECT s3_path, etag, data_date FROM redshift_load_history`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"s3_path", "etag", "data_date"}))
+	entry, err = mockRedshift.LastLoad("testschema", "tablename", dataDate)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("redshift_load_history"))
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE schema_name = 'testschema' AND table_name = 'tablename' AND data_date = '2015-11-10T23:00:00Z'`)).
+		WithArgs().WillReturnRows(sqlmock.NewRows([]string{"s3_path", "etag", "data_date"}).AddRow("s3://bucket/testschema_tablename.json.gz", "abc123", dataDate))
+	entry, err = mockRedshift.LastLoad("testschema", "tablename", dataDate)
+	assert.NoError(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "s3://bucket/testschema_tablename.json.gz", entry.S3Path)
+		assert.Equal(t, "abc123", entry.ETag)
+	}
+
+	// the latest load of any date
+	older := dataDate.AddDate(0, 0, -1)
+	mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("redshift_load_history"))
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE schema_name = 'testschema' AND table_name = 'tablename' AND success`)).
+		WithArgs().WillReturnRows(sqlmock.NewRows([]string{"s3_path", "etag", "data_date"}).AddRow("s3://bucket/testschema_tablename.json.gz", "abc123", older))
+	entry, err = mockRedshift.LastTableLoad("testschema", "tablename")
+	assert.NoError(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "abc123", entry.ETag)
+		assert.Equal(t, older, entry.DataDate)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
 }
 
-func TestCheckSchemasDiffs(t *testing.T) {
-	// Do a re-order and a type difference
-	inputTable := Table{Columns: []ColInfo{
-		ColInfo{Name: "IntColumn", Type: "int"},
-		ColInfo{Name: "DateColumn", Type: "timestamp without time zone"},
-		ColInfo{Name: "IntColumn2", Type: "int"},
-	}}
-	targetTable := Table{Columns: []ColInfo{
-		ColInfo{Name: "DateColumn", Type: "timestamp"},
-		ColInfo{Name: "IntColumn", Type: "integer"},
-		ColInfo{Name: "IntColumn2", Type: "long"},
-	}}
-	columnOps, err := checkSchemas(inputTable, targetTable)
-	assert.Equal(t, 0, len(columnOps))
-	assert.Equal(t, 5, len(err.(*multierror.Error).Errors), fmt.Sprintf("Errors: %s", err))
+func TestCheckNewData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+	dataDate := time.Date(2015, 11, 10, 23, 0, 0, 0, time.UTC)
+	path := "s3://bucket/testschema_tablename.json.gz"
+
+	history := func() {
+		mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("redshift_load_history"))
+		mock.ExpectQuery(`SELECT s3_path, etag, data_date FROM redshift_load_history`).WithArgs().
+			WillReturnRows(sqlmock.NewRows([]string{"s3_path", "etag", "data_date"}).AddRow(path, "abc123", dataDate))
+	}
+	history()
+	err = mockRedshift.CheckNewData("testschema", "tablename", dataDate, path, "abc123")
+	assert.True(t, errors.Is(err, ErrNoNewData))
+
+	// re-uploaded since it was loaded
+	history()
+	assert.NoError(t, mockRedshift.CheckNewData("testschema", "tablename", dataDate, path, "def456"))
+
+	// nothing recorded for the date, e.g. it was loaded before there was a history table
+	mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnError(sql.ErrNoRows)
+	err = mockRedshift.CheckNewData("testschema", "tablename", dataDate, path, "abc123")
+	assert.True(t, errors.Is(err, ErrNoLoadHistory))
+
+	mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnError(fmt.Errorf("connection reset"))
+	err = mockRedshift.CheckNewData("testschema", "tablename", dataDate, path, "abc123")
+	if assert.Error(t, err) {
+		assert.False(t, errors.Is(err, ErrNoNewData))
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
 }
 
-func TestCheckSchemasDifferingSortkey(t *testing.T) {
-	// Do a different sortkey
-	inputTable := Table{Columns: []ColInfo{
-		ColInfo{Name: "DateColumn", Type: "timestamp"},
-		ColInfo{Name: "IntColumn", Type: "int", SortOrdinal: 1},
-		ColInfo{Name: "IntColumn2", Type: "int"},
-	}}
-	targetTable := Table{Columns: []ColInfo{
-		ColInfo{Name: "DateColumn", Type: "timestamp without time zone"},
-		ColInfo{Name: "IntColumn", Type: "integer"},
-		ColInfo{Name: "IntColumn2", Type: "integer", SortOrdinal: 1},
-	}}
-	columnOps, err := checkSchemas(inputTable, targetTable)
-	assert.Equal(t, 0, len(columnOps))
-	assert.Equal(t, 1, len(err.(*multierror.Error).Errors), fmt.Sprintf("Errors: %s", err))
+func TestHasDataInTimeRange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+	meta := Meta{DataDateColumn: "date"}
+	start := time.Date(2015, 11, 10, 0, 0, 0, 0, time.UTC)
+
+	q := regexp.QuoteMeta(`SELECT 1 FROM "testschema"."tablename" WHERE "date" >= '2015-11-10 00:00:00' AND "date" < '2015-11-11 00:00:00' LIMIT 1`)
+	mock.ExpectQuery(q).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow(1))
+	loaded, err := mockRedshift.HasDataInTimeRange("testschema", "tablename", meta, start, start.AddDate(0, 0, 1))
+	assert.NoError(t, err)
+	assert.True(t, loaded)
+
+	mock.ExpectQuery(q).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"one"}))
+	loaded, err = mockRedshift.HasDataInTimeRange("testschema", "tablename", meta, start, start.AddDate(0, 0, 1))
+	assert.NoError(t, err)
+	assert.False(t, loaded)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
 }
 
-func TestReorder(t *testing.T) {
-	inputTable := Table{Columns: []ColInfo{
-		ColInfo{Name: "IntColumn2", Type: "int"},
-		ColInfo{Name: "IntColumn", Type: "int"},
-	}}
-	targetTable := Table{Columns: []ColInfo{
-		ColInfo{Name: "IntColumn", Type: "integer"},
-		ColInfo{Name: "IntColumn2", Type: "integer"},
+func TestSourceChanged(t *testing.T) {
+	path := "s3://bucket/mongo_users_2020-01-01.json.gz"
+	assert.False(t, sourceChanged(nil, path, "abc"))
+	assert.False(t, sourceChanged(&LoadEntry{S3Path: path, ETag: "abc"}, path, "abc"))
+	assert.True(t, sourceChanged(&LoadEntry{S3Path: path, ETag: "abc"}, path, "def"))
+	assert.True(t, sourceChanged(&LoadEntry{S3Path: "s3://bucket/mongo_users_2020-01-01.json", ETag: "abc"}, path, "abc"))
+	// loads recorded before ETags were, or ETags we couldn't get, only compare the path
+	assert.False(t, sourceChanged(&LoadEntry{S3Path: path}, path, "abc"))
+	assert.False(t, sourceChanged(&LoadEntry{S3Path: path, ETag: "abc"}, path, ""))
+}
+
+func TestParallelCopy(t *testing.T) {
+	parts := []s3filepath.S3File{{
+		Bucket:    s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "arn"},
+		Schema:    "testschema",
+		Table:     "tablename",
+		Suffix:    "manifest",
+		DataDate:  time.Date(2015, 11, 10, 23, 0, 0, 0, time.UTC),
+		Subfolder: "_part0",
 	}}
-	columnOps, err := checkSchemas(inputTable, targetTable)
-	assert.Equal(t, 0, len(columnOps))
-	assert.Equal(t, 2, len(err.(*multierror.Error).Errors), fmt.Sprintf("Errors: %s", err))
+	table := Table{
+		Name: "tablename",
+		Columns: []ColInfo{
+			{"id", "int", "", true, false, true, 1, ""},
+		},
+		Meta: Meta{Schema: "testschema"},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	// the staging table names end in the process ID and some random hex
+	stagingRegex := fmt.Sprintf(`"testschema"."tablename_part0_%d_[0-9a-f]{8}"`, os.Getpid())
+	mock.ExpectBegin()
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS ` + stagingRegex).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopySession(mock)
+	mock.ExpectExec(`COPY ` + stagingRegex + regexp.QuoteMeta(` FROM 's3://bucket/_part0/testschema_tablename_2015-11-10T23:00:00Z.manifest'`)).
+		WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT pg_last_copy_count()`)).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+	mock.ExpectCommit()
+
+	staging, rows, err := mockRedshift.ParallelCopy(parts, table, "", 0, sql.LevelDefault, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, staging, 1) {
+		assert.Regexp(t, "^"+stagingRegex+"$", staging[0])
+	}
+	assert.Equal(t, int64(42), rows)
+
+	// a failed COPY drops the staging tables, which can go in a scratch schema instead. Each part's
+	// transaction SETs the session parameters, like the load's
+	mockRedshift.SetStagingSchema("scratch")
+	assert.NoError(t, mockRedshift.SetSessionParams([]SessionParam{{Name: "query_group", Value: "loads"}}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET query_group TO 'loads'`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "scratch"."tablename_part0_`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopySession(mock)
+	mock.ExpectExec(`COPY`).WithArgs().WillReturnError(fmt.Errorf("copy failed"))
+	mock.ExpectRollback()
+	mock.ExpectExec(`DROP TABLE IF EXISTS "scratch"."tablename_part0_`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, _, err = mockRedshift.ParallelCopy(parts, table, "", 0, sql.LevelDefault, 0)
+	assert.Error(t, err)
+
+	// the parts get the statement timeout too, and a part timing out fails it as a timeout
+	mockRedshift.sessionParams = nil
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET LOCAL statement_timeout TO 60000`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "scratch"."tablename_part0_`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopySession(mock)
+	mock.ExpectExec(`COPY`).WithArgs().WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+	mock.ExpectRollback()
+	mock.ExpectExec(`DROP TABLE IF EXISTS "scratch"."tablename_part0_`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, _, err = mockRedshift.ParallelCopy(parts, table, "", 0, sql.LevelDefault, time.Minute)
+	assert.True(t, errors.Is(err, ErrStatementTimeout))
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestAppendStaging(t *testing.T) {
+	table := Table{Name: "tablename", Meta: Meta{Schema: "testschema"}}
+	staging := []string{`"testschema"."tablename_part0"`, `"testschema"."tablename_part1"`}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	for _, s := range staging {
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "testschema"."tablename" APPEND FROM ` + s + ` FILLTARGET`)).
+			WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	for _, s := range staging {
+		mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS ` + s)).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	assert.NoError(t, mockRedshift.AppendStaging(staging, table))
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// the 2nd of 3 appends fails: only the appended staging table is dropped, the other two are kept and
+// returned so the append can be finished
+func TestAppendStagingPartialFailure(t *testing.T) {
+	table := Table{Name: "tablename", Meta: Meta{Schema: "testschema"}}
+	staging := []string{`"testschema"."tablename_part0"`, `"testschema"."tablename_part1"`, `"testschema"."tablename_part2"`}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	recorder := &execRecorder{DB: db}
+	mockRedshift := Redshift{dbExecCloser: recorder, ctx: textCtx}
+
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "testschema"."tablename" APPEND FROM ` + staging[0] + ` FILLTARGET`)).
+		WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "testschema"."tablename" APPEND FROM ` + staging[1] + ` FILLTARGET`)).
+		WithArgs().WillReturnError(fmt.Errorf("columns don't match"))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS ` + staging[0])).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = mockRedshift.AppendStaging(staging, table)
+	var appendErr *AppendError
+	if assert.True(t, errors.As(err, &appendErr)) {
+		assert.Equal(t, staging[1:], appendErr.Remaining)
+		assert.Contains(t, err.Error(), "1 of 3 staging tables were appended")
+		assert.Contains(t, err.Error(), staging[2])
+	}
+
+	// a failed drop is only logged, so look at what was run rather than relying on sqlmock to fail it
+	var drops []string
+	for _, query := range recorder.queries {
+		if strings.HasPrefix(query, "DROP") {
+			drops = append(drops, query)
+		}
+	}
+	assert.Equal(t, []string{`DROP TABLE IF EXISTS ` + staging[0]}, drops)
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// execRecorder records the statements Exec'd on the database
+type execRecorder struct {
+	*sql.DB
+	queries []string
+}
+
+func (e *execRecorder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	e.queries = append(e.queries, query)
+	return e.DB.ExecContext(ctx, query, args...)
+}
+
+func BenchmarkParallelCopy(b *testing.B) {
+	host := os.Getenv("REDSHIFT_BENCHMARK_HOST")
+	if host == "" {
+		b.Skip("REDSHIFT_BENCHMARK_HOST isn't set")
+	}
+	date, err := time.Parse(time.RFC3339, os.Getenv("REDSHIFT_BENCHMARK_DATE"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	n, err := strconv.Atoi(os.Getenv("REDSHIFT_BENCHMARK_PARTS"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := NewRedshift(textCtx, host, "5439", os.Getenv("REDSHIFT_BENCHMARK_DB"),
+		os.Getenv("REDSHIFT_BENCHMARK_USER"), os.Getenv("REDSHIFT_BENCHMARK_PASSWORD"), 60)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	bucket := s3filepath.S3Bucket{
+		Name:            os.Getenv("REDSHIFT_BENCHMARK_BUCKET"),
+		Region:          os.Getenv("REDSHIFT_BENCHMARK_REGION"),
+		RedshiftRoleARN: os.Getenv("REDSHIFT_BENCHMARK_ROLE_ARN"),
+	}
+	schema, tableName := os.Getenv("REDSHIFT_BENCHMARK_SCHEMA"), os.Getenv("REDSHIFT_BENCHMARK_TABLE")
+	store := s3filepath.S3ObjectStore{Region: bucket.Region}
+	single, err := s3filepath.CreateManifestFile(store, bucket, schema, tableName, "", date)
+	if err != nil {
+		b.Fatal(err)
+	}
+	manifests, err := s3filepath.CreateManifestFiles(store, bucket, schema, tableName, "", date, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var parts []s3filepath.S3File
+	for _, m := range manifests {
+		parts = append(parts, *m)
+	}
+	table, err := db.GetTableFromConf(*single)
+	if err != nil {
+		b.Fatal(err)
+	}
+	table.Name += "_benchmark"
+
+	b.Run("copy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tx, err := db.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := db.CreateTable(tx, *table); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := db.CopyInto(tx, fmt.Sprintf(`"%s"."%s"`, schema, table.Name), *single, *table, "", true, 0); err != nil {
+				b.Fatal(err)
+			}
+			tx.Rollback()
+		}
+	})
+	b.Run(fmt.Sprintf("parallel-%d", len(parts)), func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			staging, _, err := db.ParallelCopy(parts, *table, "", 0, sql.LevelDefault, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := db.DropStaging(staging); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAppendTable(t *testing.T) {
+	source := Table{
+		Name: "tablename_corrected",
+		Columns: []ColInfo{
+			{"id", "int", "", true, false, true, 1, ""},
+			{"name", "text", "", false, false, false, 0, ""},
+		},
+		Meta: Meta{Schema: "testschema"},
+	}
+	// a live table, with redshift's types
+	target := Table{
+		Name: "tablename",
+		Columns: []ColInfo{
+			{"name", "character varying(256)", "", false, false, false, 0, ""},
+			{"id", "integer", "", true, false, true, 1, ""},
+		},
+		Meta: Meta{Schema: "testschema"},
+	}
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "testschema"."tablename" APPEND FROM "testschema"."tablename_corrected"`)).
+		WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(t, mockRedshift.AppendTable(source, target))
+
+	// mismatches are all reported, without running anything
+	target.Columns = []ColInfo{
+		{"name", "character varying(65535)", "", false, false, false, 0, ""},
+		{"id", "integer", "", false, false, false, 0, ""},
+		{"extra", "boolean", "", false, false, false, 0, ""},
+	}
+	err = mockRedshift.AppendTable(source, target)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "column name has type character varying(256) in the source table but character varying(65535) in the target table")
+		assert.Contains(t, err.Error(), "column id has not null true in the source table but false in the target table")
+		assert.Contains(t, err.Error(), "column extra is only in the target table")
+		assert.Contains(t, err.Error(), `distkey is "id" in the source table but "" in the target table`)
+		assert.Contains(t, err.Error(), "sortkey is (id) in the source table but () in the target table")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	mock.ExpectQuery(`SELECT 1`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow(1))
+	assert.NoError(t, mockRedshift.HealthCheck())
+	mock.ExpectQuery(`SELECT 1`).WithArgs().WillReturnError(fmt.Errorf("connection refused"))
+	assert.EqualError(t, mockRedshift.HealthCheck(), "can't query redshift: connection refused")
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	bucket := s3filepath.S3Bucket{Name: "bucket", Region: "region", RedshiftRoleARN: "arn"}
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx, user: "loader"}
+
+	expectPrivilege := func(canCreate bool) {
+		mock.ExpectQuery(`SELECT 1`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow(1))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT has_schema_privilege(current_user, 'testschema', 'CREATE')`)).
+			WithArgs().WillReturnRows(sqlmock.NewRows([]string{"has_schema_privilege"}).AddRow(canCreate))
+	}
+	copyRegex := regexp.QuoteMeta(`COPY "s3_to_redshift_preflight" FROM 's3://bucket/testschema/_s3_to_redshift_preflight_' REGION 'region' NOLOAD IAM_ROLE 'arn'`)
+
+	// the prefix not existing means COPY could list the bucket
+	expectPrivilege(true)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE "s3_to_redshift_preflight"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(copyRegex).WithArgs().WillReturnError(fmt.Errorf("The specified S3 prefix '_s3_to_redshift_preflight_' does not exist"))
+	mock.ExpectRollback()
+	assert.NoError(t, mockRedshift.Preflight("testschema", bucket))
+
+	expectPrivilege(true)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE "s3_to_redshift_preflight"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(copyRegex).WithArgs().WillReturnError(fmt.Errorf("S3ServiceException:Access Denied"))
+	mock.ExpectRollback()
+	err = mockRedshift.Preflight("testschema", bucket)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "COPY can't read from s3://bucket")
+	}
+
+	// but the bucket not existing fails it
+	expectPrivilege(true)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE "s3_to_redshift_preflight"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(copyRegex).WithArgs().WillReturnError(fmt.Errorf("S3ServiceException:The specified bucket does not exist,Status 404,Error NoSuchBucket"))
+	mock.ExpectRollback()
+	err = mockRedshift.Preflight("testschema", bucket)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "NoSuchBucket")
+	}
+
+	expectPrivilege(false)
+	err = mockRedshift.Preflight("testschema", bucket)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "user loader can't create tables in schema testschema")
+	}
+
+	// the staging schema needs creating in too
+	mockRedshift.SetStagingSchema("scratch")
+	expectPrivilege(true)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT has_schema_privilege(current_user, 'scratch', 'CREATE')`)).
+		WithArgs().WillReturnRows(sqlmock.NewRows([]string{"has_schema_privilege"}).AddRow(false))
+	err = mockRedshift.Preflight("testschema", bucket)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "staging schema: user loader can't create tables in schema scratch")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// isolationDriver records the isolation level of each transaction begun on it
+type isolationDriver struct{ levels []driver.IsolationLevel }
+
+func (d *isolationDriver) Open(name string) (driver.Conn, error) { return isolationConn{d}, nil }
+
+type isolationConn struct{ d *isolationDriver }
+
+func (c isolationConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("unsupported")
+}
+func (c isolationConn) Close() error              { return nil }
+func (c isolationConn) Begin() (driver.Tx, error) { return c, nil }
+func (c isolationConn) Commit() error             { return nil }
+func (c isolationConn) Rollback() error           { return nil }
+func (c isolationConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.d.levels = append(c.d.levels, opts.Isolation)
+	return c, nil
+}
+
+func TestBeginIsolated(t *testing.T) {
+	recorder := &isolationDriver{}
+	sql.Register("isolation-recorder", recorder)
+	db, err := sql.Open("isolation-recorder", "")
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := Redshift{dbExecCloser: db, ctx: textCtx}
+
+	for _, name := range []string{"", "serializable", "read-committed"} {
+		tx, err := mockRedshift.BeginIsolated(IsolationLevels[name])
+		if assert.NoError(t, err) {
+			assert.NoError(t, tx.Commit())
+		}
+	}
+	assert.Equal(t, []driver.IsolationLevel{
+		driver.IsolationLevel(sql.LevelDefault),
+		driver.IsolationLevel(sql.LevelSerializable),
+		driver.IsolationLevel(sql.LevelReadCommitted),
+	}, recorder.levels)
+}
+
+func TestParseEndpoints(t *testing.T) {
+	assert.Equal(t, []endpoint{{host: "localhost", port: "5439"}}, parseEndpoints("localhost", "5439"))
+	assert.Equal(t, []endpoint{{host: "primary.example.com", port: "5439"}, {host: "dr.example.com", port: "5440"}},
+		parseEndpoints("primary.example.com, dr.example.com:5440", "5439"))
+}
+
+func TestConnectFirst(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	dr, drMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer dr.Close()
+	dbs := map[string]*sql.DB{"primary": primary, "dr": dr}
+	open := func(e endpoint) (*sql.DB, error) {
+		if db, ok := dbs[e.host]; ok {
+			return db, nil
+		}
+		return nil, fmt.Errorf("no such host %s", e.host)
+	}
+	endpoints := parseEndpoints("missing,primary,dr", "5439")
+
+	// the primary is failing over, so accepts connections but not queries
+	primaryMock.ExpectQuery(`SELECT 1`).WithArgs().WillReturnError(fmt.Errorf("cannot connect now"))
+	primaryMock.ExpectClose()
+	drMock.ExpectQuery(`SELECT 1`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow(1))
+	db, chosen, err := connectFirst(textCtx, endpoints, open)
+	assert.NoError(t, err)
+	assert.Equal(t, dr, db)
+	assert.Equal(t, endpoint{host: "dr", port: "5439"}, chosen)
+
+	_, _, err = connectFirst(textCtx, endpoints[:1], open)
+	assert.EqualError(t, err, "no such host missing")
+
+	for _, m := range []sqlmock.Sqlmock{primaryMock, drMock} {
+		if err = m.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	}
 }
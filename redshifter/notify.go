@@ -0,0 +1,78 @@
+package redshifter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Notifier is told about each table's load once it's finished, whether it worked or not, e.g. to
+// post to Slack or start whatever runs on the table next. err is the error LoadTable returns.
+type Notifier interface {
+	Notify(result LoadResult, err error)
+}
+
+// Notification is the JSON body HTTPNotifier posts
+type Notification struct {
+	Schema          string    `json:"schema"`
+	Table           string    `json:"table"`
+	DataDate        time.Time `json:"data_date"`
+	Success         bool      `json:"success"`
+	Skipped         string    `json:"skipped,omitempty"`
+	RowsLoaded      int64     `json:"rows_loaded"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// HTTPNotifier POSTs a Notification for each load to its URL as JSON. A failed notification is
+// only passed to OnError, if it's set, as the load itself has already finished.
+type HTTPNotifier struct {
+	URL     string
+	Client  *http.Client
+	OnError func(err error)
+}
+
+// the longest to wait on the notification URL before giving up on it
+const notifyTimeout = 10 * time.Second
+
+// NewHTTPNotifier returns a notifier posting to the URL, which waits up to 10s for a response
+func NewHTTPNotifier(url string) *HTTPNotifier {
+	return &HTTPNotifier{URL: url, Client: &http.Client{Timeout: notifyTimeout}}
+}
+
+// Notify implements Notifier
+func (n *HTTPNotifier) Notify(result LoadResult, err error) {
+	if postErr := n.post(result, err); postErr != nil && n.OnError != nil {
+		n.OnError(postErr)
+	}
+}
+
+func (n *HTTPNotifier) post(result LoadResult, err error) error {
+	body := Notification{
+		Schema:          result.Schema,
+		Table:           result.Table,
+		DataDate:        result.DataDate,
+		Success:         err == nil,
+		Skipped:         result.Skipped,
+		RowsLoaded:      result.RowsLoaded,
+		DurationSeconds: result.Duration.Seconds(),
+	}
+	if err != nil {
+		body.Error = err.Error()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := n.Client.Post(n.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("issue posting notification to %s: %w", n.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification to %s got status %s", n.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package redshifter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPNotifier(t *testing.T) {
+	var received []Notification
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		received = append(received, n)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notifier := NewHTTPNotifier(server.URL)
+	var notifyErrs []error
+	notifier.OnError = func(err error) { notifyErrs = append(notifyErrs, err) }
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	notifier.Notify(LoadResult{Schema: "mongo", Table: "users", DataDate: date, RowsLoaded: 10, Duration: 1500 * time.Millisecond}, nil)
+	notifier.Notify(LoadResult{Schema: "mongo", Table: "schools", DataDate: date}, errors.New("err running copy"))
+	assert.Equal(t, []Notification{
+		{Schema: "mongo", Table: "users", DataDate: date, Success: true, RowsLoaded: 10, DurationSeconds: 1.5},
+		{Schema: "mongo", Table: "schools", DataDate: date, Error: "err running copy"},
+	}, received)
+	assert.Empty(t, notifyErrs)
+
+	status = http.StatusInternalServerError
+	notifier.Notify(LoadResult{Schema: "mongo", Table: "users", DataDate: date, Skipped: SkippedAlreadyLoaded}, nil)
+	if assert.Len(t, notifyErrs, 1) {
+		assert.Contains(t, notifyErrs[0].Error(), "500 Internal Server Error")
+	}
+}
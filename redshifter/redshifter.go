@@ -0,0 +1,1051 @@
+// Package redshifter loads the data for a table and date from s3 into redshift, for embedding
+// loads in other programs. The s3-to-redshift worker is a thin wrapper around LoadTable.
+package redshifter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Clever/s3-to-redshift/v3/logger"
+	"github.com/Clever/s3-to-redshift/v3/metrics"
+	redshift "github.com/Clever/s3-to-redshift/v3/redshift"
+	s3filepath "github.com/Clever/s3-to-redshift/v3/s3filepath"
+)
+
+// LoadConfig is what to load, and how. Its fields match the worker's flags of the same names,
+// other than the ones the worker parses into the DB and Bucket
+type LoadConfig struct {
+	// DB is the cluster to load into, set up with any dry run, staging schema and session params
+	DB *redshift.Redshift
+	// Bucket is where the data and configs are
+	Bucket   s3filepath.S3Bucket
+	Schema   string
+	Table    string
+	DataDate time.Time
+	// ConfigFile overrides the usual config next to the data
+	ConfigFile string
+	// S3Path, if set, is the data file to load, in Bucket, rather than finding the table's data
+	// for the date. It can't be used with Manifest
+	S3Path string
+
+	// Manifest gathers the data's part files into a manifest, split between up to ParallelCopy
+	// manifests which are COPYd at once. GZip says whether the parts are gzipped
+	Manifest     bool
+	ParallelCopy int
+	GZip         bool
+	Delimiter    string
+
+	// TimeGranularity is hour, day or stream, with StreamStart and StreamEnd bounding a stream's window
+	TimeGranularity string
+	StreamStart     string
+	StreamEnd       string
+	// TargetTimezone is the timezone of the table's data date, UTC if not set
+	TargetTimezone string
+
+	Truncate         bool
+	Swap             bool
+	Force            bool
+	DryRun           bool
+	Upsert           bool
+	Dedup            bool
+	Vacuum           bool
+	AllowKeyDrift    bool
+	AllowDropColumns bool
+	VerifyCounts     bool
+	// ValidateGzip checks gzipped data decompresses before the COPY, with s3filepath.CheckGzip
+	ValidateGzip bool
+	// AllowRebuild rebuilds an existing table whose distkey or sortkey differ from the config, with
+	// RebuildTable, rather than failing the load (or only warning, with AllowKeyDrift)
+	AllowRebuild bool
+	// OnlyIfChanged skips the load if the data has the same ETag as the table's last load, whatever
+	// date that was for, e.g. for tables whose producers publish the same file every day. Unless Force
+	OnlyIfChanged bool
+	// Reset drops an existing table in the load's transaction and creates it afresh from the
+	// config, whatever data it had. It can't be used with Swap or Upsert
+	Reset bool
+	// EmptyFiles is one of the EmptyFiles constants, EmptyFilesLoad if not set
+	EmptyFiles string
+
+	MaxErrors      int
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	// DeadlockRetries is how many times to load the table again, from the start, when redshift
+	// aborts the load to break a deadlock with another, after a jittered backoff from RetryBaseDelay.
+	// Deadlocks don't count against MaxRetries
+	DeadlockRetries int
+	// IsolationLevel is the isolation level of the load's transaction, the database's default if not
+	// set, e.g. sql.LevelSerializable so concurrent upserts into a table can't interleave
+	IsolationLevel sql.IsolationLevel
+	// StatementTimeout, if set, is how long each statement in the load's transaction, or in a
+	// ParallelCopy part's, may run for before redshift cancels it and the load fails with a
+	// redshift.StatementTimeoutError, which errors.Is matches to redshift.ErrStatementTimeout.
+	// The vacuum after the load isn't limited by it
+	StatementTimeout time.Duration
+	// RefreshCredentials, if set, gets the credentials for COPY before each table's COPY, and
+	// again if it fails on an expired token, which is then retried once. For temporary
+	// credentials (e.g. from an assumed role) which can expire over a long backfill
+	RefreshCredentials func() (redshift.Credentials, error)
+	// WaitForDate is how long to wait for the data to arrive in s3, if it isn't there yet
+	WaitForDate time.Duration
+	// MaxDataAge, if set, is how old the data date may be before the data is considered stale,
+	// and StaleData (one of the StaleData constants, StaleDataFail if not set) what to do about it
+	MaxDataAge time.Duration
+	StaleData  string
+
+	// Metrics receives the load metrics, if set
+	Metrics metrics.Reporter
+	// Notifier is told about the load once it's finished, if set
+	Notifier Notifier
+	// QueueVacuum is called after a load without Vacuum, to have the table vacuumed elsewhere
+	QueueVacuum func(schema, table string)
+}
+
+// Validate checks the options can be used together, e.g. that Swap has Truncate, and are
+// in range. LoadTable checks them before looking for the data
+func (cfg LoadConfig) Validate() error {
+	// granularities are PostgreSQL dateparts, and a stream runs from StreamStart to StreamEnd
+	switch cfg.TimeGranularity {
+	case "hour", "day", "stream":
+	default:
+		return fmt.Errorf("unsupported timeGranularity %q, must be one of hour, day or stream", cfg.TimeGranularity)
+	}
+	if cfg.TargetTimezone != "" {
+		if _, err := time.LoadLocation(cfg.TargetTimezone); err != nil {
+			return fmt.Errorf("unable to load timezone %s: %w", cfg.TargetTimezone, err)
+		}
+	}
+	if cfg.MaxErrors < 0 || cfg.MaxRetries < 0 || cfg.DeadlockRetries < 0 || cfg.ParallelCopy < 0 {
+		return fmt.Errorf("maxErrors, maxRetries, deadlockRetries and parallelCopy can't be negative")
+	}
+	if cfg.RetryBaseDelay < 0 || cfg.WaitForDate < 0 || cfg.MaxDataAge < 0 {
+		return fmt.Errorf("retryBaseDelay, waitForDate and maxDataAge can't be negative")
+	}
+	// redshift's statement_timeout is in milliseconds, and 0 would turn it off
+	if cfg.StatementTimeout != 0 && cfg.StatementTimeout < time.Millisecond {
+		return fmt.Errorf("invalid statementTimeout %s, must be at least 1ms", cfg.StatementTimeout)
+	}
+	if cfg.StaleData != "" && cfg.StaleData != StaleDataFail && cfg.StaleData != StaleDataWarn {
+		return fmt.Errorf("invalid staleData %q, must be %s or %s", cfg.StaleData, StaleDataFail, StaleDataWarn)
+	}
+	if cfg.EmptyFiles != "" && cfg.EmptyFiles != EmptyFilesLoad && cfg.EmptyFiles != EmptyFilesSkip && cfg.EmptyFiles != EmptyFilesFail {
+		return fmt.Errorf("invalid emptyFiles %q, must be one of %s, %s or %s", cfg.EmptyFiles, EmptyFilesLoad, EmptyFilesSkip, EmptyFilesFail)
+	}
+
+	// upserts replace rows by primary key, which makes no sense if we're clearing the table anyway
+	if cfg.Upsert && cfg.Truncate {
+		return fmt.Errorf("upsert and truncate can't be used together")
+	}
+	// a reset table is created afresh, so there's nothing to swap out or upsert into
+	if cfg.Reset && (cfg.Swap || cfg.Upsert) {
+		return fmt.Errorf("reset can't be used with swap or upsert")
+	}
+	// the parts are appended without being merged, so upserted rows would be duplicated
+	if cfg.ParallelCopy > 1 && (!cfg.Manifest || cfg.Upsert) {
+		return fmt.Errorf("parallelCopy needs manifest, and can't be used with upsert")
+	}
+	// the staging table to dedup is created like the table, and the parts are never staged together
+	if cfg.Dedup && (cfg.Swap || cfg.ParallelCopy > 1) {
+		return fmt.Errorf("dedup can't be used with swap or parallelCopy")
+	}
+	// the swap table only has the date's data, and the parts would be appended after the swap, so
+	// readers would see the table part loaded
+	if cfg.Swap && (!cfg.Truncate || cfg.ParallelCopy > 1) {
+		return fmt.Errorf("swap needs truncate, and can't be used with parallelCopy")
+	}
+	// an exact file is the data itself, so there's no manifest to gather
+	if cfg.S3Path != "" && cfg.Manifest {
+		return fmt.Errorf("s3Path can't be used with manifest")
+	}
+	// data laid out by a key template is in part files with no known names, and the parts are
+	// only found, and their metadata read, when building a manifest
+	if cfg.Bucket.KeyTemplate != "" {
+		if err := s3filepath.ValidateKeyTemplate(cfg.Bucket.KeyTemplate, cfg.Bucket.DateMetadata != ""); err != nil {
+			return err
+		}
+		if !cfg.Manifest {
+			return fmt.Errorf("keyTemplate needs manifest")
+		}
+	}
+	if cfg.Bucket.DateMetadata != "" && !cfg.Manifest {
+		return fmt.Errorf("dateMetadata needs manifest")
+	}
+	// COPY can't read a requester pays bucket, so the parts are copied to one it can
+	if cfg.Bucket.RequesterPays && (!cfg.Manifest || cfg.Bucket.StagingBucket == "") {
+		return fmt.Errorf("requesterPays needs manifest and a staging bucket")
+	}
+	return nil
+}
+
+// LoadResult is what LoadTable did
+type LoadResult struct {
+	Schema   string
+	Table    string
+	DataDate time.Time
+	// Skipped says why nothing was loaded, one of the Skipped constants, or is empty if the data was
+	Skipped    string
+	RowsLoaded int64
+	Duration   time.Duration
+}
+
+// Why LoadResult.Skipped
+const (
+	SkippedAlreadyLoaded = "already-loaded"
+	SkippedEmptyFile     = "empty-file"
+	SkippedUnchanged     = "unchanged"
+)
+
+// LoadTable finds the s3 data for a single table, checks whether it's newer than what's already
+// in redshift, and if so copies it in
+func LoadTable(ctx context.Context, cfg LoadConfig) (result LoadResult, err error) {
+	start := time.Now()
+	db, bucket, schema, t, parsedInputDate := cfg.DB, cfg.Bucket, cfg.Schema, cfg.Table, cfg.DataDate
+	result = LoadResult{Schema: schema, Table: t, DataDate: parsedInputDate}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NoopReporter{}
+	}
+	// count every failed load, whether it failed finding the data, on the config, or in redshift
+	defer func() {
+		if err != nil {
+			cfg.Metrics.Count("load.errors", 1, map[string]string{"schema": schema, "table": t})
+		}
+		if cfg.Notifier != nil {
+			if result.Duration == 0 {
+				result.Duration = time.Since(start)
+			}
+			cfg.Notifier.Notify(result, err)
+		}
+	}()
+	if err := cfg.Validate(); err != nil {
+		return result, fmt.Errorf("invalid load config: %w", err)
+	}
+	targetTimezone := cfg.TargetTimezone
+	if targetTimezone == "" {
+		targetTimezone = "UTC"
+	}
+	targetDataLocation, err := time.LoadLocation(targetTimezone)
+	if err != nil {
+		return result, fmt.Errorf("unable to load timezone %s: %w", targetTimezone, err)
+	}
+	logger.GetLogger().InfoD("load-table-start", logger.M{
+		"schema": schema, "table": t, "data_date": parsedInputDate,
+	})
+	// over a long run the connections can go stale, so make sure there's a working one first
+	if err := db.Ping(); err != nil {
+		return result, fmt.Errorf("error checking the redshift connection: %w", err)
+	}
+	var inputConf *s3filepath.S3File
+	var parts []s3filepath.S3File
+	findInput := func() error {
+		if cfg.Manifest {
+			// the data is in many part files, so gather them all up in a manifest to load at once,
+			// or in several to load with parallel COPYs
+			store := s3filepath.S3ObjectStore{
+				Region: bucket.Region, KMSKeyARN: bucket.KMSKeyARN, Endpoint: bucket.Endpoint, RequesterPays: bucket.RequesterPays,
+				Credentials: bucket.Credentials,
+			}
+			manifests, err := s3filepath.CreateManifestFiles(store, bucket, schema, t, cfg.ConfigFile, parsedInputDate, cfg.ParallelCopy)
+			if err != nil {
+				return fmt.Errorf("issue creating manifest in s3: %w", err)
+			}
+			inputConf = manifests[0]
+			if len(manifests) > 1 {
+				for _, m := range manifests {
+					parts = append(parts, *m)
+				}
+			}
+			return nil
+		}
+		var err error
+		if cfg.S3Path != "" {
+			inputConf, err = s3filepath.S3FileFromPath(s3filepath.S3PathChecker{Bucket: bucket}, bucket, cfg.S3Path, schema, t, cfg.ConfigFile, parsedInputDate)
+		} else {
+			inputConf, err = s3filepath.CreateS3File(s3filepath.S3PathChecker{Bucket: bucket}, bucket, schema, t, cfg.ConfigFile, parsedInputDate)
+		}
+		if err != nil {
+			return fmt.Errorf("issue getting data file from s3: %w", err)
+		}
+		// manifests obscure the compression of their files, so that comes from the gzip flag
+		if inputConf.Suffix == "manifest" && cfg.GZip {
+			inputConf.Compression = s3filepath.CompressionGzip
+		}
+		return nil
+	}
+	if err := waitForData(ctx, findInput, cfg.WaitForDate, dataPollDelay); err != nil {
+		return result, err
+	}
+	if err := checkDataAge(cfg.MaxDataAge, inputConf.DataDate, time.Now()); err != nil {
+		if cfg.StaleData != StaleDataWarn {
+			return result, err
+		}
+		logger.GetLogger().WarnD("stale-data", logger.M{"schema": schema, "table": t, "error": err.Error()})
+	}
+	inputTable, err := db.GetTableFromConf(*inputConf) // allow passing explicit config later
+	if err != nil {
+		return result, fmt.Errorf("issue getting table from input: %w", err)
+	}
+	// fail before touching the database if the config is malformed
+	if err := redshift.ValidateTableConfig(*inputTable); err != nil {
+		return result, fmt.Errorf("invalid config for table %s: %w", t, err)
+	}
+	if cfg.Truncate, err = shouldTruncate(cfg.Truncate, cfg.Upsert, inputTable.Meta); err != nil {
+		return result, fmt.Errorf("invalid config for table %s: %w", t, err)
+	}
+	if cfg.Delimiter, err = copyDelimiter(cfg.Delimiter, inputTable.Meta); err != nil {
+		return result, fmt.Errorf("invalid config for table %s: %w", t, err)
+	}
+
+	// figure out what the current state of the table is to determine if the table is already up to date
+	targetTable, targetDataDate, err := db.GetTableMetadata(inputConf.Schema, inputConf.Table, inputTable.Meta)
+	if err != nil {
+		return result, fmt.Errorf("error getting existing latest table metadata: %w", err)
+	}
+
+	// a table's config can say its data date is in a different timezone from --timezone
+	if inputTable.Meta.DataDateTimezone != "" {
+		targetTimezone = inputTable.Meta.DataDateTimezone
+		// already checked by ValidateTableConfig
+		targetDataLocation, _ = time.LoadLocation(targetTimezone)
+	}
+
+	// the ETag lets us tell when a file for a date we've already loaded has been re-uploaded
+	dataPath := inputConf.GetDataFilename()
+	info, err := s3filepath.Head(bucket, dataPath)
+	etag := info.ETag
+	if err != nil {
+		logger.GetLogger().WarnD("etag-error", logger.M{"schema": inputConf.Schema, "table": inputConf.Table, "error": err.Error()})
+	} else if inputConf.Suffix != "manifest" {
+		// a manifest's size says nothing about its parts, so only a single data file is checked
+		logger.GetLogger().InfoD("data-file", logger.M{
+			"schema": inputConf.Schema, "table": inputConf.Table, "s3_path": dataPath, "size_bytes": info.Size,
+		})
+		skip, err := checkDataFileSize(cfg.EmptyFiles, dataPath, info.Size)
+		if err != nil {
+			return result, err
+		}
+		if skip {
+			logger.GetLogger().WarnD("skipping-empty-file", logger.M{
+				"schema": inputConf.Schema, "table": inputConf.Table, "s3_path": dataPath, "data_date": parsedInputDate,
+			})
+			result.Skipped = SkippedEmptyFile
+			return result, nil
+		}
+	}
+
+	if cfg.OnlyIfChanged && !cfg.Force {
+		unchanged, err := unchangedSinceLastLoad(db, inputConf.Schema, inputConf.Table, etag)
+		if err != nil {
+			return result, err
+		}
+		if unchanged {
+			logger.GetLogger().InfoD("data-unchanged", logger.M{
+				"schema": inputConf.Schema, "table": inputConf.Table, "data_date": parsedInputDate, "etag": etag,
+			})
+			result.Skipped = SkippedUnchanged
+			return result, nil
+		}
+	}
+
+	// unless --force, don't update unless input data is new or has changed since it was loaded.
+	// Data older than the table's newest can still be new, if its date was never loaded
+	if cfg.TimeGranularity != "stream" && isInputDataStale(parsedInputDate, targetDataDate, cfg.TimeGranularity, targetDataLocation) {
+		if cfg.Force || cfg.Reset {
+			logger.GetLogger().InfoD("forcing-update", logger.M{"schema": inputConf.Schema, "table": inputConf.Table})
+		} else {
+			err := db.CheckNewData(inputConf.Schema, inputConf.Table, parsedInputDate, dataPath, etag)
+			if errors.Is(err, redshift.ErrNoLoadHistory) {
+				err = checkDateLoaded(db, inputConf.Schema, inputConf.Table, inputTable.Meta, parsedInputDate, cfg.TimeGranularity, targetTimezone)
+			}
+			if errors.Is(err, redshift.ErrNoNewData) {
+				logger.GetLogger().InfoD("data-already-loaded", logger.M{
+					"schema": inputConf.Schema, "table": inputConf.Table, "data_date": parsedInputDate,
+					"target_data_date": *targetDataDate,
+				})
+				result.Skipped = SkippedAlreadyLoaded
+				return result, nil
+			} else if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	// redshift only says it couldn't parse a JSON array, so catch them before the COPY
+	if cfg.Delimiter == "" && inputConf.Suffix != "parquet" {
+		if err := s3filepath.CheckJSONLines(*inputConf); errors.Is(err, s3filepath.ErrJSONArray) {
+			return result, fmt.Errorf("%w, rewrite it with an object per line, e.g. with jq -c '.[]'", err)
+		} else if err != nil {
+			logger.GetLogger().WarnD("json-check-error", logger.M{"schema": inputConf.Schema, "table": inputConf.Table, "error": err.Error()})
+		}
+	}
+
+	// a corrupt gzip file only fails the COPY once redshift gets to it
+	if cfg.ValidateGzip {
+		files := parts
+		if len(files) == 0 {
+			files = []s3filepath.S3File{*inputConf}
+		}
+		for _, f := range files {
+			if err := s3filepath.CheckGzip(f); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	// the credentials are in each COPY's SQL, so get fresh ones in case they've expired
+	refreshCredentials := func() error {
+		if cfg.RefreshCredentials == nil {
+			return nil
+		}
+		creds, err := cfg.RefreshCredentials()
+		if err != nil {
+			return fmt.Errorf("error refreshing credentials: %w", err)
+		}
+		inputConf.Bucket = creds.ApplyTo(inputConf.Bucket)
+		for i := range parts {
+			parts[i].Bucket = creds.ApplyTo(parts[i].Bucket)
+		}
+		return nil
+	}
+	if err := refreshCredentials(); err != nil {
+		return result, err
+	}
+
+	copyStart := time.Now()
+	var rowsLoaded int64
+	refreshed := false
+	// each attempt runs in a fresh transaction, as the failed one has been rolled back
+	for attempt := 0; ; attempt++ {
+		rowsLoaded, err = retryDeadlocks(ctx, cfg.DeadlockRetries, cfg.RetryBaseDelay, inputConf.Schema, t, func(deadlocks int) (int64, error) {
+			// the transaction which won may have changed the table, so look at it afresh
+			if deadlocks > 0 {
+				var metaErr error
+				if targetTable, _, metaErr = db.GetTableMetadata(inputConf.Schema, inputConf.Table, inputTable.Meta); metaErr != nil {
+					return 0, fmt.Errorf("error getting existing latest table metadata: %w", metaErr)
+				}
+			}
+			return runCopy(cfg, *inputConf, parts, *inputTable, targetTable, targetTimezone)
+		})
+		// credentials which expired since they were refreshed get one more go, straight away
+		if cfg.RefreshCredentials != nil && !refreshed && redshift.IsExpiredTokenError(err) {
+			refreshed = true
+			logger.GetLogger().WarnD("refreshing-expired-credentials", logger.M{
+				"schema": inputConf.Schema, "table": t, "error": err.Error(),
+			})
+			if refreshErr := refreshCredentials(); refreshErr != nil {
+				err = refreshErr
+				break
+			}
+			attempt--
+			continue
+		}
+		// deadlocks have already been retried, against their own count
+		if err == nil || attempt >= cfg.MaxRetries || !redshift.IsTransientError(err) || redshift.IsDeadlockError(err) {
+			break
+		}
+		// the retry copies the data afresh, so the staging tables a failed append kept aren't needed
+		var appendErr *redshift.AppendError
+		if errors.As(err, &appendErr) {
+			if dropErr := db.DropStaging(appendErr.Remaining); dropErr != nil {
+				logger.GetLogger().ErrorD("drop-staging-error", logger.M{
+					"schema": inputConf.Schema, "table": t, "error": dropErr.Error(),
+				})
+			}
+		}
+		delay := retryDelay(cfg.RetryBaseDelay, attempt)
+		logger.GetLogger().WarnD("retrying-load", logger.M{
+			"schema": inputConf.Schema, "table": t, "attempt": attempt + 1, "delay": delay.String(), "error": err.Error(),
+		})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, fmt.Errorf("error running copy, cancelled before retrying: %w", err)
+		}
+	}
+	if err != nil && redshift.IsStatementTimeoutError(err) {
+		err = &redshift.StatementTimeoutError{Err: err}
+	}
+	// keep a record of the load in redshift, whether or not it worked
+	entry := redshift.LoadEntry{
+		Schema: inputConf.Schema, Table: inputConf.Table, DataDate: parsedInputDate, S3Path: dataPath, ETag: etag,
+		RowsLoaded: rowsLoaded, Start: copyStart, End: time.Now(), Success: err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if recordErr := db.RecordLoad(entry); recordErr != nil {
+		logger.GetLogger().WarnD("record-load-error", logger.M{
+			"schema": inputConf.Schema, "table": inputConf.Table, "error": recordErr.Error(),
+		})
+	}
+	tags := map[string]string{"schema": inputConf.Schema, "table": inputConf.Table}
+	if err != nil {
+		return result, fmt.Errorf("error running copy: %w", err)
+	}
+	cfg.Metrics.Count("loads", 1, tags)
+	cfg.Metrics.Timing("load.duration", time.Since(copyStart), tags)
+	cfg.Metrics.Gauge("load.rows", rowsLoaded, tags)
+	cfg.Metrics.Gauge("load.last_success", time.Now().Unix(), tags)
+	// the table's size after the load is useful for spotting tables which are growing unexpectedly
+	if stats, err := db.GetTableStats(inputConf.Schema, inputConf.Table); err != nil {
+		logger.GetLogger().WarnD("table-stats-error", logger.M{"schema": inputConf.Schema, "table": inputConf.Table, "error": err.Error()})
+	} else {
+		logger.GetLogger().InfoD("table-stats", logger.M{
+			"schema": inputConf.Schema, "table": inputConf.Table, "rows": stats.Rows, "size_mb": stats.SizeMB,
+			"unsorted_pct": stats.UnsortedPct,
+		})
+		cfg.Metrics.Gauge("table.rows", stats.Rows, tags)
+		cfg.Metrics.Gauge("table.size_mb", stats.SizeMB, tags)
+	}
+
+	// DON'T NEED TO CREATE VIEWS - will be handled by the refresh script
+	result.RowsLoaded = rowsLoaded
+	result.Duration = time.Since(start)
+	logger.GetLogger().InfoD("load-table-done", logger.M{
+		"schema": inputConf.Schema, "table": t, "data_date": parsedInputDate, "rows_loaded": rowsLoaded,
+		"duration_ms": result.Duration.Nanoseconds() / int64(time.Millisecond),
+	})
+	return result, nil
+}
+
+// vacuumUnsortedThreshold is the percentage of a table's rows which must be unsorted before
+// we bother running VACUUM on it with LoadConfig.Vacuum, since vacuuming a mostly sorted table wastes cluster time
+const vacuumUnsortedThreshold = 5.0
+
+// Rounds down a dateTime to a granularity
+// For instance, 11:50AM will be truncated to 11:00AM
+// if given a granularity of an hour
+func truncateDate(date time.Time, granularity string) time.Time {
+	switch granularity {
+	case "hour":
+		return date.Truncate(time.Hour)
+	default:
+		// Round down to day granularity by default
+		return date.Truncate(24 * time.Hour)
+	}
+}
+
+// Calculates whether or not input data (s3) is more stale than target data (Redshift)
+// Expects:
+// - inputDataDate corresponds to the s3 data timestamp of the job
+// - targetDataDate is the maximum timestamp of the DB table
+// - granularity indicating how often data snapshots are recorded in the target
+func isInputDataStale(inputDataDate time.Time, targetDataDate *time.Time,
+	granularity string, targetDataLoc *time.Location,
+) bool {
+	// If target table has no data, then input data is fresh by default
+	if targetDataDate == nil {
+		return false
+	}
+
+	// Handle comparison for target data in a different time zone (ex. PT)
+	_, offsetSec := targetDataDate.In(targetDataLoc).Zone()
+	*targetDataDate = targetDataDate.Add(time.Duration(-offsetSec) * time.Second)
+
+	// We truncate the timestamps to make the comparison at the correct granularity
+	// i.e. input data lagging by two hours is considered stale when granularity is hourly,
+	// but it can still be considered fresh when the granularity is daily.
+	return truncateDate(*targetDataDate, granularity).After(truncateDate(inputDataDate, granularity))
+}
+
+// unchangedSinceLastLoad returns whether the data with the ETag is what the table's last successful
+// load of any date loaded. Without an ETag there's nothing to compare, so it's treated as changed
+func unchangedSinceLastLoad(db *redshift.Redshift, schema, table, etag string) (bool, error) {
+	if etag == "" {
+		return false, nil
+	}
+	lastLoad, err := db.LastTableLoad(schema, table)
+	if err != nil {
+		return false, fmt.Errorf("error getting the last load of the table: %w", err)
+	}
+	return lastLoad != nil && lastLoad.ETag == etag, nil
+}
+
+// checkDateLoaded returns redshift.ErrNoNewData if the table has any rows for the data date, at
+// the granularity, for dates without any load history, e.g. those loaded before it was kept. A date
+// without any is late data, which arrived after newer dates were loaded, and still needs loading
+func checkDateLoaded(db *redshift.Redshift, schema, table string, meta redshift.Meta, dataDate time.Time, granularity, targetTimezone string) error {
+	start, end, err := startEndFromGranularity(dataDate, granularity, targetTimezone)
+	if err != nil {
+		return err
+	}
+	loaded, err := db.HasDataInTimeRange(schema, table, meta, start, end)
+	if err != nil {
+		return fmt.Errorf("error checking whether the data date was loaded: %w", err)
+	}
+	if loaded {
+		return redshift.ErrNoNewData
+	}
+	logger.GetLogger().InfoD("late-data", logger.M{"schema": schema, "table": table, "data_date": dataDate})
+	return nil
+}
+
+// shouldTruncate returns whether to truncate the table before loading it: as its config says, if
+// it does, or else as truncate (i.e. --truncate) says. Upserts can't truncate
+func shouldTruncate(truncate, upsert bool, meta redshift.Meta) (bool, error) {
+	if meta.Truncate != nil {
+		truncate = *meta.Truncate
+	}
+	if truncate && upsert {
+		return false, fmt.Errorf("truncate can't be used with upsert")
+	}
+	return truncate, nil
+}
+
+// copyDelimiter returns the delimiter to COPY the table's data with: its config's, if it has one,
+// or else delimiter (i.e. --delimiter). A quote character is only for CSV, and can't be the delimiter
+func copyDelimiter(delimiter string, meta redshift.Meta) (string, error) {
+	if meta.Delimiter != "" {
+		delimiter = meta.Delimiter
+	}
+	if meta.Quote != "" && delimiter == "" {
+		return "", fmt.Errorf("quote is only for CSV data, which needs a delimiter")
+	}
+	if meta.Quote != "" && meta.Quote == delimiter {
+		return "", fmt.Errorf("quote and delimiter can't both be %q", delimiter)
+	}
+	return delimiter, nil
+}
+
+// verifyRowCount checks that the rows loaded account for every row of the data files, except
+// as many as maxErrors allowed COPY to reject, so a truncated file can't load only partly
+func verifyRowCount(files []s3filepath.S3File, rowsLoaded int64, maxErrors int) error {
+	var rows int64
+	for _, f := range files {
+		n, err := s3filepath.CountRows(f)
+		if err != nil {
+			return fmt.Errorf("err counting rows to verify: %w", err)
+		}
+		rows += n
+	}
+	return checkRowCount(rows, rowsLoaded, maxErrors)
+}
+
+// checkRowCount checks the rows loaded from data with the given number of rows
+func checkRowCount(rows, rowsLoaded int64, maxErrors int) error {
+	if rowsLoaded > rows || rows-rowsLoaded > int64(maxErrors) {
+		return fmt.Errorf("loaded %d rows but the data has %d, and maxErrors allows %d to be rejected", rowsLoaded, rows, maxErrors)
+	}
+	return nil
+}
+
+// in a transaction, truncate, create or update, and then copy from the s3 data file or manifest
+// returns the number of rows loaded
+// If there are parts, they're copied into staging tables in parallel before the transaction and
+// appended to the table after it commits, instead of copying in the transaction
+// When swapping, an existing table is truncated by loading a new table and swapping it in for it
+// yell loudly if there is anything different in the target table compared to config (different distkey, etc)
+func runCopy(
+	cfg LoadConfig, inputConf s3filepath.S3File, parts []s3filepath.S3File, inputTable redshift.Table, targetTable *redshift.Table,
+	targetTimeZone string,
+) (rowsLoaded int64, err error) {
+	db := cfg.DB
+	// swapping replaces the whole table, so a table whose config opts out of truncating is loaded
+	// as usual
+	swapping := cfg.Swap && cfg.Truncate && targetTable != nil
+	resetting := cfg.Reset && targetTable != nil
+	// widening columns can't happen inside a transaction, so do it before starting the load.
+	// A table being swapped out or reset doesn't need it, the new one is created from the config
+	if targetTable != nil && !resetting {
+		if cfg.DryRun {
+			diff, err := db.DiffTable(inputTable, *targetTable)
+			if err != nil {
+				return 0, fmt.Errorf("err diffing table: %w", err)
+			}
+			logger.GetLogger().InfoD("table-diff", logger.M{"schema": inputTable.Meta.Schema, "table": inputTable.Name, "diff": diff})
+		}
+		if !swapping {
+			if err := db.WidenColumns(inputTable, *targetTable); err != nil {
+				return 0, fmt.Errorf("err widening columns: %w", err)
+			}
+		}
+	}
+
+	var staging []string
+	if len(parts) > 0 {
+		if staging, rowsLoaded, err = db.ParallelCopy(parts, inputTable, cfg.Delimiter, cfg.MaxErrors, cfg.IsolationLevel, cfg.StatementTimeout); err != nil {
+			return 0, fmt.Errorf("err running parallel copy: %w", err)
+		}
+	}
+
+	tx, err := db.BeginIsolated(cfg.IsolationLevel)
+	if err != nil {
+		return 0, err
+	}
+	// a failed statement aborts the transaction, so roll it back rather than leaving it open.
+	// If the run was cancelled or timed out, database/sql has rolled it back already
+	defer func() {
+		if err != nil {
+			logger.GetLogger().WarnD("rollback-transaction", logger.M{
+				"schema": inputConf.Schema, "table": inputTable.Name, "error": err.Error(),
+			})
+			tx.Rollback()
+			if dropErr := db.DropStaging(staging); dropErr != nil {
+				logger.GetLogger().ErrorD("drop-staging-error", logger.M{
+					"schema": inputConf.Schema, "table": inputTable.Name, "error": dropErr.Error(),
+				})
+			}
+		}
+	}()
+	if cfg.StatementTimeout > 0 {
+		if err := db.SetStatementTimeout(tx, cfg.StatementTimeout); err != nil {
+			return 0, err
+		}
+	}
+
+	// the table is dropped with the rest of the load, so a failed load leaves it as it was
+	if resetting {
+		logger.GetLogger().WarnD("resetting-table", logger.M{
+			"schema": inputConf.Schema, "table": inputTable.Name, "data_date": inputConf.DataDate,
+		})
+		if err := db.DropTable(tx, inputConf.Schema, inputTable.Name); err != nil {
+			return 0, fmt.Errorf("err dropping table to reset it: %w", err)
+		}
+		targetTable = nil
+	}
+
+	// TRUNCATE for dimension tables, but not fact tables
+	if cfg.Truncate && targetTable != nil && !swapping {
+		logger.GetLogger().InfoD("truncating-table", logger.M{"schema": inputConf.Schema, "table": inputTable.Name})
+		if err := db.Truncate(tx, inputConf.Schema, inputTable.Name); err != nil {
+			return 0, fmt.Errorf("err running truncate table: %w", err)
+		}
+	}
+	var swapTable, oldTable string
+	rebuilt := false
+	if resetting {
+		// the dropped table is still visible outside the transaction, so create the new one
+		// directly rather than comparing it with the old one as EnsureTable would
+		if err := db.CreateTable(tx, inputTable); err != nil {
+			return 0, fmt.Errorf("err running create table: %w", err)
+		}
+	} else if targetTable == nil {
+		if err := db.EnsureTable(tx, inputTable, cfg.AllowKeyDrift, cfg.AllowDropColumns); err != nil {
+			return 0, fmt.Errorf("err running create table: %w", err)
+		}
+	} else if swapping {
+		if swapTable, err = db.CreateSwapTable(tx, inputTable); err != nil {
+			return 0, fmt.Errorf("err creating swap table: %w", err)
+		}
+	} else {
+		if cfg.AllowRebuild {
+			diff, err := db.DiffTable(inputTable, *targetTable)
+			if err != nil {
+				return 0, fmt.Errorf("err diffing table: %w", err)
+			}
+			if len(diff.KeyChanges) > 0 {
+				logger.GetLogger().InfoD("rebuilding-table", logger.M{
+					"schema": inputConf.Schema, "table": inputTable.Name, "key_changes": diff.KeyChanges,
+				})
+				if oldTable, err = db.RebuildTable(tx, inputTable, *targetTable); err != nil {
+					return 0, fmt.Errorf("err rebuilding table: %w", err)
+				}
+				rebuilt = true
+			}
+		}
+		var start, end time.Time
+		var err error
+		if cfg.TimeGranularity == "stream" {
+			start, err = time.Parse("2006-01-02T15:04:05", cfg.StreamStart)
+			if err != nil {
+				return 0, err
+			}
+			end, err = time.Parse("2006-01-02T15:04:05", cfg.StreamEnd)
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			if start, end, err = startEndFromGranularity(inputConf.DataDate, cfg.TimeGranularity, targetTimeZone); err != nil {
+				return 0, err
+			}
+		}
+		// To prevent duplicates, clear away any existing data within a certain time range as the data date
+		// (that is, sharing the same data date up to a certain time granularity)
+		// Upserts instead replace existing rows by primary key, so leave the time range alone
+		if !cfg.Upsert {
+			if err := db.TruncateInTimeRange(tx, inputConf.Schema, inputTable.Name, inputTable.Meta, start, end); err != nil {
+				return 0, fmt.Errorf("err truncating data for data refresh: %w", err)
+			}
+		}
+
+		// a rebuilt table was just created from the config, so it's already up to date
+		if !rebuilt {
+			if err := db.UpdateTable(tx, inputTable, *targetTable, cfg.AllowKeyDrift, cfg.AllowDropColumns); err != nil {
+				return 0, fmt.Errorf("err running update table: %w", err)
+			}
+		}
+	}
+
+	// When upserting into an existing table, COPY into a staging table and merge that in by
+	// primary key. A new table has nothing to merge with, so it gets a plain COPY.
+	// Deduping also COPYs into a staging table, whose duplicates are removed before it's inserted
+	dest := fmt.Sprintf(`"%s"."%s"`, inputConf.Schema, inputTable.Name)
+	upserting := cfg.Upsert && targetTable != nil
+	// the swap table is created from the config, so its columns are in the config's order, as
+	// are a rebuilt table's
+	copyTarget := targetTable
+	if swapping {
+		dest = fmt.Sprintf(`"%s"."%s"`, inputConf.Schema, swapTable)
+		copyTarget = nil
+	} else if rebuilt {
+		copyTarget = nil
+	}
+	if upserting || cfg.Dedup {
+		if dest, err = db.CreateStagingTable(tx, inputTable); err != nil {
+			return 0, fmt.Errorf("err creating staging table: %w", err)
+		}
+	}
+
+	// COPY direct into it, ok to do since we're in a transaction
+	// can't switch on file ending as manifest files b/c
+	// manifest files obscure the underlying file types
+	// instead just pass the delimiter along even if it's null
+	// parquet is self-describing, so it gets its own COPY rather than the CSV/JSON one
+	// parts have already been copied into staging tables, which are appended after the commit
+	if len(staging) == 0 {
+		if inputConf.Suffix == "parquet" {
+			if rowsLoaded, err = db.ParquetCopyInto(tx, dest, inputConf, inputTable, copyTarget); err != nil {
+				return 0, fmt.Errorf("err running parquet copy: %w", err)
+			}
+		} else if rowsLoaded, err = db.CopyInto(tx, dest, inputConf, inputTable, cfg.Delimiter, true, cfg.MaxErrors); err != nil {
+			return 0, fmt.Errorf("err running copy: %w", err)
+		}
+	}
+
+	// nothing was loaded in a dry run, so there's nothing to check
+	if cfg.VerifyCounts && !cfg.DryRun {
+		files := parts
+		if len(files) == 0 {
+			files = []s3filepath.S3File{inputConf}
+		}
+		if err := verifyRowCount(files, rowsLoaded, cfg.MaxErrors); err != nil {
+			return 0, err
+		}
+	}
+
+	if cfg.Dedup {
+		if err := db.DedupStagingTable(tx, dest, inputTable); err != nil {
+			return 0, fmt.Errorf("err deduping staging table: %w", err)
+		}
+	}
+	if upserting {
+		if err := db.MergeStagingTable(tx, dest, inputTable); err != nil {
+			return 0, fmt.Errorf("err merging staging table: %w", err)
+		}
+	} else if cfg.Dedup {
+		if err := db.InsertStagingTable(tx, dest, inputTable); err != nil {
+			return 0, fmt.Errorf("err inserting staging table: %w", err)
+		}
+	}
+	if swapping {
+		if oldTable, err = db.SwapTable(tx, inputConf.Schema, inputTable.Name, swapTable); err != nil {
+			return 0, fmt.Errorf("err swapping table: %w", err)
+		}
+	}
+
+	// after a swap the grants are made on the new table, which is now the table's name
+	if err := db.GrantAccess(tx, inputTable); err != nil {
+		return 0, fmt.Errorf("err granting access: %w", err)
+	}
+
+	// Update the latency info table so we have an easier record of the last update.
+	// targetTable is nil on the first load of a table, so use the config's
+	if err := db.UpdateLatencyInfo(tx, inputTable); err != nil {
+		return 0, fmt.Errorf("err updating latency info: %w", err)
+	}
+
+	// in a dry run nothing was modified, but roll back anyway rather than committing
+	if cfg.DryRun {
+		logger.GetLogger().InfoD("dry-run-rollback", logger.M{"schema": inputConf.Schema, "table": inputTable.Name})
+		return rowsLoaded, tx.Rollback()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("err committing transaction: %w", err)
+	}
+	// the new data is committed, so a failed drop shouldn't fail the load
+	if oldTable != "" {
+		if err := db.DropTable(nil, inputConf.Schema, oldTable); err != nil {
+			logger.GetLogger().ErrorD("drop-old-table-error", logger.M{
+				"schema": inputConf.Schema, "table": inputTable.Name, "old_table": oldTable, "error": err.Error(),
+			})
+		}
+	}
+	if len(staging) > 0 {
+		// AppendStaging drops the staging tables, other than any it couldn't append, which are
+		// kept for the append to be finished, so don't drop them again
+		parallel := staging
+		staging = nil
+		if err := db.AppendStaging(parallel, inputTable); err != nil {
+			return 0, fmt.Errorf("err appending staging tables: %w", err)
+		}
+	}
+
+	// a new table has just had its first data loaded, so see how it could be compressed better
+	if targetTable == nil {
+		if _, err := db.AnalyzeCompression(inputConf.Schema, inputTable.Name); err != nil {
+			logger.GetLogger().ErrorD("analyze-compression-error", logger.M{
+				"schema": inputConf.Schema, "table": inputTable.Name, "error": err.Error(),
+			})
+		}
+	}
+
+	// There's a good chance we've deleted some data in the table here (e.g. a stream load,
+	// truncate, or update historical set that exists). Run a vacuum to clear out the old data.
+	// Only one vacuum can be run at a time, so unless asked to run it ourselves we're going to
+	// throw this over the wall to redshift-vacuum and use gearman-admin as a queueing service.
+	if cfg.Vacuum {
+		// the data is already committed, so a failed vacuum shouldn't fail the load
+		if err := db.VacuumAnalyze(inputConf.Schema, inputTable.Name, vacuumUnsortedThreshold); err != nil {
+			logger.GetLogger().ErrorD("vacuum-analyze-error", logger.M{
+				"schema": inputConf.Schema, "table": inputTable.Name, "error": err.Error(),
+			})
+		}
+	} else if cfg.QueueVacuum != nil {
+		cfg.QueueVacuum(inputConf.Schema, inputTable.Name)
+	}
+	return rowsLoaded, nil
+}
+
+// What LoadConfig.EmptyFiles says to do with a zero-byte data file, which COPYs "successfully"
+// without any rows
+const (
+	EmptyFilesLoad = "load"
+	EmptyFilesSkip = "skip"
+	EmptyFilesFail = "fail"
+)
+
+// checkDataFileSize returns whether to skip loading the data file at path, or an error if it should
+// fail the load, given its size and what emptyFiles says to do with an empty one
+func checkDataFileSize(emptyFiles, path string, size int64) (bool, error) {
+	if size > 0 {
+		return false, nil
+	}
+	switch emptyFiles {
+	case EmptyFilesSkip:
+		return true, nil
+	case EmptyFilesFail:
+		return false, fmt.Errorf("data file %s is empty", path)
+	}
+	return false, nil
+}
+
+// What LoadConfig.StaleData says to do with data older than LoadConfig.MaxDataAge
+const (
+	StaleDataFail = "fail"
+	StaleDataWarn = "warn"
+)
+
+// ErrStaleData is returned when the data date is older than LoadConfig.MaxDataAge, which usually
+// means whatever writes the data has stopped
+var ErrStaleData = errors.New("data is older than the max data age")
+
+// checkDataAge returns ErrStaleData if the data date is more than maxAge before now. A maxAge of 0
+// means any age is fine
+func checkDataAge(maxAge time.Duration, dataDate, now time.Time) error {
+	if age := now.Sub(dataDate); maxAge > 0 && age > maxAge {
+		return fmt.Errorf("%w: the data date %s is %s old, more than %s", ErrStaleData,
+			dataDate.Format(time.RFC3339), age.Truncate(time.Second), maxAge)
+	}
+	return nil
+}
+
+// errDataWaitTimedOut is returned when LoadConfig.WaitForDate runs out waiting on the data arriving in s3
+var errDataWaitTimedOut = errors.New("timed out waiting for the data to arrive in s3")
+
+const (
+	// how long to wait before first looking for the data again, doubling each time after
+	dataPollDelay = 30 * time.Second
+	// the longest to wait between looking for the data
+	maxDataPollDelay = 5 * time.Minute
+)
+
+// waitForData runs find until it finds the data, for up to wait while it isn't there yet, waiting
+// between attempts from pollDelay, doubling up to maxDataPollDelay. Other errors aren't waited on
+func waitForData(ctx context.Context, find func() error, wait, pollDelay time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for attempt := 0; ; attempt++ {
+		err := find()
+		if wait <= 0 || !errors.Is(err, s3filepath.ErrDataNotFound) {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%w after %s: %v", errDataWaitTimedOut, wait, err)
+		}
+		delay := retryDelay(pollDelay, attempt)
+		if delay > maxDataPollDelay {
+			delay = maxDataPollDelay
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		logger.GetLogger().InfoD("waiting-for-data", logger.M{"attempt": attempt + 1, "delay": delay.String(), "error": err.Error()})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("cancelled waiting for the data: %w", err)
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying after the given (zero-indexed) attempt,
+// doubling each time
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	return base << uint(attempt)
+}
+
+// retryDeadlocks runs load, and runs it again up to maxRetries times while it fails on a deadlock.
+// Loads which deadlock with each other would most likely do so again if retried in step, so each
+// retry waits a random half to all of the retryDelay
+func retryDeadlocks(ctx context.Context, maxRetries int, base time.Duration, schema, table string,
+	load func(deadlocks int) (int64, error),
+) (int64, error) {
+	for deadlocks := 0; ; deadlocks++ {
+		rowsLoaded, err := load(deadlocks)
+		if deadlocks >= maxRetries || !redshift.IsDeadlockError(err) {
+			return rowsLoaded, err
+		}
+		delay := jitter(retryDelay(base, deadlocks))
+		logger.GetLogger().WarnD("retrying-deadlocked-load", logger.M{
+			"schema": schema, "table": table, "attempt": deadlocks + 1, "delay": delay.String(), "error": err.Error(),
+		})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return 0, fmt.Errorf("cancelled before retrying deadlocked load: %w", err)
+		}
+	}
+}
+
+// jitter returns a random duration between half of d and d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// startEndFromGranularity returns the window of the granularity the time is in, in the timezone
+func startEndFromGranularity(t time.Time, granularity string, targetTimezone string) (time.Time, time.Time, error) {
+	// Rotate time if in PT
+	if targetTimezone != "UTC" {
+		ptLoc, err := time.LoadLocation(targetTimezone)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("unable to load timezone %s: %w", targetTimezone, err)
+		}
+
+		_, ptOffsetSec := t.In(ptLoc).Zone()
+		t = t.Add(time.Duration(ptOffsetSec) * time.Second)
+	}
+
+	var duration time.Duration
+	if granularity == "day" {
+		duration = time.Hour * 24
+	} else {
+		duration = time.Hour
+	}
+
+	start := t.UTC().Truncate(duration)
+	end := start.Add(duration)
+	return start, end, nil
+}
@@ -0,0 +1,459 @@
+package redshifter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Clever/pq"
+	redshift "github.com/Clever/s3-to-redshift/v3/redshift"
+	s3filepath "github.com/Clever/s3-to-redshift/v3/s3filepath"
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeGranularity(t *testing.T) {
+	baseTime := time.Date(2017, 7, 11, 12, 9, 0, 0, time.UTC)
+
+	start, end, _ := startEndFromGranularity(baseTime, "day", "UTC")
+	assert.Equal(t, start, time.Date(2017, 7, 11, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, end, time.Date(2017, 7, 12, 0, 0, 0, 0, time.UTC))
+
+	start, end, _ = startEndFromGranularity(baseTime, "hour", "UTC")
+	assert.Equal(t, start, time.Date(2017, 7, 11, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, end, time.Date(2017, 7, 11, 13, 0, 0, 0, time.UTC))
+
+	// Simulate timestamps that cross timezones in PT vs UTC
+	baseTime = time.Date(2017, 7, 11, 4, 0, 0, 0, time.UTC)
+
+	start, end, _ = startEndFromGranularity(baseTime, "day", "UTC")
+	assert.Equal(t, start, time.Date(2017, 7, 11, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, end, time.Date(2017, 7, 12, 0, 0, 0, 0, time.UTC))
+
+	start, end, _ = startEndFromGranularity(baseTime, "day", "America/Los_Angeles")
+	assert.Equal(t, start, time.Date(2017, 7, 10, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, end, time.Date(2017, 7, 11, 0, 0, 0, 0, time.UTC))
+
+	_, _, err := startEndFromGranularity(baseTime, "day", "Not/A_Timezone")
+	assert.Error(t, err)
+}
+
+func TestIsInputDataStale(t *testing.T) {
+	locationUTC, _ := time.LoadLocation("UTC")
+	inputDataDate, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+	targetDataDate, _ := time.Parse(time.RFC3339, "2017-08-15T21:00:00Z")
+
+	assert.Equal(t, false, isInputDataStale(inputDataDate, &targetDataDate, "day", locationUTC))
+	assert.Equal(t, true, isInputDataStale(inputDataDate, &targetDataDate, "hour", locationUTC))
+	assert.Equal(t, false, isInputDataStale(inputDataDate, nil, "hour", locationUTC))
+
+	// Simulate Redshift timestamp without time zones that is parsed as UTC but is actually PT
+	locationPT, _ := time.LoadLocation("America/Los_Angeles")
+	targetDataDatePT, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+	inputDataDateUTC, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+
+	assert.Equal(t, false, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "hour", locationUTC))
+	assert.Equal(t, true, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "hour", locationPT))
+
+	// Test Redshift timestamp without time zones where UTC and PT are on different days
+	targetDataDatePT, _ = time.Parse(time.RFC3339, "2017-08-15T23:00:00Z")
+	inputDataDateUTC, _ = time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+
+	assert.Equal(t, false, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "day", locationUTC))
+	assert.Equal(t, true, isInputDataStale(inputDataDateUTC, &targetDataDatePT, "day", locationPT))
+}
+
+// the first load of a table has no target table or data date, which used to be dereferenced
+func TestRunCopyFirstLoad(t *testing.T) {
+	inputDataDate, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+	assert.Equal(t, false, isInputDataStale(inputDataDate, nil, "day", time.UTC))
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := redshift.NewRedshiftFromDB(context.Background(), db)
+	mockRedshift.SetDryRun(true)
+
+	// in a dry run only the transaction itself, and the check for a concurrently created table,
+	// touch the database
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT table_name FROM information_schema.tables`).WithArgs().WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	inputConf := s3filepath.S3File{Schema: "testschema", Table: "testtable", Suffix: "json.gz", DataDate: inputDataDate}
+	inputTable := redshift.Table{
+		Name: "testtable",
+		Columns: []redshift.ColInfo{
+			{Name: "id", Type: "text", DistKey: true},
+			{Name: "created", Type: "timestamp", SortOrdinal: 1},
+		},
+		Meta: redshift.Meta{Schema: "testschema", DataDateColumn: "created"},
+	}
+	cfg := LoadConfig{DB: mockRedshift, TimeGranularity: "day", DryRun: true}
+	_, err = runCopy(cfg, inputConf, nil, inputTable, nil, "UTC")
+	assert.NoError(t, err)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// a reset changing the table's keys: the old table is dropped in the load's transaction, but other
+// connections still see it until the load commits, so it mustn't be compared with the config
+func TestRunCopyReset(t *testing.T) {
+	inputDataDate, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := redshift.NewRedshiftFromDB(context.Background(), db)
+
+	// the table is created from the config straight after the drop, without looking for the old one
+	mock.ExpectBegin()
+	mock.ExpectExec(`DROP TABLE "testschema"."testtable"`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "testschema"."testtable" \(.*"id" character varying\(256\).*DISTKEY,.*"created" timestamp.*SORTKEY`).
+		WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\), GETDATE\(\)`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid", "getdate"}).AddRow(1234, inputDataDate))
+	mock.ExpectExec(`COPY "testschema"."testtable" FROM`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT pg_last_copy_count\(\)`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
+	mock.ExpectExec(`INSERT INTO latencies`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT last_update FROM latencies`).WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"last_update"}).AddRow(inputDataDate))
+	mock.ExpectExec(`UPDATE latencies SET last_update`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`ANALYZE COMPRESSION "testschema"."testtable"`).WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"table", "column", "encoding", "est_reduction_pct"}))
+
+	inputConf := s3filepath.S3File{Schema: "testschema", Table: "testtable", Suffix: "json.gz", DataDate: inputDataDate}
+	inputTable := redshift.Table{
+		Name: "testtable",
+		Columns: []redshift.ColInfo{
+			{Name: "id", Type: "text", DistKey: true},
+			{Name: "created", Type: "timestamp", SortOrdinal: 1},
+		},
+		Meta: redshift.Meta{Schema: "testschema", DataDateColumn: "created"},
+	}
+	// the old table, as other connections see it, has different keys
+	targetTable := redshift.Table{
+		Name: "testtable",
+		Columns: []redshift.ColInfo{
+			{Name: "id", Type: "text", SortOrdinal: 1},
+			{Name: "created", Type: "timestamp", DistKey: true},
+		},
+		Meta: redshift.Meta{Schema: "testschema"},
+	}
+	cfg := LoadConfig{DB: mockRedshift, TimeGranularity: "day", Reset: true}
+	rows, err := runCopy(cfg, inputConf, nil, inputTable, &targetTable, "UTC")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), rows)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// a fact table opting out of truncation isn't swapped out under --swap, which would replace its
+// history with the one date's data, but has the date's rows replaced as usual
+func TestRunCopySwapNoTruncate(t *testing.T) {
+	inputDataDate, _ := time.Parse(time.RFC3339, "2017-08-15T14:00:00Z")
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := redshift.NewRedshiftFromDB(context.Background(), db)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("This needs to be here, but not evaluated")
+	mock.ExpectExec(`DELETE FROM "testschema"."testtable"\s+WHERE "created" >= '2017-08-15 00:00:00' AND "created" < '2017-08-16 00:00:00'`).
+		WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\), GETDATE\(\)`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid", "getdate"}).AddRow(1234, inputDataDate))
+	mock.ExpectExec(`COPY "testschema"."testtable" FROM`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT pg_last_copy_count\(\)`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
+	mock.ExpectExec(`INSERT INTO latencies`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT last_update FROM latencies`).WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"last_update"}).AddRow(inputDataDate))
+	mock.ExpectExec(`UPDATE latencies SET last_update`).WithArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	inputConf := s3filepath.S3File{Schema: "testschema", Table: "testtable", Suffix: "json.gz", DataDate: inputDataDate}
+	noTruncate := false
+	inputTable := redshift.Table{
+		Name: "testtable",
+		Columns: []redshift.ColInfo{
+			{Name: "id", Type: "text", DistKey: true},
+			{Name: "created", Type: "timestamp", SortOrdinal: 1},
+		},
+		Meta: redshift.Meta{Schema: "testschema", DataDateColumn: "created", Truncate: &noTruncate},
+	}
+	targetTable := redshift.Table{
+		Name: "testtable",
+		Columns: []redshift.ColInfo{
+			{Name: "id", Type: "character varying(256)", DistKey: true},
+			{Name: "created", Type: "timestamp without time zone", SortOrdinal: 1},
+		},
+		Meta: redshift.Meta{Schema: "testschema"},
+	}
+	cfg := LoadConfig{DB: mockRedshift, TimeGranularity: "day", Swap: true, Truncate: true}
+	cfg.Truncate, err = shouldTruncate(cfg.Truncate, cfg.Upsert, inputTable.Meta)
+	assert.NoError(t, err)
+	rows, err := runCopy(cfg, inputConf, nil, inputTable, &targetTable, "UTC")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), rows)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestUnchangedSinceLastLoad(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := redshift.NewRedshiftFromDB(context.Background(), db)
+	lastLoad := func() {
+		mock.ExpectQuery(`SELECT table_name`).WithArgs().WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("redshift_load_history"))
+		mock.ExpectQuery(`SELECT s3_path, etag, data_date FROM redshift_load_history`).WithArgs().
+			WillReturnRows(sqlmock.NewRows([]string{"s3_path", "etag", "data_date"}).
+				AddRow("s3://bucket/testschema_testtable_2017-08-14T00:00:00Z.json.gz", "abc123", time.Date(2017, 8, 14, 0, 0, 0, 0, time.UTC)))
+	}
+
+	// the same file as yesterday's
+	lastLoad()
+	unchanged, err := unchangedSinceLastLoad(mockRedshift, "testschema", "testtable", "abc123")
+	assert.NoError(t, err)
+	assert.True(t, unchanged)
+
+	lastLoad()
+	unchanged, err = unchangedSinceLastLoad(mockRedshift, "testschema", "testtable", "def456")
+	assert.NoError(t, err)
+	assert.False(t, unchanged)
+
+	// without an ETag, redshift isn't asked
+	unchanged, err = unchangedSinceLastLoad(mockRedshift, "testschema", "testtable", "")
+	assert.NoError(t, err)
+	assert.False(t, unchanged)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestCheckDateLoaded(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mockRedshift := redshift.NewRedshiftFromDB(context.Background(), db)
+	meta := redshift.Meta{DataDateColumn: "created"}
+	// data for an old date, e.g. one arriving after newer dates were loaded
+	dataDate := time.Date(2017, 8, 10, 14, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT 1 FROM "testschema"."testtable" WHERE "created" >= '2017-08-10 00:00:00' AND "created" < '2017-08-11 00:00:00'`).
+		WithArgs().WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow(1))
+	err = checkDateLoaded(mockRedshift, "testschema", "testtable", meta, dataDate, "day", "UTC")
+	assert.True(t, errors.Is(err, redshift.ErrNoNewData))
+
+	// nothing for the date yet, so it's late data to load
+	mock.ExpectQuery(`SELECT 1 FROM "testschema"."testtable" WHERE "created" >= '2017-08-10 14:00:00' AND "created" < '2017-08-10 15:00:00'`).
+		WithArgs().WillReturnRows(sqlmock.NewRows([]string{"one"}))
+	assert.NoError(t, checkDateLoaded(mockRedshift, "testschema", "testtable", meta, dataDate, "hour", "UTC"))
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// a bad timezone fails the load before it touches redshift or s3
+func TestLoadTableBadTimezone(t *testing.T) {
+	result, err := LoadTable(context.Background(), LoadConfig{
+		Schema: "testschema", Table: "testtable", TimeGranularity: "day", TargetTimezone: "Not/A_Timezone",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to load timezone Not/A_Timezone")
+	}
+	assert.Equal(t, LoadResult{Schema: "testschema", Table: "testtable"}, result)
+}
+
+// library callers get the same checks as the CLI, before anything is loaded
+func TestLoadConfigValidate(t *testing.T) {
+	valid := LoadConfig{TimeGranularity: "day"}
+	assert.NoError(t, valid.Validate())
+
+	for name, cfg := range map[string]LoadConfig{
+		"parallel upsert":      {TimeGranularity: "day", Manifest: true, ParallelCopy: 4, Upsert: true},
+		"parallel no manifest": {TimeGranularity: "day", ParallelCopy: 4},
+		"swap no truncate":     {TimeGranularity: "day", Swap: true},
+		"swap parallel":        {TimeGranularity: "day", Manifest: true, ParallelCopy: 4, Swap: true, Truncate: true},
+		"reset swap":           {TimeGranularity: "day", Reset: true, Swap: true, Truncate: true},
+		"upsert truncate":      {TimeGranularity: "day", Upsert: true, Truncate: true},
+		"dedup swap":           {TimeGranularity: "day", Dedup: true, Swap: true, Truncate: true},
+		"s3Path manifest":      {TimeGranularity: "day", S3Path: "s3://bucket/data.json.gz", Manifest: true},
+		"key template":         {TimeGranularity: "day", Bucket: s3filepath.S3Bucket{KeyTemplate: "{schema}/{table}/dt={date:2006-01-02}"}},
+		"requester pays":       {TimeGranularity: "day", Manifest: true, Bucket: s3filepath.S3Bucket{RequesterPays: true}},
+		"granularity":          {TimeGranularity: "week"},
+		"timezone":             {TimeGranularity: "day", TargetTimezone: "Not/A_Timezone"},
+		"negative retries":     {TimeGranularity: "day", MaxRetries: -1},
+		"stale data":           {TimeGranularity: "day", StaleData: "ignore"},
+	} {
+		assert.Error(t, cfg.Validate(), name)
+	}
+
+	// LoadTable checks them first
+	_, err := LoadTable(context.Background(), LoadConfig{TimeGranularity: "day", Swap: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "swap needs truncate")
+	}
+}
+
+func TestCheckRowCount(t *testing.T) {
+	assert.NoError(t, checkRowCount(10, 10, 0))
+	assert.NoError(t, checkRowCount(10, 8, 2))
+	assert.Error(t, checkRowCount(10, 8, 1))
+	// more rows than the data has means it was counted wrong, e.g. newlines in CSV fields
+	assert.Error(t, checkRowCount(10, 11, 5))
+}
+
+func TestShouldTruncate(t *testing.T) {
+	yes, no := true, false
+	for _, c := range []struct {
+		flag     bool
+		meta     *bool
+		expected bool
+	}{
+		{false, nil, false},
+		{true, nil, true},
+		// dimension tables truncate and fact tables append, whatever the flag says
+		{false, &yes, true},
+		{true, &no, false},
+	} {
+		truncate, err := shouldTruncate(c.flag, false, redshift.Meta{Truncate: c.meta})
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, truncate)
+	}
+	_, err := shouldTruncate(false, true, redshift.Meta{Truncate: &yes})
+	assert.Error(t, err)
+	truncate, err := shouldTruncate(false, true, redshift.Meta{Truncate: &no})
+	assert.NoError(t, err)
+	assert.False(t, truncate)
+}
+
+func TestCopyDelimiter(t *testing.T) {
+	delimiter, err := copyDelimiter("|", redshift.Meta{})
+	assert.NoError(t, err)
+	assert.Equal(t, "|", delimiter)
+	delimiter, err = copyDelimiter("", redshift.Meta{Delimiter: "|", Quote: "`"})
+	assert.NoError(t, err)
+	assert.Equal(t, "|", delimiter)
+	_, err = copyDelimiter("`", redshift.Meta{Quote: "`"})
+	assert.Error(t, err)
+	// JSON has no quote character
+	_, err = copyDelimiter("", redshift.Meta{Quote: "`"})
+	assert.Error(t, err)
+}
+
+func TestCheckDataFileSize(t *testing.T) {
+	path := "s3://bucket/mongo_users_2020-01-01.json.gz"
+	for _, mode := range []string{EmptyFilesLoad, EmptyFilesSkip, EmptyFilesFail} {
+		skip, err := checkDataFileSize(mode, path, 20)
+		assert.NoError(t, err)
+		assert.False(t, skip)
+	}
+
+	skip, err := checkDataFileSize(EmptyFilesLoad, path, 0)
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	skip, err = checkDataFileSize(EmptyFilesSkip, path, 0)
+	assert.NoError(t, err)
+	assert.True(t, skip)
+	_, err = checkDataFileSize(EmptyFilesFail, path, 0)
+	assert.EqualError(t, err, "data file s3://bucket/mongo_users_2020-01-01.json.gz is empty")
+}
+
+func TestCheckDataAge(t *testing.T) {
+	now := time.Date(2020, 1, 8, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, checkDataAge(0, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), now))
+	assert.NoError(t, checkDataAge(48*time.Hour, time.Date(2020, 1, 7, 0, 0, 0, 0, time.UTC), now))
+	err := checkDataAge(48*time.Hour, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), now)
+	assert.True(t, errors.Is(err, ErrStaleData))
+	assert.EqualError(t, err, "data is older than the max data age: the data date 2020-01-01T00:00:00Z is 180h0m0s old, more than 48h0m0s")
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryDelay(5*time.Second, 0))
+	assert.Equal(t, 10*time.Second, retryDelay(5*time.Second, 1))
+	assert.Equal(t, 40*time.Second, retryDelay(5*time.Second, 3))
+}
+
+func TestRetryDeadlocks(t *testing.T) {
+	deadlock := fmt.Errorf("err running copy: %w", &pq.Error{Code: "40P01", Message: "deadlock detected"})
+	var attempts []int
+	// deadlocks on the first attempt, then loads
+	rows, err := retryDeadlocks(context.Background(), 2, 0, "mongo", "users", func(deadlocks int) (int64, error) {
+		attempts = append(attempts, deadlocks)
+		if deadlocks == 0 {
+			return 0, deadlock
+		}
+		return 10, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), rows)
+	assert.Equal(t, []int{0, 1}, attempts)
+
+	// gives up after the retries, and doesn't retry other errors
+	attempts = nil
+	_, err = retryDeadlocks(context.Background(), 2, 0, "mongo", "users", func(deadlocks int) (int64, error) {
+		attempts = append(attempts, deadlocks)
+		return 0, deadlock
+	})
+	assert.True(t, errors.Is(err, deadlock))
+	assert.Equal(t, []int{0, 1, 2}, attempts)
+	attempts = nil
+	_, err = retryDeadlocks(context.Background(), 2, 0, "mongo", "users", func(deadlocks int) (int64, error) {
+		attempts = append(attempts, deadlocks)
+		return 0, &pq.Error{Code: "40001"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []int{0}, attempts)
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(t, d >= 500*time.Millisecond && d <= time.Second, d.String())
+	}
+	assert.Equal(t, time.Duration(0), jitter(0))
+}
+
+func TestWaitForData(t *testing.T) {
+	notFound := fmt.Errorf("issue getting data file from s3: %w", s3filepath.ErrDataNotFound)
+
+	// found after a couple of polls
+	calls := 0
+	err := waitForData(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return notFound
+		}
+		return nil
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// other errors aren't waited on
+	calls = 0
+	err = waitForData(context.Background(), func() error {
+		calls++
+		return errors.New("access denied")
+	}, time.Second, time.Millisecond)
+	assert.EqualError(t, err, "access denied")
+	assert.Equal(t, 1, calls)
+
+	// without a wait, not finding the data fails right away
+	err = waitForData(context.Background(), func() error { return notFound }, 0, time.Millisecond)
+	assert.True(t, errors.Is(err, s3filepath.ErrDataNotFound))
+
+	// gives up once the wait is over
+	err = waitForData(context.Background(), func() error { return notFound }, 10*time.Millisecond, time.Millisecond)
+	assert.True(t, errors.Is(err, errDataWaitTimedOut))
+}
@@ -1,24 +1,104 @@
 package s3filepath
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/Clever/pathio"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 var (
 	// currently assumes no unix file created timestamp
 	s3Regex   = regexp.MustCompile(".*_.*_(.*?)\\.(.*)")
 	yamlRegex = regexp.MustCompile(".*\\.yml")
+	// splits an s3 path into bucket and key
+	s3PathRegex = regexp.MustCompile("^s3://([^/]+)/(.+)$")
+	// the fields of a key template, e.g. {schema} or {date:2006-01-02}
+	keyTemplateFieldRegex = regexp.MustCompile(`\{(schema|table|date:[^}]+)\}`)
+)
+
+// dataSuffixes are the suffixes of the data files CreateS3File looks for, in order
+var dataSuffixes = []string{
+	"manifest", // 1) manifest file
+	"json.gz",  // 2) gzipped json file
+	"json.lzo", // 3) lzop json file
+	"json.zst", // 4) zstd json file
+	"json",     // 5) json file
+	"parquet",  // 6) parquet file
+	".gz",      // 7) gzipped csv file (.gz)
+	".lzo",     // 8) lzop csv file (.lzo)
+	".zst",     // 9) zstd csv file (.zst)
+	"",         // 10) csv file (no suffix when UNLOADed :-/)
+}
+
+// ErrDataNotFound is returned when there's no data for the table and date, e.g. it hasn't been
+// written yet
+var ErrDataNotFound = errors.New("s3 file not found")
+
+// ErrJSONArray is returned by CheckJSONLines when the JSON data is a single array of objects,
+// which COPY can't load
+var ErrJSONArray = errors.New("JSON data is an array, but COPY needs one object per line (JSON lines)")
+
+// ErrCorruptGzip is returned by CheckGzip when a gzipped data file doesn't decompress
+var ErrCorruptGzip = errors.New("corrupt gzip")
+
+// Compression formats of the data files, named by the COPY option which loads them
+const (
+	CompressionNone = ""
+	CompressionGzip = "GZIP"
+	CompressionLzop = "LZOP"
+	CompressionZstd = "ZSTD"
 )
 
 // S3Bucket is our subset of the s3.Bucket class, useful for testing mostly
+// COPY uses RedshiftRoleARN if set, otherwise the access keys (and session token, for
+// temporary credentials)
+// KMSKeyARN is the customer managed key the bucket's objects are encrypted with, if any. COPY
+// decrypts SSE-KMS objects itself, so it isn't part of the SQL, but the credentials used must be
+// allowed to kms:Decrypt with it, and objects we write (i.e. manifests) are encrypted with it.
+// Endpoint overrides the S3 API endpoint (e.g. MinIO for local testing) for our own reads, listing
+// and writes. Redshift can only COPY from AWS S3 though, so it has no effect on the COPY itself.
+// KeyTemplate is the layout of the folder of a table's data for a date, if it isn't the default
+// <schema>/<table>/_data_timestamp_year=<year>/... one, e.g. "{schema}/{table}/dt={date:2006-01-02}"
+// for Hive style partitions. See ValidateKeyTemplate. Every data file in the folder is a part of
+// the date's data, so they can only be loaded through a manifest.
 type S3Bucket struct {
 	Name            string
 	Region          string
 	RedshiftRoleARN string
+	AccessID        string
+	SecretKey       string
+	Token           string
+	KMSKeyARN       string
+	Endpoint        string
+	KeyTemplate     string
+	// DateMetadata is the object metadata the data date of each part is read from, e.g.
+	// x-amz-meta-data-date, for producers that don't put it in the key. See ListAvailableDates.
+	DateMetadata string
+	// RequesterPays says the bucket is requester pays, so we pay for (and must say we'll pay for)
+	// every request to it. COPY can't, so its parts are copied to StagingBucket to load from there.
+	// See CreateManifestFiles.
+	RequesterPays bool
+	StagingBucket string
+	// Credentials, if set, are what our own requests to s3 are signed with, rather than the SDK's
+	// default chain, e.g. keys from the redshift credential provider. COPY uses the keys above.
+	Credentials *credentials.Credentials
 }
 
 // S3File holds everything needed to run a COPY on the file
@@ -31,6 +111,10 @@ type S3File struct {
 	DataDate  time.Time
 	Subfolder string
 	ConfFile  string
+	// Compression is detected from the suffix, manifests don't say so it's left to the caller
+	Compression string
+	// Path, if set, is the data file's path, rather than the one the other fields make
+	Path string
 }
 
 // PathChecker is the interface for determining if a path in S3 exists, which allows
@@ -40,48 +124,852 @@ type PathChecker interface {
 }
 
 // S3PathChecker will use pathio to determine if the path actually exists in S3, and
-// will be used in prod.
-type S3PathChecker struct{}
+// will be used in prod. It uses the bucket's endpoint instead, if it has one.
+type S3PathChecker struct {
+	Bucket S3Bucket
+}
 
-// FileExists looks up if the file exists in S3 using the pathio.Reader method.
-func (S3PathChecker) FileExists(path string) bool {
-	reader, err := pathio.Reader(path)
+// FileExists looks up if the file exists in S3 using the Reader method.
+func (pc S3PathChecker) FileExists(path string) bool {
+	reader, err := Reader(pc.Bucket, path)
 	if reader != nil {
 		defer reader.Close()
 	}
 	return err == nil
 }
 
+// Reader opens the file at the path, which may be local or in S3, using pathio. If the bucket
+// has a custom endpoint S3 paths are read from that instead, since pathio only knows about AWS,
+// and the same goes for a requester pays bucket, since pathio can't say we'll pay, and for
+// credentials, since pathio only uses the default chain.
+func Reader(b S3Bucket, path string) (io.ReadCloser, error) {
+	match := s3PathRegex.FindStringSubmatch(path)
+	if (b.Endpoint == "" && !b.RequesterPays && b.Credentials == nil) || match == nil {
+		return pathio.Reader(path)
+	}
+	resp, err := newS3Client(b.Region, b.Endpoint, b.Credentials).GetObject(&s3.GetObjectInput{
+		Bucket:       aws.String(match[1]),
+		Key:          aws.String(match[2]),
+		RequestPayer: requestPayer(b.RequesterPays),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// CountRows counts the rows in the data file, or in every part file behind a manifest, by reading
+// all of them through: a row is a line, which holds for JSON with an object per line and CSV
+// without newlines in quoted fields. Only gzipped and uncompressed data can be counted, not
+// parquet. The parts of a manifest have its compression.
+func CountRows(f S3File) (int64, error) {
+	return countRows(func(path string) (io.ReadCloser, error) { return Reader(f.Bucket, path) }, f)
+}
+
+func countRows(open func(path string) (io.ReadCloser, error), f S3File) (int64, error) {
+	if f.Suffix == "parquet" {
+		return 0, fmt.Errorf("can't count the rows of parquet file %s", f.GetDataFilename())
+	}
+	if f.Compression != CompressionNone && f.Compression != CompressionGzip {
+		return 0, fmt.Errorf("can't count the rows of %s, which is %s compressed", f.GetDataFilename(), f.Compression)
+	}
+	paths := []string{f.GetDataFilename()}
+	if f.Suffix == "manifest" {
+		var err error
+		if paths, err = manifestURLs(open, f.GetDataFilename()); err != nil {
+			return 0, err
+		}
+	}
+	var rows int64
+	for _, p := range paths {
+		n, err := countLines(open, p, f.Compression == CompressionGzip)
+		if err != nil {
+			return 0, fmt.Errorf("issue counting rows of %s: %w", p, err)
+		}
+		rows += n
+	}
+	return rows, nil
+}
+
+// manifestURLs returns the files listed in the manifest
+func manifestURLs(open func(path string) (io.ReadCloser, error), path string) ([]string, error) {
+	reader, err := open(path)
+	if err != nil {
+		return nil, fmt.Errorf("issue opening manifest %s: %w", path, err)
+	}
+	defer reader.Close()
+	var m manifest
+	if err := json.NewDecoder(reader).Decode(&m); err != nil {
+		return nil, fmt.Errorf("issue decoding manifest %s: %w", path, err)
+	}
+	var urls []string
+	for _, e := range m.Entries {
+		urls = append(urls, e.URL)
+	}
+	return urls, nil
+}
+
+// gzipReadCloser closes the file under the gzip reader along with it
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// openData opens the file, decompressing it if it's gzipped
+func openData(open func(path string) (io.ReadCloser, error), path string, gzipped bool) (io.ReadCloser, error) {
+	reader, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !gzipped {
+		return reader, nil
+	}
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return gzipReadCloser{gz, reader}, nil
+}
+
+// countLines counts the lines of the file, including a last one without a newline
+func countLines(open func(path string) (io.ReadCloser, error), path string, gzipped bool) (int64, error) {
+	data, err := openData(open, path, gzipped)
+	if err != nil {
+		return 0, err
+	}
+	defer data.Close()
+	var lines int64
+	var last byte = '\n'
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := data.Read(buf)
+		if n > 0 {
+			lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if last != '\n' {
+		lines++
+	}
+	return lines, nil
+}
+
+// CheckJSONLines reads the start of the JSON data file, or of the first file behind a manifest,
+// and returns ErrJSONArray if it's an array rather than JSON lines. Only gzipped and uncompressed
+// data can be read, so lzop and zstd data isn't checked.
+func CheckJSONLines(f S3File) error {
+	return checkJSONLines(func(path string) (io.ReadCloser, error) { return Reader(f.Bucket, path) }, f)
+}
+
+func checkJSONLines(open func(path string) (io.ReadCloser, error), f S3File) error {
+	if f.Compression != CompressionNone && f.Compression != CompressionGzip {
+		return nil
+	}
+	path := f.GetDataFilename()
+	if f.Suffix == "manifest" {
+		urls, err := manifestURLs(open, path)
+		if err != nil {
+			return err
+		}
+		if len(urls) == 0 {
+			return nil
+		}
+		path = urls[0]
+	}
+	data, err := openData(open, path, f.Compression == CompressionGzip)
+	if err == io.EOF {
+		// an empty gzip file has no header
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("issue reading %s: %w", path, err)
+	}
+	defer data.Close()
+	// the first thing after any whitespace or byte order mark says which it is
+	buf := bufio.NewReader(data)
+	for {
+		c, err := buf.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("issue reading %s: %w", path, err)
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n', 0xEF, 0xBB, 0xBF:
+			continue
+		case '[':
+			return fmt.Errorf("%w: %s", ErrJSONArray, path)
+		}
+		return nil
+	}
+}
+
+// the most of each file CheckGzip decompresses. Smaller files are read all the way through, which
+// checks their checksum too
+const gzipCheckBytes = 1 << 20
+
+// CheckGzip reads the start of the gzipped data file, or of each file behind a manifest, through a
+// gzip reader, and returns ErrCorruptGzip if its header or data don't decompress, so that COPY
+// doesn't fail on it part way through the load. It gets each file, so costs a GET each.
+// Data which isn't gzipped isn't checked.
+func CheckGzip(f S3File) error {
+	return checkGzip(func(path string) (io.ReadCloser, error) { return Reader(f.Bucket, path) }, f)
+}
+
+func checkGzip(open func(path string) (io.ReadCloser, error), f S3File) error {
+	if f.Compression != CompressionGzip {
+		return nil
+	}
+	paths := []string{f.GetDataFilename()}
+	if f.Suffix == "manifest" {
+		var err error
+		if paths, err = manifestURLs(open, f.GetDataFilename()); err != nil {
+			return err
+		}
+	}
+	for _, p := range paths {
+		if err := checkGzipFile(open, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGzipFile decompresses up to gzipCheckBytes of the file
+func checkGzipFile(open func(path string) (io.ReadCloser, error), path string) error {
+	reader, err := open(path)
+	if err != nil {
+		return fmt.Errorf("issue reading %s: %w", path, err)
+	}
+	defer reader.Close()
+	gz, err := gzip.NewReader(reader)
+	if err == io.EOF {
+		// an empty gzip file has no header
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w %s: %v", ErrCorruptGzip, path, err)
+	}
+	defer gz.Close()
+	if _, err := io.CopyN(ioutil.Discard, gz, gzipCheckBytes); err != nil && err != io.EOF {
+		return fmt.Errorf("%w %s: %v", ErrCorruptGzip, path, err)
+	}
+	return nil
+}
+
+// ObjectInfo is what we use of an s3 object's metadata
+type ObjectInfo struct {
+	// ETag changes whenever the object is re-uploaded with different contents
+	ETag string
+	// Size is the object's size in bytes
+	Size int64
+	// Metadata is the object's user metadata, keyed by lower case name without x-amz-meta-
+	Metadata map[string]string
+}
+
+// Head returns the metadata of the s3 object at path, without reading the object.
+func Head(b S3Bucket, path string) (ObjectInfo, error) {
+	match := s3PathRegex.FindStringSubmatch(path)
+	if match == nil {
+		return ObjectInfo{}, fmt.Errorf("not an s3 path: %s", path)
+	}
+	resp, err := newS3Client(b.Region, b.Endpoint, b.Credentials).HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(match[1]),
+		Key:          aws.String(match[2]),
+		RequestPayer: requestPayer(b.RequesterPays),
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	var metadata map[string]string
+	for k, v := range resp.Metadata {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return ObjectInfo{
+		ETag:     strings.Trim(aws.StringValue(resp.ETag), `"`),
+		Size:     aws.Int64Value(resp.ContentLength),
+		Metadata: metadata,
+	}, nil
+}
+
+// requestPayer returns the RequestPayer of a request to a bucket, which must say we'll pay for
+// requests to a requester pays bucket. It's nil otherwise
+func requestPayer(requesterPays bool) *string {
+	if !requesterPays {
+		return nil
+	}
+	return aws.String(s3.RequestPayerRequester)
+}
+
+// HeadBucket checks the bucket exists and we may access it, without listing or reading anything
+func HeadBucket(b S3Bucket) error {
+	_, err := newS3Client(b.Region, b.Endpoint, b.Credentials).HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(b.Name)})
+	return err
+}
+
+// ETag returns the ETag of the s3 object at path, which changes whenever the object is re-uploaded
+// with different contents.
+func ETag(b S3Bucket, path string) (string, error) {
+	info, err := Head(b, path)
+	return info.ETag, err
+}
+
+// ChainCredentials returns AWS credentials from the SDK's default chain: the environment, then
+// the shared credentials file, then the ECS task role or EC2 instance profile. Credentials from a
+// role are temporary, so come with a session token.
+func ChainCredentials() (credentials.Value, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	return sess.Config.Credentials.Get()
+}
+
+// newS3Client returns a client for the region, using the endpoint instead of AWS if it's set, and
+// the credentials instead of the default chain if they are.
+// Custom endpoints need path style requests, as they don't have a DNS name per bucket.
+func newS3Client(region, endpoint string, creds *credentials.Credentials) *s3.S3 {
+	config := aws.NewConfig().WithRegion(region)
+	if creds != nil {
+		config = config.WithCredentials(creds)
+	}
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	return s3.New(session.New(), config)
+}
+
+// ObjectStore is the interface for listing, reading the metadata of and writing objects in S3,
+// which allows DI for testing.
+type ObjectStore interface {
+	ListKeys(bucket, prefix string) ([]string, error)
+	ListDirs(bucket, prefix string) ([]string, error)
+	Head(path string) (ObjectInfo, error)
+	Write(path string, data []byte) error
+	Copy(src, dst string) error
+}
+
+// S3ObjectStore uses the S3 API to list objects and pathio to write them, and will be used in prod.
+// If KMSKeyARN is set, objects are written with SSE-KMS using that key instead, and if Endpoint
+// is set all requests go to it rather than AWS. With RequesterPays, every request to list, HEAD or
+// copy objects says we'll pay for it. Requests are signed with Credentials, if set, like S3Bucket's.
+type S3ObjectStore struct {
+	Region        string
+	KMSKeyARN     string
+	Endpoint      string
+	RequesterPays bool
+	Credentials   *credentials.Credentials
+}
+
+// ListKeys returns the keys of every object in the bucket starting with the prefix, following
+// every page of the listing, since S3 returns at most 1000 keys a page
+func (s S3ObjectStore) ListKeys(bucket, prefix string) ([]string, error) {
+	client := newS3Client(s.Region, s.Endpoint, s.Credentials)
+	var keys []string
+	err := client.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket:       aws.String(bucket),
+		Prefix:       aws.String(prefix),
+		RequestPayer: requestPayer(s.RequesterPays),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, *obj.Key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// ListDirs returns the names of the "directories" directly under the prefix, i.e. the distinct
+// next path segments of the keys under it, without listing every object. Like ListKeys, it
+// follows every page of the listing
+func (s S3ObjectStore) ListDirs(bucket, prefix string) ([]string, error) {
+	client := newS3Client(s.Region, s.Endpoint, s.Credentials)
+	var dirs []string
+	err := client.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket:       aws.String(bucket),
+		Prefix:       aws.String(prefix),
+		Delimiter:    aws.String("/"),
+		RequestPayer: requestPayer(s.RequesterPays),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			dirs = append(dirs, strings.TrimSuffix(strings.TrimPrefix(*p.Prefix, prefix), "/"))
+		}
+		return true
+	})
+	return dirs, err
+}
+
+// Head returns the metadata of the object at the s3 path
+func (s S3ObjectStore) Head(path string) (ObjectInfo, error) {
+	return Head(S3Bucket{Region: s.Region, Endpoint: s.Endpoint, RequesterPays: s.RequesterPays, Credentials: s.Credentials}, path)
+}
+
+// Copy copies the object at the src s3 path to the dst one, within S3, encrypting the copy like
+// Write does
+func (s S3ObjectStore) Copy(src, dst string) error {
+	srcMatch, dstMatch := s3PathRegex.FindStringSubmatch(src), s3PathRegex.FindStringSubmatch(dst)
+	if srcMatch == nil || dstMatch == nil {
+		return fmt.Errorf("invalid s3 path: %s or %s", src, dst)
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:               aws.String(dstMatch[1]),
+		Key:                  aws.String(dstMatch[2]),
+		CopySource:           aws.String(url.PathEscape(srcMatch[1] + "/" + srcMatch[2])),
+		RequestPayer:         requestPayer(s.RequesterPays),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	}
+	if s.KMSKeyARN != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(s.KMSKeyARN)
+	}
+	_, err := newS3Client(s.Region, s.Endpoint, s.Credentials).CopyObject(input)
+	return err
+}
+
+// Write writes the data to the s3 path using pathio, or with the KMS key if there is one
+func (s S3ObjectStore) Write(path string, data []byte) error {
+	if s.KMSKeyARN == "" && s.Endpoint == "" && s.Credentials == nil {
+		return pathio.Write(path, data)
+	}
+	match := s3PathRegex.FindStringSubmatch(path)
+	if match == nil {
+		return fmt.Errorf("invalid s3 path: %s", path)
+	}
+	client := newS3Client(s.Region, s.Endpoint, s.Credentials)
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(match[1]),
+		Key:                  aws.String(match[2]),
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	}
+	if s.KMSKeyARN != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(s.KMSKeyARN)
+	}
+	_, err := client.PutObject(input)
+	return err
+}
+
+// manifest is the file format of a redshift COPY manifest
+type manifest struct {
+	Entries []manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	URL       string `json:"url"`
+	Mandatory bool   `json:"mandatory"`
+}
+
 // GetDataFilename returns the s3 filepath associated with an S3File
 // 3useful for redshift COPY commands, amongst other things
+// csv suffixes start with the "." themselves, as an UNLOADed csv file has no suffix at all
 func (f *S3File) GetDataFilename() string {
-	return fmt.Sprintf("s3://%s/%s/%s_%s_%s.%s", f.Bucket.Name, f.Subfolder, f.Schema, f.Table, f.DataDate.Format(time.RFC3339), f.Suffix)
+	if f.Path != "" {
+		return f.Path
+	}
+	name := fmt.Sprintf("s3://%s/%s/%s_%s_%s", f.Bucket.Name, f.Subfolder, f.Schema, f.Table, f.DataDate.Format(time.RFC3339))
+	if f.Suffix == "" || strings.HasPrefix(f.Suffix, ".") {
+		return name + f.Suffix
+	}
+	return name + "." + f.Suffix
+}
+
+// ValidateKeyTemplate checks a key template can be used to find data. A template is a path of
+// literal text and the fields {schema}, {table} and {date:<layout>}, where the layout is a Go
+// time layout the data date is formatted with. There may be several date fields, e.g.
+// "year={date:2006}/month={date:01}", but together they must give the data date.
+// When the date is read from the objects' metadata instead, the template needn't have a date.
+func ValidateKeyTemplate(tmpl string, datedByMetadata bool) error {
+	if strings.HasPrefix(tmpl, "/") || strings.HasSuffix(tmpl, "/") {
+		return fmt.Errorf("key template %s must not start or end with /", tmpl)
+	}
+	if rest := keyTemplateFieldRegex.ReplaceAllString(tmpl, ""); strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("key template %s has an unknown field, only {schema}, {table} and {date:<layout>} are allowed", tmpl)
+	}
+	if !strings.Contains(tmpl, "{date:") {
+		if datedByMetadata {
+			return nil
+		}
+		return fmt.Errorf("key template %s has no {date:<layout>} field", tmpl)
+	}
+	// a date should come back out of the folder it's put in, at least as far as the year
+	date := time.Date(2015, time.November, 10, 23, 0, 0, 0, time.UTC)
+	folder := renderKeyTemplate(tmpl, "s", "t", date)
+	if parsed, ok := keyTemplateDate(tmpl, "s", "t", folder+"/f"); !ok || parsed.Year() != date.Year() {
+		return fmt.Errorf("key template %s can't be parsed back into the data date", tmpl)
+	}
+	return nil
+}
+
+// renderKeyTemplate fills in the fields of the key template for the table and date
+func renderKeyTemplate(tmpl, schema, table string, date time.Time) string {
+	return keyTemplateFieldRegex.ReplaceAllStringFunc(tmpl, func(field string) string {
+		switch field {
+		case "{schema}":
+			return schema
+		case "{table}":
+			return table
+		}
+		return date.Format(strings.TrimSuffix(strings.TrimPrefix(field, "{date:"), "}"))
+	})
+}
+
+// keyTemplateDate returns the data date of a key in a folder laid out by the key template for the table
+func keyTemplateDate(tmpl, schema, table, key string) (time.Time, bool) {
+	pattern := "^"
+	var layouts []string
+	last := 0
+	for _, loc := range keyTemplateFieldRegex.FindAllStringSubmatchIndex(tmpl, -1) {
+		pattern += regexp.QuoteMeta(tmpl[last:loc[0]])
+		switch field := tmpl[loc[2]:loc[3]]; field {
+		case "schema":
+			pattern += regexp.QuoteMeta(schema)
+		case "table":
+			pattern += regexp.QuoteMeta(table)
+		default:
+			layouts = append(layouts, strings.TrimPrefix(field, "date:"))
+			pattern += "([^/]+?)"
+		}
+		last = loc[1]
+	}
+	pattern += regexp.QuoteMeta(tmpl[last:]) + "/"
+	match := regexp.MustCompile(pattern).FindStringSubmatch(key)
+	if match == nil || len(layouts) == 0 {
+		return time.Time{}, false
+	}
+	// the date fields are parsed together, so e.g. year, month and day folders make one date
+	date, err := time.Parse(strings.Join(layouts, "|"), strings.Join(match[1:], "|"))
+	return date, err == nil
+}
+
+// keyDate returns the data date in the key of a data file or manifest of the table, from the
+// folder with a key template and from the filename otherwise
+func keyDate(bucket S3Bucket, schema, table, key string) (time.Time, bool) {
+	if bucket.KeyTemplate != "" {
+		return keyTemplateDate(bucket.KeyTemplate, schema, table, key)
+	}
+	// data files are named <schema>_<table>_<date>.<suffix>, so skip configs and the like
+	namePrefix := fmt.Sprintf("%s_%s_", schema, table)
+	name := path.Base(key)
+	if !strings.HasPrefix(name, namePrefix) {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(time.RFC3339, strings.SplitN(strings.TrimPrefix(name, namePrefix), ".", 2)[0])
+	return date, err == nil
+}
+
+// isPartKey returns whether the key is of a part file rather than a manifest, e.g. one we wrote
+// on a previous run, the config, or hidden files like the _SUCCESS markers Spark and Glue jobs write
+func isPartKey(key string) bool {
+	name := path.Base(key)
+	return !strings.HasSuffix(key, ".manifest") && !yamlRegex.MatchString(name) && !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".")
+}
+
+// objectDate returns the data date of the object at the key: the date in its DateMetadata if the
+// bucket has one and the object is a part with it set, else the date in its key. The metadata is
+// an RFC3339 timestamp or a 2006-01-02 date.
+func objectDate(store ObjectStore, bucket S3Bucket, schema, table, key string) (time.Time, bool, error) {
+	if bucket.DateMetadata != "" && isPartKey(key) {
+		objectPath := fmt.Sprintf("s3://%s/%s", bucket.Name, key)
+		info, err := store.Head(objectPath)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("issue reading the metadata of %s: %w", objectPath, err)
+		}
+		name := strings.TrimPrefix(strings.ToLower(bucket.DateMetadata), "x-amz-meta-")
+		if value, ok := info.Metadata[name]; ok {
+			date, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				if date, err = time.Parse("2006-01-02", value); err != nil {
+					return time.Time{}, false, fmt.Errorf("%s has an invalid %s %q", objectPath, bucket.DateMetadata, value)
+				}
+			}
+			return date, true, nil
+		}
+	}
+	date, ok := keyDate(bucket, schema, table, key)
+	return date, ok, nil
+}
+
+// dateFolder returns the folder of the bucket that the table's data for the date is in
+func dateFolder(bucket S3Bucket, schema, table string, date time.Time) string {
+	if bucket.KeyTemplate != "" {
+		return renderKeyTemplate(bucket.KeyTemplate, schema, table, date)
+	}
+	return fmt.Sprintf("%s/%s/_data_timestamp_year=%02d/_data_timestamp_month=%02d/_data_timestamp_day=%02d",
+		schema, table, date.Year(), int(date.Month()), date.Day())
 }
 
 // CreateS3File creates an S3File object with either a supplied config
 // file or the function generates a config file name
+// Data laid out by a key template has no one data file, so must use CreateManifestFile
 func CreateS3File(pc PathChecker, bucket S3Bucket, schema, table, suppliedConf string, date time.Time) (*S3File, error) {
+	if bucket.KeyTemplate != "" {
+		return nil, fmt.Errorf("data laid out by key template %s can only be loaded through a manifest", bucket.KeyTemplate)
+	}
+	if bucket.RequesterPays {
+		return nil, fmt.Errorf("data in requester pays bucket %s can only be loaded through a manifest", bucket.Name)
+	}
 	// set configuration location
 	formattedDate := date.Format(time.RFC3339)
-	subfolder := fmt.Sprintf("%s/%s/_data_timestamp_year=%02d/_data_timestamp_month=%02d/_data_timestamp_day=%02d",
-		schema, table, date.Year(), int(date.Month()), date.Day())
+	subfolder := dateFolder(bucket, schema, table, date)
 	confFile := fmt.Sprintf("s3://%s/%s/config_%s_%s_%s.yml", bucket.Name, subfolder, schema, table, formattedDate)
 	if suppliedConf != "" {
 		confFile = suppliedConf
 	}
-	// Try to find manifest or data files out of the following patterns, in order
+	// Try to find manifest or data files out of the suffixes, in order
 	// we try to get in order as otherwise
-	for _, suffix := range []string{
-		"manifest", // 1) manifest file
-		"json.gz",  // 2) gzipped json file
-		"json",     // 3) json file
-		".gz",      // 4) gzipped csv file (.gz)
-		""} {       // 5) csv file (no suffix when UNLOADed :-/)
-		inputFile := S3File{bucket, schema, table, suffix, date, subfolder, confFile}
+	for _, suffix := range dataSuffixes {
+		inputFile := S3File{bucket, schema, table, suffix, date, subfolder, confFile, compressionForSuffix(suffix), ""}
 		if pc.FileExists(inputFile.GetDataFilename()) {
 			return &inputFile, nil
 		}
 	}
-	return nil, fmt.Errorf("s3 file not found at: bucket: %s schema: %s, table: %s date: %s",
+	return nil, fmt.Errorf("%w at: bucket: %s schema: %s, table: %s date: %s", ErrDataNotFound,
 		bucket.Name, schema, table, formattedDate)
 }
+
+// S3FileFromPath returns the data file at the s3 path, which must be in the bucket, as the data of the
+// table for the date, rather than finding it. Its format and compression come from its suffix, as
+// with CreateS3File, and its config is suppliedConf, or else the usual one in the same folder.
+// It's an error if the file doesn't exist.
+func S3FileFromPath(pc PathChecker, bucket S3Bucket, s3Path, schema, table, suppliedConf string, date time.Time) (*S3File, error) {
+	match := s3PathRegex.FindStringSubmatch(s3Path)
+	if match == nil {
+		return nil, fmt.Errorf("%s isn't an s3 path like s3://bucket/key", s3Path)
+	}
+	if match[1] != bucket.Name {
+		return nil, fmt.Errorf("s3 path %s isn't in bucket %s", s3Path, bucket.Name)
+	}
+	key := match[2]
+	subfolder := path.Dir(key)
+	if subfolder == "." {
+		subfolder = ""
+	}
+	confFile := fmt.Sprintf("s3://%s/%s/config_%s_%s_%s.yml", bucket.Name, subfolder, schema, table, date.Format(time.RFC3339))
+	if suppliedConf != "" {
+		confFile = suppliedConf
+	}
+	suffix := ""
+	for _, s := range dataSuffixes {
+		ending := s
+		if !strings.HasPrefix(s, ".") {
+			ending = "." + s
+		}
+		if s != "" && strings.HasSuffix(key, ending) {
+			suffix = s
+			break
+		}
+	}
+	if !pc.FileExists(s3Path) {
+		return nil, fmt.Errorf("%w at: %s", ErrDataNotFound, s3Path)
+	}
+	return &S3File{bucket, schema, table, suffix, date, subfolder, confFile, compressionForSuffix(suffix), s3Path}, nil
+}
+
+// DiscoverTables returns the sorted tables in the schema's folder of the bucket whose names match
+// the pattern, which uses path.Match syntax (e.g. events_*)
+func DiscoverTables(store ObjectStore, bucket S3Bucket, schema, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid table pattern %s: %w", pattern, err)
+	}
+	dirs, err := store.ListDirs(bucket.Name, schema+"/")
+	if err != nil {
+		return nil, fmt.Errorf("issue listing tables under s3://%s/%s/: %w", bucket.Name, schema, err)
+	}
+	seen := map[string]bool{}
+	var tables []string
+	for _, dir := range dirs {
+		if matched, _ := path.Match(pattern, dir); matched && !seen[dir] {
+			seen[dir] = true
+			tables = append(tables, dir)
+		}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// ListAvailableDates returns the data dates there are data files (or manifests) for in the table's
+// folder of the bucket, newest first. It lists every object under the folder, so is for diagnosing
+// rather than for every load
+// With a key template, the dates are those of the folders with anything in them
+// With DateMetadata, each part's date is read from its metadata, falling back to the date in its
+// key when it doesn't have it, which means a HEAD request for every part
+func ListAvailableDates(store ObjectStore, bucket S3Bucket, schema, table string) ([]time.Time, error) {
+	prefix := fmt.Sprintf("%s/%s/", schema, table)
+	if bucket.KeyTemplate != "" {
+		// everything before the first date field is the same for every date
+		literal := bucket.KeyTemplate + "/"
+		if i := strings.Index(bucket.KeyTemplate, "{date:"); i >= 0 {
+			literal = bucket.KeyTemplate[:i]
+		}
+		prefix = renderKeyTemplate(literal, schema, table, time.Time{})
+	}
+	keys, err := store.ListKeys(bucket.Name, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("issue listing data files under s3://%s/%s: %w", bucket.Name, prefix, err)
+	}
+	seen := map[string]bool{}
+	var dates []time.Time
+	for _, key := range keys {
+		date, ok, err := objectDate(store, bucket, schema, table, key)
+		if err != nil {
+			return nil, err
+		}
+		if formattedDate := date.Format(time.RFC3339); ok && !seen[formattedDate] {
+			seen[formattedDate] = true
+			dates = append(dates, date)
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].After(dates[j]) })
+	return dates, nil
+}
+
+// CreateManifestFile lists all the part files of the data for a schema, table and date, writes
+// a COPY manifest of them next to them, and returns an S3File for the manifest.
+// Parts are the objects in the date's folder whose names start with the usual data filename,
+// e.g. s_t_2015-11-10T23:00:00Z.json.gz.0001. Every part is marked mandatory, so the COPY fails
+// rather than loading an incomplete set. The parts must all have the same compression.
+// With DateMetadata, only the parts whose date (from their metadata, or else their key) is the
+// date are included, so a key template needn't have a date at all.
+// COPY can't read from a requester pays bucket, so its parts are copied to the same keys in the
+// bucket's StagingBucket, and the manifest is written there too, listing the copies.
+func CreateManifestFile(store ObjectStore, bucket S3Bucket, schema, table, suppliedConf string, date time.Time) (*S3File, error) {
+	files, err := CreateManifestFiles(store, bucket, schema, table, suppliedConf, date, 1)
+	if err != nil {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// CreateManifestFiles is like CreateManifestFile, but splits the part files between up to n
+// manifests, so they can be loaded by separate COPYs. With more than one manifest, each is
+// written to its own _part<N> folder under the date's folder, where it won't be picked up as
+// a part file itself.
+func CreateManifestFiles(store ObjectStore, bucket S3Bucket, schema, table, suppliedConf string, date time.Time, n int) ([]*S3File, error) {
+	if bucket.RequesterPays && bucket.StagingBucket == "" {
+		return nil, fmt.Errorf("requester pays bucket %s needs a staging bucket to load from", bucket.Name)
+	}
+	manifestFile := S3File{
+		Bucket:    bucket,
+		Schema:    schema,
+		Table:     table,
+		Suffix:    "manifest",
+		DataDate:  date,
+		Subfolder: dateFolder(bucket, schema, table, date),
+	}
+	manifestFile.ConfFile = fmt.Sprintf("s3://%s/%s/config_%s_%s_%s.yml", bucket.Name, manifestFile.Subfolder, schema, table, date.Format(time.RFC3339))
+	if suppliedConf != "" {
+		manifestFile.ConfFile = suppliedConf
+	}
+
+	// with a key template, the parts are everything in the date's folder
+	prefix := fmt.Sprintf("%s/%s_%s_%s", manifestFile.Subfolder, schema, table, date.Format(time.RFC3339))
+	if bucket.KeyTemplate != "" {
+		prefix = manifestFile.Subfolder + "/"
+	}
+	keys, err := store.ListKeys(bucket.Name, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("issue listing part files under s3://%s/%s: %s", bucket.Name, prefix, err)
+	}
+	var entries []manifestEntry
+	compressions := map[string]bool{}
+	for _, key := range keys {
+		if !isPartKey(key) {
+			continue
+		}
+		if bucket.DateMetadata != "" {
+			partDate, ok, err := objectDate(store, bucket, schema, table, key)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || !partDate.Equal(date) {
+				continue
+			}
+		}
+		partPath := fmt.Sprintf("s3://%s/%s", bucket.Name, key)
+		if bucket.RequesterPays {
+			staged := fmt.Sprintf("s3://%s/%s", bucket.StagingBucket, key)
+			if err := store.Copy(partPath, staged); err != nil {
+				return nil, fmt.Errorf("issue copying %s to the staging bucket: %w", partPath, err)
+			}
+			partPath = staged
+		}
+		entries = append(entries, manifestEntry{URL: partPath, Mandatory: true})
+		compressions[compressionForSuffix(partSuffix(key))] = true
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w, no part files under s3://%s/%s", ErrDataNotFound, bucket.Name, prefix)
+	}
+	if len(compressions) > 1 {
+		return nil, fmt.Errorf("part files under s3://%s/%s have mixed compression", bucket.Name, prefix)
+	}
+	for c := range compressions {
+		manifestFile.Compression = c
+	}
+	// the config is still read from the bucket, which is fine as reads still say we'll pay
+	if bucket.RequesterPays {
+		manifestFile.Bucket.Name = bucket.StagingBucket
+	}
+
+	// no point in a manifest without any parts
+	if n > len(entries) {
+		n = len(entries)
+	}
+	if n < 1 {
+		n = 1
+	}
+	manifests := make([]manifest, n)
+	for i, entry := range entries {
+		manifests[i%n].Entries = append(manifests[i%n].Entries, entry)
+	}
+	var files []*S3File
+	for i, m := range manifests {
+		f := manifestFile
+		if n > 1 {
+			f.Subfolder = fmt.Sprintf("%s/_part%d", manifestFile.Subfolder, i)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("issue encoding manifest: %s", err)
+		}
+		if err := store.Write(f.GetDataFilename(), data); err != nil {
+			return nil, fmt.Errorf("issue writing manifest %s: %s", f.GetDataFilename(), err)
+		}
+		files = append(files, &f)
+	}
+	return files, nil
+}
+
+// partSuffix strips any part number off the end of a part file's key, so its compression
+// can be detected, e.g. "a.json.gz.0001" becomes "a.json.gz"
+func partSuffix(key string) string {
+	if i := strings.LastIndex(key, "."); i >= 0 && strings.Trim(key[i+1:], "0123456789") == "" {
+		return key[:i]
+	}
+	return key
+}
+
+// compressionForSuffix returns the compression of a data file with the given suffix
+func compressionForSuffix(suffix string) string {
+	switch {
+	case strings.HasSuffix(suffix, ".gz"):
+		return CompressionGzip
+	case strings.HasSuffix(suffix, ".lzo"):
+		return CompressionLzop
+	case strings.HasSuffix(suffix, ".zst"):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
@@ -1,11 +1,20 @@
 package s3filepath
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,8 +22,8 @@ var (
 	expectedDate = time.Date(2015, time.November, 10, 23, 0, 0, 0, time.UTC)
 )
 
-func getTestFileWithResults(b, s, t, r, arn, subfolder, confFile, suf string, date time.Time) S3File {
-	bucket := S3Bucket{b, r, arn}
+func getTestFileWithResults(b, s, t, r, arn, subfolder, confFile, suf, compression string, date time.Time) S3File {
+	bucket := S3Bucket{Name: b, Region: r, RedshiftRoleARN: arn}
 	s3File := S3File{
 		Bucket:    bucket,
 		Schema:    s,
@@ -23,6 +32,8 @@ func getTestFileWithResults(b, s, t, r, arn, subfolder, confFile, suf string, da
 		DataDate:  date,
 		Subfolder: subfolder,
 		ConfFile:  confFile,
+		// the compression detected from the suffix
+		Compression: compression,
 	}
 	return s3File
 }
@@ -46,15 +57,19 @@ func TestCreateS3File(t *testing.T) {
 	jsonGzipPath := "s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z.json.gz"
 	csvPath := "s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z"
 	csvGzipPath := "s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z.gz"
+	jsonLzopPath := "s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z.json.lzo"
+	csvZstdPath := "s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z.zst"
+	parquetPath := "s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z.parquet"
 	manifestPath := "s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z.manifest"
 
 	// test completely non-existent file
-	expFile := getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "json.gz", expectedDate)
+	expFile := getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "json.gz", "GZIP", expectedDate)
 	returnedFile, err := CreateS3File(MockPathChecker{}, expFile.Bucket, schema, "bad_table", "", expectedDate)
-	assert.Equal(t, errors.New("s3 file not found at: bucket: b schema: s, table: bad_table date: 2015-11-10T23:00:00Z"), err)
+	assert.EqualError(t, err, "s3 file not found at: bucket: b schema: s, table: bad_table date: 2015-11-10T23:00:00Z")
+	assert.True(t, errors.Is(err, ErrDataNotFound))
 
 	// test generated json gzip conf file
-	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "json.gz", expectedDate)
+	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "json.gz", "GZIP", expectedDate)
 	testFiles := map[string]bool{
 		jsonGzipPath: true,
 		jsonPath:     true, // here to make sure it doesn't get confused if there's also a ".json" file
@@ -66,7 +81,7 @@ func TestCreateS3File(t *testing.T) {
 	assert.Equal(t, expFile, *returnedFile)
 
 	// test generated conf file that isn't zipped
-	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "json", expectedDate)
+	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "json", "", expectedDate)
 	testFiles = map[string]bool{
 		jsonPath: true,
 	}
@@ -74,8 +89,18 @@ func TestCreateS3File(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, expFile, *returnedFile)
 
+	// test parquet file
+	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "parquet", "", expectedDate)
+	testFiles = map[string]bool{
+		parquetPath: true,
+		csvPath:     true,
+	}
+	returnedFile, err = CreateS3File(MockPathChecker{testFiles}, expFile.Bucket, schema, table, "", expectedDate)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expFile, *returnedFile)
+
 	// test generated manifest conf file
-	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "manifest", expectedDate)
+	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "manifest", "", expectedDate)
 	testFiles = map[string]bool{
 		manifestPath: true,
 		jsonGzipPath: true,
@@ -85,8 +110,27 @@ func TestCreateS3File(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, expFile, *returnedFile)
 
+	// test lzop and zstd compressed files
+	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, "json.lzo", "LZOP", expectedDate)
+	testFiles = map[string]bool{
+		jsonLzopPath: true,
+		jsonPath:     true,
+	}
+	returnedFile, err = CreateS3File(MockPathChecker{testFiles}, expFile.Bucket, schema, table, "", expectedDate)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expFile, *returnedFile)
+
+	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, expConf, ".zst", "ZSTD", expectedDate)
+	testFiles = map[string]bool{
+		csvZstdPath: true,
+		csvPath:     true,
+	}
+	returnedFile, err = CreateS3File(MockPathChecker{testFiles}, expFile.Bucket, schema, table, "", expectedDate)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expFile, *returnedFile)
+
 	// test supplied conf file
-	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, "foo", "json.gz", expectedDate)
+	expFile = getTestFileWithResults(bucket, schema, table, region, redshiftRoleARN, expFolder, "foo", "json.gz", "GZIP", expectedDate)
 	testFiles = map[string]bool{
 		jsonGzipPath: true,
 		jsonPath:     true,
@@ -95,3 +139,662 @@ func TestCreateS3File(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, expFile, *returnedFile)
 }
+
+func TestS3FileFromPath(t *testing.T) {
+	bucket := S3Bucket{Name: "b", Region: "r"}
+	badPath := "s3://b/debug/bad-export.json.gz"
+	pc := MockPathChecker{map[string]bool{badPath: true, "s3://b/export": true}}
+
+	f, err := S3FileFromPath(pc, bucket, badPath, "s", "t", "", expectedDate)
+	assert.NoError(t, err)
+	assert.Equal(t, S3File{
+		Bucket: bucket, Schema: "s", Table: "t", Suffix: "json.gz", DataDate: expectedDate, Subfolder: "debug",
+		ConfFile: "s3://b/debug/config_s_t_2015-11-10T23:00:00Z.yml", Compression: CompressionGzip, Path: badPath,
+	}, *f)
+	assert.Equal(t, badPath, f.GetDataFilename())
+
+	// without a known suffix it's csv
+	f, err = S3FileFromPath(pc, bucket, "s3://b/export", "s", "t", "s3://b/t.yml", expectedDate)
+	assert.NoError(t, err)
+	assert.Equal(t, "", f.Suffix)
+	assert.Equal(t, "", f.Subfolder)
+	assert.Equal(t, "s3://b/t.yml", f.ConfFile)
+
+	_, err = S3FileFromPath(pc, bucket, "s3://b/missing.json", "s", "t", "", expectedDate)
+	assert.True(t, errors.Is(err, ErrDataNotFound))
+	_, err = S3FileFromPath(pc, bucket, "s3://other/debug/bad-export.json.gz", "s", "t", "", expectedDate)
+	assert.EqualError(t, err, "s3 path s3://other/debug/bad-export.json.gz isn't in bucket b")
+	_, err = S3FileFromPath(pc, bucket, "debug/bad-export.json.gz", "s", "t", "", expectedDate)
+	assert.Error(t, err)
+}
+
+type MockObjectStore struct {
+	Keys     []string
+	Metadata map[string]map[string]string
+	Written  map[string]string
+	Copied   map[string]string
+}
+
+func (ms *MockObjectStore) ListKeys(bucket, prefix string) ([]string, error) {
+	var keys []string
+	for _, k := range ms.Keys {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (ms *MockObjectStore) ListDirs(bucket, prefix string) ([]string, error) {
+	var dirs []string
+	for _, k := range ms.Keys {
+		if strings.HasPrefix(k, prefix) {
+			dirs = append(dirs, strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0])
+		}
+	}
+	return dirs, nil
+}
+
+func (ms *MockObjectStore) Head(path string) (ObjectInfo, error) {
+	return ObjectInfo{Metadata: ms.Metadata[path]}, nil
+}
+
+func (ms *MockObjectStore) Write(path string, data []byte) error {
+	ms.Written[path] = string(data)
+	return nil
+}
+
+func (ms *MockObjectStore) Copy(src, dst string) error {
+	ms.Copied[dst] = src
+	return nil
+}
+
+func TestCreateS3FileMixedCompression(t *testing.T) {
+	// while a table's files move to being gzipped, each date is loaded with its own compression
+	bucket := S3Bucket{Name: "b", Region: "r", RedshiftRoleARN: "arn"}
+	dayFolder := func(day int) string {
+		return fmt.Sprintf("s3://b/s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=%02d", day)
+	}
+	pc := MockPathChecker{ExistingPaths: map[string]bool{
+		dayFolder(9) + "/s_t_2015-11-09T23:00:00Z":           true,
+		dayFolder(10) + "/s_t_2015-11-10T23:00:00Z.gz":       true,
+		dayFolder(11) + "/s_t_2015-11-11T23:00:00Z.gz":       true,
+		dayFolder(11) + "/s_t_2015-11-11T23:00:00Z":          true,
+		dayFolder(12) + "/s_t_2015-11-12T23:00:00Z.json.zst": true,
+	}}
+	for day, compression := range map[int]string{
+		9:  CompressionNone,
+		10: CompressionGzip,
+		11: CompressionGzip, // both formats for the date, the gzipped file comes first
+		12: CompressionZstd,
+	} {
+		f, err := CreateS3File(pc, bucket, "s", "t", "", time.Date(2015, 11, day, 23, 0, 0, 0, time.UTC))
+		if assert.NoError(t, err) {
+			assert.Equal(t, compression, f.Compression, "day %d", day)
+			assert.True(t, strings.HasPrefix(f.GetDataFilename(), dayFolder(day)))
+		}
+	}
+}
+
+func TestCreateManifestFile(t *testing.T) {
+	bucket := S3Bucket{Name: "b", Region: "r", RedshiftRoleARN: "arn"}
+	folder := "s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10"
+	manifestPath := "s3://b/" + folder + "/s_t_2015-11-10T23:00:00Z.manifest"
+	store := &MockObjectStore{
+		Keys: []string{
+			folder + "/config_s_t_2015-11-10T23:00:00Z.yml",
+			folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0001",
+			folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0000",
+			folder + "/s_t_2015-11-10T23:00:00Z.manifest",
+			folder + "/s_t_2015-11-10T22:00:00Z.json.gz.0000", // a different hour
+		},
+		Written: map[string]string{},
+	}
+
+	expFile := getTestFileWithResults("b", "s", "t", "r", "arn", folder,
+		"s3://b/"+folder+"/config_s_t_2015-11-10T23:00:00Z.yml", "manifest", "GZIP", expectedDate)
+	returnedFile, err := CreateManifestFile(store, bucket, "s", "t", "", expectedDate)
+	assert.NoError(t, err)
+	assert.Equal(t, expFile, *returnedFile)
+	assert.Equal(t, manifestPath, returnedFile.GetDataFilename())
+	assert.JSONEq(t, `{"entries": [
+		{"url": "s3://b/`+folder+`/s_t_2015-11-10T23:00:00Z.json.gz.0001", "mandatory": true},
+		{"url": "s3://b/`+folder+`/s_t_2015-11-10T23:00:00Z.json.gz.0000", "mandatory": true}
+	]}`, store.Written[manifestPath])
+
+	// mixed compression can't be loaded by one COPY
+	store.Keys = append(store.Keys, folder+"/s_t_2015-11-10T23:00:00Z.json.0002")
+	_, err = CreateManifestFile(store, bucket, "s", "t", "", expectedDate)
+	assert.Error(t, err)
+
+	// no parts at all
+	_, err = CreateManifestFile(store, bucket, "s", "bad_table", "", expectedDate)
+	assert.True(t, errors.Is(err, ErrDataNotFound))
+}
+
+func TestKeyTemplate(t *testing.T) {
+	assert.NoError(t, ValidateKeyTemplate("{schema}/{table}/dt={date:2006-01-02}", false))
+	assert.NoError(t, ValidateKeyTemplate("{schema}/{table}/year={date:2006}/month={date:01}/day={date:02}", false))
+	assert.Error(t, ValidateKeyTemplate("{schema}/{table}/", false))
+	assert.Error(t, ValidateKeyTemplate("{schema}/{table}", false))
+	assert.Error(t, ValidateKeyTemplate("{schema}/{tabel}/dt={date:2006-01-02}", false))
+	assert.Error(t, ValidateKeyTemplate("{schema}/{table}/dt={date:Jan 2}", false)) // no year
+
+	// Hive style partitions, as written by Athena or Glue
+	date := time.Date(2024, time.January, 2, 0, 0, 0, 0, time.UTC)
+	bucket := S3Bucket{Name: "b", Region: "r", RedshiftRoleARN: "arn", KeyTemplate: "{schema}/{table}/dt={date:2006-01-02}"}
+	store := &MockObjectStore{
+		Keys: []string{
+			"s/t/dt=2024-01-01/part-00000.json.gz",
+			"s/t/dt=2024-01-02/_SUCCESS",
+			"s/t/dt=2024-01-02/config_s_t_2024-01-02T00:00:00Z.yml",
+			"s/t/dt=2024-01-02/part-00000.json.gz",
+			"s/t/dt=2024-01-02/part-00001.json.gz",
+			"s/t/notadate/part-00000.json.gz",
+		},
+		Written: map[string]string{},
+	}
+	manifestPath := "s3://b/s/t/dt=2024-01-02/s_t_2024-01-02T00:00:00Z.manifest"
+	expFile := getTestFileWithResults("b", "s", "t", "r", "arn", "s/t/dt=2024-01-02",
+		"s3://b/s/t/dt=2024-01-02/config_s_t_2024-01-02T00:00:00Z.yml", "manifest", "GZIP", date)
+	expFile.Bucket.KeyTemplate = bucket.KeyTemplate
+	returnedFile, err := CreateManifestFile(store, bucket, "s", "t", "", date)
+	assert.NoError(t, err)
+	assert.Equal(t, expFile, *returnedFile)
+	assert.JSONEq(t, `{"entries": [
+		{"url": "s3://b/s/t/dt=2024-01-02/part-00000.json.gz", "mandatory": true},
+		{"url": "s3://b/s/t/dt=2024-01-02/part-00001.json.gz", "mandatory": true}
+	]}`, store.Written[manifestPath])
+
+	dates, err := ListAvailableDates(store, bucket, "s", "t")
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{date, date.AddDate(0, 0, -1)}, dates)
+
+	// there's no one data file to find
+	_, err = CreateS3File(MockPathChecker{}, bucket, "s", "t", "", date)
+	assert.Error(t, err)
+
+	// dates split over several folders are put back together
+	bucket.KeyTemplate = "{table}/year={date:2006}/month={date:01}/day={date:02}"
+	store.Keys = []string{"t/year=2024/month=01/day=02/part-00000.json"}
+	dates, err = ListAvailableDates(store, bucket, "s", "t")
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{date}, dates)
+}
+
+func TestDateMetadata(t *testing.T) {
+	assert.NoError(t, ValidateKeyTemplate("{schema}/{table}", true))
+	assert.Error(t, ValidateKeyTemplate("{schema}/{tabel}", true))
+
+	// the producer overwrites its files in one folder, with the date only in their metadata
+	date := time.Date(2024, time.January, 2, 0, 0, 0, 0, time.UTC)
+	bucket := S3Bucket{Name: "b", Region: "r", KeyTemplate: "{schema}/{table}", DateMetadata: "x-amz-meta-data-date"}
+	store := &MockObjectStore{
+		Keys: []string{
+			"s/t/_SUCCESS",
+			"s/t/part-00000.json.gz",
+			"s/t/part-00001.json.gz",
+			"s/t/part-00002.json.gz",
+			"s/t/part-00003.json.gz",
+		},
+		Metadata: map[string]map[string]string{
+			"s3://b/s/t/part-00000.json.gz": {"data-date": "2024-01-02"},
+			"s3://b/s/t/part-00001.json.gz": {"data-date": "2024-01-02T00:00:00Z"},
+			"s3://b/s/t/part-00002.json.gz": {"data-date": "2024-01-01"},
+			// no date, and none in the key to fall back to
+		},
+		Written: map[string]string{},
+	}
+	_, err := CreateManifestFile(store, bucket, "s", "t", "", date)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"entries": [
+		{"url": "s3://b/s/t/part-00000.json.gz", "mandatory": true},
+		{"url": "s3://b/s/t/part-00001.json.gz", "mandatory": true}
+	]}`, store.Written["s3://b/s/t/s_t_2024-01-02T00:00:00Z.manifest"])
+
+	dates, err := ListAvailableDates(store, bucket, "s", "t")
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{date, date.AddDate(0, 0, -1)}, dates)
+
+	// without the metadata, the date in the key is used
+	bucket.KeyTemplate = "{schema}/{table}/dt={date:2006-01-02}"
+	store.Keys = []string{"s/t/dt=2024-01-02/part-00000.json.gz", "s/t/dt=2024-01-03/part-00000.json.gz"}
+	store.Metadata = map[string]map[string]string{"s3://b/s/t/dt=2024-01-03/part-00000.json.gz": {"data-date": "2024-01-01"}}
+	dates, err = ListAvailableDates(store, bucket, "s", "t")
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{date, date.AddDate(0, 0, -1)}, dates)
+
+	store.Metadata["s3://b/s/t/dt=2024-01-02/part-00000.json.gz"] = map[string]string{"data-date": "yesterday"}
+	_, err = ListAvailableDates(store, bucket, "s", "t")
+	assert.Error(t, err)
+}
+
+func TestRequesterPays(t *testing.T) {
+	bucket := S3Bucket{Name: "partner", Region: "r", RedshiftRoleARN: "arn", RequesterPays: true}
+	folder := "s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10"
+	store := &MockObjectStore{
+		Keys: []string{
+			folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0000",
+			folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0001",
+		},
+		Written: map[string]string{},
+		Copied:  map[string]string{},
+	}
+	_, err := CreateManifestFile(store, bucket, "s", "t", "", expectedDate)
+	assert.Error(t, err) // nowhere to copy the parts to
+	_, err = CreateS3File(MockPathChecker{}, bucket, "s", "t", "", expectedDate)
+	assert.Error(t, err)
+
+	// the parts are copied to the staging bucket, and the manifest written there lists the copies
+	bucket.StagingBucket = "staging"
+	f, err := CreateManifestFile(store, bucket, "s", "t", "", expectedDate)
+	assert.NoError(t, err)
+	manifestPath := "s3://staging/" + folder + "/s_t_2015-11-10T23:00:00Z.manifest"
+	assert.Equal(t, manifestPath, f.GetDataFilename())
+	assert.Equal(t, "s3://partner/"+folder+"/config_s_t_2015-11-10T23:00:00Z.yml", f.ConfFile)
+	assert.Equal(t, map[string]string{
+		"s3://staging/" + folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0000": "s3://partner/" + folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0000",
+		"s3://staging/" + folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0001": "s3://partner/" + folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0001",
+	}, store.Copied)
+	assert.JSONEq(t, `{"entries": [
+		{"url": "s3://staging/`+folder+`/s_t_2015-11-10T23:00:00Z.json.gz.0000", "mandatory": true},
+		{"url": "s3://staging/`+folder+`/s_t_2015-11-10T23:00:00Z.json.gz.0001", "mandatory": true}
+	]}`, store.Written[manifestPath])
+}
+
+// credentials from a provider sign our own requests, rather than the SDK's default chain
+func TestBucketCredentials(t *testing.T) {
+	var signed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed = append(signed, r.Header.Get("Authorization"))
+		w.Write([]byte("contents"))
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	creds := credentials.NewStaticCredentials("vault", "secret", "")
+	bucket := S3Bucket{Name: "b", Region: "us-east-1", Endpoint: server.URL, Credentials: creds}
+
+	reader, err := Reader(bucket, "s3://b/s/config.yml")
+	if assert.NoError(t, err) {
+		reader.Close()
+	}
+	assert.NoError(t, S3ObjectStore{Region: "us-east-1", Endpoint: server.URL, Credentials: creds}.Write("s3://b/s/manifest", []byte("{}")))
+	bucket.Credentials = nil
+	assert.NoError(t, HeadBucket(bucket))
+	if assert.Len(t, signed, 3) {
+		assert.Contains(t, signed[0], "Credential=vault/")
+		assert.Contains(t, signed[1], "Credential=vault/")
+		assert.Contains(t, signed[2], "Credential=minio/")
+	}
+}
+
+func TestRequesterPaysHeader(t *testing.T) {
+	// every request to a requester pays bucket must say we'll pay, or S3 denies it
+	var payers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payers = append(payers, r.Header.Get("x-amz-request-payer"))
+		if r.Method == http.MethodHead || r.URL.Path == "/b/s/config.yml" {
+			w.Write([]byte("contents"))
+			return
+		}
+		fmt.Fprint(w, `<ListBucketResult><Name>b</Name><IsTruncated>false</IsTruncated><Contents><Key>s/config.yml</Key></Contents></ListBucketResult>`)
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	bucket := S3Bucket{Name: "b", Region: "us-east-1", Endpoint: server.URL, RequesterPays: true}
+
+	reader, err := Reader(bucket, "s3://b/s/config.yml")
+	if assert.NoError(t, err) {
+		reader.Close()
+	}
+	_, err = Head(bucket, "s3://b/s/config.yml")
+	assert.NoError(t, err)
+	keys, err := S3ObjectStore{Region: "us-east-1", Endpoint: server.URL, RequesterPays: true}.ListKeys("b", "s/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"s/config.yml"}, keys)
+	assert.Equal(t, []string{"requester", "requester", "requester"}, payers)
+
+	payers = nil
+	bucket.RequesterPays = false
+	_, err = Head(bucket, "s3://b/s/config.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, payers)
+}
+
+func TestCreateManifestFiles(t *testing.T) {
+	bucket := S3Bucket{Name: "b", Region: "r", RedshiftRoleARN: "arn"}
+	folder := "s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10"
+	store := &MockObjectStore{
+		Keys: []string{
+			folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0000",
+			folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0001",
+			folder + "/s_t_2015-11-10T23:00:00Z.json.gz.0002",
+		},
+		Written: map[string]string{},
+	}
+
+	files, err := CreateManifestFiles(store, bucket, "s", "t", "", expectedDate, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, "s3://b/"+folder+"/_part0/s_t_2015-11-10T23:00:00Z.manifest", files[0].GetDataFilename())
+		assert.Equal(t, "s3://b/"+folder+"/_part1/s_t_2015-11-10T23:00:00Z.manifest", files[1].GetDataFilename())
+		// the config is still the one next to the data
+		assert.Equal(t, "s3://b/"+folder+"/config_s_t_2015-11-10T23:00:00Z.yml", files[1].ConfFile)
+		assert.Equal(t, CompressionGzip, files[1].Compression)
+	}
+	assert.JSONEq(t, `{"entries": [
+		{"url": "s3://b/`+folder+`/s_t_2015-11-10T23:00:00Z.json.gz.0000", "mandatory": true},
+		{"url": "s3://b/`+folder+`/s_t_2015-11-10T23:00:00Z.json.gz.0002", "mandatory": true}
+	]}`, store.Written["s3://b/"+folder+"/_part0/s_t_2015-11-10T23:00:00Z.manifest"])
+	assert.JSONEq(t, `{"entries": [
+		{"url": "s3://b/`+folder+`/s_t_2015-11-10T23:00:00Z.json.gz.0001", "mandatory": true}
+	]}`, store.Written["s3://b/"+folder+"/_part1/s_t_2015-11-10T23:00:00Z.manifest"])
+
+	// never more manifests than parts
+	files, err = CreateManifestFiles(store, bucket, "s", "t", "", expectedDate, 8)
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+}
+
+func TestDiscoverTables(t *testing.T) {
+	store := &MockObjectStore{Keys: []string{
+		"s/events_views/_data_timestamp_year=2015/s_events_views_2015-11-10T23:00:00Z.json.gz",
+		"s/events_views/_data_timestamp_year=2015/s_events_views_2015-11-11T23:00:00Z.json.gz",
+		"s/events_clicks/_data_timestamp_year=2015/s_events_clicks_2015-11-10T23:00:00Z.json.gz",
+		"s/users/_data_timestamp_year=2015/s_users_2015-11-10T23:00:00Z.json.gz",
+		"other/events_logins/_data_timestamp_year=2015/other_events_logins_2015-11-10T23:00:00Z.json.gz",
+	}}
+	tables, err := DiscoverTables(store, S3Bucket{Name: "b"}, "s", "events_*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"events_clicks", "events_views"}, tables)
+
+	_, err = DiscoverTables(store, S3Bucket{Name: "b"}, "s", "events_[")
+	assert.Error(t, err)
+}
+
+func TestListAvailableDates(t *testing.T) {
+	store := &MockObjectStore{Keys: []string{
+		"s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/s_t_2015-11-10T23:00:00Z.json.gz",
+		"s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=10/config_s_t_2015-11-10T23:00:00Z.yml",
+		"s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=12/s_t_2015-11-12T23:00:00Z.json.gz.0001",
+		"s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=12/s_t_2015-11-12T23:00:00Z.json.gz.0002",
+		"s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=11/s_t_2015-11-11T23:00:00Z",
+		"s/t/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=11/s_t_notadate.json",
+		"s/t_other/_data_timestamp_year=2015/_data_timestamp_month=11/_data_timestamp_day=13/s_t_other_2015-11-13T23:00:00Z.json",
+	}}
+	dates, err := ListAvailableDates(store, S3Bucket{Name: "b"}, "s", "t")
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{
+		time.Date(2015, 11, 12, 23, 0, 0, 0, time.UTC),
+		time.Date(2015, 11, 11, 23, 0, 0, 0, time.UTC),
+		time.Date(2015, 11, 10, 23, 0, 0, 0, time.UTC),
+	}, dates)
+
+	dates, err = ListAvailableDates(store, S3Bucket{Name: "b"}, "s", "missing")
+	assert.NoError(t, err)
+	assert.Empty(t, dates)
+}
+
+func TestCountRows(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("{\"id\": 1}\n{\"id\": 2}\n{\"id\": 3}\n"))
+	gz.Close()
+	files := map[string]string{
+		"s3://b/f/s_t_2015-11-10T23:00:00Z.json.gz": gzipped.String(),
+		"s3://b/f/s_t_2015-11-10T23:00:00Z":         "1|a\n2|b", // no newline at the end
+		"s3://b/f/s_t_2015-11-10T23:00:00Z.manifest": `{"entries": [
+			{"url": "s3://b/f/part.0000", "mandatory": true},
+			{"url": "s3://b/f/part.0001", "mandatory": true}
+		]}`,
+		"s3://b/f/part.0000": "1|a\n2|b\n",
+		"s3://b/f/part.0001": "",
+	}
+	open := func(path string) (io.ReadCloser, error) {
+		data, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("no such file %s", path)
+		}
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+	f := S3File{Bucket: S3Bucket{Name: "b"}, Schema: "s", Table: "t", DataDate: expectedDate, Subfolder: "f"}
+
+	for suffix, rows := range map[string]int64{"json.gz": 3, "": 2, "manifest": 2} {
+		f.Suffix, f.Compression = suffix, compressionForSuffix(suffix)
+		n, err := countRows(open, f)
+		assert.NoError(t, err, suffix)
+		assert.Equal(t, rows, n, suffix)
+	}
+
+	f.Suffix, f.Compression = "json.zst", CompressionZstd
+	_, err := countRows(open, f)
+	assert.Error(t, err)
+	f.Suffix, f.Compression = "parquet", CompressionNone
+	_, err = countRows(open, f)
+	assert.Error(t, err)
+}
+
+func TestCheckJSONLines(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("\n  [{\"id\": 1},\n{\"id\": 2}]\n"))
+	gz.Close()
+	files := map[string]string{
+		"s3://b/f/s_t_2015-11-10T23:00:00Z.json.gz": gzipped.String(),
+		"s3://b/f/s_t_2015-11-10T23:00:00Z.json":    "{\"id\": 1}\n{\"id\": 2}\n",
+		"s3://b/f/s_t_2015-11-10T23:00:00Z.manifest": `{"entries": [
+			{"url": "s3://b/f/part.0000", "mandatory": true}
+		]}`,
+		"s3://b/f/part.0000": "\ufeff[]",
+	}
+	open := func(path string) (io.ReadCloser, error) {
+		data, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("no such file %s", path)
+		}
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+	f := S3File{Bucket: S3Bucket{Name: "b"}, Schema: "s", Table: "t", DataDate: expectedDate, Subfolder: "f"}
+
+	f.Suffix, f.Compression = "json", CompressionNone
+	assert.NoError(t, checkJSONLines(open, f))
+	f.Suffix, f.Compression = "json.gz", CompressionGzip
+	err := checkJSONLines(open, f)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrJSONArray))
+		assert.Contains(t, err.Error(), "s_t_2015-11-10T23:00:00Z.json.gz")
+	}
+	f.Suffix, f.Compression = "manifest", CompressionNone
+	assert.True(t, errors.Is(checkJSONLines(open, f), ErrJSONArray))
+	// can't be read, so aren't checked
+	f.Suffix, f.Compression = "json.zst", CompressionZstd
+	assert.NoError(t, checkJSONLines(open, f))
+
+	files["s3://b/f/s_t_2015-11-10T23:00:00Z.json"] = ""
+	f.Suffix, f.Compression = "json", CompressionNone
+	assert.NoError(t, checkJSONLines(open, f))
+}
+
+func TestCheckGzip(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("{\"id\": 1}\n{\"id\": 2}\n"))
+	gz.Close()
+	// the end of the deflated data, and its checksum, are missing
+	truncated := gzipped.String()[:gzipped.Len()-10]
+	files := map[string]string{
+		"s3://b/f/s_t_2015-11-10T23:00:00Z.json.gz": gzipped.String(),
+		"s3://b/f/s_t_2015-11-10T23:00:00Z.manifest": `{"entries": [
+			{"url": "s3://b/f/part.0000.gz", "mandatory": true},
+			{"url": "s3://b/f/part.0001.gz", "mandatory": true}
+		]}`,
+		"s3://b/f/part.0000.gz": gzipped.String(),
+		"s3://b/f/part.0001.gz": truncated,
+	}
+	open := func(path string) (io.ReadCloser, error) {
+		data, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("no such file %s", path)
+		}
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+	f := S3File{Bucket: S3Bucket{Name: "b"}, Schema: "s", Table: "t", DataDate: expectedDate, Subfolder: "f"}
+
+	f.Suffix, f.Compression = "json.gz", CompressionGzip
+	assert.NoError(t, checkGzip(open, f))
+	f.Suffix = "manifest"
+	err := checkGzip(open, f)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrCorruptGzip))
+		assert.Contains(t, err.Error(), "part.0001.gz")
+	}
+
+	files["s3://b/f/s_t_2015-11-10T23:00:00Z.json.gz"] = "{\"id\": 1}\n"
+	f.Suffix = "json.gz"
+	assert.True(t, errors.Is(checkGzip(open, f), ErrCorruptGzip))
+	// isn't gzipped, so isn't checked
+	f.Compression = CompressionNone
+	assert.NoError(t, checkGzip(open, f))
+	// can't be opened, which isn't corruption
+	f.Suffix, f.Compression = "json.gz", CompressionGzip
+	delete(files, "s3://b/f/s_t_2015-11-10T23:00:00Z.json.gz")
+	err = checkGzip(open, f)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrCorruptGzip))
+}
+
+func TestS3ObjectStorePagination(t *testing.T) {
+	// stands in for S3, listing at most two keys or prefixes a page
+	keys := []string{"s/t/_data_timestamp_year=2020/a", "s/t/_data_timestamp_year=2020/b",
+		"s/t/_data_timestamp_year=2021/c", "s/t/_data_timestamp_year=2022/d", "s/t/_data_timestamp_year=2022/e"}
+	var markers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		marker, prefix := q.Get("marker"), q.Get("prefix")
+		markers = append(markers, marker)
+		var entries []string
+		seen := map[string]bool{}
+		for _, k := range keys {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			entry := k
+			if q.Get("delimiter") == "/" {
+				entry = prefix + strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0] + "/"
+			}
+			if entry > marker && !seen[entry] {
+				seen[entry] = true
+				entries = append(entries, entry)
+			}
+		}
+		truncated := len(entries) > 2
+		if truncated {
+			entries = entries[:2]
+		}
+		fmt.Fprintf(w, `<ListBucketResult><Name>b</Name><IsTruncated>%t</IsTruncated>`, truncated)
+		for _, e := range entries {
+			if q.Get("delimiter") == "/" {
+				fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, e)
+			} else {
+				fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, e)
+			}
+		}
+		if truncated && q.Get("delimiter") == "/" {
+			fmt.Fprintf(w, `<NextMarker>%s</NextMarker>`, entries[len(entries)-1])
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	store := S3ObjectStore{Region: "us-east-1", Endpoint: server.URL}
+
+	listed, err := store.ListKeys("b", "s/t/")
+	assert.NoError(t, err)
+	assert.Equal(t, keys, listed)
+	// without a delimiter S3 leaves out the next marker, so the last key of the page is used
+	assert.Equal(t, []string{"", "s/t/_data_timestamp_year=2020/b", "s/t/_data_timestamp_year=2022/d"}, markers)
+
+	markers = nil
+	dirs, err := store.ListDirs("b", "s/t/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"_data_timestamp_year=2020", "_data_timestamp_year=2021", "_data_timestamp_year=2022"}, dirs)
+	assert.Equal(t, []string{"", "s/t/_data_timestamp_year=2021/"}, markers)
+}
+
+func TestReaderCustomEndpoint(t *testing.T) {
+	// stands in for MinIO, serving objects with path style requests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b/s/config.yml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	bucket := S3Bucket{Name: "b", Region: "us-east-1", Endpoint: server.URL}
+
+	reader, err := Reader(bucket, "s3://b/s/config.yml")
+	if assert.NoError(t, err) {
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "contents", string(data))
+	}
+
+	pc := S3PathChecker{Bucket: bucket}
+	assert.True(t, pc.FileExists("s3://b/s/config.yml"))
+	assert.False(t, pc.FileExists("s3://b/s/missing.yml"))
+}
+
+func TestETag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "HEAD", r.Method)
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	bucket := S3Bucket{Name: "b", Region: "us-east-1", Endpoint: server.URL}
+
+	etag, err := ETag(bucket, "s3://b/s_t_2020-01-01.json.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", etag)
+
+	_, err = ETag(bucket, "not/an/s3/path")
+	assert.Error(t, err)
+}
+
+func TestHead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "HEAD", r.Method)
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.Header().Set("Content-Length", "0")
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	bucket := S3Bucket{Name: "b", Region: "us-east-1", Endpoint: server.URL}
+
+	info, err := Head(bucket, "s3://b/s_t_2020-01-01.json.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectInfo{ETag: "d41d8cd98f00b204e9800998ecf8427e", Size: 0}, info)
+}
+
+func TestChainCredentials(t *testing.T) {
+	// the environment is first in the chain
+	os.Setenv("AWS_ACCESS_KEY_ID", "id")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv("AWS_SESSION_TOKEN", "token")
+	defer os.Unsetenv("AWS_SESSION_TOKEN")
+
+	creds, err := ChainCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "id", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+	assert.Equal(t, "token", creds.SessionToken)
+}